@@ -2,8 +2,11 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 
@@ -17,6 +20,22 @@ import (
 type Config struct {
 	RemoteAddr string
 	TLSConfig  *tls.Config
+	// 支持的QUIC版本，按优先级从高到低排列，第一个版本用于发起连接，为空时使用protocol.SupportedVersions
+	Versions []uint32
+	// 使用同一代1-RTT密钥发送多少个数据包后自动发起密钥更新，为0时使用crypto.DefaultKeyUpdateInterval
+	KeyUpdateInterval uint64
+	// 向服务器通告的传输参数，为nil时使用connection.DefaultTransportParameters；
+	// 连接ID由客户端填写，仅限服务端发送的参数被忽略
+	TransportParameters *protocol.TransportParameters
+	// 保存TLS会话恢复状态的存储，例如crypto.FileSessionStore，为nil时使用TLSConfig.ClientSessionCache
+	SessionStore crypto.SessionStore
+	// 恢复允许0-RTT的会话时，是否将握手完成之前写入流的数据作为0-RTT数据发送
+	EnableEarlyData bool
+	// 服务器要求客户端证书时出示的证书，为空时使用TLSConfig.Certificates
+	Certificates []tls.Certificate
+	// 以NSS密钥日志格式（SSLKEYLOGFILE）输出连接的流量密钥，供Wireshark等工具解密抓包，为nil时不输出。
+	// 设置后不再使用TLSConfig.KeyLogWriter；密钥日志会泄露全部流量，只能用于调试
+	KeyLogWriter io.Writer
 }
 
 // Client QUIC客户端
@@ -30,20 +49,173 @@ type Client struct {
 	cryptoSetup *crypto.CryptoSetup
 	// 连接ID生成器
 	idGenerator *connection.IDGenerator
-	// 关闭通道
+	// 当前使用的版本和发起连接时选择的连接ID
+	version    uint32
+	srcConnID  protocol.ConnectionID
+	destConnID protocol.ConnectionID
+	// 是否已经收到服务器的Initial包
+	receivedInitial bool
+	// 是否已经处理过版本协商包，每次连接只处理一次
+	versionNegotiated bool
+	// 地址验证相关
+	token          []byte                // Initial包携带的令牌
+	origDestConnID protocol.ConnectionID // 首个Initial包的目标连接ID
+	retrySrcConnID protocol.ConnectionID // Retry包的源连接ID
+	retryReceived  bool                  // 是否已经处理过Retry包，每次连接只处理一次
+	// 连接失败的原因
+	err error
+	// 关闭通道，closeOnce保证重复关闭时只关闭一次
 	closeChan chan struct{}
+	closeOnce sync.Once
 }
 
 // New 创建新的QUIC客户端
 func New(config Config) (*Client, error) {
+	if len(config.Versions) == 0 {
+		config.Versions = protocol.SupportedVersions
+	}
+	for _, v := range config.Versions {
+		if !protocol.IsSupportedVersion(protocol.SupportedVersions, v) {
+			return nil, fmt.Errorf("不支持的QUIC版本: 0x%x", v)
+		}
+	}
+	if config.TransportParameters == nil {
+		config.TransportParameters = connection.DefaultTransportParameters()
+	}
+	// 未指定ServerName时使用服务器地址中的主机名验证证书
+	if config.TLSConfig != nil && config.TLSConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(config.RemoteAddr); err == nil {
+			config.TLSConfig = config.TLSConfig.Clone()
+			config.TLSConfig.ServerName = host
+		}
+	}
+	if config.TLSConfig != nil && len(config.Certificates) > 0 {
+		config.TLSConfig = config.TLSConfig.Clone()
+		config.TLSConfig.Certificates = config.Certificates
+	}
+	if config.TLSConfig != nil && config.SessionStore != nil {
+		config.TLSConfig = config.TLSConfig.Clone()
+		config.TLSConfig.ClientSessionCache = crypto.NewClientSessionCache(config.SessionStore)
+	}
 	return &Client{
 		config:      config,
 		idGenerator: connection.NewIDGenerator(connection.IDLength),
 		closeChan:   make(chan struct{}),
-		cryptoSetup: crypto.NewCryptoSetup(config.TLSConfig),
+		cryptoSetup: crypto.NewCryptoSetup(config.TLSConfig, protocol.PerspectiveClient),
+		version:     config.Versions[0],
 	}, nil
 }
 
+// Version 返回当前使用的QUIC版本
+func (c *Client) Version() uint32 {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.version
+}
+
+// Err 返回导致连接失败的错误，例如版本协商失败或证书验证失败
+func (c *Client) Err() error {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.err
+}
+
+// HandshakeComplete 检查TLS握手是否已经完成
+func (c *Client) HandshakeComplete() bool {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.connection != nil && c.connection.GetState() == connection.StateEstablished
+}
+
+// ConnectionState 返回TLS握手协商的连接状态
+func (c *Client) ConnectionState() tls.ConnectionState {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.cryptoSetup.ConnectionState()
+}
+
+// PeerIdentity 返回服务器经过验证的证书身份，握手尚未完成或跳过了证书验证时返回nil
+func (c *Client) PeerIdentity() *crypto.PeerIdentity {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.cryptoSetup.PeerIdentity()
+}
+
+// UpdateKeys 发起1-RTT密钥更新
+func (c *Client) UpdateKeys() error {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	if c.connection == nil {
+		return fmt.Errorf("连接尚未建立")
+	}
+	return c.connection.UpdateKeys()
+}
+
+// OpenStream 在当前连接上打开一个双向流，服务器允许的流已经全部打开时返回connection.ErrStreamLimitReached。
+// 恢复允许0-RTT的会话时，Connect之后即可按票据记录的限制打开流，握手完成之前写入的数据作为0-RTT数据发送，
+// 0-RTT被服务器拒绝时自动在1-RTT包中重新发送
+func (c *Client) OpenStream() (*connection.Stream, error) {
+	conn, err := c.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.OpenStream()
+}
+
+// OpenStreamSync 在当前连接上打开一个双向流，服务器允许的流已经全部打开时阻塞，直到服务器提高上限、ctx结束或连接关闭
+func (c *Client) OpenStreamSync(ctx context.Context) (*connection.Stream, error) {
+	conn, err := c.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.OpenStreamSync(ctx)
+}
+
+// OpenUniStream 在当前连接上打开一个单向流，客户端只能写入
+func (c *Client) OpenUniStream() (*connection.Stream, error) {
+	conn, err := c.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.OpenUniStream()
+}
+
+// AcceptStream 等待并返回服务器打开的下一个双向流
+func (c *Client) AcceptStream(ctx context.Context) (*connection.Stream, error) {
+	conn, err := c.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.AcceptStream(ctx)
+}
+
+// AcceptUniStream 等待并返回服务器打开的下一个单向流，客户端只能读取
+func (c *Client) AcceptUniStream(ctx context.Context) (*connection.Stream, error) {
+	conn, err := c.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.AcceptUniStream(ctx)
+}
+
+// currentConnection 返回当前的连接，Connect之前返回错误。
+// 版本协商会以新的连接重新握手，之前打开的流随旧连接一起关闭
+func (c *Client) currentConnection() (*connection.Connection, error) {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	if c.connection == nil {
+		return nil, fmt.Errorf("连接尚未建立")
+	}
+	return c.connection, nil
+}
+
+// EarlyDataState 返回0-RTT数据的状态，握手完成后可以得知0-RTT数据是否被服务器接受
+func (c *Client) EarlyDataState() crypto.EarlyDataState {
+	c.connectionMux.RLock()
+	defer c.connectionMux.RUnlock()
+	return c.cryptoSetup.EarlyDataState()
+}
+
 // Connect 连接到服务器
 func (c *Client) Connect() error {
 	addr, err := net.ResolveUDPAddr("udp", c.config.RemoteAddr)
@@ -62,9 +234,17 @@ func (c *Client) Connect() error {
 	if err != nil {
 		return fmt.Errorf("生成连接ID失败: %v", err)
 	}
-
+	srcConnID, err := c.idGenerator.GenerateConnectionID()
+	if err != nil {
+		return fmt.Errorf("生成连接ID失败: %v", err)
+	}
+	c.connectionMux.Lock()
+	c.destConnID = destConnID
+	c.origDestConnID = destConnID
+	c.srcConnID = srcConnID
 	// 发送初始数据包
-	err = c.sendInitialPacket(destConnID)
+	err = c.startHandshake()
+	c.connectionMux.Unlock()
 	if err != nil {
 		return fmt.Errorf("发送初始数据包失败: %v", err)
 	}
@@ -73,28 +253,50 @@ func (c *Client) Connect() error {
 	return nil
 }
 
-// sendInitialPacket 发送初始数据包
-func (c *Client) sendInitialPacket(destConnID protocol.ConnectionID) error {
-	// 创建初始数据包
-	p := &packet.Packet{
-		Header: packet.Header{
-			Type:         protocol.PacketTypeInitial,
-			Version:      protocol.Version,
-			DestConnID:   destConnID,
-			PacketNumber: 0,
-		},
-		Payload: c.cryptoSetup.GetCryptoData(crypto.LevelInitial), // 添加初始握手数据
+// startHandshake 使用当前版本开始新的TLS握手，并发送携带ClientHello的Initial包。
+// 调用方需持有connectionMux
+func (c *Client) startHandshake() error {
+	if c.connection != nil {
+		c.connection.Close()
 	}
-
-	// 序列化数据包
-	data, err := p.Pack()
-	if err != nil {
+	c.cryptoSetup = crypto.NewCryptoSetup(c.config.TLSConfig, protocol.PerspectiveClient)
+	c.cryptoSetup.SetVersion(c.version)
+	c.cryptoSetup.SetKeyUpdateConfig(crypto.KeyUpdateConfig{Interval: c.config.KeyUpdateInterval})
+	if c.config.KeyLogWriter != nil {
+		c.cryptoSetup.SetKeyLogWriter(c.config.KeyLogWriter)
+	}
+	if c.config.EnableEarlyData {
+		c.cryptoSetup.EnableEarlyData()
+	}
+	c.connection = c.newConnection()
+	if err := c.connection.SetTransportParameters(c.config.TransportParameters); err != nil {
+		return err
+	}
+	if err := c.connection.StartHandshake(protocol.PerspectiveClient); err != nil {
+		return err
+	}
+	if err := c.cryptoSetup.SetInitialKeys(c.destConnID); err != nil {
 		return err
 	}
+	return c.connection.SendPendingPackets()
+}
 
-	// 发送数据包
-	_, err = c.conn.Write(data)
-	return err
+// newConnection 创建与服务器之间的连接，调用方需持有connectionMux
+func (c *Client) newConnection() *connection.Connection {
+	conn := connection.NewConnection(
+		c.destConnID,
+		c.srcConnID,
+		c.conn.RemoteAddr().(*net.UDPAddr),
+		c.conn,
+		c.cryptoSetup,
+	)
+	conn.SetAvailableVersions(c.config.Versions)
+	conn.SetVersion(c.version)
+	if c.versionNegotiated {
+		conn.SetVersionNegotiated()
+	}
+	conn.SetToken(c.token)
+	return conn
 }
 
 // readLoop 读取数据包
@@ -109,82 +311,192 @@ func (c *Client) readLoop() {
 			if err != nil {
 				continue
 			}
-			go c.handlePacket(buf[:n])
+			// 读缓冲区会被下一次读取复用，需要复制；
+			// 握手数据依赖接收顺序，数据报按到达顺序依次处理
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			c.handlePacket(data)
 		}
 	}
 }
 
-// handlePacket 处理接收到的数据包
+// handlePacket 处理接收到的UDP数据报，其中可能合并了多个数据包
 func (c *Client) handlePacket(data []byte) {
-	// 解析数据包
-	p, err := packet.Unpack(data)
+	// 解析数据报中的全部数据包
+	packets, err := packet.ParseDatagram(data, connection.IDLength)
 	if err != nil {
 		return
 	}
 
-	// 处理握手和加密
-	switch p.Header.Type {
+	// 版本协商包和Retry包单独处理，不与其他数据包一起交给连接
+	switch packets[0].Header.Type {
+	case protocol.PacketTypeVersionNegotiation:
+		c.handleVersionNegotiation(packets[0])
+		return
+	case protocol.PacketTypeRetry:
+		c.handleRetry(packets[0])
+		return
 	case protocol.PacketTypeInitial:
-		c.handleInitialResponse(p)
-	case protocol.PacketTypeHandshake:
-		c.handleHandshakeResponse(p)
-	case protocol.PacketTypeOneRTT:
-		c.handleOneRTTPacket(p)
+		if !c.handleInitialResponse(packets[0]) {
+			return
+		}
+	}
+
+	c.connectionMux.RLock()
+	conn := c.connection
+	c.connectionMux.RUnlock()
+	if conn == nil {
+		return
+	}
+
+	// 由连接处理握手和应用数据，并发送由此产生的响应
+	if err := conn.HandleDatagram(packets); err != nil {
+		// TLS握手失败（例如证书验证失败）时连接无法继续
+		var transportErr *protocol.TransportError
+		if errors.As(err, &transportErr) && transportErr.Code >= protocol.CryptoErrorBase {
+			c.connectionMux.Lock()
+			c.err = fmt.Errorf("TLS握手失败: %w", err)
+			c.connectionMux.Unlock()
+		}
+	}
+	c.syncInitialResponse(conn)
+	// 服务器以CONNECTION_CLOSE帧关闭了连接，例如没有共同支持的应用层协议
+	if closeErr := conn.CloseError(); closeErr != nil {
+		c.connectionMux.Lock()
+		if c.err == nil {
+			c.err = fmt.Errorf("连接已关闭: %w", closeErr)
+		}
+		c.connectionMux.Unlock()
 	}
 }
 
-// handleInitialResponse 处理初始响应数据包
-func (c *Client) handleInitialResponse(p *packet.Packet) {
-	// 处理服务器的Initial包
-	if err := c.cryptoSetup.HandleCryptoFrame(p.Payload, crypto.LevelInitial); err != nil {
+// handleVersionNegotiation 处理服务器的版本协商包，选出双方都支持的版本后重新发起连接
+func (c *Client) handleVersionNegotiation(p *packet.Packet) {
+	hdr, versions, err := packet.ParseVersionNegotiation(p.Raw)
+	if err != nil {
 		return
 	}
 
-	// 更新连接状态
 	c.connectionMux.Lock()
-	if c.connection == nil {
-		c.connection = connection.NewConnection(
-			p.Header.DestConnID,
-			p.Header.SrcConnID,
-			c.conn.RemoteAddr().(*net.UDPAddr),
-			c.conn,
-			c.cryptoSetup,
-		)
+	defer c.connectionMux.Unlock()
+
+	// 已收到服务器的其他数据包或已处理过版本协商时必须忽略，见RFC 9000第6.2节
+	if c.receivedInitial || c.versionNegotiated {
+		return
 	}
-	c.connectionMux.Unlock()
-}
+	// 连接ID必须与发出的Initial包相呼应
+	if string(hdr.DestConnID) != string(c.srcConnID) || string(hdr.SrcConnID) != string(c.destConnID) {
+		return
+	}
+	// 列表中包含当前版本说明数据包是伪造的或已过期
+	if protocol.IsSupportedVersion(versions, c.version) {
+		return
+	}
+	c.versionNegotiated = true
 
-// handleHandshakeResponse 处理握手响应数据包
-func (c *Client) handleHandshakeResponse(p *packet.Packet) {
-	// 处理服务器的Handshake包
-	if err := c.cryptoSetup.HandleCryptoFrame(p.Payload, crypto.LevelHandshake); err != nil {
+	version, ok := protocol.ChooseSupportedVersion(c.config.Versions, versions)
+	if !ok {
+		c.err = fmt.Errorf("版本协商失败，服务器支持的版本: %x", versions)
 		return
 	}
 
-	// 如果握手完成，更新加密状态
-	if c.cryptoSetup.HandshakeComplete() {
-		c.cryptoSetup.SetHandshakeComplete()
+	// 使用新版本重新开始握手
+	c.version = version
+	if err := c.startHandshake(); err != nil {
+		c.err = fmt.Errorf("重新发送初始数据包失败: %v", err)
 	}
 }
 
-// handleOneRTTPacket 处理1-RTT数据包
-func (c *Client) handleOneRTTPacket(p *packet.Packet) {
-	c.connectionMux.RLock()
-	defer c.connectionMux.RUnlock()
+// handleRetry 处理服务器的Retry包，校验完整性标签后携带令牌重新发送Initial包
+func (c *Client) handleRetry(p *packet.Packet) {
+	c.connectionMux.Lock()
+	defer c.connectionMux.Unlock()
 
-	if c.connection == nil {
+	// 已收到服务器的其他数据包或已处理过Retry包时必须忽略，见RFC 9000第17.2.5.2节
+	if c.receivedInitial || c.retryReceived || c.connection == nil {
+		return
+	}
+	if len(p.Header.Token) == 0 || p.Header.Version != c.version ||
+		string(p.Header.DestConnID) != string(c.srcConnID) {
+		return
+	}
+	if !packet.VerifyRetry(&p.Header, p.Raw, c.origDestConnID) {
 		return
 	}
+	c.retryReceived = true
 
-	// 将数据包交给连接处理
-	c.connection.HandlePacket(p)
+	// 之后的数据包使用服务器选择的连接ID，并携带Retry令牌
+	c.destConnID = append(protocol.ConnectionID{}, p.Header.SrcConnID...)
+	c.retrySrcConnID = c.destConnID
+	c.token = append([]byte{}, p.Header.Token...)
+
+	// 服务器没有保存任何状态，沿用原有的TLS握手重新发送ClientHello，
+	// Initial密钥改由新的目标连接ID派生，见RFC 9001第5.2节
+	if err := c.cryptoSetup.SetInitialKeys(c.destConnID); err != nil {
+		c.err = fmt.Errorf("重新派生Initial密钥失败: %v", err)
+		return
+	}
+	c.connection.HandleRetry(c.destConnID, c.token)
+	if err := c.connection.SendPendingPackets(); err != nil {
+		c.err = fmt.Errorf("重新发送初始数据包失败: %v", err)
+	}
 }
 
-// Close 关闭客户端
-func (c *Client) Close() error {
-	close(c.closeChan)
-	if c.conn != nil {
-		return c.conn.Close()
+// handleInitialResponse 在服务器的首个Initial包解密之前检查其连接ID和版本，返回false时丢弃该数据报。
+// 服务器选择的连接ID和版本由连接在数据包通过认证后采用，伪造的Initial包不会改变连接的状态
+func (c *Client) handleInitialResponse(p *packet.Packet) bool {
+	c.connectionMux.Lock()
+	defer c.connectionMux.Unlock()
+
+	if c.receivedInitial {
+		return true
 	}
-	return nil
+	if c.connection == nil || string(p.Header.DestConnID) != string(c.srcConnID) {
+		return false
+	}
+
+	// 服务器的首个Initial包可以使用兼容版本协商选定的新版本，见RFC 9368第2.3节，
+	// 先派生该版本的Initial读取密钥用于尝试解密
+	if p.Header.Version != c.version {
+		if !protocol.IsCompatibleVersion(c.version, p.Header.Version) ||
+			!protocol.IsSupportedVersion(c.config.Versions, p.Header.Version) {
+			return false
+		}
+		if err := c.cryptoSetup.PrepareInitialVersion(p.Header.Version); err != nil {
+			return false
+		}
+	}
+	c.connection.SetRetryConnIDs(c.origDestConnID, c.retrySrcConnID)
+	return true
+}
+
+// syncInitialResponse 连接处理了服务器通过认证的首个Initial包之后，记录服务器选择的连接ID和版本，
+// 之后不再处理版本协商包和Retry包
+func (c *Client) syncInitialResponse(conn *connection.Connection) {
+	c.connectionMux.Lock()
+	defer c.connectionMux.Unlock()
+
+	if c.receivedInitial || conn != c.connection || !conn.ServerInitialReceived() {
+		return
+	}
+	c.receivedInitial = true
+	c.destConnID = conn.GetDestConnID()
+	c.version = conn.Version()
+}
+
+// Close 关闭客户端，可以重复调用
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.connectionMux.RLock()
+		if c.connection != nil {
+			c.connection.Close()
+		}
+		c.connectionMux.RUnlock()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	return err
 }
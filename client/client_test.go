@@ -1,11 +1,14 @@
 package client
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"net"
 	"testing"
 	"time"
 
+	"LQUIC/internal/crypto"
 	"LQUIC/internal/packet"
 	"LQUIC/internal/protocol"
 )
@@ -105,6 +108,14 @@ func TestConnect(t *testing.T) {
 	if client.conn == nil {
 		t.Error("UDP连接未建立")
 	}
+
+	// 重复关闭不应panic
+	if err := client.Close(); err != nil {
+		t.Errorf("关闭客户端失败: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("重复关闭客户端应返回nil，实际%v", err)
+	}
 }
 
 func TestHandlePacket(t *testing.T) {
@@ -115,65 +126,359 @@ func TestHandlePacket(t *testing.T) {
 	}
 	defer listener.Close()
 
-	// 获取服务器地址
-	serverAddr := listener.LocalAddr().String()
-
 	// 创建客户端
 	client, err := New(Config{
-		RemoteAddr: serverAddr,
-		TLSConfig:  &tls.Config{},
+		RemoteAddr: listener.LocalAddr().String(),
+		TLSConfig:  &tls.Config{Rand: rand.Reader},
 	})
 	if err != nil {
 		t.Fatalf("创建客户端失败: %v", err)
 	}
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("连接服务器失败: %v", err)
+	}
+	client.conn = conn
+	defer client.Close()
+
+	client.srcConnID = protocol.ConnectionID{5, 6, 7, 8}
+	client.destConnID = protocol.ConnectionID{9, 10, 11, 12, 13, 14, 15, 16}
+	client.origDestConnID = client.destConnID
+	client.connectionMux.Lock()
+	err = client.startHandshake()
+	client.connectionMux.Unlock()
+	if err != nil {
+		t.Fatalf("开始握手失败: %v", err)
+	}
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := serverCrypto.SetInitialKeys(client.origDestConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+
+	// 服务器以客户端的源连接ID作为目标连接ID，并给出自己选择的连接ID
+	serverConnID := protocol.ConnectionID{1, 2, 3, 4}
+	hdr := packet.Header{Type: protocol.PacketTypeInitial, Version: protocol.Version, SrcConnID: serverConnID, DestConnID: client.srcConnID}
+
+	// 目标连接ID不是客户端的源连接ID、或者未通过认证的Initial包不改变连接状态
+	wrongDest := hdr
+	wrongDest.DestConnID = protocol.ConnectionID{0xff}
+	forged := &packet.Packet{Header: hdr, Payload: []byte("forged initial payload")}
+	forgedData, err := forged.Pack()
+	if err != nil {
+		t.Fatalf("数据包序列化失败: %v", err)
+	}
+	for _, data := range [][]byte{sealInitial(t, serverCrypto, wrongDest, 0), forgedData} {
+		client.handlePacket(data)
+		if client.receivedInitial || string(client.connection.GetDestConnID()) != string(client.origDestConnID) {
+			t.Fatalf("无效的Initial包不应改变连接ID: %x", client.connection.GetDestConnID())
+		}
+	}
 
-	// 初始化客户端连接
-	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	// 通过认证之后，之后的数据包发往服务器选择的连接ID
+	client.handlePacket(sealInitial(t, serverCrypto, hdr, 0))
+	client.connectionMux.RLock()
+	defer client.connectionMux.RUnlock()
+	if !client.receivedInitial {
+		t.Fatal("通过认证的Initial包应被处理")
+	}
+	if string(client.connection.GetDestConnID()) != string(serverConnID) || string(client.destConnID) != string(serverConnID) {
+		t.Error("目标连接ID不匹配")
+	}
+	if string(client.connection.GetSrcConnID()) != string(client.srcConnID) {
+		t.Error("源连接ID不匹配")
+	}
+}
+
+// sealInitial 模拟服务器以serverCrypto的Initial密钥加密携带PING帧的Initial包并添加头部保护
+func sealInitial(t *testing.T, serverCrypto *crypto.CryptoSetup, hdr packet.Header, pn protocol.PacketNumber) []byte {
+	t.Helper()
+
+	hdr.PacketNumber = pn
+	payload := make([]byte, 20)
+	payload[0] = 0x01 // PING帧，其余为PADDING帧
+	hdr.PayloadLen = protocol.ByteCount(len(payload) + serverCrypto.Overhead(crypto.LevelInitial))
+	raw, err := hdr.Pack()
 	if err != nil {
-		t.Fatalf("解析地址失败: %v", err)
+		t.Fatalf("数据包序列化失败: %v", err)
 	}
-	conn, err := net.DialUDP("udp", nil, addr)
+	data, err := serverCrypto.Seal(crypto.LevelInitial, raw, payload, pn, raw)
+	if err != nil {
+		t.Fatalf("加密Initial包失败: %v", err)
+	}
+	pnOffset := len(raw) - 4
+	sample := data[pnOffset+4 : pnOffset+4+crypto.HeaderProtectionSampleLen]
+	if err := serverCrypto.EncryptHeader(crypto.LevelInitial, sample, &data[0], data[pnOffset:pnOffset+4]); err != nil {
+		t.Fatalf("添加头部保护失败: %v", err)
+	}
+	return data
+}
+
+func TestHandleVersionNegotiation(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建模拟服务器失败: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := New(Config{
+		RemoteAddr: listener.LocalAddr().String(),
+		TLSConfig:  &tls.Config{Rand: rand.Reader},
+	})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
 	if err != nil {
 		t.Fatalf("连接服务器失败: %v", err)
 	}
 	client.conn = conn
 	defer client.Close()
 
-	// 创建测试数据包
-	srcConnID := []byte{1, 2, 3, 4}
-	destConnID := []byte{5, 6, 7, 8}
-	p := &packet.Packet{
-		Header: packet.Header{
-			Type:         protocol.PacketTypeInitial,
-			Version:      protocol.Version,
-			SrcConnID:    srcConnID,
-			DestConnID:   destConnID,
-			PacketNumber: 0,
-		},
-		Payload: []byte("test payload"),
+	// 模拟客户端以服务器不支持的版本发起了连接
+	client.version = 0x1a2a3a4a
+	client.srcConnID = protocol.ConnectionID{1, 2, 3, 4}
+	client.destConnID = protocol.ConnectionID{5, 6, 7, 8, 9, 10, 11, 12}
+
+	// 连接ID不匹配的版本协商包被忽略
+	client.handlePacket(packet.ComposeVersionNegotiation(protocol.ConnectionID{9}, client.destConnID, []uint32{protocol.Version1}))
+	if client.Version() != 0x1a2a3a4a {
+		t.Fatal("连接ID不匹配时不应切换版本")
 	}
 
-	// 序列化数据包
-	data, err := p.Pack()
+	// 包含当前版本的版本协商包被视为降级攻击而忽略
+	client.handlePacket(packet.ComposeVersionNegotiation(client.srcConnID, client.destConnID, []uint32{0x1a2a3a4a, protocol.Version1}))
+	if client.Version() != 0x1a2a3a4a {
+		t.Fatal("列表包含当前版本时不应切换版本")
+	}
+
+	// 正常的版本协商包触发使用新版本重新发送Initial包
+	client.handlePacket(packet.ComposeVersionNegotiation(client.srcConnID, client.destConnID, []uint32{0xff00001d, protocol.Version1}))
+	if client.Version() != protocol.Version1 {
+		t.Fatalf("版本未切换，当前版本0x%x", client.Version())
+	}
+
+	buf := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFromUDP(buf)
 	if err != nil {
-		t.Fatalf("数据包序列化失败: %v", err)
+		t.Fatalf("未收到重新发送的Initial包: %v", err)
+	}
+	p, err := packet.Unpack(buf[:n])
+	if err != nil {
+		t.Fatalf("解析Initial包失败: %v", err)
+	}
+	if p.Header.Type != protocol.PacketTypeInitial || p.Header.Version != protocol.Version1 {
+		t.Errorf("重新发送的数据包错误: 类型%v，版本0x%x", p.Header.Type, p.Header.Version)
+	}
+
+	// 每次连接只处理一次版本协商
+	client.handlePacket(packet.ComposeVersionNegotiation(client.srcConnID, client.destConnID, []uint32{0xff00001d}))
+	if client.Err() != nil {
+		t.Errorf("重复的版本协商包应该被忽略: %v", client.Err())
+	}
+}
+
+func TestVersionNegotiationFailure(t *testing.T) {
+	client, err := New(Config{TLSConfig: &tls.Config{Rand: rand.Reader}})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	client.version = 0x1a2a3a4a
+	client.srcConnID = protocol.ConnectionID{1, 2, 3, 4}
+	client.destConnID = protocol.ConnectionID{5, 6, 7, 8}
+
+	client.handlePacket(packet.ComposeVersionNegotiation(client.srcConnID, client.destConnID, []uint32{0xff00001d}))
+	if client.Err() == nil {
+		t.Error("没有共同支持的版本时应该返回错误")
+	}
+
+	if _, err := New(Config{Versions: []uint32{0x1a2a3a4a}}); err == nil {
+		t.Error("配置不支持的版本应该返回错误")
+	}
+}
+
+func TestCompatibleVersionUpgrade(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建模拟服务器失败: %v", err)
 	}
+	defer listener.Close()
 
-	// 测试数据包处理
+	client, err := New(Config{
+		RemoteAddr: listener.LocalAddr().String(),
+		TLSConfig:  &tls.Config{Rand: rand.Reader},
+		Versions:   []uint32{protocol.Version1, protocol.Version2},
+	})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("连接服务器失败: %v", err)
+	}
+	client.conn = conn
+	defer client.Close()
+
+	client.srcConnID = protocol.ConnectionID{5, 6, 7, 8}
+	client.destConnID = protocol.ConnectionID{9, 10, 11, 12, 13, 14, 15, 16}
+	client.origDestConnID = client.destConnID
+	client.connectionMux.Lock()
+	err = client.startHandshake()
+	client.connectionMux.Unlock()
+	if err != nil {
+		t.Fatalf("开始握手失败: %v", err)
+	}
+
+	// 伪造的版本2的Initial包不会使客户端切换版本
+	hdr := packet.Header{Type: protocol.PacketTypeInitial, Version: protocol.Version2, SrcConnID: protocol.ConnectionID{1, 2, 3, 4}, DestConnID: client.srcConnID}
+	forged := &packet.Packet{Header: hdr, Payload: []byte("forged initial payload")}
+	data, err := forged.Pack()
+	if err != nil {
+		t.Fatalf("数据包序列化失败: %v", err)
+	}
 	client.handlePacket(data)
+	if client.Version() != protocol.Version1 || client.connection.Version() != protocol.Version1 {
+		t.Fatalf("未通过认证的Initial包不应切换版本，当前0x%x", client.Version())
+	}
 
-	// 验证连接是否正确创建
+	// 服务器以兼容版本协商选定的版本2回复Initial包，使用版本2的Initial密钥
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	serverCrypto.SetVersion(protocol.Version2)
+	if err := serverCrypto.SetInitialKeys(client.origDestConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	client.handlePacket(sealInitial(t, serverCrypto, hdr, 0))
+
+	if client.Version() != protocol.Version2 {
+		t.Fatalf("客户端未升级到版本2，当前0x%x", client.Version())
+	}
 	client.connectionMux.RLock()
 	defer client.connectionMux.RUnlock()
+	if client.connection.Version() != protocol.Version2 || client.connection.OriginalVersion() != protocol.Version1 {
+		t.Errorf("连接版本错误，当前0x%x，原始0x%x", client.connection.Version(), client.connection.OriginalVersion())
+	}
+	if client.cryptoSetup.Version() != protocol.Version2 {
+		t.Error("加密设置未切换版本")
+	}
+}
 
-	if client.connection == nil {
-		t.Error("连接未创建")
-	} else {
-		if string(client.connection.GetDestConnID()) != string(destConnID) {
-			t.Error("目标连接ID不匹配")
-		}
-		if string(client.connection.GetSrcConnID()) != string(srcConnID) {
-			t.Error("源连接ID不匹配")
-		}
+func TestHandleRetry(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建模拟服务器失败: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := New(Config{
+		RemoteAddr: listener.LocalAddr().String(),
+		TLSConfig:  &tls.Config{Rand: rand.Reader},
+	})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	conn, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("连接服务器失败: %v", err)
+	}
+	client.conn = conn
+	defer client.Close()
+
+	client.srcConnID = protocol.ConnectionID{1, 2, 3, 4}
+	client.destConnID = protocol.ConnectionID{5, 6, 7, 8, 9, 10, 11, 12}
+	client.origDestConnID = client.destConnID
+	retrySrcConnID := protocol.ConnectionID{0xa, 0xb, 0xc, 0xd}
+	token := []byte("retry token")
+
+	// 发送首个Initial包
+	client.connectionMux.Lock()
+	err = client.startHandshake()
+	client.connectionMux.Unlock()
+	if err != nil {
+		t.Fatalf("开始握手失败: %v", err)
+	}
+	buf := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("未收到首个Initial包: %v", err)
+	}
+	// 模拟服务器以客户端选择的目标连接ID派生Initial密钥
+	serverCrypto := crypto.NewCryptoSetup(&tls.Config{}, protocol.PerspectiveServer)
+	if err := serverCrypto.StartHandshake(); err != nil {
+		t.Fatalf("开始服务端握手失败: %v", err)
+	}
+	if err := serverCrypto.SetInitialKeys(client.origDestConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	first := openInitial(t, serverCrypto, append([]byte{}, buf[:n]...))
+
+	// 完整性标签错误的Retry包被忽略
+	bad, err := packet.ComposeRetry(client.version, client.srcConnID, retrySrcConnID, protocol.ConnectionID{1}, token)
+	if err != nil {
+		t.Fatalf("构造Retry包失败: %v", err)
+	}
+	client.handlePacket(bad)
+	if client.retryReceived {
+		t.Fatal("完整性标签错误的Retry包应该被忽略")
+	}
+
+	retry, err := packet.ComposeRetry(client.version, client.srcConnID, retrySrcConnID, client.origDestConnID, token)
+	if err != nil {
+		t.Fatalf("构造Retry包失败: %v", err)
+	}
+	client.handlePacket(retry)
+	if !client.retryReceived {
+		t.Fatal("Retry包未被处理")
+	}
+
+	// 重新发送的Initial包携带令牌并使用新的目标连接ID
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = listener.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("未收到重新发送的Initial包: %v", err)
+	}
+	// Retry之后的Initial密钥由Retry包中的源连接ID派生
+	if err := serverCrypto.SetInitialKeys(retrySrcConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	p := openInitial(t, serverCrypto, buf[:n])
+	if string(p.Header.DestConnID) != string(retrySrcConnID) || string(p.Header.Token) != string(token) {
+		t.Errorf("重新发送的Initial包错误: 目标连接ID%x，令牌%q", p.Header.DestConnID, p.Header.Token)
+	}
+	// 重发的Initial包从偏移量0开始携带相同的ClientHello，且包序号不重置
+	if !bytes.Equal(p.Payload[:len(first.Payload)/2], first.Payload[:len(first.Payload)/2]) {
+		t.Error("重发的Initial包应携带相同的CRYPTO数据")
+	}
+	if p.Header.PacketNumber <= first.Header.PacketNumber {
+		t.Errorf("Retry之后包序号不应重置，首个%d，重发%d", first.Header.PacketNumber, p.Header.PacketNumber)
+	}
+
+	// 第二个Retry包被忽略
+	again, _ := packet.ComposeRetry(client.version, client.srcConnID, protocol.ConnectionID{0xe}, client.origDestConnID, []byte("other"))
+	client.handlePacket(again)
+	if string(client.token) != string(token) {
+		t.Error("第二个Retry包应该被忽略")
+	}
+}
+
+// openInitial 解析客户端发送的Initial包，去除头部保护并解密负载
+func openInitial(t *testing.T, serverCrypto *crypto.CryptoSetup, data []byte) *packet.Packet {
+	t.Helper()
+
+	p, err := packet.Unpack(data)
+	if err != nil {
+		t.Fatalf("解析Initial包失败: %v", err)
+	}
+	if err := p.Unprotect(func(sample []byte, firstByte *byte, pnBytes []byte) error {
+		return serverCrypto.DecryptHeader(crypto.LevelInitial, sample, firstByte, pnBytes)
+	}); err != nil {
+		t.Fatalf("去除头部保护失败: %v", err)
+	}
+	hdrLen := len(p.Raw) - len(p.Payload)
+	payload, err := serverCrypto.Open(crypto.LevelInitial, nil, p.Payload, p.Header.PacketNumber, p.Raw[:hdrLen])
+	if err != nil {
+		t.Fatalf("解密Initial包失败: %v", err)
 	}
+	p.Payload = payload
+	return p
 }
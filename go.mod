@@ -1,3 +1,7 @@
 module LQUIC
 
-go 1.21
+go 1.23
+
+require golang.org/x/crypto v0.32.0
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -9,7 +9,7 @@ import (
 )
 
 // IDLength 定义连接ID的默认长度
-const IDLength = 8
+const IDLength = protocol.DefaultConnectionIDLen
 
 // IDGenerator 用于生成连接ID
 type IDGenerator struct {
@@ -2,12 +2,16 @@
 package connection
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"LQUIC/internal/crypto"
 	"LQUIC/internal/flowcontrol"
+	"LQUIC/internal/frame"
 	"LQUIC/internal/packet"
 	"LQUIC/internal/protocol"
 )
@@ -35,6 +39,16 @@ type Connection struct {
 	// 连接标识
 	destConnID protocol.ConnectionID
 	srcConnID  protocol.ConnectionID
+	// 版本相关
+	version           uint32   // 当前使用的QUIC版本
+	originalVersion   uint32   // 客户端首个Initial包使用的版本
+	availableVersions []uint32 // 本端支持的版本，用于兼容版本协商
+	versionNegotiated bool     // 客户端是否因版本协商包重新发起了连接
+	versionMux        sync.RWMutex
+	// 地址验证相关
+	token              []byte                // Initial包携带的令牌
+	originalDestConnID protocol.ConnectionID // 客户端首个Initial包的目标连接ID
+	retrySrcConnID     protocol.ConnectionID // Retry包的源连接ID，未发生Retry时为nil
 
 	// 网络相关
 	remoteAddr *net.UDPAddr
@@ -43,20 +57,48 @@ type Connection struct {
 	// 加密相关
 	cryptoSetup *crypto.CryptoSetup
 
-	// 流量控制
-	flowController *flowcontrol.FlowController
+	// 连接级别的流量控制，由frameMux保护
+	sendWindow *flowcontrol.SendWindow    // 对端允许本端发送的数据量，由对端的传输参数和MAX_DATA帧给出
+	recvWindow *flowcontrol.ReceiveWindow // 本端允许对端发送的数据量
 
-	// 数据包处理
-	packetNumberGenerator protocol.PacketNumber // 用于生成递增的数据包序号
-	packetNumberMux       sync.Mutex            // 保护包序号生成器的互斥锁
+	// 传输参数，由frameMux保护
+	perspective protocol.Perspective          // 本端角色，StartHandshake之前为0
+	localParams *protocol.TransportParameters // 本端的传输参数
+	peerParams  *protocol.TransportParameters // 对端的传输参数，握手中收到之前为nil
 
-	// 0-RTT相关
-	zeroRTTEnabled bool
-	zeroRTTTicket  []byte
+	// 数据包处理
+	pnSpaces        [numSpaces]*packetNumberSpace // 各包序号空间的收发状态
+	packetNumberMux sync.Mutex                    // 保护包序号空间的互斥锁
+	ackPending      [numSpaces]bool               // 各包序号空间是否需要发送ACK
+	lastReceived    time.Time                     // 最近一个通过认证的数据包的接收时间，用于空闲超时
+	maxDatagramSize int                           // 发送数据报的最大长度
+
+	// 帧处理相关
+	frameMux              sync.Mutex                           // 保护帧处理状态
+	cryptoStreams         map[crypto.CryptoLevel]*cryptoStream // 各加密级别的CRYPTO数据重组
+	controlFrames         []frame.Frame                        // 待发送的控制帧
+	peerConnIDs           map[uint64]protocol.ConnectionID     // 对端通过NEW_CONNECTION_ID提供的连接ID
+	newToken              []byte                               // 服务端通过NEW_TOKEN下发的令牌
+	serverInitialReceived bool                                 // 客户端是否已经收到通过认证的服务端Initial包
+
+	// 抗放大攻击（RFC 9000第8.1节），由frameMux保护：服务端验证客户端地址之前，发送的数据不超过收到的数据的3倍
+	addressValidated bool               // 服务端是否已经验证了客户端地址
+	bytesReceived    protocol.ByteCount // 从对端收到的数据量
+	bytesSent        protocol.ByteCount // 向对端发送的数据量
+
+	// 流数据，由frameMux保护
+	sendStreams   map[protocol.StreamID]*sendStream // 各流发送方向的状态
+	recvStreams   map[protocol.StreamID]*recvStream // 各流接收到的数据
+	streamFrames  []*frame.StreamFrame              // 待发送的STREAM帧
+	earlyFrames   []*frame.StreamFrame              // 客户端在0-RTT包中发送、尚未得知是否被接受的STREAM帧
+	earlyDataSent protocol.ByteCount                // 客户端在0-RTT包中发送的流数据总量
+	earlyParams   *protocol.TransportParameters     // 客户端从票据中取出的服务端传输参数，限制0-RTT数据
+	streams       streamsState                      // 流的打开和接受
 
 	// 关闭相关
 	closeChan chan struct{}
 	closeOnce sync.Once
+	closeErr  error // 关闭连接的原因，由本端或对端的CONNECTION_CLOSE帧设置
 }
 
 // GetDestConnID 返回目标连接ID
@@ -69,59 +111,104 @@ func (c *Connection) GetSrcConnID() protocol.ConnectionID {
 	return c.srcConnID
 }
 
-// NewConnection 创建新的QUIC连接
-func NewConnection(destConnID, srcConnID protocol.ConnectionID, remoteAddr *net.UDPAddr, conn *net.UDPConn, cryptoSetup *crypto.CryptoSetup) *Connection {
-	// 设置默认的初始窗口大小
-	initialWindowSize := flowcontrol.WindowSize(1048576) // 1MB
-	maxWindowSize := flowcontrol.WindowSize(16777216)    // 16MB
+// SetDestConnID 设置目标连接ID，客户端收到服务器的首个Initial包后改用服务器选择的连接ID
+func (c *Connection) SetDestConnID(destConnID protocol.ConnectionID) {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+	c.destConnID = destConnID
+}
 
-	return &Connection{
-		state:          StateInitial,
-		destConnID:     destConnID,
-		srcConnID:      srcConnID,
-		remoteAddr:     remoteAddr,
-		conn:           conn,
-		cryptoSetup:    cryptoSetup,
-		flowController: flowcontrol.NewFlowController(initialWindowSize, maxWindowSize),
-		zeroRTTEnabled: false,
-		closeChan:      make(chan struct{}),
-	}
+// HandleRetry 客户端收到Retry包后改用新的目标连接ID和令牌，并从头重发Initial包中的CRYPTO数据。
+// 包序号不会重置，见RFC 9000第17.2.5.3节
+func (c *Connection) HandleRetry(destConnID protocol.ConnectionID, token []byte) {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+	c.destConnID = destConnID
+	c.token = token
+	c.cryptoStreams[crypto.LevelInitial].rewind()
 }
 
-// TryZeroRTT 尝试建立0-RTT连接
-func (c *Connection) TryZeroRTT(ticketID []byte) bool {
-	// 尝试使用会话票据进行0-RTT连接
-	success, key := c.cryptoSetup.TryZeroRTT(ticketID)
-	if !success {
-		return false
-	}
+// UpdateKeys 发起1-RTT密钥更新，握手确认之前或上一次更新尚未被对端确认时返回错误
+func (c *Connection) UpdateKeys() error {
+	return c.cryptoSetup.InitiateKeyUpdate()
+}
 
-	// 使用返回的密钥设置0-RTT加密
-	if err := c.cryptoSetup.SetZeroRTTKey(key); err != nil {
-		return false
-	}
+// ConnectionState 返回TLS握手协商的连接状态
+func (c *Connection) ConnectionState() tls.ConnectionState {
+	return c.cryptoSetup.ConnectionState()
+}
 
-	c.zeroRTTEnabled = true
-	c.zeroRTTTicket = ticketID
-	return true
+// PeerIdentity 返回对端经过验证的证书身份，包括验证通过的证书链和URI/SPIFFE SAN；
+// 对端没有出示经过验证的证书时返回nil，例如服务端没有要求客户端证书
+func (c *Connection) PeerIdentity() *crypto.PeerIdentity {
+	return c.cryptoSetup.PeerIdentity()
 }
 
-// CompleteHandshake 完成握手过程
-func (c *Connection) CompleteHandshake() error {
-	// 完成1-RTT握手
-	ticket, err := c.cryptoSetup.CompleteOneRTT()
-	if err != nil {
-		return fmt.Errorf("完成1-RTT握手失败: %v", err)
-	}
+// SetToken 设置客户端后续Initial包携带的令牌
+func (c *Connection) SetToken(token []byte) {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+	c.token = token
+}
 
-	// 更新会话票据用于未来的0-RTT连接
-	if err := c.cryptoSetup.UpdateSessionTicket(ticket); err != nil {
-		return fmt.Errorf("更新会话票据失败: %v", err)
+// SetRetryConnIDs 记录客户端首个Initial包的目标连接ID和Retry包的源连接ID，
+// 供传输参数校验使用，未发生Retry时retrySrcConnID为nil
+func (c *Connection) SetRetryConnIDs(origDestConnID, retrySrcConnID protocol.ConnectionID) {
+	c.originalDestConnID = origDestConnID
+	c.retrySrcConnID = retrySrcConnID
+	// 客户端携带有效的Retry令牌，地址已经得到验证，不再受抗放大攻击限制
+	if retrySrcConnID != nil {
+		c.frameMux.Lock()
+		c.addressValidated = true
+		c.frameMux.Unlock()
 	}
+}
 
-	// 更新连接状态
-	c.setState(StateEstablished)
-	return nil
+// OriginalDestConnID 返回客户端首个Initial包的目标连接ID
+func (c *Connection) OriginalDestConnID() protocol.ConnectionID {
+	return c.originalDestConnID
+}
+
+// RetrySrcConnID 返回Retry包的源连接ID，未发生Retry时返回nil
+func (c *Connection) RetrySrcConnID() protocol.ConnectionID {
+	return c.retrySrcConnID
+}
+
+// NewConnection 创建新的QUIC连接，使用DefaultTransportParameters作为本端的传输参数
+func NewConnection(destConnID, srcConnID protocol.ConnectionID, remoteAddr *net.UDPAddr, conn *net.UDPConn, cryptoSetup *crypto.CryptoSetup) *Connection {
+	localParams := DefaultTransportParameters()
+
+	return &Connection{
+		state:             StateInitial,
+		destConnID:        destConnID,
+		srcConnID:         srcConnID,
+		version:           protocol.Version,
+		originalVersion:   protocol.Version,
+		availableVersions: protocol.SupportedVersions,
+		remoteAddr:        remoteAddr,
+		conn:              conn,
+		cryptoSetup:       cryptoSetup,
+		sendWindow:        flowcontrol.NewSendWindow(0),
+		recvWindow:        flowcontrol.NewReceiveWindow(localParams.InitialMaxData),
+		localParams:       localParams,
+		cryptoStreams: map[crypto.CryptoLevel]*cryptoStream{
+			crypto.LevelInitial:   newCryptoStream(),
+			crypto.LevelHandshake: newCryptoStream(),
+			crypto.LevelOneRTT:    newCryptoStream(),
+		},
+		pnSpaces: [numSpaces]*packetNumberSpace{
+			newPacketNumberSpace(),
+			newPacketNumberSpace(),
+			newPacketNumberSpace(),
+		},
+		peerConnIDs:     make(map[uint64]protocol.ConnectionID),
+		sendStreams:     make(map[protocol.StreamID]*sendStream),
+		recvStreams:     make(map[protocol.StreamID]*recvStream),
+		streams:         streamsState{notify: make(chan struct{})},
+		maxDatagramSize: protocol.DefaultMaxDatagramSize,
+		lastReceived:    time.Now(),
+		closeChan:       make(chan struct{}),
+	}
 }
 
 // GetState 获取连接状态
@@ -138,51 +225,146 @@ func (c *Connection) setState(state ConnectionState) {
 	c.state = state
 }
 
-// generatePacketNumber 生成新的数据包序号
-func (c *Connection) generatePacketNumber() protocol.PacketNumber {
+// generatePacketNumber 在指定包序号空间中生成新的数据包序号，并返回截断编码长度
+func (c *Connection) generatePacketNumber(space pnSpace) (protocol.PacketNumber, int) {
+	c.packetNumberMux.Lock()
+	defer c.packetNumberMux.Unlock()
+	return c.pnSpaces[space].popPacketNumber()
+}
+
+// decodePacketNumber 还原接收到的截断包序号，并拒绝重复的数据包
+func (c *Connection) decodePacketNumber(space pnSpace, h *packet.Header) (protocol.PacketNumber, error) {
+	c.packetNumberMux.Lock()
+	defer c.packetNumberMux.Unlock()
+
+	s := c.pnSpaces[space]
+	pn := s.decodePacketNumber(h.PacketNumber, h.PacketNumberLen)
+	if s.isDuplicate(pn) {
+		return 0, fmt.Errorf("重复的数据包序号: %d", pn)
+	}
+	return pn, nil
+}
+
+// onPacketReceived 记录通过认证的数据包序号，用于生成ACK和还原后续包序号
+func (c *Connection) onPacketReceived(space pnSpace, pn protocol.PacketNumber) {
 	c.packetNumberMux.Lock()
 	defer c.packetNumberMux.Unlock()
-	c.packetNumberGenerator++
-	return c.packetNumberGenerator
+	c.pnSpaces[space].onPacketReceived(pn)
+	c.lastReceived = time.Now()
 }
 
-// validatePacketNumber 验证数据包序号的有效性
-func (c *Connection) validatePacketNumber(receivedPN protocol.PacketNumber) bool {
+// IdleDeadline 返回空闲超时的时刻：最近一个通过认证的数据包之后经过IdleTimeout仍未收到数据包时连接超时，
+// 不限制空闲时间时返回false，见RFC 9000第10.1节
+func (c *Connection) IdleDeadline() (time.Time, bool) {
+	timeout := c.IdleTimeout()
+	if timeout == 0 {
+		return time.Time{}, false
+	}
 	c.packetNumberMux.Lock()
 	defer c.packetNumberMux.Unlock()
-	// 检查接收到的包序号是否大于当前最大包序号
-	return receivedPN > c.packetNumberGenerator
+	return c.lastReceived.Add(timeout), true
+}
+
+// HandleDatagram 依次处理同一个UDP数据报中合并发送的数据包，并发送由此产生的响应
+func (c *Connection) HandleDatagram(packets []*packet.Packet) error {
+	c.frameMux.Lock()
+	for _, p := range packets {
+		c.bytesReceived += protocol.ByteCount(len(p.Raw))
+	}
+	c.frameMux.Unlock()
+
+	var errs []error
+	for _, p := range packets {
+		if err := c.HandlePacket(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.GetState() != StateClosed {
+		if err := c.SendPendingPackets(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // HandlePacket 处理接收到的数据包
 func (c *Connection) HandlePacket(p *packet.Packet) error {
-	// 验证数据包序号
-	if !c.validatePacketNumber(p.Header.PacketNumber) {
-		return fmt.Errorf("无效的数据包序号: %d", p.Header.PacketNumber)
+	space, ok := spaceForType(p.Header.Type)
+	if !ok {
+		return nil
+	}
+	// 已经丢弃密钥的加密级别的数据包直接丢弃，见RFC 9001第4.9节
+	if level, ok := levelForType(p.Header.Type); ok && c.cryptoSetup.KeysDiscarded(level) {
+		return nil
+	}
+	// 尚未得到密钥的加密级别的数据包直接丢弃，不能按明文处理，见RFC 9001第5.7节；
+	// 只有接受了0-RTT的服务端才有0-RTT密钥，其他情况下0-RTT包同样丢弃
+	if level, ok := levelForType(p.Header.Type); !ok || !c.cryptoSetup.HasKeys(level) {
+		return nil
+	}
+
+	// 包序号受头部保护，需要先去除保护
+	if err := c.unprotectHeader(p); err != nil {
+		return err
+	}
+
+	// 还原完整的包序号并检查重复
+	pn, err := c.decodePacketNumber(space, &p.Header)
+	if err != nil {
+		return err
+	}
+
+	// 解密负载，认证失败的数据包直接丢弃，不影响包序号空间的状态；
+	// 密钥更新错误或超过AEAD完整性上限时关闭连接
+	if err := c.openPacket(p, pn); err != nil {
+		var transportErr *protocol.TransportError
+		if errors.As(err, &transportErr) {
+			c.closeWithError(transportErr)
+		}
+		return err
+	}
+	if err := p.CheckReservedBits(); err != nil {
+		return protocol.NewTransportError(protocol.ProtocolViolation, "%v", err)
 	}
+	c.onPacketReceived(space, pn)
+	p.Header.PacketNumber = pn
 
 	switch p.Header.Type {
 	case protocol.PacketTypeInitial:
-		return c.handleInitialPacket(p)
+		err = c.handleInitialPacket(p)
 	case protocol.PacketTypeHandshake:
-		return c.handleHandshakePacket(p)
+		err = c.handleHandshakePacket(p)
+	case protocol.PacketTypeZeroRTT:
+		err = c.handleZeroRTTPacket(p)
 	case protocol.PacketTypeOneRTT:
-		return c.handleOneRTTPacket(p)
-	default:
-		return nil
+		err = c.handleOneRTTPacket(p)
+	}
+	// 处理帧时出现的传输层错误（包括TLS告警转换的CRYPTO_ERROR）同样关闭连接
+	var transportErr *protocol.TransportError
+	if errors.As(err, &transportErr) {
+		c.closeWithError(transportErr)
 	}
+	return err
 }
 
-// handleInitialPacket 处理Initial数据包
+// handleInitialPacket 处理通过认证的Initial数据包
 func (c *Connection) handleInitialPacket(p *packet.Packet) error {
-	// 验证版本
-	if p.Header.Version != protocol.Version {
-		return fmt.Errorf("不支持的QUIC版本: %d", p.Header.Version)
+	// 以另一个版本的密钥解密成功后改用该版本的读取密钥
+	c.cryptoSetup.CommitInitialVersion(p.Header.Version)
+	if c.cryptoSetup.IsClient() {
+		if err := c.onServerInitial(p); err != nil {
+			return err
+		}
 	}
 
-	// 处理加密握手数据
-	if err := c.cryptoSetup.HandleCryptoFrame(p.Payload, crypto.LevelInitial); err != nil {
-		return fmt.Errorf("处理Initial加密数据失败: %v", err)
+	// 验证版本，兼容版本协商后客户端仍可能使用原始版本发送Initial包
+	if version := p.Header.Version; version != c.Version() && version != c.OriginalVersion() {
+		return fmt.Errorf("不支持的QUIC版本: 0x%x", version)
+	}
+
+	// 处理Initial包中的帧
+	if err := c.handleFrames(p.Payload, p.Header.Type, crypto.LevelInitial); err != nil {
+		return fmt.Errorf("处理Initial数据包失败: %w", err)
 	}
 
 	// 更新连接状态
@@ -193,19 +375,80 @@ func (c *Connection) handleInitialPacket(p *packet.Packet) error {
 	return nil
 }
 
+// onServerInitial 客户端收到通过认证的服务端首个Initial包后，改用服务端选择的连接ID，
+// 服务端以兼容版本协商选定了新版本时切换版本，见RFC 9000第7.2节和RFC 9368第2.3节。
+// 未通过认证的数据包不会改变这些状态
+func (c *Connection) onServerInitial(p *packet.Packet) error {
+	c.frameMux.Lock()
+	if c.serverInitialReceived {
+		c.frameMux.Unlock()
+		return nil
+	}
+	c.serverInitialReceived = true
+	c.destConnID = append(protocol.ConnectionID{}, p.Header.SrcConnID...)
+	c.frameMux.Unlock()
+
+	if p.Header.Version != c.Version() {
+		return c.SwitchVersion(p.Header.Version)
+	}
+	return nil
+}
+
+// ServerInitialReceived 客户端是否已经收到通过认证的服务端Initial包
+func (c *Connection) ServerInitialReceived() bool {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+	return c.serverInitialReceived
+}
+
 // handleHandshakePacket 处理Handshake数据包
 func (c *Connection) handleHandshakePacket(p *packet.Packet) error {
-	// 处理握手数据
-	if err := c.cryptoSetup.HandleCryptoFrame(p.Payload, crypto.LevelHandshake); err != nil {
-		return fmt.Errorf("处理Handshake加密数据失败: %v", err)
+	// 服务端第一次成功处理Handshake包后不再需要Initial密钥，见RFC 9001第4.9.1节；
+	// 客户端能够发送Handshake包，说明它收到了发往该地址的数据，地址得到验证，见RFC 9000第8.1节
+	if !c.cryptoSetup.IsClient() {
+		c.frameMux.Lock()
+		c.discardKeys(crypto.LevelInitial)
+		c.addressValidated = true
+		c.frameMux.Unlock()
 	}
 
-	// 检查握手是否完成
-	if c.cryptoSetup.HandshakeComplete() {
+	// 处理Handshake包中的帧
+	if err := c.handleFrames(p.Payload, p.Header.Type, crypto.LevelHandshake); err != nil {
+		return fmt.Errorf("处理Handshake数据包失败: %w", err)
+	}
+
+	// 检查握手是否完成，服务端完成握手即确认握手，丢弃Handshake密钥后通过HANDSHAKE_DONE帧通知客户端
+	if c.cryptoSetup.HandshakeComplete() && c.GetState() != StateEstablished {
 		c.setState(StateEstablished)
-		c.cryptoSetup.SetHandshakeComplete()
+		if !c.cryptoSetup.IsClient() {
+			c.frameMux.Lock()
+			c.discardKeys(crypto.LevelHandshake)
+			c.queueControlFrame(&frame.HandshakeDoneFrame{})
+			c.frameMux.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// discardKeys 丢弃加密级别的密钥，以及对应包序号空间待发送的ACK和CRYPTO数据，见RFC 9001第4.9节。
+// 调用方需持有frameMux
+func (c *Connection) discardKeys(level crypto.CryptoLevel) {
+	if c.cryptoSetup.KeysDiscarded(level) {
+		return
 	}
+	c.cryptoSetup.DiscardKeys(level)
+	c.ackPending[spaceForLevel(level)] = false
+	if stream, ok := c.cryptoStreams[level]; ok {
+		stream.discard()
+	}
+}
 
+// handleZeroRTTPacket 服务端处理客户端在握手完成之前发送的0-RTT数据包
+func (c *Connection) handleZeroRTTPacket(p *packet.Packet) error {
+	if err := c.handleFrames(p.Payload, p.Header.Type, crypto.LevelZeroRTT); err != nil {
+		return fmt.Errorf("处理0-RTT数据包失败: %w", err)
+	}
 	return nil
 }
 
@@ -216,31 +459,42 @@ func (c *Connection) handleOneRTTPacket(p *packet.Packet) error {
 		return fmt.Errorf("连接未建立，无法处理1-RTT数据包")
 	}
 
-	// 检查流量控制
-	if !c.flowController.CanSend(protocol.ByteCount(len(p.Payload))) {
-		return fmt.Errorf("超出流量控制窗口限制")
+	// 1-RTT数据必须在加密握手完成后处理
+	if !c.cryptoSetup.HandshakeComplete() {
+		return fmt.Errorf("加密握手未完成，无法处理应用层数据")
 	}
 
-	// 更新流量控制
-	c.flowController.OnDataSent(protocol.ByteCount(len(p.Payload)))
-
-	// 处理应用层数据
-	if len(p.Payload) > 0 {
-		// 根据QUIC协议规范处理应用层数据
-		// 1. 验证数据完整性
-		if !c.cryptoSetup.HandshakeComplete() {
-			return fmt.Errorf("加密握手未完成，无法处理应用层数据")
-		}
+	// 处理1-RTT包中的帧
+	if err := c.handleFrames(p.Payload, p.Header.Type, crypto.LevelOneRTT); err != nil {
+		return fmt.Errorf("处理1-RTT数据包失败: %w", err)
+	}
+	return nil
+}
 
-		// 2. 处理数据帧
-		// 这里可以根据实际应用协议进行扩展
-		// 例如：HTTP/3、WebSocket等
+// CloseError 返回关闭连接的原因，连接未因错误关闭时返回nil
+func (c *Connection) CloseError() error {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+	return c.closeErr
+}
 
-		// 3. 更新接收窗口
-		c.flowController.UpdateWindow(protocol.ByteCount(len(p.Payload)))
+// closeWithError 因传输层错误关闭连接，关闭之前尽量在当前最高的加密级别发送CONNECTION_CLOSE帧，
+// 见RFC 9000第10.2节
+func (c *Connection) closeWithError(err *protocol.TransportError) {
+	if c.GetState() == StateClosed {
+		return
 	}
+	c.frameMux.Lock()
+	c.closeErr = err
+	// 发送失败（例如发送密钥已达到机密性上限）时直接关闭
+	_ = c.sendConnectionClose(err)
+	c.frameMux.Unlock()
+	c.Close()
+}
 
-	return nil
+// Done 返回连接关闭时关闭的通道
+func (c *Connection) Done() <-chan struct{} {
+	return c.closeChan
 }
 
 // Close 关闭连接
@@ -248,6 +502,7 @@ func (c *Connection) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeChan)
 		c.setState(StateClosed)
+		c.cryptoSetup.Close()
 	})
 	return nil
 }
@@ -1,10 +1,18 @@
 package connection
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 
 	"LQUIC/internal/crypto"
+	"LQUIC/internal/flowcontrol"
+	"LQUIC/internal/frame"
 	"LQUIC/internal/packet"
 	"LQUIC/internal/protocol"
 )
@@ -15,7 +23,7 @@ func TestNewConnection(t *testing.T) {
 	srcConnID := protocol.ConnectionID{5, 6, 7, 8}
 	remoteAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
 	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
-	cryptoSetup := crypto.NewCryptoSetup(nil)
+	cryptoSetup := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
 
 	// 创建连接
 	c := NewConnection(destConnID, srcConnID, remoteAddr, conn, cryptoSetup)
@@ -46,7 +54,7 @@ func TestConnectionState(t *testing.T) {
 		protocol.ConnectionID{5, 6, 7, 8},
 		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
 		nil,
-		crypto.NewCryptoSetup(nil),
+		crypto.NewCryptoSetup(nil, protocol.PerspectiveClient),
 	)
 
 	// 测试状态转换
@@ -78,69 +86,1205 @@ func TestPacketNumberGeneration(t *testing.T) {
 		protocol.ConnectionID{5, 6, 7, 8},
 		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
 		nil,
-		crypto.NewCryptoSetup(nil),
+		crypto.NewCryptoSetup(nil, protocol.PerspectiveClient),
 	)
 
 	// 测试包序号生成
-	pn1 := c.generatePacketNumber()
-	pn2 := c.generatePacketNumber()
+	pn1, _ := c.generatePacketNumber(spaceAppData)
+	pn2, pnLen := c.generatePacketNumber(spaceAppData)
 
 	if pn1 >= pn2 {
 		t.Error("包序号应该递增")
 	}
+	if pnLen != 1 {
+		t.Errorf("尚未被确认的小包序号应编码为1字节，实际%d字节", pnLen)
+	}
+
+	// 不同包序号空间相互独立
+	if pn, _ := c.generatePacketNumber(spaceInitial); pn != 0 {
+		t.Errorf("Initial空间的首个包序号应为0，实际%d", pn)
+	}
 
-	// 测试包序号验证
-	if !c.validatePacketNumber(pn2 + 1) {
-		t.Error("有效的包序号验证失败")
+	// 测试包序号还原和重复检测
+	receivePacketNumber := func(space pnSpace, h *packet.Header) (protocol.PacketNumber, error) {
+		pn, err := c.decodePacketNumber(space, h)
+		if err == nil {
+			c.onPacketReceived(space, pn)
+		}
+		return pn, err
+	}
+	h := &packet.Header{PacketNumber: 0x01, PacketNumberLen: 1}
+	if pn, err := receivePacketNumber(spaceAppData, h); err != nil || pn != 1 {
+		t.Errorf("有效的包序号验证失败: %d, %v", pn, err)
+	}
+	if _, err := receivePacketNumber(spaceAppData, h); err == nil {
+		t.Error("重复的包序号验证应该失败")
 	}
 
-	if c.validatePacketNumber(pn1) {
-		t.Error("过期的包序号验证应该失败")
+	// 截断的包序号根据已接收的最大包序号还原
+	for pn := protocol.PacketNumber(2); pn <= 0x102; pn++ {
+		if _, err := receivePacketNumber(spaceAppData, &packet.Header{PacketNumber: pn, PacketNumberLen: 4}); err != nil {
+			t.Fatalf("接收包序号%d失败: %v", pn, err)
+		}
+	}
+	if pn, err := receivePacketNumber(spaceAppData, &packet.Header{PacketNumber: 0x03, PacketNumberLen: 1}); err != nil || pn != 0x103 {
+		t.Errorf("截断包序号还原错误，期望0x103，实际0x%x, %v", pn, err)
+	}
+}
+
+func TestPacketNumberSpaceAckTracking(t *testing.T) {
+	s := newPacketNumberSpace()
+
+	// 乱序接收的包序号合并为区间
+	for _, pn := range []protocol.PacketNumber{5, 3, 4, 1, 9} {
+		s.onPacketReceived(pn)
+	}
+	expected := []frame.AckRange{{Smallest: 9, Largest: 9}, {Smallest: 3, Largest: 5}, {Smallest: 1, Largest: 1}}
+	if len(s.received) != len(expected) {
+		t.Fatalf("区间数量错误，期望%v，实际%v", expected, s.received)
+	}
+	for i := range expected {
+		if s.received[i] != expected[i] {
+			t.Errorf("区间错误，期望%v，实际%v", expected, s.received)
+		}
+	}
+	if s.largestReceived != 9 || !s.isDuplicate(4) || s.isDuplicate(2) {
+		t.Error("已接收包序号记录错误")
+	}
+
+	// 确认尚未发送的包序号违反协议
+	if err := s.onAckReceived(&frame.AckFrame{Ranges: []frame.AckRange{{Smallest: 0, Largest: 0}}}); err == nil {
+		t.Error("确认未发送的包序号应该返回错误")
+	}
+	for i := 0; i < 300; i++ {
+		s.popPacketNumber()
+	}
+	if err := s.onAckReceived(&frame.AckFrame{Ranges: []frame.AckRange{{Smallest: 0, Largest: 255}}}); err != nil {
+		t.Fatalf("处理ACK失败: %v", err)
+	}
+	// 已确认255后，发送300只需1字节编码
+	if pn, pnLen := s.popPacketNumber(); pn != 300 || pnLen != 1 {
+		t.Errorf("包序号截断错误，包序号%d，长度%d", pn, pnLen)
 	}
 }
 
 func TestHandlePacket(t *testing.T) {
-	// 创建测试连接
+	// 创建测试连接，服务端以相同的目标连接ID派生Initial密钥
+	clientCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
 	c := NewConnection(
 		protocol.ConnectionID{1, 2, 3, 4},
 		protocol.ConnectionID{5, 6, 7, 8},
 		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
 		nil,
-		crypto.NewCryptoSetup(nil),
+		clientCrypto,
 	)
-
-	// 测试处理Initial包
-	initialPacket := &packet.Packet{
-		Header: packet.Header{
-			Type:         protocol.PacketTypeInitial,
-			Version:      protocol.Version,
-			DestConnID:   protocol.ConnectionID{1, 2, 3, 4},
-			PacketNumber: c.generatePacketNumber() + 1,
-		},
-		Payload: []byte("initial payload"),
+	defer c.Close()
+	server := NewConnection(protocol.ConnectionID{5, 6, 7, 8}, protocol.ConnectionID{1, 2, 3, 4}, nil, nil, serverCrypto)
+	if err := serverCrypto.SetInitialKeys(protocol.ConnectionID{1, 2, 3, 4}); err != nil {
+		t.Fatalf("安装服务端Initial密钥失败: %v", err)
 	}
 
-	err := c.HandlePacket(initialPacket)
+	payload, err := (&frame.CryptoFrame{Data: []byte("initial payload")}).Append(nil)
 	if err != nil {
+		t.Fatalf("序列化CRYPTO帧失败: %v", err)
+	}
+	hdr := server.newHeader(crypto.LevelInitial)
+	hdr.PacketNumber, hdr.PacketNumberLen = server.generatePacketNumber(spaceInitial)
+	data, err := server.sealPacket(crypto.LevelInitial, hdr, payload)
+	if err != nil {
+		t.Fatalf("加密数据包失败: %v", err)
+	}
+	unpack := func() *packet.Packet {
+		t.Helper()
+		// 去除头部保护会修改原始字节，每次处理使用副本
+		p, err := packet.Unpack(append([]byte{}, data...))
+		if err != nil {
+			t.Fatalf("解析数据包失败: %v", err)
+		}
+		return p
+	}
+
+	// 尚未安装Initial密钥时数据包被丢弃，不按明文处理
+	if err := c.HandlePacket(unpack()); err != nil {
+		t.Errorf("没有密钥的数据包应被直接丢弃: %v", err)
+	}
+	if c.GetState() != StateInitial || c.ackPending[spaceInitial] {
+		t.Error("没有密钥的数据包不应被处理")
+	}
+	// 明文的数据包同样被丢弃
+	plain := &packet.Packet{Header: hdr, Payload: payload}
+	if err := c.HandlePacket(plain); err != nil || c.GetState() != StateInitial {
+		t.Errorf("明文的数据包应被直接丢弃: %v", err)
+	}
+
+	// 测试处理Initial包
+	if err := clientCrypto.SetInitialKeys(protocol.ConnectionID{1, 2, 3, 4}); err != nil {
+		t.Fatalf("安装客户端Initial密钥失败: %v", err)
+	}
+	if err := c.HandlePacket(unpack()); err != nil {
 		t.Errorf("处理Initial包失败: %v", err)
 	}
 	if c.GetState() != StateHandshaking {
 		t.Error("处理Initial包后状态应该是握手中")
 	}
 
-	// 测试处理无效的包序号
-	invalidPacket := &packet.Packet{
-		Header: packet.Header{
-			Type:         protocol.PacketTypeInitial,
-			PacketNumber: 0, // 无效的包序号
-		},
+	// 测试处理重复的包序号
+	if err := c.HandlePacket(unpack()); err == nil {
+		t.Error("处理重复的包序号应该返回错误")
 	}
 
-	err = c.HandlePacket(invalidPacket)
-	if err == nil {
-		t.Error("处理无效包序号应该返回错误")
+	// 没有Handshake密钥时不能发送Handshake包
+	if _, err := c.sealPacket(crypto.LevelHandshake, c.newHeader(crypto.LevelHandshake), payload); err == nil {
+		t.Error("没有密钥的加密级别不应发送数据包")
 	}
+}
 
-	// 清理资源
-	c.Close()
+func TestHandleFrames(t *testing.T) {
+	c := NewConnection(
+		protocol.ConnectionID{1, 2, 3, 4},
+		protocol.ConnectionID{5, 6, 7, 8},
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+		nil,
+		crypto.NewCryptoSetup(nil, protocol.PerspectiveClient),
+	)
+	defer c.Close()
+
+	// Initial包中不允许出现STREAM帧
+	payload, _ := frame.AppendAll(nil, []frame.Frame{&frame.StreamFrame{StreamID: 0, Data: []byte("data")}})
+	err := c.handleFrames(payload, protocol.PacketTypeInitial, crypto.LevelInitial)
+	var terr *protocol.TransportError
+	if !errors.As(err, &terr) || terr.Code != protocol.ProtocolViolation {
+		t.Errorf("期望PROTOCOL_VIOLATION错误，实际%v", err)
+	}
+
+	// 空负载违反协议
+	if err := c.handleFrames(nil, protocol.PacketTypeInitial, crypto.LevelInitial); err == nil {
+		t.Error("空负载应该返回错误")
+	}
+
+	// 服务端收到HANDSHAKE_DONE帧时返回PROTOCOL_VIOLATION错误
+	server := NewConnection(protocol.ConnectionID{5, 6, 7, 8}, protocol.ConnectionID{1, 2, 3, 4}, nil, nil, crypto.NewCryptoSetup(nil, protocol.PerspectiveServer))
+	defer server.Close()
+	payload, _ = frame.AppendAll(nil, []frame.Frame{&frame.HandshakeDoneFrame{}})
+	if err := server.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != protocol.ProtocolViolation {
+		t.Errorf("服务端收到HANDSHAKE_DONE时期望PROTOCOL_VIOLATION错误，实际%v", err)
+	}
+	if server.cryptoSetup.HandshakeComplete() {
+		t.Error("服务端收到HANDSHAKE_DONE后不应认为握手已确认")
+	}
+
+	// 乱序的CRYPTO帧按偏移量重组后交给加密模块
+	payload, _ = frame.AppendAll(nil, []frame.Frame{
+		&frame.CryptoFrame{Offset: 5, Data: []byte("world")},
+		&frame.CryptoFrame{Offset: 0, Data: []byte("hello")},
+	})
+	if err := c.handleFrames(payload, protocol.PacketTypeInitial, crypto.LevelInitial); err != nil {
+		t.Fatalf("处理CRYPTO帧失败: %v", err)
+	}
+	if stream := c.cryptoStreams[crypto.LevelInitial]; stream.readOffset != 10 || len(stream.pending) != 0 {
+		t.Errorf("CRYPTO数据重组错误，读取偏移量%d，缓存%d段", stream.readOffset, len(stream.pending))
+	}
+
+	// PATH_CHALLENGE需要回复PATH_RESPONSE
+	challenge := &frame.PathChallengeFrame{Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	payload, _ = challenge.Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理PATH_CHALLENGE帧失败: %v", err)
+	}
+	if len(c.controlFrames) != 1 {
+		t.Fatalf("期望1个待发送控制帧，实际%d个", len(c.controlFrames))
+	}
+	if resp, ok := c.controlFrames[0].(*frame.PathResponseFrame); !ok || resp.Data != challenge.Data {
+		t.Errorf("PATH_RESPONSE不匹配: %+v", c.controlFrames[0])
+	}
+
+	// 对端关闭连接
+	payload, _ = (&frame.ConnectionCloseFrame{ErrorCode: uint64(protocol.NoError)}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理CONNECTION_CLOSE帧失败: %v", err)
+	}
+	if c.GetState() != StateClosed {
+		t.Error("收到CONNECTION_CLOSE后连接应关闭")
+	}
+	var transportErr *protocol.TransportError
+	if !errors.As(c.closeErr, &transportErr) || transportErr.Code != protocol.NoError {
+		t.Errorf("传输层关闭原因错误: %v", c.closeErr)
+	}
+
+	// 应用层关闭帧的错误码属于应用层协议，不能映射为传输层错误码
+	app := NewConnection(
+		protocol.ConnectionID{1, 2, 3, 4},
+		protocol.ConnectionID{5, 6, 7, 8},
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+		nil,
+		crypto.NewCryptoSetup(nil, protocol.PerspectiveClient),
+	)
+	payload, _ = (&frame.ConnectionCloseFrame{IsApplicationError: true, ErrorCode: 0xa, ReasonPhrase: "bye"}).Append(nil)
+	if err := app.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理应用层CONNECTION_CLOSE帧失败: %v", err)
+	}
+	var appErr *protocol.ApplicationCloseError
+	if !errors.As(app.closeErr, &appErr) || appErr.Code != 0xa || appErr.Reason != "bye" {
+		t.Errorf("应用层关闭原因错误: %v", app.closeErr)
+	}
+	if errors.As(app.closeErr, &transportErr) {
+		t.Error("应用层关闭原因不应是传输层错误")
+	}
+}
+
+func TestSendCoalescedPackets(t *testing.T) {
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建本地套接字失败: %v", err)
+	}
+	defer local.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建对端套接字失败: %v", err)
+	}
+	defer peer.Close()
+
+	destConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	cryptoSetup := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	c := NewConnection(
+		destConnID,
+		protocol.ConnectionID{5, 6, 7, 8},
+		peer.LocalAddr().(*net.UDPAddr),
+		local,
+		cryptoSetup,
+	)
+	defer c.Close()
+
+	// 没有任何密钥时待发送的数据保留，不发送明文数据包
+	c.queueCryptoData(crypto.LevelInitial, []byte("initial crypto"))
+	if datagram, err := c.packDatagram(); err != nil || datagram != nil {
+		t.Fatalf("没有密钥时不应组装数据报: %v", err)
+	}
+
+	if err := cryptoSetup.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	secret := bytes.Repeat([]byte{1}, 32)
+	for _, level := range []crypto.CryptoLevel{crypto.LevelHandshake, crypto.LevelOneRTT} {
+		if err := cryptoSetup.InstallKeys(level, tls.TLS_AES_128_GCM_SHA256, secret, secret); err != nil {
+			t.Fatalf("安装密钥失败: %v", err)
+		}
+	}
+	cryptoSetup.SetHandshakeComplete()
+	// 服务端以相同的目标连接ID派生Initial密钥，用于解密客户端的Initial包
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := serverCrypto.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装服务端Initial密钥失败: %v", err)
+	}
+	server := NewConnection(protocol.ConnectionID{5, 6, 7, 8}, destConnID, nil, nil, serverCrypto)
+
+	// 各加密级别都有待发送的数据
+	c.queueCryptoData(crypto.LevelHandshake, []byte("handshake crypto"))
+	c.queueControlFrame(&frame.PingFrame{})
+
+	if err := c.SendPendingPackets(); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+
+	buf := make([]byte, 2048)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("读取数据报失败: %v", err)
+	}
+	if n < protocol.MinInitialDatagramSize {
+		t.Errorf("携带Initial包的数据报应至少%d字节，实际%d字节", protocol.MinInitialDatagramSize, n)
+	}
+
+	packets, err := packet.ParseDatagram(buf[:n], 8)
+	if err != nil {
+		t.Fatalf("解析数据报失败: %v", err)
+	}
+	expected := []protocol.PacketType{protocol.PacketTypeInitial, protocol.PacketTypeHandshake, protocol.PacketTypeOneRTT}
+	if len(packets) != len(expected) {
+		t.Fatalf("期望合并%d个数据包，实际%d个", len(expected), len(packets))
+	}
+	for i, p := range packets {
+		if p.Header.Type != expected[i] {
+			t.Errorf("第%d个数据包类型错误，期望%v，实际%v", i, expected[i], p.Header.Type)
+		}
+	}
+	if err := server.unprotectHeader(packets[0]); err != nil {
+		t.Fatalf("去除头部保护失败: %v", err)
+	}
+	if err := server.openPacket(packets[0], packets[0].Header.PacketNumber); err != nil {
+		t.Fatalf("解密Initial包失败: %v", err)
+	}
+	frames, err := frame.ParseAll(packets[0].Payload)
+	if err != nil {
+		t.Fatalf("解析Initial包负载失败: %v", err)
+	}
+	if cf, ok := frames[0].(*frame.CryptoFrame); !ok || string(cf.Data) != "initial crypto" {
+		t.Errorf("Initial包中的CRYPTO帧错误: %+v", frames[0])
+	}
+
+	// 客户端发送Handshake包后丢弃Initial密钥，之后不再发送Initial包
+	if !cryptoSetup.KeysDiscarded(crypto.LevelInitial) || c.canSendAt(crypto.LevelInitial) {
+		t.Error("客户端发送Handshake包后应丢弃Initial密钥")
+	}
+	c.queueCryptoData(crypto.LevelInitial, []byte("late initial"))
+
+	// 没有待发送数据时不再发送
+	if datagram, err := c.packDatagram(); err != nil || datagram != nil {
+		t.Errorf("没有待发送数据时不应组装数据报: %v", err)
+	}
+}
+
+func TestAmplificationLimit(t *testing.T) {
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建本地套接字失败: %v", err)
+	}
+	defer local.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("创建对端套接字失败: %v", err)
+	}
+	defer peer.Close()
+
+	destConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	cryptoSetup := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := cryptoSetup.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	c := NewConnection(
+		protocol.ConnectionID{5, 6, 7, 8},
+		destConnID,
+		peer.LocalAddr().(*net.UDPAddr),
+		local,
+		cryptoSetup,
+	)
+	defer c.Close()
+
+	// readAll 读取对端收到的全部数据报，返回总字节数
+	readAll := func() int {
+		total := 0
+		buf := make([]byte, 2048)
+		for {
+			peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				return total
+			}
+			total += n
+		}
+	}
+
+	// 尚未收到任何数据时不发送
+	c.queueCryptoData(crypto.LevelInitial, make([]byte, 8000))
+	if err := c.SendPendingPackets(); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	if n := readAll(); n != 0 {
+		t.Fatalf("未收到数据时不应发送，实际发送%d字节", n)
+	}
+
+	// 验证地址之前发送的数据不超过收到的数据的3倍
+	c.frameMux.Lock()
+	c.bytesReceived = protocol.MinInitialDatagramSize
+	c.frameMux.Unlock()
+	if err := c.SendPendingPackets(); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	limit := amplificationFactor * protocol.MinInitialDatagramSize
+	if n := readAll(); n == 0 || n > limit {
+		t.Errorf("验证地址之前应发送不超过%d字节，实际%d字节", limit, n)
+	}
+
+	// 地址得到验证后继续发送剩余的数据
+	c.frameMux.Lock()
+	c.addressValidated = true
+	c.frameMux.Unlock()
+	if err := c.SendPendingPackets(); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	if n := readAll(); n == 0 {
+		t.Error("地址得到验证后应继续发送剩余的数据")
+	}
+}
+
+func TestCompatibleVersionNegotiation(t *testing.T) {
+	cryptoSetup := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	c := NewConnection(protocol.ConnectionID{1, 2, 3, 4}, protocol.ConnectionID{5, 6, 7, 8}, nil, nil, cryptoSetup)
+	c.SetAvailableVersions([]uint32{protocol.Version2, protocol.Version1})
+	c.SetVersion(protocol.Version1)
+	if err := cryptoSetup.SetInitialKeys(protocol.ConnectionID{5, 6, 7, 8}); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+
+	// Chosen Version与Initial包的版本不一致
+	err := c.NegotiateVersion(&protocol.VersionInformation{ChosenVersion: protocol.Version2})
+	var terr *protocol.TransportError
+	if !errors.As(err, &terr) || terr.Code != protocol.VersionNegotiationError {
+		t.Fatalf("期望VERSION_NEGOTIATION_ERROR，实际%v", err)
+	}
+
+	// 客户端支持版本2时服务端按优先级升级
+	err = c.NegotiateVersion(&protocol.VersionInformation{
+		ChosenVersion:     protocol.Version1,
+		AvailableVersions: []uint32{protocol.Version1, protocol.Version2},
+	})
+	if err != nil {
+		t.Fatalf("兼容版本协商失败: %v", err)
+	}
+	if c.Version() != protocol.Version2 || c.OriginalVersion() != protocol.Version1 {
+		t.Errorf("版本错误，当前0x%x，原始0x%x", c.Version(), c.OriginalVersion())
+	}
+	if cryptoSetup.Version() != protocol.Version2 {
+		t.Error("加密设置未切换版本")
+	}
+	if info := c.LocalVersionInformation(); info.ChosenVersion != protocol.Version2 {
+		t.Errorf("version_information的Chosen Version错误: 0x%x", info.ChosenVersion)
+	}
+
+	// 切换后仍以原始版本的密钥接受客户端的Initial包，收到新版本的Initial包之后不再接受原始版本
+	clientCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	client := NewConnection(protocol.ConnectionID{5, 6, 7, 8}, protocol.ConnectionID{1, 2, 3, 4}, nil, nil, clientCrypto)
+	client.SetVersion(protocol.Version1)
+	if err := clientCrypto.SetInitialKeys(protocol.ConnectionID{5, 6, 7, 8}); err != nil {
+		t.Fatalf("安装客户端Initial密钥失败: %v", err)
+	}
+	sealInitial := func(version uint32) *packet.Packet {
+		t.Helper()
+		if err := client.SwitchVersion(version); err != nil {
+			t.Fatalf("切换客户端版本失败: %v", err)
+		}
+		hdr := client.newHeader(crypto.LevelInitial)
+		hdr.PacketNumber, hdr.PacketNumberLen = client.generatePacketNumber(spaceInitial)
+		data, err := client.sealPacket(crypto.LevelInitial, hdr, []byte{byte(frame.TypePing)})
+		if err != nil {
+			t.Fatalf("加密数据包失败: %v", err)
+		}
+		p, err := packet.Unpack(data)
+		if err != nil {
+			t.Fatalf("解析数据包失败: %v", err)
+		}
+		return p
+	}
+	if err := c.HandlePacket(sealInitial(protocol.Version1)); err != nil {
+		t.Errorf("原始版本的Initial包应该被接受: %v", err)
+	}
+	if err := c.HandlePacket(sealInitial(protocol.Version2)); err != nil {
+		t.Errorf("新版本的Initial包应该被接受: %v", err)
+	}
+	if err := c.HandlePacket(sealInitial(protocol.Version1)); err == nil {
+		t.Error("收到新版本的Initial包之后不应再接受原始版本")
+	}
+
+	// 客户端校验服务端选定的版本
+	if err := c.ValidateVersionInformation(&protocol.VersionInformation{ChosenVersion: protocol.Version1}); err == nil {
+		t.Error("服务端版本与实际不一致时应该返回错误")
+	}
+	if err := c.ValidateVersionInformation(nil); err != nil {
+		t.Errorf("没有发生版本协商时服务端可以不发送version_information: %v", err)
+	}
+
+	// 版本协商之后必须收到version_information，且按本端优先级从服务端支持的版本中选出的就是当前版本
+	negotiated := NewConnection(protocol.ConnectionID{1, 2, 3, 4}, protocol.ConnectionID{5, 6, 7, 8}, nil, nil, crypto.NewCryptoSetup(nil, protocol.PerspectiveClient))
+	negotiated.SetAvailableVersions([]uint32{protocol.Version2, protocol.Version1})
+	negotiated.SetVersion(protocol.Version1)
+	negotiated.SetVersionNegotiated()
+	for _, tc := range []struct {
+		name   string
+		server *protocol.VersionInformation
+		ok     bool
+	}{
+		{"缺少version_information", nil, false},
+		{"服务端也支持更优先的版本", &protocol.VersionInformation{ChosenVersion: protocol.Version1, AvailableVersions: []uint32{protocol.Version1, protocol.Version2}}, false},
+		{"服务端只支持当前版本", &protocol.VersionInformation{ChosenVersion: protocol.Version1, AvailableVersions: []uint32{protocol.Version1}}, true},
+	} {
+		err := negotiated.ValidateVersionInformation(tc.server)
+		if tc.ok && err != nil {
+			t.Errorf("%s: 不应返回错误: %v", tc.name, err)
+		}
+		if !tc.ok && (!errors.As(err, &terr) || terr.Code != protocol.VersionNegotiationError) {
+			t.Errorf("%s: 期望VERSION_NEGOTIATION_ERROR，实际%v", tc.name, err)
+		}
+	}
+
+	// 不支持的版本无法切换
+	if err := c.SwitchVersion(0x1a2a3a4a); err == nil {
+		t.Error("切换到不兼容的版本应该返回错误")
+	}
+}
+
+func TestPacketProtection(t *testing.T) {
+	clientSecret := make([]byte, 32)
+	serverSecret := make([]byte, 32)
+	serverSecret[0] = 1
+
+	clientCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := clientCrypto.InstallKeys(crypto.LevelHandshake, tls.TLS_AES_128_GCM_SHA256, serverSecret, clientSecret); err != nil {
+		t.Fatalf("安装客户端密钥失败: %v", err)
+	}
+	if err := serverCrypto.InstallKeys(crypto.LevelHandshake, tls.TLS_AES_128_GCM_SHA256, clientSecret, serverSecret); err != nil {
+		t.Fatalf("安装服务端密钥失败: %v", err)
+	}
+	client := NewConnection(protocol.ConnectionID{1, 2, 3, 4}, protocol.ConnectionID{5, 6, 7, 8}, nil, nil, clientCrypto)
+	server := NewConnection(protocol.ConnectionID{5, 6, 7, 8}, protocol.ConnectionID{1, 2, 3, 4}, nil, nil, serverCrypto)
+
+	hdr := client.newHeader(crypto.LevelHandshake)
+	hdr.PacketNumber, hdr.PacketNumberLen = client.generatePacketNumber(spaceHandshake)
+	payload := []byte{byte(frame.TypePing)}
+	data, err := client.sealPacket(crypto.LevelHandshake, hdr, payload)
+	if err != nil {
+		t.Fatalf("加密数据包失败: %v", err)
+	}
+	// 包序号为1字节，负载需要填充到3字节才能满足头部保护的采样要求
+	if plain, _ := (&packet.Packet{Header: hdr, Payload: []byte{byte(frame.TypePing), 0, 0}}).Pack(); bytes.Equal(data[1:], plain[1:]) || len(data) != len(plain)+16 {
+		t.Fatal("负载未加密")
+	}
+
+	// 被篡改的数据包认证失败，且不记录包序号
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	p, err := packet.Unpack(tampered)
+	if err != nil {
+		t.Fatalf("解析数据包失败: %v", err)
+	}
+	if err := server.HandlePacket(p); !errors.Is(err, crypto.ErrDecryptionFailed) {
+		t.Fatalf("期望解密失败，实际%v", err)
+	}
+	if server.ackPending[spaceHandshake] || len(server.pnSpaces[spaceHandshake].received) != 0 {
+		t.Fatal("认证失败的数据包不应被记录")
+	}
+
+	// 正常的数据包解密后处理其中的帧
+	p, err = packet.Unpack(data)
+	if err != nil {
+		t.Fatalf("解析数据包失败: %v", err)
+	}
+	if err := server.HandlePacket(p); err != nil {
+		t.Fatalf("处理加密数据包失败: %v", err)
+	}
+	if !server.ackPending[spaceHandshake] {
+		t.Error("解密后的PING帧应触发ACK")
+	}
+	// 服务端成功处理Handshake包后丢弃Initial密钥
+	if !serverCrypto.KeysDiscarded(crypto.LevelInitial) {
+		t.Error("服务端处理Handshake包后应丢弃Initial密钥")
+	}
+
+	// 丢弃Handshake密钥后，该级别的数据包被直接丢弃，不再触发ACK
+	server.frameMux.Lock()
+	server.discardKeys(crypto.LevelHandshake)
+	server.frameMux.Unlock()
+	if server.ackPending[spaceHandshake] {
+		t.Error("丢弃密钥后不应再发送该级别的ACK")
+	}
+	hdr.PacketNumber, hdr.PacketNumberLen = client.generatePacketNumber(spaceHandshake)
+	data, err = client.sealPacket(crypto.LevelHandshake, hdr, payload)
+	if err != nil {
+		t.Fatalf("加密数据包失败: %v", err)
+	}
+	p, err = packet.Unpack(data)
+	if err != nil {
+		t.Fatalf("解析数据包失败: %v", err)
+	}
+	if err := server.HandlePacket(p); err != nil {
+		t.Fatalf("丢弃密钥的加密级别的数据包应被忽略: %v", err)
+	}
+	if server.ackPending[spaceHandshake] {
+		t.Error("被丢弃的数据包不应触发ACK")
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	clientSecret := bytes.Repeat([]byte{1}, 32)
+	serverSecret := bytes.Repeat([]byte{2}, 32)
+	clientCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := clientCrypto.InstallKeys(crypto.LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, serverSecret, clientSecret); err != nil {
+		t.Fatalf("安装客户端密钥失败: %v", err)
+	}
+	if err := serverCrypto.InstallKeys(crypto.LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, clientSecret, serverSecret); err != nil {
+		t.Fatalf("安装服务端密钥失败: %v", err)
+	}
+	clientCrypto.SetHandshakeComplete()
+	serverCrypto.SetHandshakeComplete()
+	clientID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	serverID := protocol.ConnectionID{8, 7, 6, 5, 4, 3, 2, 1}
+	client := NewConnection(serverID, clientID, nil, nil, clientCrypto)
+	server := NewConnection(clientID, serverID, nil, nil, serverCrypto)
+	client.setState(StateEstablished)
+	server.setState(StateEstablished)
+
+	// send 构造携带指定帧的1-RTT数据包，并交给接收方处理
+	send := func(from, to *Connection, f frame.Frame) *packet.Packet {
+		t.Helper()
+		payload, err := f.Append(nil)
+		if err != nil {
+			t.Fatalf("序列化帧失败: %v", err)
+		}
+		hdr := from.newHeader(crypto.LevelOneRTT)
+		hdr.PacketNumber, hdr.PacketNumberLen = from.generatePacketNumber(spaceAppData)
+		data, err := from.sealPacket(crypto.LevelOneRTT, hdr, payload)
+		if err != nil {
+			t.Fatalf("加密数据包失败: %v", err)
+		}
+		p, err := packet.Unpack(data)
+		if err != nil {
+			t.Fatalf("解析数据包失败: %v", err)
+		}
+		if err := to.HandlePacket(p); err != nil {
+			t.Fatalf("处理数据包失败: %v", err)
+		}
+		return p
+	}
+
+	send(client, server, &frame.PingFrame{})
+	if err := client.UpdateKeys(); err == nil {
+		t.Fatal("数据包被确认之前不应允许密钥更新")
+	}
+	// 服务端的ACK确认了客户端当前阶段的数据包
+	send(server, client, server.buildAckFrame(spaceAppData))
+	if err := client.UpdateKeys(); err != nil {
+		t.Fatalf("发起密钥更新失败: %v", err)
+	}
+
+	p := send(client, server, &frame.PingFrame{})
+	if !p.Header.KeyPhase {
+		t.Error("密钥更新后发送的数据包应设置密钥阶段位")
+	}
+	if !serverCrypto.KeyPhase() || serverCrypto.KeyGeneration() != 1 {
+		t.Error("服务端应随客户端更新密钥")
+	}
+	if p := send(server, client, &frame.PingFrame{}); !p.Header.KeyPhase {
+		t.Error("服务端更新后发送的数据包应设置密钥阶段位")
+	}
+}
+
+func TestAEADIntegrityLimit(t *testing.T) {
+	clientSecret := bytes.Repeat([]byte{1}, 32)
+	serverSecret := bytes.Repeat([]byte{2}, 32)
+	clientCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveClient)
+	serverCrypto := crypto.NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := clientCrypto.InstallKeys(crypto.LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, serverSecret, clientSecret); err != nil {
+		t.Fatalf("安装客户端密钥失败: %v", err)
+	}
+	if err := serverCrypto.InstallKeys(crypto.LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, clientSecret, serverSecret); err != nil {
+		t.Fatalf("安装服务端密钥失败: %v", err)
+	}
+	clientCrypto.SetHandshakeComplete()
+	serverCrypto.SetHandshakeComplete()
+	serverCrypto.SetAEADLimits(0, 1)
+	clientID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	serverID := protocol.ConnectionID{8, 7, 6, 5, 4, 3, 2, 1}
+	client := NewConnection(serverID, clientID, nil, nil, clientCrypto)
+	server := NewConnection(clientID, serverID, nil, nil, serverCrypto)
+	server.setState(StateEstablished)
+
+	// forge 构造负载被篡改的1-RTT数据包
+	forge := func() *packet.Packet {
+		hdr := client.newHeader(crypto.LevelOneRTT)
+		hdr.PacketNumber, hdr.PacketNumberLen = client.generatePacketNumber(spaceAppData)
+		data, err := client.sealPacket(crypto.LevelOneRTT, hdr, []byte{byte(frame.TypePing)})
+		if err != nil {
+			t.Fatalf("加密数据包失败: %v", err)
+		}
+		data[len(data)-1] ^= 1
+		p, err := packet.Unpack(data)
+		if err != nil {
+			t.Fatalf("解析数据包失败: %v", err)
+		}
+		return p
+	}
+
+	if err := server.HandlePacket(forge()); !errors.Is(err, crypto.ErrDecryptionFailed) {
+		t.Fatalf("期望解密失败，实际%v", err)
+	}
+	if server.GetState() == StateClosed {
+		t.Fatal("未超过完整性上限时不应关闭连接")
+	}
+	var transportErr *protocol.TransportError
+	if err := server.HandlePacket(forge()); !errors.As(err, &transportErr) || transportErr.Code != protocol.AEADLimitReached {
+		t.Fatalf("超过完整性上限后应返回AEAD_LIMIT_REACHED，实际%v", err)
+	}
+	if server.GetState() != StateClosed {
+		t.Error("超过完整性上限后应关闭连接")
+	}
+	if !errors.As(server.CloseError(), &transportErr) || transportErr.Code != protocol.AEADLimitReached {
+		t.Errorf("关闭原因错误: %v", server.CloseError())
+	}
+
+	if stats := server.Stats(); stats.AEAD[crypto.LevelOneRTT].DecryptionFailures != 2 {
+		t.Errorf("认证失败的数据包数量错误: %+v", stats.AEAD[crypto.LevelOneRTT])
+	}
+	if stats := client.Stats(); stats.AEAD[crypto.LevelOneRTT].PacketsSealed != 2 || stats.KeyUpdates != 0 {
+		t.Errorf("客户端统计错误: %+v", stats)
+	}
+}
+
+func TestTransportParameters(t *testing.T) {
+	origDestConnID := protocol.ConnectionID{9, 9, 9, 9}
+	serverConnID := protocol.ConnectionID{1, 2, 3, 4}
+	c := NewConnection(serverConnID, protocol.ConnectionID{5, 6, 7, 8}, nil, nil,
+		crypto.NewCryptoSetup(&tls.Config{ServerName: "localhost"}, protocol.PerspectiveClient))
+	c.SetRetryConnIDs(origDestConnID, nil)
+
+	local := DefaultTransportParameters()
+	local.MaxIdleTimeout = 10 * time.Second
+	// 客户端不能发送的参数在开始握手时被清除
+	local.StatelessResetToken = &protocol.StatelessResetToken{1}
+	if err := c.SetTransportParameters(local); err != nil {
+		t.Fatalf("设置传输参数失败: %v", err)
+	}
+	if err := c.StartHandshake(protocol.PerspectiveClient); err != nil {
+		t.Fatalf("开始握手失败: %v", err)
+	}
+	if err := c.SetTransportParameters(local); err == nil {
+		t.Error("握手开始后不能修改传输参数")
+	}
+	params := c.LocalTransportParameters()
+	if string(params.InitialSourceConnectionID) != string(c.GetSrcConnID()) || params.StatelessResetToken != nil {
+		t.Errorf("本端传输参数错误: %+v", params)
+	}
+	if params.VersionInformation == nil || params.VersionInformation.ChosenVersion != c.Version() {
+		t.Error("传输参数应包含version_information")
+	}
+
+	// 客户端校验服务端传输参数中的连接ID
+	peer := func() *protocol.TransportParameters {
+		return &protocol.TransportParameters{
+			OriginalDestinationConnectionID: origDestConnID,
+			InitialSourceConnectionID:       serverConnID,
+		}
+	}
+	if err := c.validatePeerConnIDs(peer()); err != nil {
+		t.Errorf("连接ID一致时校验应通过: %v", err)
+	}
+	bad := []*protocol.TransportParameters{peer(), peer(), peer()}
+	bad[0].OriginalDestinationConnectionID = protocol.ConnectionID{1}
+	bad[1].InitialSourceConnectionID = protocol.ConnectionID{1}
+	bad[2].RetrySourceConnectionID = protocol.ConnectionID{1}
+	for i, p := range bad {
+		var terr *protocol.TransportError
+		if err := c.validatePeerConnIDs(p); !errors.As(err, &terr) || terr.Code != protocol.TransportParameterError {
+			t.Errorf("第%d组连接ID应返回TRANSPORT_PARAMETER_ERROR，实际%v", i, err)
+		}
+	}
+	// 发生Retry后必须携带一致的retry_source_connection_id
+	c.SetRetryConnIDs(origDestConnID, protocol.ConnectionID{7})
+	if err := c.validatePeerConnIDs(peer()); err == nil {
+		t.Error("缺少retry_source_connection_id时应返回错误")
+	}
+
+	// 空闲超时取双方非零值中的较小值
+	if c.IdleTimeout() != 10*time.Second {
+		t.Errorf("空闲超时错误: %v", c.IdleTimeout())
+	}
+	c.peerParams = &protocol.TransportParameters{MaxIdleTimeout: 3 * time.Second}
+	if c.IdleTimeout() != 3*time.Second {
+		t.Errorf("空闲超时应取较小值，实际%v", c.IdleTimeout())
+	}
+	c.peerParams.MaxIdleTimeout = 0
+	if c.IdleTimeout() != 10*time.Second {
+		t.Errorf("对端不限制时使用本端的空闲超时，实际%v", c.IdleTimeout())
+	}
+}
+
+func TestStreamData(t *testing.T) {
+	c := NewConnection(protocol.ConnectionID{1, 2, 3, 4}, protocol.ConnectionID{5, 6, 7, 8}, nil, nil, crypto.NewCryptoSetup(nil, protocol.PerspectiveClient))
+	defer c.Close()
+	params := DefaultTransportParameters()
+	params.InitialMaxData = 20
+	params.InitialMaxStreamDataBidiRemote = 10
+	if err := c.SetTransportParameters(params); err != nil {
+		t.Fatalf("设置传输参数失败: %v", err)
+	}
+
+	// 乱序的STREAM帧按偏移量重组，数据全部读取后报告FIN
+	payload, _ := frame.AppendAll(nil, []frame.Frame{
+		&frame.StreamFrame{StreamID: 4, Offset: 5, Data: []byte("world"), Fin: true, DataLenPresent: true},
+		&frame.StreamFrame{StreamID: 4, Offset: 0, Data: []byte("hello"), DataLenPresent: true},
+	})
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理STREAM帧失败: %v", err)
+	}
+	if data, err := io.ReadAll(&Stream{conn: c, id: 4}); string(data) != "helloworld" || err != nil {
+		t.Errorf("读取流数据错误: %q, %v", data, err)
+	}
+	// 读取了一半的连接窗口后通告新的上限，已经结束的流不再通告
+	if len(c.controlFrames) != 1 {
+		t.Fatalf("读取数据后应通告新的连接上限: %+v", c.controlFrames)
+	}
+	if f, ok := c.controlFrames[0].(*frame.MaxDataFrame); !ok || f.MaximumData != 30 {
+		t.Errorf("MAX_DATA帧错误: %+v", c.controlFrames[0])
+	}
+	c.controlFrames = nil
+
+	// 超出最终大小的数据
+	payload, _ = frame.AppendAll(nil, []frame.Frame{&frame.StreamFrame{StreamID: 4, Offset: 10, Data: []byte("!")}})
+	var terr *protocol.TransportError
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != protocol.FinalSizeError {
+		t.Errorf("期望FINAL_SIZE_ERROR错误，实际%v", err)
+	}
+
+	// 0-RTT数据受本端传输参数给出的流量控制上限约束，且只能由客户端发起的流携带
+	for _, tc := range []struct {
+		name string
+		f    *frame.StreamFrame
+		code protocol.TransportErrorCode
+	}{
+		{"服务器发起的流", &frame.StreamFrame{StreamID: 1, Data: []byte("x")}, protocol.StreamStateError},
+		{"超出流的上限", &frame.StreamFrame{StreamID: 0, Data: []byte("0123456789a")}, protocol.FlowControlError},
+		{"流的上限之内", &frame.StreamFrame{StreamID: 0, Data: []byte("0123456789")}, 0},
+		{"连接的上限之内", &frame.StreamFrame{StreamID: 12, Data: []byte("0123456789")}, 0},
+		{"超出连接的上限", &frame.StreamFrame{StreamID: 16, Data: []byte("x")}, protocol.FlowControlError},
+	} {
+		payload, _ := tc.f.Append(nil)
+		err := c.handleFrames(payload, protocol.PacketTypeZeroRTT, crypto.LevelZeroRTT)
+		if tc.code == 0 {
+			if err != nil {
+				t.Errorf("%s: 不应返回错误: %v", tc.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &terr) || terr.Code != tc.code {
+			t.Errorf("%s: 期望错误码0x%x，实际%v", tc.name, tc.code, err)
+		}
+	}
+
+	// 收到对端的传输参数后，按其中的初始值设置连接和已经打开的流的发送上限
+	for _, id := range []protocol.StreamID{0, 4, 8} {
+		c.newSendStream(id)
+	}
+	c.peerParams = &protocol.TransportParameters{InitialMaxData: 20, InitialMaxStreamDataBidiLocal: 16, InitialMaxStreamDataBidiRemote: 16}
+	c.applyPeerFlowControlLimits()
+	if c.sendWindow.Limit() != 20 || c.sendStreams[4].window.Limit() != 16 {
+		t.Fatalf("发送上限应取对端传输参数中的初始值: %d, %d", c.sendWindow.Limit(), c.sendStreams[4].window.Limit())
+	}
+
+	// 没有记住服务端传输参数时不发送0-RTT数据
+	c.streamFrames = []*frame.StreamFrame{{StreamID: 0, Data: []byte("0123456789"), Fin: true, DataLenPresent: true}}
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f != nil {
+		t.Fatalf("没有记住的传输参数时不应在0-RTT包中发送数据: %+v", f)
+	}
+
+	// 过长的STREAM帧拆分到多个数据包中，0-RTT发送的帧保留到得知0-RTT的结果
+	c.earlyParams = DefaultTransportParameters()
+	first := c.popStreamFrame(crypto.LevelZeroRTT, 8)
+	if first == nil || string(first.Data) != "01234" || first.Fin {
+		t.Fatalf("拆分后的第一个帧错误: %+v", first)
+	}
+	rest := c.popStreamFrame(crypto.LevelOneRTT, 64)
+	if rest == nil || rest.Offset != 5 || string(rest.Data) != "56789" || !rest.Fin {
+		t.Fatalf("拆分后的剩余帧错误: %+v", rest)
+	}
+	if len(c.earlyFrames) != 1 || c.earlyFrames[0] != first || len(c.streamFrames) != 0 {
+		t.Errorf("只有0-RTT发送的帧应被保留: %d", len(c.earlyFrames))
+	}
+
+	// 0-RTT数据不超出票据记录的服务端传输参数，超出的部分等到1-RTT发送
+	c.earlyParams.InitialMaxData = 12
+	c.earlyParams.InitialMaxStreamDataBidiRemote = 8
+	c.earlyParams.InitialMaxStreamsBidi = 2
+	c.streamFrames = []*frame.StreamFrame{
+		{StreamID: 4, Data: []byte("0123456789"), DataLenPresent: true},
+		{StreamID: 8, Data: []byte("x"), DataLenPresent: true},
+	}
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f == nil || string(f.Data) != "0123456" {
+		t.Fatalf("0-RTT数据应受连接的流量控制限制: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f != nil {
+		t.Fatalf("达到连接的流量控制限制后不应继续发送0-RTT数据: %+v", f)
+	}
+	c.earlyParams.InitialMaxData = 64
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f == nil || f.Offset != 7 || string(f.Data) != "7" {
+		t.Fatalf("0-RTT数据应受流的流量控制限制: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f != nil {
+		t.Fatalf("达到流的流量控制限制后不应继续发送0-RTT数据: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f == nil || f.Offset != 8 || string(f.Data) != "89" {
+		t.Fatalf("超出限制的数据应在1-RTT包中发送: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelZeroRTT, 64); f != nil {
+		t.Fatalf("超出流数量限制的流不应在0-RTT包中发送: %+v", f)
+	}
+
+	// 1-RTT数据不超出对端允许的流级别和连接级别的发送上限，达到流级别上限的流不影响其他流
+	c.streamFrames = []*frame.StreamFrame{
+		{StreamID: 0, Offset: 10, Data: []byte("abcdefghij"), DataLenPresent: true},
+		{StreamID: 8, Data: []byte("0123456789"), DataLenPresent: true},
+	}
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f == nil || f.StreamID != 0 || string(f.Data) != "abcdef" {
+		t.Fatalf("1-RTT数据应受流的发送上限限制: %+v", f)
+	}
+	// 已经发送了13字节，连接级别还可以发送7字节
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f == nil || f.StreamID != 8 || string(f.Data) != "0123456" {
+		t.Fatalf("1-RTT数据应受连接的发送窗口限制: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f != nil {
+		t.Fatalf("发送窗口用完后不应继续发送: %+v", f)
+	}
+	// MAX_DATA只扩大连接的发送窗口，流0仍受流级别的上限限制
+	payload, _ = (&frame.MaxDataFrame{MaximumData: 1 << 20}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理MAX_DATA帧失败: %v", err)
+	}
+	if c.sendWindow.Limit() != 1<<20 || c.recvWindow.Limit() != 30 {
+		t.Errorf("MAX_DATA应只扩大发送窗口，发送上限%d，接收上限%d", c.sendWindow.Limit(), c.recvWindow.Limit())
+	}
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f == nil || f.StreamID != 8 || string(f.Data) != "789" {
+		t.Fatalf("发送窗口扩大后应发送其他流剩余的数据: %+v", f)
+	}
+	if f := c.popStreamFrame(crypto.LevelOneRTT, 64); f != nil {
+		t.Fatalf("达到流级别上限的流不应继续发送: %+v", f)
+	}
+
+	// 收到的数据超出本端通告的连接级别上限
+	payload, _ = (&frame.StreamFrame{StreamID: 20, Data: []byte("abc")}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != protocol.FlowControlError {
+		t.Errorf("超出连接的接收上限时期望FLOW_CONTROL_ERROR，实际%v", err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	c := NewConnection(protocol.ConnectionID{1, 2, 3, 4}, protocol.ConnectionID{5, 6, 7, 8}, nil, nil, crypto.NewCryptoSetup(nil, protocol.PerspectiveClient))
+	defer c.Close()
+	params := DefaultTransportParameters()
+	params.InitialMaxStreamsBidi = 2
+	params.InitialMaxStreamsUni = 1
+	if err := c.SetTransportParameters(params); err != nil {
+		t.Fatalf("设置传输参数失败: %v", err)
+	}
+	if _, err := c.OpenStream(); err == nil {
+		t.Fatal("握手开始前不能打开流")
+	}
+	c.perspective = protocol.PerspectiveClient
+
+	// 收到服务端的传输参数之前不知道允许打开的流数量
+	if _, err := c.OpenStream(); !errors.Is(err, ErrStreamLimitReached) {
+		t.Fatalf("期望ErrStreamLimitReached，实际%v", err)
+	}
+	c.peerParams = &protocol.TransportParameters{InitialMaxStreamsBidi: 1, InitialMaxStreamsUni: 1}
+
+	// 客户端发起的双向流和单向流分别从0和2开始编号
+	bidi, err := c.OpenStream()
+	if err != nil || bidi.StreamID() != 0 {
+		t.Fatalf("打开双向流错误: %v", err)
+	}
+	uni, err := c.OpenUniStream()
+	if err != nil || uni.StreamID() != 2 {
+		t.Fatalf("打开单向流错误: %v", err)
+	}
+	if _, err := c.OpenStream(); !errors.Is(err, ErrStreamLimitReached) {
+		t.Fatalf("超出对端允许的流数量时期望ErrStreamLimitReached，实际%v", err)
+	}
+	if _, err := uni.Read(make([]byte, 1)); err == nil {
+		t.Error("不能读取本端发起的单向流")
+	}
+	// 只能写入已经打开的流，不能绕过对端允许的流数量
+	if _, err := (&Stream{conn: c, id: 4}).Write([]byte("x")); err == nil {
+		t.Error("不能写入本端尚未打开的流")
+	}
+	if _, err := (&Stream{conn: c, id: 3}).Write([]byte("x")); err == nil {
+		t.Error("不能写入对端发起的单向流")
+	}
+	if len(c.streamFrames) != 0 {
+		t.Errorf("写入失败时不应产生STREAM帧: %+v", c.streamFrames)
+	}
+
+	// 对端通过MAX_STREAMS帧提高上限后，阻塞的OpenStreamSync返回下一个流
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.OpenStreamSync(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ctx结束时期望context.Canceled，实际%v", err)
+	}
+	opened := make(chan *Stream, 1)
+	go func() {
+		s, err := c.OpenStreamSync(context.Background())
+		if err != nil {
+			t.Errorf("打开流失败: %v", err)
+		}
+		opened <- s
+	}()
+	payload, _ := (&frame.MaxStreamsFrame{Bidirectional: true, MaximumStreams: 2}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理MAX_STREAMS帧失败: %v", err)
+	}
+	select {
+	case s := <-opened:
+		if s == nil || s.StreamID() != 4 {
+			t.Fatalf("OpenStreamSync返回的流错误: %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("提高上限后OpenStreamSync应返回")
+	}
+
+	// 对端打开流5时同时打开流1，按序号等待接受
+	accepted := make(chan *Stream, 2)
+	go func() {
+		for range 2 {
+			s, err := c.AcceptStream(context.Background())
+			if err != nil {
+				t.Errorf("接受流失败: %v", err)
+			}
+			accepted <- s
+		}
+	}()
+	payload, _ = frame.AppendAll(nil, []frame.Frame{
+		&frame.StreamFrame{StreamID: 5, Data: []byte("hello"), Fin: true, DataLenPresent: true},
+		&frame.StreamFrame{StreamID: 3, Data: []byte("uni"), DataLenPresent: true},
+	})
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理STREAM帧失败: %v", err)
+	}
+	for _, want := range []protocol.StreamID{1, 5} {
+		select {
+		case s := <-accepted:
+			if s.StreamID() != want {
+				t.Fatalf("接受的流错误，期望%d，实际%d", want, s.StreamID())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("应接受流%d", want)
+		}
+	}
+	serverUni, err := c.AcceptUniStream(context.Background())
+	if err != nil || serverUni.StreamID() != 3 {
+		t.Fatalf("接受单向流错误: %v", err)
+	}
+	if _, err := serverUni.Write([]byte("x")); err == nil {
+		t.Error("不能写入对端发起的单向流")
+	}
+	if err := serverUni.Close(); err != nil {
+		t.Errorf("关闭对端发起的单向流不应返回错误: %v", err)
+	}
+	buf := make([]byte, 2)
+	if n, err := serverUni.Read(buf); err != nil || string(buf[:n]) != "un" {
+		t.Errorf("读取单向流错误: %q, %v", buf[:n], err)
+	}
+
+	// 读完对端结束的流后返回io.EOF；双向都结束后允许对端再打开一个流
+	stream := &Stream{conn: c, id: 5}
+	if data, err := io.ReadAll(stream); err != nil || string(data) != "hello" {
+		t.Fatalf("读取流数据错误: %q, %v", data, err)
+	}
+	if len(c.controlFrames) != 0 {
+		t.Fatal("发送方向结束之前不应提高流数量上限")
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("关闭流失败: %v", err)
+	}
+	if f, ok := c.controlFrames[0].(*frame.MaxStreamsFrame); !ok || !f.Bidirectional || f.MaximumStreams != 3 {
+		t.Errorf("应发送MAX_STREAMS帧提高上限: %+v", c.controlFrames)
+	}
+
+	var terr *protocol.TransportError
+	for _, tc := range []struct {
+		name string
+		id   protocol.StreamID
+		code protocol.TransportErrorCode
+	}{
+		{"本端发起的单向流", 2, protocol.StreamStateError},
+		{"本端尚未打开的流", 8, protocol.StreamStateError},
+		{"超出允许的流数量", 7, protocol.StreamLimitError},
+	} {
+		payload, _ := (&frame.StreamFrame{StreamID: tc.id, Data: []byte("x")}).Append(nil)
+		if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != tc.code {
+			t.Errorf("%s: 期望错误码0x%x，实际%v", tc.name, tc.code, err)
+		}
+	}
+
+	// 应用读取了流窗口的一半后通过MAX_STREAM_DATA帧通告新的上限
+	c.controlFrames = nil
+	c.newRecvStream(1).window = flowcontrol.NewReceiveWindow(6)
+	payload, _ = (&frame.StreamFrame{StreamID: 1, Data: []byte("abc")}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理STREAM帧失败: %v", err)
+	}
+	peerStream := &Stream{conn: c, id: 1}
+	if n, err := peerStream.Read(buf); err != nil || n != 2 {
+		t.Fatalf("读取流数据错误: %d, %v", n, err)
+	}
+	if len(c.controlFrames) != 0 {
+		t.Fatalf("剩余窗口超过一半时不应通告新的上限: %+v", c.controlFrames)
+	}
+	if n, err := peerStream.Read(buf); err != nil || n != 1 {
+		t.Fatalf("读取流数据错误: %d, %v", n, err)
+	}
+	if len(c.controlFrames) != 1 {
+		t.Fatalf("应通告新的流上限: %+v", c.controlFrames)
+	}
+	if f, ok := c.controlFrames[0].(*frame.MaxStreamDataFrame); !ok || f.StreamID != 1 || f.MaximumStreamData != 9 {
+		t.Errorf("MAX_STREAM_DATA帧错误: %+v", c.controlFrames[0])
+	}
+
+	// 对端重置流后，阻塞中的Read返回带有错误码的StreamError
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := peerStream.Read(buf)
+		readErr <- err
+	}()
+	payload, _ = (&frame.ResetStreamFrame{StreamID: 1, ErrorCode: 0x10, FinalSize: 5}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理RESET_STREAM帧失败: %v", err)
+	}
+	select {
+	case err := <-readErr:
+		var serr *StreamError
+		if !errors.As(err, &serr) || serr.StreamID != 1 || serr.ErrorCode != 0x10 {
+			t.Errorf("重置后期望StreamError，实际%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("对端重置流后Read应返回")
+	}
+	payload, _ = (&frame.ResetStreamFrame{StreamID: 1, FinalSize: 6}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != protocol.FinalSizeError {
+		t.Errorf("最终大小变化时期望FINAL_SIZE_ERROR，实际%v", err)
+	}
+
+	// 对端要求停止发送后丢弃尚未发送的数据并发送RESET_STREAM帧，之后写入返回StreamError
+	c.controlFrames = nil
+	if _, err := bidi.Write([]byte("data")); err != nil {
+		t.Fatalf("写入流失败: %v", err)
+	}
+	payload, _ = (&frame.StopSendingFrame{StreamID: 0, ErrorCode: 7}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理STOP_SENDING帧失败: %v", err)
+	}
+	for _, f := range c.streamFrames {
+		if f.StreamID == 0 {
+			t.Errorf("停止发送后应丢弃流的数据: %+v", f)
+		}
+	}
+	if len(c.controlFrames) != 1 {
+		t.Fatalf("停止发送后应发送RESET_STREAM帧: %+v", c.controlFrames)
+	}
+	if f, ok := c.controlFrames[0].(*frame.ResetStreamFrame); !ok || f.StreamID != 0 || f.ErrorCode != 7 || f.FinalSize != 0 {
+		t.Errorf("RESET_STREAM帧错误: %+v", c.controlFrames[0])
+	}
+	var serr *StreamError
+	if _, err := bidi.Write([]byte("x")); !errors.As(err, &serr) || serr.ErrorCode != 7 {
+		t.Errorf("停止发送后写入期望StreamError，实际%v", err)
+	}
+
+	// MAX_STREAM_DATA提高流的发送上限，不能用于对端发起的单向流和本端尚未打开的流
+	payload, _ = (&frame.MaxStreamDataFrame{StreamID: 4, MaximumStreamData: 1 << 20}).Append(nil)
+	if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); err != nil {
+		t.Fatalf("处理MAX_STREAM_DATA帧失败: %v", err)
+	}
+	if c.sendStreams[4].window.Limit() != 1<<20 {
+		t.Errorf("MAX_STREAM_DATA应提高流的发送上限: %d", c.sendStreams[4].window.Limit())
+	}
+	for _, id := range []protocol.StreamID{3, 8} {
+		payload, _ = (&frame.MaxStreamDataFrame{StreamID: id, MaximumStreamData: 1}).Append(nil)
+		if err := c.handleFrames(payload, protocol.PacketTypeOneRTT, crypto.LevelOneRTT); !errors.As(err, &terr) || terr.Code != protocol.StreamStateError {
+			t.Errorf("流%d: 期望STREAM_STATE_ERROR，实际%v", id, err)
+		}
+	}
+
+	// 连接关闭时唤醒等待中的调用
+	go c.Close()
+	if _, err := c.AcceptStream(context.Background()); err == nil {
+		t.Error("连接关闭后接受流应返回错误")
+	}
 }
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"LQUIC/internal/frame"
+	"LQUIC/internal/protocol"
+)
+
+// maxCryptoBufferSize 单个加密级别允许缓存的乱序CRYPTO数据上限
+const maxCryptoBufferSize = 64 * 1024
+
+// cryptoStream 按偏移量重组某一加密级别接收到的CRYPTO帧数据，并缓存待发送的CRYPTO数据
+type cryptoStream struct {
+	// 接收到的CRYPTO数据的重组状态
+	reassembler
+
+	// sendBuf 待发送的CRYPTO数据
+	sendBuf []byte
+	// sentBuf 已发送的CRYPTO数据，用于从头重新发送
+	sentBuf []byte
+	// writeOffset 下一个待发送CRYPTO帧的偏移量
+	writeOffset protocol.ByteCount
+}
+
+// newCryptoStream 创建新的CRYPTO数据重组器
+func newCryptoStream() *cryptoStream {
+	return &cryptoStream{reassembler: newReassembler()}
+}
+
+// handleData 接收一段CRYPTO数据，返回可以按序交付的数据
+func (s *cryptoStream) handleData(offset protocol.ByteCount, data []byte) ([]byte, error) {
+	out, ok := s.push(offset, data, maxCryptoBufferSize)
+	if !ok {
+		return nil, protocol.NewTransportError(protocol.CryptoBufferExceeded, "乱序CRYPTO数据超出缓冲区上限")
+	}
+	return out, nil
+}
+
+// queueData 追加待发送的CRYPTO数据
+func (s *cryptoStream) queueData(data []byte) {
+	s.sendBuf = append(s.sendBuf, data...)
+}
+
+// hasData 检查是否有待发送的CRYPTO数据
+func (s *cryptoStream) hasData() bool {
+	return len(s.sendBuf) > 0
+}
+
+// popFrame 取出不超过maxLen字节的CRYPTO帧，空间不足时返回nil
+func (s *cryptoStream) popFrame(maxLen int) *frame.CryptoFrame {
+	if len(s.sendBuf) == 0 {
+		return nil
+	}
+	// 帧头：类型 + 偏移量 + 数据长度
+	hdrLen := 1 + protocol.VarIntLen(uint64(s.writeOffset)) + protocol.VarIntLen(uint64(len(s.sendBuf)))
+	if maxLen <= hdrLen {
+		return nil
+	}
+	n := maxLen - hdrLen
+	if n > len(s.sendBuf) {
+		n = len(s.sendBuf)
+	}
+	f := &frame.CryptoFrame{Offset: s.writeOffset, Data: s.sendBuf[:n]}
+	s.sentBuf = append(s.sentBuf, s.sendBuf[:n]...)
+	s.sendBuf = s.sendBuf[n:]
+	s.writeOffset += protocol.ByteCount(n)
+	return f
+}
+
+// discard 丢弃待发送和已发送的CRYPTO数据，加密级别的密钥丢弃后不再发送
+func (s *cryptoStream) discard() {
+	s.sendBuf = nil
+	s.sentBuf = nil
+}
+
+// rewind 从偏移量0开始重新发送全部CRYPTO数据，用于客户端收到Retry包后重发ClientHello
+func (s *cryptoStream) rewind() {
+	s.sendBuf = append(s.sentBuf, s.sendBuf...)
+	s.sentBuf = nil
+	s.writeOffset = 0
+}
@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"fmt"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/frame"
+	"LQUIC/internal/protocol"
+)
+
+// handleFrames 解析数据包负载并逐个处理其中的帧
+func (c *Connection) handleFrames(payload []byte, packetType protocol.PacketType, level crypto.CryptoLevel) error {
+	frames, err := frame.ParseAll(payload)
+	if err != nil {
+		return err
+	}
+	// 不含任何帧的数据包违反协议
+	if len(frames) == 0 {
+		return protocol.NewTransportError(protocol.ProtocolViolation, "数据包不包含任何帧")
+	}
+
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	ackEliciting := false
+	for _, f := range frames {
+		if !frame.IsAllowed(f, packetType) {
+			return protocol.NewTransportError(protocol.ProtocolViolation, "帧%T不允许出现在该类型的数据包中", f)
+		}
+		if err := c.handleFrame(f, level); err != nil {
+			return err
+		}
+		ackEliciting = ackEliciting || frame.IsAckEliciting(f)
+	}
+
+	// 收到需要确认的帧后，在下一个数据包中发送ACK
+	if ackEliciting {
+		c.ackPending[spaceForLevel(level)] = true
+	}
+	return nil
+}
+
+// handleFrame 分发处理单个帧
+func (c *Connection) handleFrame(f frame.Frame, level crypto.CryptoLevel) error {
+	switch f := f.(type) {
+	case *frame.PaddingFrame, *frame.PingFrame:
+		// 只需要确认，无需额外处理
+		return nil
+	case *frame.AckFrame:
+		return c.handleAckFrame(f, level)
+	case *frame.CryptoFrame:
+		return c.handleCryptoFrame(f, level)
+	case *frame.StreamFrame:
+		return c.handleStreamFrame(f, level)
+	case *frame.MaxStreamsFrame:
+		return c.handleMaxStreamsFrame(f)
+	case *frame.MaxStreamDataFrame:
+		return c.handleMaxStreamDataFrame(f)
+	case *frame.ResetStreamFrame:
+		return c.handleResetStreamFrame(f)
+	case *frame.StopSendingFrame:
+		return c.handleStopSendingFrame(f)
+	case *frame.MaxDataFrame:
+		// MAX_DATA只扩大本端的发送窗口，见RFC 9000第19.9节
+		c.sendWindow.UpdateLimit(f.MaximumData)
+		return nil
+	case *frame.NewConnectionIDFrame:
+		return c.handleNewConnectionIDFrame(f)
+	case *frame.NewTokenFrame:
+		c.newToken = append([]byte(nil), f.Token...)
+		return nil
+	case *frame.PathChallengeFrame:
+		c.queueControlFrame(&frame.PathResponseFrame{Data: f.Data})
+		return nil
+	case *frame.ConnectionCloseFrame:
+		c.closeErr = closeFrameError(f)
+		c.Close()
+		return nil
+	case *frame.HandshakeDoneFrame:
+		// 只有服务端可以发送HANDSHAKE_DONE帧，见RFC 9000第19.20节
+		if c.cryptoSetup.Perspective() == protocol.PerspectiveServer {
+			return protocol.NewTransportError(protocol.ProtocolViolation, "服务端收到HANDSHAKE_DONE帧")
+		}
+		// 握手已被服务端确认，不再需要Handshake密钥，见RFC 9001第4.9.2节
+		c.cryptoSetup.SetHandshakeComplete()
+		c.discardKeys(crypto.LevelHandshake)
+		c.setState(StateEstablished)
+		return nil
+	case *frame.DataBlockedFrame, *frame.StreamDataBlockedFrame,
+		*frame.StreamsBlockedFrame, *frame.RetireConnectionIDFrame, *frame.PathResponseFrame:
+		// 额度在应用读取数据时主动通告，连接迁移尚未实现，这些帧暂不处理
+		return nil
+	default:
+		return fmt.Errorf("未处理的帧类型: %T", f)
+	}
+}
+
+// closeFrameError 将对端的CONNECTION_CLOSE帧转换为关闭原因，
+// 应用层关闭帧的错误码由应用层协议定义，不能按传输层错误码解释，见RFC 9000第19.19节
+func closeFrameError(f *frame.ConnectionCloseFrame) error {
+	if f.IsApplicationError {
+		return &protocol.ApplicationCloseError{
+			Code:   protocol.ApplicationErrorCode(f.ErrorCode),
+			Reason: f.ReasonPhrase,
+		}
+	}
+	return &protocol.TransportError{
+		Code:      protocol.TransportErrorCode(f.ErrorCode),
+		FrameType: f.FrameType,
+		Reason:    f.ReasonPhrase,
+	}
+}
+
+// handleAckFrame 记录对端确认的最大包序号，用于后续包序号的截断编码。
+// 1-RTT数据包被确认后才允许再次发起密钥更新
+func (c *Connection) handleAckFrame(f *frame.AckFrame, level crypto.CryptoLevel) error {
+	c.packetNumberMux.Lock()
+	s := c.pnSpaces[spaceForLevel(level)]
+	err := s.onAckReceived(f)
+	largestAcked := s.largestAcked
+	c.packetNumberMux.Unlock()
+	if err != nil {
+		return err
+	}
+	if level == crypto.LevelOneRTT && largestAcked != protocol.InvalidPacketNumber {
+		c.cryptoSetup.SetLargestAcked(largestAcked)
+	}
+	return nil
+}
+
+// handleCryptoFrame 重组CRYPTO数据并交给加密模块，握手中收到对端的传输参数后进行校验，
+// 得知0-RTT的结果后处理在0-RTT包中发送过的数据
+func (c *Connection) handleCryptoFrame(f *frame.CryptoFrame, level crypto.CryptoLevel) error {
+	stream, ok := c.cryptoStreams[level]
+	if !ok {
+		return protocol.NewTransportError(protocol.ProtocolViolation, "无效的加密级别: %d", level)
+	}
+	data, err := stream.handleData(f.Offset, f.Data)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	if err := c.cryptoSetup.HandleCryptoFrame(data, level); err != nil {
+		return fmt.Errorf("处理加密数据失败: %w", err)
+	}
+	c.handleEarlyDataOutcome()
+	return c.handleTransportParameters()
+}
+
+// handleNewConnectionIDFrame 记录对端提供的新连接ID
+func (c *Connection) handleNewConnectionIDFrame(f *frame.NewConnectionIDFrame) error {
+	if existing, ok := c.peerConnIDs[f.SequenceNumber]; ok {
+		if string(existing) != string(f.ConnectionID) {
+			return protocol.NewTransportError(protocol.ProtocolViolation, "相同序列号对应了不同的连接ID")
+		}
+		return nil
+	}
+	c.peerConnIDs[f.SequenceNumber] = f.ConnectionID
+
+	// 退役序列号小于Retire Prior To的连接ID
+	for seq := range c.peerConnIDs {
+		if seq < f.RetirePriorTo {
+			delete(c.peerConnIDs, seq)
+			c.queueControlFrame(&frame.RetireConnectionIDFrame{SequenceNumber: seq})
+		}
+	}
+	return nil
+}
+
+// queueControlFrame 将控制帧加入待发送队列
+func (c *Connection) queueControlFrame(f frame.Frame) {
+	c.controlFrames = append(c.controlFrames, f)
+}
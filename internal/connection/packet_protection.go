@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/packet"
+	"LQUIC/internal/protocol"
+)
+
+// levelForType 返回数据包类型使用的加密级别
+func levelForType(t protocol.PacketType) (crypto.CryptoLevel, bool) {
+	switch t {
+	case protocol.PacketTypeInitial:
+		return crypto.LevelInitial, true
+	case protocol.PacketTypeHandshake:
+		return crypto.LevelHandshake, true
+	case protocol.PacketTypeZeroRTT:
+		return crypto.LevelZeroRTT, true
+	case protocol.PacketTypeOneRTT:
+		return crypto.LevelOneRTT, true
+	default:
+		return 0, false
+	}
+}
+
+// errNoKeys 数据包所属的加密级别还没有可用的密钥，数据包不能按明文处理或发送，见RFC 9001第5.7节
+var errNoKeys = errors.New("加密级别没有可用的密钥")
+
+// unprotectHeader 使用数据包所属加密级别的密钥去除头部保护
+func (c *Connection) unprotectHeader(p *packet.Packet) error {
+	level, ok := levelForType(p.Header.Type)
+	if !ok || !c.cryptoSetup.HasKeys(level) {
+		return errNoKeys
+	}
+	return p.Unprotect(func(sample []byte, firstByte *byte, pnBytes []byte) error {
+		// Initial包按数据包的版本选择密钥，兼容版本协商期间两个版本的Initial包都可能到达
+		if level == crypto.LevelInitial {
+			return c.cryptoSetup.DecryptInitialHeader(p.Header.Version, sample, firstByte, pnBytes)
+		}
+		return c.cryptoSetup.DecryptHeader(level, sample, firstByte, pnBytes)
+	})
+}
+
+// openPacket 使用数据包所属加密级别的密钥解密负载
+func (c *Connection) openPacket(p *packet.Packet, pn protocol.PacketNumber) error {
+	level, ok := levelForType(p.Header.Type)
+	if !ok || !c.cryptoSetup.HasKeys(level) {
+		return errNoKeys
+	}
+	// 附加数据为线上的完整包头，包括截断编码的包序号
+	hdrLen := len(p.Raw) - len(p.Payload)
+	if p.Raw == nil || hdrLen < 0 {
+		return fmt.Errorf("缺少数据包的原始字节，无法解密")
+	}
+	var payload []byte
+	var err error
+	if level == crypto.LevelInitial {
+		payload, err = c.cryptoSetup.OpenInitial(p.Header.Version, nil, p.Payload, pn, p.Raw[:hdrLen])
+	} else {
+		payload, err = c.cryptoSetup.Open(level, nil, p.Payload, pn, p.Raw[:hdrLen])
+	}
+	if err != nil {
+		var transportErr *protocol.TransportError
+		if errors.As(err, &transportErr) {
+			return err
+		}
+		return fmt.Errorf("丢弃包序号为%d的数据包: %w", pn, err)
+	}
+	p.Payload = payload
+	return nil
+}
+
+// sealPacket 序列化数据包并使用加密级别对应的密钥加密负载，尚未安装密钥的级别返回错误
+func (c *Connection) sealPacket(level crypto.CryptoLevel, hdr packet.Header, payload []byte) ([]byte, error) {
+	if !c.cryptoSetup.HasKeys(level) {
+		return nil, fmt.Errorf("不能发送加密级别%d的数据包: %w", level, errNoKeys)
+	}
+	// 头部保护的采样从包序号偏移之后4字节处开始，负载过短时用PADDING帧补齐，见RFC 9001第5.4.2节
+	pnLen := hdr.PacketNumberLen
+	if pnLen < 1 || pnLen > 4 {
+		pnLen = 4
+	}
+	if n := 4 - pnLen - len(payload); n > 0 {
+		payload = append(payload[:len(payload):len(payload)], make([]byte, n)...)
+	}
+
+	hdr.PayloadLen = protocol.ByteCount(len(payload) + c.cryptoSetup.Overhead(level))
+	if level == crypto.LevelOneRTT {
+		hdr.KeyPhase = c.cryptoSetup.KeyPhase()
+	}
+	raw, err := hdr.Pack()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.cryptoSetup.Seal(level, raw, payload, hdr.PacketNumber, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	pnOffset := len(raw) - pnLen
+	sample := data[pnOffset+4 : pnOffset+4+crypto.HeaderProtectionSampleLen]
+	if err := c.cryptoSetup.EncryptHeader(level, sample, &data[0], data[pnOffset:pnOffset+pnLen]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package connection
+
+import (
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/frame"
+	"LQUIC/internal/packet"
+	"LQUIC/internal/protocol"
+)
+
+// pnSpace 表示包序号空间，见RFC 9000第12.3节
+type pnSpace uint8
+
+const (
+	// spaceInitial Initial包的包序号空间
+	spaceInitial pnSpace = iota
+	// spaceHandshake Handshake包的包序号空间
+	spaceHandshake
+	// spaceAppData 0-RTT和1-RTT包共享的包序号空间
+	spaceAppData
+	// numSpaces 包序号空间的数量
+	numSpaces
+)
+
+// maxTrackedRanges 每个包序号空间最多记录的已接收区间数量
+const maxTrackedRanges = 32
+
+// spaceForType 返回数据包类型所属的包序号空间
+func spaceForType(t protocol.PacketType) (pnSpace, bool) {
+	switch t {
+	case protocol.PacketTypeInitial:
+		return spaceInitial, true
+	case protocol.PacketTypeHandshake:
+		return spaceHandshake, true
+	case protocol.PacketTypeZeroRTT, protocol.PacketTypeOneRTT:
+		return spaceAppData, true
+	default:
+		return 0, false
+	}
+}
+
+// spaceForLevel 返回加密级别对应的包序号空间
+func spaceForLevel(level crypto.CryptoLevel) pnSpace {
+	switch level {
+	case crypto.LevelInitial:
+		return spaceInitial
+	case crypto.LevelHandshake:
+		return spaceHandshake
+	default:
+		return spaceAppData
+	}
+}
+
+// packetNumberSpace 维护一个包序号空间的发送和接收状态
+type packetNumberSpace struct {
+	// next 下一个待发送的包序号
+	next protocol.PacketNumber
+	// largestAcked 对端确认的最大包序号
+	largestAcked protocol.PacketNumber
+	// largestReceived 已接收的最大包序号
+	largestReceived protocol.PacketNumber
+	// received 已接收的包序号区间，按从大到小排列
+	received []frame.AckRange
+	// ignoreBelow 小于该值的包序号已不再跟踪，一律视为重复
+	ignoreBelow protocol.PacketNumber
+}
+
+// newPacketNumberSpace 创建新的包序号空间
+func newPacketNumberSpace() *packetNumberSpace {
+	return &packetNumberSpace{
+		largestAcked:    protocol.InvalidPacketNumber,
+		largestReceived: protocol.InvalidPacketNumber,
+	}
+}
+
+// popPacketNumber 分配下一个包序号，并根据对端已确认的最大包序号计算截断长度
+func (s *packetNumberSpace) popPacketNumber() (protocol.PacketNumber, int) {
+	pn := s.next
+	s.next++
+	return pn, packet.PacketNumberLen(pn, s.largestAcked)
+}
+
+// decodePacketNumber 还原接收到的截断包序号
+func (s *packetNumberSpace) decodePacketNumber(truncated protocol.PacketNumber, pnLen int) protocol.PacketNumber {
+	return packet.DecodePacketNumber(s.largestReceived, truncated, pnLen)
+}
+
+// isDuplicate 检查包序号是否已经接收过
+func (s *packetNumberSpace) isDuplicate(pn protocol.PacketNumber) bool {
+	if pn < s.ignoreBelow {
+		return true
+	}
+	for _, r := range s.received {
+		if pn >= r.Smallest && pn <= r.Largest {
+			return true
+		}
+	}
+	return false
+}
+
+// onPacketReceived 记录已成功处理的包序号
+func (s *packetNumberSpace) onPacketReceived(pn protocol.PacketNumber) {
+	if s.largestReceived == protocol.InvalidPacketNumber || pn > s.largestReceived {
+		s.largestReceived = pn
+	}
+
+	for i := range s.received {
+		r := &s.received[i]
+		switch {
+		case pn >= r.Smallest && pn <= r.Largest:
+			return
+		case pn == r.Largest+1:
+			r.Largest = pn
+			// 与更大的区间相接时合并
+			if i > 0 && s.received[i-1].Smallest == pn+1 {
+				s.received[i-1].Smallest = r.Smallest
+				s.received = append(s.received[:i], s.received[i+1:]...)
+			}
+			return
+		case pn+1 == r.Smallest:
+			r.Smallest = pn
+			// 与更小的区间相接时合并
+			if i+1 < len(s.received) && s.received[i+1].Largest+1 == pn {
+				r.Smallest = s.received[i+1].Smallest
+				s.received = append(s.received[:i+1], s.received[i+2:]...)
+			}
+			return
+		case pn > r.Largest:
+			s.insertRange(i, pn)
+			return
+		}
+	}
+	s.insertRange(len(s.received), pn)
+}
+
+// insertRange 在位置i插入只包含pn的新区间
+func (s *packetNumberSpace) insertRange(i int, pn protocol.PacketNumber) {
+	s.received = append(s.received, frame.AckRange{})
+	copy(s.received[i+1:], s.received[i:])
+	s.received[i] = frame.AckRange{Smallest: pn, Largest: pn}
+
+	// 丢弃最旧的区间，避免记录无限增长
+	if len(s.received) > maxTrackedRanges {
+		dropped := s.received[len(s.received)-1]
+		s.received = s.received[:len(s.received)-1]
+		s.ignoreBelow = dropped.Largest + 1
+	}
+}
+
+// onAckReceived 记录对端确认的最大包序号
+func (s *packetNumberSpace) onAckReceived(f *frame.AckFrame) error {
+	largest := f.LargestAcked()
+	if largest >= s.next {
+		return protocol.NewTransportError(protocol.ProtocolViolation, "确认了尚未发送的包序号: %d", largest)
+	}
+	if s.largestAcked == protocol.InvalidPacketNumber || largest > s.largestAcked {
+		s.largestAcked = largest
+	}
+	return nil
+}
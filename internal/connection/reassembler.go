@@ -0,0 +1,67 @@
+package connection
+
+import "LQUIC/internal/protocol"
+
+// reassembler 按偏移量重组乱序到达的数据，CRYPTO帧和STREAM帧共用
+type reassembler struct {
+	// readOffset 已按序交付的数据偏移量
+	readOffset protocol.ByteCount
+	// pending 尚未连续的数据，key为偏移量
+	pending map[protocol.ByteCount][]byte
+	// pendingSize 缓存的乱序数据总量
+	pendingSize int
+}
+
+// newReassembler 创建新的数据重组器
+func newReassembler() reassembler {
+	return reassembler{pending: make(map[protocol.ByteCount][]byte)}
+}
+
+// push 接收一段数据，返回可以按序交付的数据。
+// 缓存的乱序数据将超过maxPending字节时不接收该段数据并返回false
+func (r *reassembler) push(offset protocol.ByteCount, data []byte, maxPending int) ([]byte, bool) {
+	end := offset + protocol.ByteCount(len(data))
+	// 完全重复的数据直接丢弃
+	if end <= r.readOffset {
+		return nil, true
+	}
+	// 截掉已经交付过的部分
+	if offset < r.readOffset {
+		data = data[r.readOffset-offset:]
+		offset = r.readOffset
+	}
+	if offset > r.readOffset {
+		if _, exists := r.pending[offset]; !exists {
+			if r.pendingSize+len(data) > maxPending {
+				return nil, false
+			}
+			r.pending[offset] = append([]byte(nil), data...)
+			r.pendingSize += len(data)
+		}
+		return nil, true
+	}
+
+	out := append([]byte(nil), data...)
+	r.readOffset = end
+	// 继续拼接已缓存的后续数据
+	for len(r.pending) > 0 {
+		progressed := false
+		for off, buf := range r.pending {
+			bufEnd := off + protocol.ByteCount(len(buf))
+			if off > r.readOffset {
+				continue
+			}
+			delete(r.pending, off)
+			r.pendingSize -= len(buf)
+			progressed = true
+			if bufEnd > r.readOffset {
+				out = append(out, buf[r.readOffset-off:]...)
+				r.readOffset = bufEnd
+			}
+		}
+		if !progressed {
+			break
+		}
+	}
+	return out, true
+}
@@ -0,0 +1,330 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/frame"
+	"LQUIC/internal/packet"
+	"LQUIC/internal/protocol"
+)
+
+// sendLevels 合并发送时各加密级别的顺序，短包头的1-RTT包必须位于数据报末尾
+var sendLevels = []crypto.CryptoLevel{crypto.LevelInitial, crypto.LevelZeroRTT, crypto.LevelHandshake, crypto.LevelOneRTT}
+
+// minPacketPayload 剩余空间小于该值时不再向数据报中追加新的数据包
+const minPacketPayload = 16
+
+// amplificationFactor 服务端验证客户端地址之前，发送的数据量最多为收到的数据量的倍数，见RFC 9000第8.1节
+const amplificationFactor = 3
+
+// outgoingPacket 表示一个待序列化的数据包
+type outgoingPacket struct {
+	level   crypto.CryptoLevel
+	header  packet.Header
+	payload []byte
+}
+
+// SendPendingPackets 将待发送的ACK、CRYPTO数据和控制帧打包发送，
+// 不同加密级别的数据包尽量合并到同一个UDP数据报中。发送密钥达到AEAD使用上限时关闭连接
+func (c *Connection) SendPendingPackets() error {
+	err := c.sendPendingPackets()
+	var transportErr *protocol.TransportError
+	if errors.As(err, &transportErr) {
+		c.closeWithError(transportErr)
+	}
+	return err
+}
+
+// sendPendingPackets 打包发送所有待发送的数据
+func (c *Connection) sendPendingPackets() error {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	c.queueHandshakeData()
+	for {
+		datagram, err := c.packDatagram()
+		if err != nil {
+			return err
+		}
+		if datagram == nil {
+			return nil
+		}
+		if err := c.writeDatagram(datagram); err != nil {
+			return fmt.Errorf("发送数据报失败: %v", err)
+		}
+	}
+}
+
+// packDatagram 组装一个UDP数据报，没有待发送数据时返回nil。受抗放大攻击限制时数据报不超过剩余的额度，
+// 额度不足以发送填充到最小长度的数据报时同样返回nil，待发送的数据保留到收到更多数据或地址得到验证之后
+func (c *Connection) packDatagram() ([]byte, error) {
+	var packets []*outgoingPacket
+	remaining := c.maxDatagramSize
+	if budget, limited := c.amplificationBudget(); limited {
+		if budget < protocol.MinInitialDatagramSize {
+			return nil, nil
+		}
+		remaining = min(remaining, int(budget))
+	}
+	containsInitial := false
+
+	for _, level := range sendLevels {
+		if !c.canSendAt(level) {
+			continue
+		}
+		hdr := c.newHeader(level)
+		// 按最长包序号和剩余空间估算包头长度
+		hdr.PacketNumberLen = 4
+		hdr.PayloadLen = protocol.ByteCount(remaining)
+		maxHdr, err := hdr.Pack()
+		if err != nil {
+			return nil, err
+		}
+		// 加密后负载会增加认证标签的长度
+		overhead := c.cryptoSetup.Overhead(level)
+		avail := remaining - len(maxHdr) - overhead
+		if avail < minPacketPayload {
+			break
+		}
+
+		payload, err := c.collectFrames(level, avail)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) == 0 {
+			continue
+		}
+
+		hdr.PacketNumber, hdr.PacketNumberLen = c.generatePacketNumber(spaceForLevel(level))
+		hdr.PayloadLen = protocol.ByteCount(len(payload))
+		packets = append(packets, &outgoingPacket{level: level, header: hdr, payload: payload})
+		remaining -= len(maxHdr) + len(payload) + overhead
+		if level == crypto.LevelInitial {
+			containsInitial = true
+		}
+	}
+	if len(packets) == 0 {
+		return nil, nil
+	}
+
+	// 携带Initial包的数据报需要填充到最小长度，填充放在最后一个数据包中
+	if containsInitial {
+		size := 0
+		for _, p := range packets {
+			hdr, err := p.header.Pack()
+			if err != nil {
+				return nil, err
+			}
+			size += len(hdr) + len(p.payload) + c.cryptoSetup.Overhead(p.level)
+		}
+		if size < protocol.MinInitialDatagramSize {
+			last := packets[len(packets)-1]
+			padding := &frame.PaddingFrame{Length: protocol.MinInitialDatagramSize - size}
+			last.payload, _ = padding.Append(last.payload)
+		}
+	}
+
+	raw := make([][]byte, 0, len(packets))
+	containsHandshake := false
+	for _, p := range packets {
+		data, err := c.sealPacket(p.level, p.header, p.payload)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, data)
+		containsHandshake = containsHandshake || p.level == crypto.LevelHandshake
+	}
+	// 客户端发送第一个Handshake包后不再需要Initial密钥，见RFC 9001第4.9.1节
+	if containsHandshake && c.cryptoSetup.IsClient() {
+		c.discardKeys(crypto.LevelInitial)
+	}
+	return packet.Coalesce(raw...)
+}
+
+// sendConnectionClose 在已安装密钥的最高加密级别发送携带CONNECTION_CLOSE帧的数据包，调用方需持有frameMux
+func (c *Connection) sendConnectionClose(err *protocol.TransportError) error {
+	level := crypto.LevelInitial
+	for _, l := range sendLevels {
+		// 服务器可能无法解密0-RTT包，CONNECTION_CLOSE不在0-RTT包中发送
+		if l != crypto.LevelZeroRTT && c.canSendAt(l) {
+			level = l
+		}
+	}
+	f := &frame.ConnectionCloseFrame{
+		ErrorCode:    uint64(err.Code),
+		FrameType:    err.FrameType,
+		ReasonPhrase: err.Reason,
+	}
+	payload, e := f.Append(nil)
+	if e != nil {
+		return e
+	}
+	hdr := c.newHeader(level)
+	hdr.PacketNumber, hdr.PacketNumberLen = c.generatePacketNumber(spaceForLevel(level))
+	data, e := c.sealPacket(level, hdr, payload)
+	if e != nil {
+		return e
+	}
+	// 超出抗放大攻击限制时不发送
+	if budget, limited := c.amplificationBudget(); limited && budget < protocol.ByteCount(len(data)) {
+		return nil
+	}
+	return c.writeDatagram(data)
+}
+
+// amplificationBudget 返回服务端验证客户端地址之前还可以发送的字节数：发送的数据不超过收到的数据的3倍，
+// 见RFC 9000第8.1节。客户端和已经验证了地址的服务端不受限制，返回false。调用方需持有frameMux
+func (c *Connection) amplificationBudget() (protocol.ByteCount, bool) {
+	if c.cryptoSetup.IsClient() || c.addressValidated {
+		return 0, false
+	}
+	limit := amplificationFactor * c.bytesReceived
+	if c.bytesSent >= limit {
+		return 0, true
+	}
+	return limit - c.bytesSent, true
+}
+
+// canSendAt 检查当前能否发送指定加密级别的数据包：只在已经安装发送密钥的级别发送，
+// 没有密钥时待发送的数据保留到安装密钥之后。只有客户端发送0-RTT包，握手完成之后才发送1-RTT包
+func (c *Connection) canSendAt(level crypto.CryptoLevel) bool {
+	if !c.cryptoSetup.HasKeys(level) {
+		return false
+	}
+	switch level {
+	case crypto.LevelZeroRTT:
+		return c.cryptoSetup.IsClient()
+	case crypto.LevelOneRTT:
+		return c.cryptoSetup.HandshakeComplete()
+	}
+	return true
+}
+
+// newHeader 构造指定加密级别的数据包头部，包序号由调用方分配
+func (c *Connection) newHeader(level crypto.CryptoLevel) packet.Header {
+	hdr := packet.Header{
+		Version:    c.Version(),
+		DestConnID: c.destConnID,
+		SrcConnID:  c.srcConnID,
+	}
+	switch level {
+	case crypto.LevelInitial:
+		hdr.Type = protocol.PacketTypeInitial
+		hdr.Token = c.token
+	case crypto.LevelZeroRTT:
+		hdr.Type = protocol.PacketTypeZeroRTT
+	case crypto.LevelHandshake:
+		hdr.Type = protocol.PacketTypeHandshake
+	default:
+		hdr.Type = protocol.PacketTypeOneRTT
+	}
+	return hdr
+}
+
+// collectFrames 收集指定加密级别待发送的帧，返回序列化后不超过maxLen字节的负载
+func (c *Connection) collectFrames(level crypto.CryptoLevel, maxLen int) ([]byte, error) {
+	var payload []byte
+	space := spaceForLevel(level)
+
+	// ACK帧优先发送，0-RTT包不能携带ACK帧
+	if level != crypto.LevelZeroRTT && c.ackPending[space] {
+		if ack := c.buildAckFrame(space); ack != nil {
+			b, err := ack.Append(payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) <= maxLen {
+				payload = b
+				c.ackPending[space] = false
+			}
+		}
+	}
+
+	// 控制帧只在1-RTT包中发送
+	if level == crypto.LevelOneRTT {
+		for len(c.controlFrames) > 0 {
+			b, err := c.controlFrames[0].Append(payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) > maxLen {
+				break
+			}
+			payload = b
+			c.controlFrames = c.controlFrames[1:]
+		}
+	}
+
+	// CRYPTO数据
+	if stream, ok := c.cryptoStreams[level]; ok {
+		if f := stream.popFrame(maxLen - len(payload)); f != nil {
+			var err error
+			if payload, err = f.Append(payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// STREAM帧在0-RTT和1-RTT包中发送
+	if level == crypto.LevelZeroRTT || level == crypto.LevelOneRTT {
+		for {
+			f := c.popStreamFrame(level, maxLen-len(payload))
+			if f == nil {
+				break
+			}
+			var err error
+			if payload, err = f.Append(payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return payload, nil
+}
+
+// buildAckFrame 根据已接收的包序号区间构造ACK帧
+func (c *Connection) buildAckFrame(space pnSpace) *frame.AckFrame {
+	c.packetNumberMux.Lock()
+	defer c.packetNumberMux.Unlock()
+
+	received := c.pnSpaces[space].received
+	if len(received) == 0 {
+		return nil
+	}
+	return &frame.AckFrame{Ranges: append([]frame.AckRange(nil), received...)}
+}
+
+// queueHandshakeData 取出TLS握手产生的待发送数据，放入各加密级别的CRYPTO流
+func (c *Connection) queueHandshakeData() {
+	for _, level := range sendLevels {
+		if data := c.cryptoSetup.GetCryptoData(level); len(data) > 0 {
+			c.queueCryptoData(level, data)
+		}
+	}
+}
+
+// queueCryptoData 缓存待发送的握手数据
+func (c *Connection) queueCryptoData(level crypto.CryptoLevel, data []byte) {
+	if stream, ok := c.cryptoStreams[level]; ok {
+		stream.queueData(data)
+	}
+}
+
+// writeDatagram 将数据报写入UDP套接字，并记录发送的数据量。调用方需持有frameMux
+func (c *Connection) writeDatagram(data []byte) error {
+	if c.conn == nil {
+		return fmt.Errorf("连接未绑定UDP套接字")
+	}
+	var err error
+	// 客户端使用已连接的套接字，服务端共享监听套接字
+	if c.conn.RemoteAddr() != nil {
+		_, err = c.conn.Write(data)
+	} else {
+		_, err = c.conn.WriteToUDP(data, c.remoteAddr)
+	}
+	if err == nil {
+		c.bytesSent += protocol.ByteCount(len(data))
+	}
+	return err
+}
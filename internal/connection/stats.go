@@ -0,0 +1,25 @@
+package connection
+
+import (
+	"LQUIC/internal/crypto"
+)
+
+// Stats 连接的统计信息
+type Stats struct {
+	// AEAD 各加密级别的包保护统计，包括加密和认证失败的数据包数量
+	AEAD map[crypto.CryptoLevel]crypto.AEADStats
+	// KeyUpdates 完成的1-RTT密钥更新次数，包括对端发起的更新
+	KeyUpdates uint64
+}
+
+// Stats 返回连接的统计信息
+func (c *Connection) Stats() Stats {
+	stats := Stats{
+		AEAD:       make(map[crypto.CryptoLevel]crypto.AEADStats, len(sendLevels)),
+		KeyUpdates: c.cryptoSetup.KeyGeneration(),
+	}
+	for _, level := range sendLevels {
+		stats.AEAD[level] = c.cryptoSetup.AEADStats(level)
+	}
+	return stats
+}
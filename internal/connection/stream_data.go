@@ -0,0 +1,425 @@
+package connection
+
+import (
+	"fmt"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/flowcontrol"
+	"LQUIC/internal/frame"
+	"LQUIC/internal/protocol"
+)
+
+// sendStream 记录某个流发送方向的状态
+type sendStream struct {
+	// offset 下一段写入数据的偏移量
+	offset protocol.ByteCount
+	// finished 是否已经写入了FIN
+	finished bool
+	// sent 已经发送的数据的最大偏移量，重置流时作为最终大小
+	sent protocol.ByteCount
+	// reset 对端通过STOP_SENDING要求停止发送后，本端已经发送RESET_STREAM帧重置了该流
+	reset     bool
+	resetCode uint64
+	// window 对端允许本端在该流上发送的数据量，由对端的传输参数和MAX_STREAM_DATA帧给出
+	window *flowcontrol.SendWindow
+}
+
+// recvStream 按偏移量重组某个流接收到的STREAM帧数据
+type recvStream struct {
+	reassembler
+	// data 已按序重组、尚未被应用读取的数据
+	data []byte
+	// highest 收到的数据的最大偏移量
+	highest protocol.ByteCount
+	// finalSize 流的最终大小，finReceived为true时有效
+	finalSize   protocol.ByteCount
+	finReceived bool
+	// retired 对端发起的流是否已经结束并允许对端打开新的流
+	retired bool
+	// reset 对端是否通过RESET_STREAM帧重置了该流，resetCode为对端给出的错误码
+	reset     bool
+	resetCode uint64
+	// window 本端允许对端在该流上发送的数据量
+	window *flowcontrol.ReceiveWindow
+}
+
+// handleFrame 接收一个STREAM帧，校验流的最终大小（见RFC 9000第4.5节）和流级别的流量控制上限，
+// 返回流收到的最大偏移量增加的数据量，供连接级别的流量控制累计
+func (s *recvStream) handleFrame(f *frame.StreamFrame) (protocol.ByteCount, error) {
+	end := f.Offset + protocol.ByteCount(len(f.Data))
+	if s.finReceived && end > s.finalSize {
+		return 0, protocol.NewTransportError(protocol.FinalSizeError, "流%d的数据超出最终大小%d", f.StreamID, s.finalSize)
+	}
+	if f.Fin && ((s.finReceived && end != s.finalSize) || end < s.highest) {
+		return 0, protocol.NewTransportError(protocol.FinalSizeError, "流%d的最终大小发生变化", f.StreamID)
+	}
+	increment, ok := s.window.UpdateHighest(end)
+	if !ok {
+		return 0, protocol.NewTransportError(protocol.FlowControlError, "流%d的数据超出流量控制上限%d", f.StreamID, s.window.Limit())
+	}
+	if f.Fin {
+		s.finalSize = end
+		s.finReceived = true
+	}
+	if end > s.highest {
+		s.highest = end
+	}
+	data, ok := s.push(f.Offset, f.Data, maxFlowControlWindow)
+	if !ok {
+		return 0, protocol.NewTransportError(protocol.FlowControlError, "流%d缓存的乱序数据过多", f.StreamID)
+	}
+	s.data = append(s.data, data...)
+	return increment, nil
+}
+
+// newSendStream 创建本端在流上的发送方向，发送上限取对端传输参数中对应类型的初始值，
+// 尚未收到对端的传输参数时为0，收到后由applyPeerFlowControlLimits更新。调用方需持有frameMux
+func (c *Connection) newSendStream(id protocol.StreamID) *sendStream {
+	s := &sendStream{window: flowcontrol.NewSendWindow(c.peerStreamDataLimit(id))}
+	c.sendStreams[id] = s
+	return s
+}
+
+// newRecvStream 创建本端在流上的接收方向，接收上限取本端传输参数中对应类型的初始值。调用方需持有frameMux
+func (c *Connection) newRecvStream(id protocol.StreamID) *recvStream {
+	limit := c.localParams.InitialMaxStreamDataUni
+	if id.Type() == protocol.StreamTypeBidi {
+		limit = c.localParams.InitialMaxStreamDataBidiRemote
+		if id.InitiatedBy() == c.perspective {
+			limit = c.localParams.InitialMaxStreamDataBidiLocal
+		}
+	}
+	s := &recvStream{reassembler: newReassembler(), window: flowcontrol.NewReceiveWindow(limit)}
+	c.recvStreams[id] = s
+	return s
+}
+
+// peerStreamDataLimit 返回对端传输参数给出的流的初始发送上限：本端发起的双向流对于对端是remote，
+// 对端发起的双向流是local，见RFC 9000第18.2节。调用方需持有frameMux
+func (c *Connection) peerStreamDataLimit(id protocol.StreamID) protocol.ByteCount {
+	params := c.peerParams
+	switch {
+	case params == nil:
+		return 0
+	case id.Type() == protocol.StreamTypeUni:
+		return params.InitialMaxStreamDataUni
+	case id.InitiatedBy() == c.perspective:
+		return params.InitialMaxStreamDataBidiRemote
+	default:
+		return params.InitialMaxStreamDataBidiLocal
+	}
+}
+
+// applyPeerFlowControlLimits 收到对端的传输参数后按其中的初始值设置连接和已经打开的流的发送上限。
+// 调用方需持有frameMux
+func (c *Connection) applyPeerFlowControlLimits() {
+	c.sendWindow.UpdateLimit(c.peerParams.InitialMaxData)
+	for id, s := range c.sendStreams {
+		s.window.UpdateLimit(c.peerStreamDataLimit(id))
+	}
+}
+
+// writeStream 将数据写入已经打开的流，fin为true时同时结束该流的发送方向。本端发起的流必须通过OpenStream打开，
+// 对端发起的流只有双向流可以写入，流ID的规则和流量控制都由Stream统一遵守。
+// 客户端在握手完成之前写入的数据在0-RTT包中发送，0-RTT被服务器拒绝时自动在1-RTT包中重新发送；
+// 没有可用的0-RTT密钥时数据在握手完成后发送
+func (c *Connection) writeStream(id protocol.StreamID, data []byte, fin bool) error {
+	if c.GetState() == StateClosed {
+		return fmt.Errorf("连接已关闭")
+	}
+
+	c.frameMux.Lock()
+	s, ok := c.sendStreams[id]
+	if !ok {
+		switch {
+		case id.InitiatedBy() == c.perspective:
+			c.frameMux.Unlock()
+			return fmt.Errorf("流%d尚未打开", id)
+		case id.Type() == protocol.StreamTypeUni:
+			c.frameMux.Unlock()
+			return fmt.Errorf("不能写入对端发起的单向流%d", id)
+		}
+		// 对端发起的双向流在本端首次写入时创建发送方向
+		s = c.newSendStream(id)
+	}
+	if s.reset {
+		c.frameMux.Unlock()
+		return &StreamError{StreamID: id, ErrorCode: s.resetCode}
+	}
+	if s.finished {
+		c.frameMux.Unlock()
+		return fmt.Errorf("流%d的发送方向已经结束", id)
+	}
+	c.streamFrames = append(c.streamFrames, &frame.StreamFrame{
+		StreamID:       id,
+		Offset:         s.offset,
+		Data:           append([]byte(nil), data...),
+		Fin:            fin,
+		DataLenPresent: true,
+	})
+	s.offset += protocol.ByteCount(len(data))
+	s.finished = fin
+	c.retireStream(id)
+	c.frameMux.Unlock()
+
+	return c.SendPendingPackets()
+}
+
+// EarlyDataState 返回0-RTT数据的状态：客户端可以据此得知0-RTT数据是否被服务器接受，
+// 服务端可以得知是否接受了客户端的0-RTT数据
+func (c *Connection) EarlyDataState() crypto.EarlyDataState {
+	return c.cryptoSetup.EarlyDataState()
+}
+
+// handleStreamFrame 处理STREAM帧，将数据交给对应的流重组
+func (c *Connection) handleStreamFrame(f *frame.StreamFrame, level crypto.CryptoLevel) error {
+	// 0-RTT数据只能由客户端发起的流携带，见RFC 9000第7.4.1节
+	if level == crypto.LevelZeroRTT && f.StreamID.InitiatedBy() != protocol.PerspectiveClient {
+		return protocol.NewTransportError(protocol.StreamStateError, "0-RTT数据包中出现服务器发起的流%d", f.StreamID)
+	}
+	if err := c.openIncomingStream(f.StreamID); err != nil {
+		return err
+	}
+	s, ok := c.recvStreams[f.StreamID]
+	if !ok {
+		s = c.newRecvStream(f.StreamID)
+	}
+	if s.reset {
+		// 重置之后的数据不再交给应用，最终大小和流量控制已经在收到RESET_STREAM时处理
+		if end := f.Offset + protocol.ByteCount(len(f.Data)); end > s.finalSize || (f.Fin && end != s.finalSize) {
+			return protocol.NewTransportError(protocol.FinalSizeError, "流%d的数据超出最终大小%d", f.StreamID, s.finalSize)
+		}
+		return nil
+	}
+	increment, err := s.handleFrame(f)
+	if err != nil {
+		return err
+	}
+	// 连接级别的流量控制按各个流收到的最大偏移量的增量累计，不能超出本端通告的上限，见RFC 9000第4.1节。
+	// 0-RTT数据同样受本端传输参数给出的上限约束
+	if !c.recvWindow.AddBytesReceived(increment) {
+		return protocol.NewTransportError(protocol.FlowControlError, "流数据超出连接的流量控制上限%d", c.recvWindow.Limit())
+	}
+	c.notifyStreams()
+	return nil
+}
+
+// handleEarlyDataOutcome 客户端得知0-RTT的结果后处理在0-RTT包中发送过的STREAM帧：
+// 被拒绝时按原来的偏移量在1-RTT包中重新发送，被接受时不再保留。调用方需持有frameMux
+func (c *Connection) handleEarlyDataOutcome() {
+	if len(c.earlyFrames) == 0 {
+		return
+	}
+	switch c.cryptoSetup.EarlyDataState() {
+	case crypto.EarlyDataRejected:
+		c.streamFrames = append(c.earlyFrames, c.streamFrames...)
+		c.earlyFrames = nil
+	case crypto.EarlyDataAccepted:
+		// 被接受的0-RTT数据同样占用连接的发送窗口
+		c.sendWindow.AddBytesSent(c.earlyDataSent)
+		c.earlyFrames = nil
+	}
+}
+
+// popStreamFrame 按顺序取出第一个可以发送的STREAM帧，不超过maxLen字节，数据过长或超出流量控制上限时拆分，
+// 剩余部分留待下一个数据包；达到流级别上限的流不影响其他流的发送。
+// 在0-RTT包中发送的帧在得知0-RTT的结果之前保留。调用方需持有frameMux
+func (c *Connection) popStreamFrame(level crypto.CryptoLevel, maxLen int) *frame.StreamFrame {
+	for i, f := range c.streamFrames {
+		// 帧头：类型 + 流ID + 偏移量 + 数据长度
+		hdrLen := 1 + protocol.VarIntLen(uint64(f.StreamID)) + protocol.VarIntLen(uint64(len(f.Data)))
+		if f.Offset != 0 {
+			hdrLen += protocol.VarIntLen(uint64(f.Offset))
+		}
+		if maxLen < hdrLen {
+			return nil
+		}
+		var allowed int
+		var ok bool
+		if level == crypto.LevelZeroRTT {
+			allowed, ok = c.earlyDataAllowance(f)
+		} else {
+			allowed, ok = c.sendAllowance(f)
+		}
+		if !ok {
+			continue
+		}
+		n := min(maxLen-hdrLen, allowed)
+		if n < len(f.Data) {
+			if n == 0 {
+				continue
+			}
+			rest := &frame.StreamFrame{
+				StreamID:       f.StreamID,
+				Offset:         f.Offset + protocol.ByteCount(n),
+				Data:           f.Data[n:],
+				Fin:            f.Fin,
+				DataLenPresent: true,
+			}
+			f = &frame.StreamFrame{StreamID: f.StreamID, Offset: f.Offset, Data: f.Data[:n], DataLenPresent: true}
+			c.streamFrames[i] = rest
+		} else {
+			c.streamFrames = append(c.streamFrames[:i:i], c.streamFrames[i+1:]...)
+		}
+		if level == crypto.LevelZeroRTT {
+			c.earlyFrames = append(c.earlyFrames, f)
+			c.earlyDataSent += protocol.ByteCount(len(f.Data))
+		} else {
+			c.sendWindow.AddBytesSent(protocol.ByteCount(len(f.Data)))
+		}
+		if s, ok := c.sendStreams[f.StreamID]; ok {
+			s.sent = max(s.sent, f.Offset+protocol.ByteCount(len(f.Data)))
+		}
+		return f
+	}
+	return nil
+}
+
+// sendAllowance 返回STREAM帧在1-RTT包中最多可以携带的数据量，不能超出对端允许的连接级别和流级别的发送上限，
+// 见RFC 9000第4.1节。流级别的上限按偏移量计算，重新发送被拒绝的0-RTT数据不会重复占用；
+// 只携带FIN的帧不占用窗口。帧不能发送时返回false。调用方需持有frameMux
+func (c *Connection) sendAllowance(f *frame.StreamFrame) (int, bool) {
+	s, ok := c.sendStreams[f.StreamID]
+	if !ok {
+		return 0, false
+	}
+	limit := s.window.Limit()
+	if f.Offset > limit {
+		return 0, false
+	}
+	allowed := min(limit-f.Offset, c.sendWindow.Available())
+	if allowed == 0 && len(f.Data) > 0 {
+		return 0, false
+	}
+	return int(min(allowed, protocol.ByteCount(len(f.Data)))), true
+}
+
+// earlyDataAllowance 客户端返回STREAM帧在0-RTT包中最多可以携带的数据量，不能超出票据记录的服务端传输参数
+// 给出的流数量和流量控制限制，见RFC 9000第7.4.1节。超出限制的数据等到1-RTT再发送，
+// 帧不能在0-RTT包中发送时返回false。调用方需持有frameMux
+func (c *Connection) earlyDataAllowance(f *frame.StreamFrame) (int, bool) {
+	if c.earlyParams == nil {
+		return 0, false
+	}
+	var maxStreams uint64
+	var limit protocol.ByteCount
+	switch f.StreamID & 0x3 {
+	case 0x0: // 客户端发起的双向流
+		maxStreams, limit = c.earlyParams.InitialMaxStreamsBidi, c.earlyParams.InitialMaxStreamDataBidiRemote
+	case 0x2: // 客户端发起的单向流
+		maxStreams, limit = c.earlyParams.InitialMaxStreamsUni, c.earlyParams.InitialMaxStreamDataUni
+	default:
+		return 0, false
+	}
+	if uint64(f.StreamID>>2) >= maxStreams || f.Offset > limit || c.earlyDataSent > c.earlyParams.InitialMaxData {
+		return 0, false
+	}
+	allowed := min(limit-f.Offset, c.earlyParams.InitialMaxData-c.earlyDataSent)
+	if allowed == 0 && len(f.Data) > 0 {
+		return 0, false
+	}
+	return int(min(allowed, protocol.ByteCount(len(f.Data)))), true
+}
+
+// handleMaxStreamDataFrame 对端提高流级别的发送上限。对端发起的单向流没有发送方向，
+// 本端尚未打开的流不能收到该帧，否则返回STREAM_STATE_ERROR，见RFC 9000第19.10节。调用方需持有frameMux
+func (c *Connection) handleMaxStreamDataFrame(f *frame.MaxStreamDataFrame) error {
+	s, err := c.sendStreamForFrame(f.StreamID)
+	if err != nil || s == nil {
+		return err
+	}
+	s.window.UpdateLimit(f.MaximumStreamData)
+	return nil
+}
+
+// handleStopSendingFrame 对端不再读取流的数据：丢弃尚未发送的数据，以对端给出的错误码发送RESET_STREAM帧，
+// 最终大小为已经发送的数据量，之后写入该流返回*StreamError，见RFC 9000第3.5节。调用方需持有frameMux
+func (c *Connection) handleStopSendingFrame(f *frame.StopSendingFrame) error {
+	s, err := c.sendStreamForFrame(f.StreamID)
+	if err != nil || s == nil || s.reset {
+		return err
+	}
+	s.reset = true
+	s.resetCode = f.ErrorCode
+	c.streamFrames = dropStreamFrames(c.streamFrames, f.StreamID)
+	c.earlyFrames = dropStreamFrames(c.earlyFrames, f.StreamID)
+	c.queueControlFrame(&frame.ResetStreamFrame{StreamID: f.StreamID, ErrorCode: f.ErrorCode, FinalSize: s.sent})
+	c.retireStream(f.StreamID)
+	c.notifyStreams()
+	return nil
+}
+
+// sendStreamForFrame 返回MAX_STREAM_DATA或STOP_SENDING帧所属的发送方向：对端发起的单向流和本端尚未打开的流
+// 返回STREAM_STATE_ERROR；对端发起的双向流首次出现时打开该流；本端已经不再记录的流返回nil。调用方需持有frameMux
+func (c *Connection) sendStreamForFrame(id protocol.StreamID) (*sendStream, error) {
+	if id.Type() == protocol.StreamTypeUni && id.InitiatedBy() != c.perspective {
+		return nil, protocol.NewTransportError(protocol.StreamStateError, "对端发起的单向流%d没有本端的发送方向", id)
+	}
+	if s, ok := c.sendStreams[id]; ok {
+		return s, nil
+	}
+	if id.InitiatedBy() == c.perspective {
+		if id.Num() >= c.streams.next[id.Type()] {
+			return nil, protocol.NewTransportError(protocol.StreamStateError, "本端尚未打开流%d", id)
+		}
+		return nil, nil
+	}
+	if err := c.openIncomingStream(id); err != nil {
+		return nil, err
+	}
+	return c.newSendStream(id), nil
+}
+
+// handleResetStreamFrame 对端中止了流的发送方向：校验最终大小并计入流量控制，丢弃尚未读取的数据并归还
+// 连接级别的额度，之后读取该流返回*StreamError，见RFC 9000第3.2节和第4.5节。调用方需持有frameMux
+func (c *Connection) handleResetStreamFrame(f *frame.ResetStreamFrame) error {
+	if f.StreamID.Type() == protocol.StreamTypeUni && f.StreamID.InitiatedBy() == c.perspective {
+		return protocol.NewTransportError(protocol.StreamStateError, "收到本端发起的单向流%d的RESET_STREAM帧", f.StreamID)
+	}
+	if err := c.openIncomingStream(f.StreamID); err != nil {
+		return err
+	}
+	s, ok := c.recvStreams[f.StreamID]
+	if !ok {
+		s = c.newRecvStream(f.StreamID)
+	}
+	if (s.finReceived || s.reset) && f.FinalSize != s.finalSize || f.FinalSize < s.highest {
+		return protocol.NewTransportError(protocol.FinalSizeError, "流%d的最终大小发生变化", f.StreamID)
+	}
+	if s.reset {
+		return nil
+	}
+	increment, ok := s.window.UpdateHighest(f.FinalSize)
+	if !ok {
+		return protocol.NewTransportError(protocol.FlowControlError, "流%d的最终大小超出流量控制上限%d", f.StreamID, s.window.Limit())
+	}
+	if !c.recvWindow.AddBytesReceived(increment) {
+		return protocol.NewTransportError(protocol.FlowControlError, "流数据超出连接的流量控制上限%d", c.recvWindow.Limit())
+	}
+	// 应用不会再读取的数据视为已经读取，归还连接级别的额度
+	consumed := s.readOffset - protocol.ByteCount(len(s.data))
+	c.recvWindow.AddBytesRead(f.FinalSize - consumed)
+	if limit, ok := c.recvWindow.WindowUpdate(); ok {
+		c.queueControlFrame(&frame.MaxDataFrame{MaximumData: limit})
+	}
+	s.reset = true
+	s.resetCode = f.ErrorCode
+	s.finalSize = f.FinalSize
+	s.highest = f.FinalSize
+	s.data = nil
+	s.reassembler = newReassembler()
+	c.retireStream(f.StreamID)
+	c.notifyStreams()
+	return nil
+}
+
+// dropStreamFrames 返回去掉指定流的STREAM帧之后的队列
+func dropStreamFrames(frames []*frame.StreamFrame, id protocol.StreamID) []*frame.StreamFrame {
+	kept := frames[:0]
+	for _, f := range frames {
+		if f.StreamID != id {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,331 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"LQUIC/internal/frame"
+	"LQUIC/internal/protocol"
+)
+
+// ErrStreamLimitReached 对端允许本端发起的流已经全部打开，需要等待对端通过MAX_STREAMS帧提高上限
+var ErrStreamLimitReached = errors.New("已达到对端允许打开的流数量上限")
+
+// StreamError 对端通过RESET_STREAM帧中止了流的发送方向，或通过STOP_SENDING帧要求本端停止发送，
+// ErrorCode为应用层协议定义的错误码
+type StreamError struct {
+	StreamID  protocol.StreamID
+	ErrorCode uint64
+}
+
+// Error 实现error接口
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("流%d被对端中止，错误码0x%x", e.StreamID, e.ErrorCode)
+}
+
+// numStreamTypes 流的类型数量，streamsState中的数组按protocol.StreamType索引
+const numStreamTypes = 2
+
+// streamsState 记录连接上流的打开和接受情况，由frameMux保护
+type streamsState struct {
+	// next 本端下一个发起的流的序号
+	next [numStreamTypes]uint64
+	// peerMax 对端通过MAX_STREAMS帧允许本端发起的流数量
+	peerMax [numStreamTypes]uint64
+	// opened 已经打开的对端发起的流数量
+	opened [numStreamTypes]uint64
+	// granted 对端发起的流结束后额外允许对端打开的流数量
+	granted [numStreamTypes]uint64
+	// accept 等待应用接受的对端发起的流
+	accept [numStreamTypes][]protocol.StreamID
+	// notify 流的状态发生变化时关闭并替换，唤醒等待读取、打开和接受流的调用
+	notify chan struct{}
+}
+
+// Stream 连接上的一个流，实现io.ReadWriteCloser。
+// 单向流只有发起方可以写入，接收方只能读取；Close只结束发送方向
+type Stream struct {
+	conn *Connection
+	id   protocol.StreamID
+}
+
+// StreamID 返回流ID
+func (s *Stream) StreamID() protocol.StreamID {
+	return s.id
+}
+
+// Read 读取流中按序到达的数据，没有数据时阻塞；对端结束流且数据全部读取后返回io.EOF，
+// 对端重置流后返回*StreamError，连接关闭时返回关闭的原因
+func (s *Stream) Read(p []byte) (int, error) {
+	return s.conn.readStream(s.id, p)
+}
+
+// Write 将数据写入流并尽快发送，握手完成之前写入的数据可能作为0-RTT数据发送；
+// 对端通过STOP_SENDING要求停止发送后返回*StreamError
+func (s *Stream) Write(p []byte) (int, error) {
+	if err := s.conn.writeStream(s.id, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 结束流的发送方向，对端读完已发送的数据后收到io.EOF。对端发起的单向流没有发送方向，关闭时不做任何事
+func (s *Stream) Close() error {
+	s.conn.frameMux.Lock()
+	recvOnly := s.id.Type() == protocol.StreamTypeUni && s.id.InitiatedBy() != s.conn.perspective
+	s.conn.frameMux.Unlock()
+	if recvOnly {
+		return nil
+	}
+	return s.conn.writeStream(s.id, nil, true)
+}
+
+// OpenStream 打开一个双向流，对端允许的流已经全部打开时返回ErrStreamLimitReached。
+// 客户端在握手完成之前按票据记录的服务端传输参数打开流，没有可以使用0-RTT的票据时需要等待握手
+func (c *Connection) OpenStream() (*Stream, error) {
+	return c.openStream(protocol.StreamTypeBidi)
+}
+
+// OpenStreamSync 打开一个双向流，对端允许的流已经全部打开时阻塞，直到对端提高上限、ctx结束或连接关闭
+func (c *Connection) OpenStreamSync(ctx context.Context) (*Stream, error) {
+	for {
+		s, err := c.openStream(protocol.StreamTypeBidi)
+		if !errors.Is(err, ErrStreamLimitReached) {
+			return s, err
+		}
+		if err := c.waitStreams(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// OpenUniStream 打开一个单向流，本端只能写入，对端允许的流已经全部打开时返回ErrStreamLimitReached
+func (c *Connection) OpenUniStream() (*Stream, error) {
+	return c.openStream(protocol.StreamTypeUni)
+}
+
+// AcceptStream 等待并返回对端打开的下一个双向流，直到ctx结束或连接关闭
+func (c *Connection) AcceptStream(ctx context.Context) (*Stream, error) {
+	return c.acceptStream(ctx, protocol.StreamTypeBidi)
+}
+
+// AcceptUniStream 等待并返回对端打开的下一个单向流，本端只能读取
+func (c *Connection) AcceptUniStream(ctx context.Context) (*Stream, error) {
+	return c.acceptStream(ctx, protocol.StreamTypeUni)
+}
+
+// openStream 按RFC 9000第2.1节的编号打开本端发起的下一个指定类型的流
+func (c *Connection) openStream(typ protocol.StreamType) (*Stream, error) {
+	if c.GetState() == StateClosed {
+		return nil, fmt.Errorf("连接已关闭")
+	}
+
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	if c.perspective == 0 {
+		return nil, fmt.Errorf("握手尚未开始")
+	}
+	if c.streams.next[typ] >= c.peerStreamLimit(typ) {
+		return nil, ErrStreamLimitReached
+	}
+	id := protocol.NewStreamID(c.streams.next[typ], typ, c.perspective)
+	c.streams.next[typ]++
+	c.newSendStream(id)
+	return &Stream{conn: c, id: id}, nil
+}
+
+// acceptStream 取出等待接受的对端发起的流，没有时阻塞
+func (c *Connection) acceptStream(ctx context.Context, typ protocol.StreamType) (*Stream, error) {
+	for {
+		c.frameMux.Lock()
+		if queue := c.streams.accept[typ]; len(queue) > 0 {
+			c.streams.accept[typ] = queue[1:]
+			c.frameMux.Unlock()
+			return &Stream{conn: c, id: queue[0]}, nil
+		}
+		c.frameMux.Unlock()
+		if err := c.waitStreams(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readStream 将流中按序到达的数据复制到p，没有数据时阻塞。读取后需要通告新的流量控制上限时立即发送
+func (c *Connection) readStream(id protocol.StreamID, p []byte) (int, error) {
+	for {
+		c.frameMux.Lock()
+		if id.Type() == protocol.StreamTypeUni && id.InitiatedBy() == c.perspective {
+			c.frameMux.Unlock()
+			return 0, fmt.Errorf("不能读取本端发起的单向流%d", id)
+		}
+		if s, ok := c.recvStreams[id]; ok {
+			if s.reset {
+				c.frameMux.Unlock()
+				return 0, &StreamError{StreamID: id, ErrorCode: s.resetCode}
+			}
+			if len(s.data) > 0 {
+				n := copy(p, s.data)
+				s.data = s.data[n:]
+				update := c.onStreamDataRead(id, s, protocol.ByteCount(n))
+				c.frameMux.Unlock()
+				if update {
+					// 发送失败时新的上限随之后的数据包发送
+					_ = c.SendPendingPackets()
+				}
+				return n, nil
+			}
+			if s.finReceived && s.readOffset == s.finalSize {
+				c.retireStream(id)
+				c.frameMux.Unlock()
+				return 0, io.EOF
+			}
+		}
+		c.frameMux.Unlock()
+		if err := c.waitStreams(context.Background()); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// waitStreams 等待流的状态发生变化，ctx结束或连接关闭时返回错误
+func (c *Connection) waitStreams(ctx context.Context) error {
+	c.frameMux.Lock()
+	notify := c.streams.notify
+	c.frameMux.Unlock()
+
+	select {
+	case <-notify:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closeChan:
+		if err := c.CloseError(); err != nil {
+			return err
+		}
+		return fmt.Errorf("连接已关闭")
+	}
+}
+
+// notifyStreams 唤醒所有等待流的状态变化的调用。调用方需持有frameMux
+func (c *Connection) notifyStreams() {
+	close(c.streams.notify)
+	c.streams.notify = make(chan struct{})
+}
+
+// peerStreamLimit 返回对端允许本端发起的指定类型的流数量。客户端在收到服务端的传输参数之前
+// 使用票据记录的服务端传输参数，见RFC 9000第7.4.1节。调用方需持有frameMux
+func (c *Connection) peerStreamLimit(typ protocol.StreamType) uint64 {
+	params := c.peerParams
+	if params == nil {
+		params = c.earlyParams
+	}
+	var limit uint64
+	if params != nil {
+		limit = params.InitialMaxStreamsUni
+		if typ == protocol.StreamTypeBidi {
+			limit = params.InitialMaxStreamsBidi
+		}
+	}
+	return max(limit, c.streams.peerMax[typ])
+}
+
+// localStreamLimit 返回本端允许对端发起的指定类型的流数量。调用方需持有frameMux
+func (c *Connection) localStreamLimit(typ protocol.StreamType) uint64 {
+	limit := c.localParams.InitialMaxStreamsUni
+	if typ == protocol.StreamTypeBidi {
+		limit = c.localParams.InitialMaxStreamsBidi
+	}
+	return limit + c.streams.granted[typ]
+}
+
+// openIncomingStream 校验收到的STREAM帧所属的流：本端发起的流必须已经打开，且不能是单向流；
+// 对端发起的流不能超出本端允许的数量，首次出现时同时打开所有序号更小的同类型流，
+// 按序号等待应用接受，见RFC 9000第3.2节。调用方需持有frameMux
+func (c *Connection) openIncomingStream(id protocol.StreamID) error {
+	typ := id.Type()
+	if id.InitiatedBy() == c.perspective {
+		if typ == protocol.StreamTypeUni {
+			return protocol.NewTransportError(protocol.StreamStateError, "收到本端发起的单向流%d的数据", id)
+		}
+		if _, ok := c.sendStreams[id]; !ok {
+			return protocol.NewTransportError(protocol.StreamStateError, "收到本端尚未打开的流%d的数据", id)
+		}
+		return nil
+	}
+	if id.Num() < c.streams.opened[typ] {
+		return nil
+	}
+	if id.Num() >= c.localStreamLimit(typ) {
+		return protocol.NewTransportError(protocol.StreamLimitError, "流%d超出本端允许打开的流数量", id)
+	}
+	for num := c.streams.opened[typ]; num <= id.Num(); num++ {
+		c.streams.accept[typ] = append(c.streams.accept[typ], protocol.NewStreamID(num, typ, c.perspective.Opposite()))
+	}
+	c.streams.opened[typ] = id.Num() + 1
+	return nil
+}
+
+// onStreamDataRead 应用读取流数据后滑动流和连接的接收窗口，剩余窗口不足一半时通过MAX_STREAM_DATA和MAX_DATA帧
+// 通告新的上限，见RFC 9000第4.2节；对端已经结束的流不再需要新的额度。返回是否有新的帧需要发送。调用方需持有frameMux
+func (c *Connection) onStreamDataRead(id protocol.StreamID, s *recvStream, n protocol.ByteCount) bool {
+	s.window.AddBytesRead(n)
+	c.recvWindow.AddBytesRead(n)
+	queued := false
+	if !s.finReceived {
+		if limit, ok := s.window.WindowUpdate(); ok {
+			c.queueControlFrame(&frame.MaxStreamDataFrame{StreamID: id, MaximumStreamData: limit})
+			queued = true
+		}
+	}
+	if limit, ok := c.recvWindow.WindowUpdate(); ok {
+		c.queueControlFrame(&frame.MaxDataFrame{MaximumData: limit})
+		queued = true
+	}
+	return queued
+}
+
+// retireStream 对端发起的流的各个方向都结束后，允许对端再打开一个同类型的流，
+// 并通过MAX_STREAMS帧通知对端，见RFC 9000第4.6节。调用方需持有frameMux
+func (c *Connection) retireStream(id protocol.StreamID) {
+	if id.InitiatedBy() == c.perspective {
+		return
+	}
+	r, ok := c.recvStreams[id]
+	if !ok || r.retired {
+		return
+	}
+	if !r.reset && (!r.finReceived || r.readOffset != r.finalSize || len(r.data) > 0) {
+		return
+	}
+	typ := id.Type()
+	if typ == protocol.StreamTypeBidi {
+		if s, ok := c.sendStreams[id]; !ok || (!s.finished && !s.reset) {
+			return
+		}
+	}
+	r.retired = true
+	c.streams.granted[typ]++
+	c.queueControlFrame(&frame.MaxStreamsFrame{
+		Bidirectional:  typ == protocol.StreamTypeBidi,
+		MaximumStreams: c.localStreamLimit(typ),
+	})
+}
+
+// handleMaxStreamsFrame 对端提高允许本端发起的流数量，唤醒等待打开流的调用
+func (c *Connection) handleMaxStreamsFrame(f *frame.MaxStreamsFrame) error {
+	if f.MaximumStreams > protocol.MaxStreamCount {
+		return protocol.NewTransportError(protocol.FrameEncodingError, "MAX_STREAMS帧的流数量超过2^60")
+	}
+	typ := protocol.StreamTypeUni
+	if f.Bidirectional {
+		typ = protocol.StreamTypeBidi
+	}
+	if f.MaximumStreams > c.streams.peerMax[typ] {
+		c.streams.peerMax[typ] = f.MaximumStreams
+		c.notifyStreams()
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package connection
+
+import (
+	"fmt"
+	"time"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/flowcontrol"
+	"LQUIC/internal/protocol"
+)
+
+// maxFlowControlWindow 每个流最多缓存的乱序数据量
+const maxFlowControlWindow = 16 << 20 // 16MB
+
+// DefaultTransportParameters 返回连接默认使用的传输参数，连接ID相关的参数在开始握手时填写
+func DefaultTransportParameters() *protocol.TransportParameters {
+	return &protocol.TransportParameters{
+		MaxIdleTimeout:                 30 * time.Second,
+		MaxUDPPayloadSize:              protocol.DefaultMaxUDPPayloadSize,
+		InitialMaxData:                 1 << 20, // 1MB
+		InitialMaxStreamDataBidiLocal:  512 << 10,
+		InitialMaxStreamDataBidiRemote: 512 << 10,
+		InitialMaxStreamDataUni:        512 << 10,
+		InitialMaxStreamsBidi:          100,
+		InitialMaxStreamsUni:           100,
+		AckDelayExponent:               protocol.DefaultAckDelayExponent,
+		MaxAckDelay:                    protocol.DefaultMaxAckDelay,
+		ActiveConnectionIDLimit:        protocol.DefaultActiveConnectionIDLimit,
+	}
+}
+
+// SetTransportParameters 设置本端的传输参数，需要在StartHandshake之前调用。
+// 连接级别的接收窗口按InitialMaxData重新设置，流级别的接收窗口在打开流时按对应的参数设置
+func (c *Connection) SetTransportParameters(params *protocol.TransportParameters) error {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	if c.perspective != 0 {
+		return fmt.Errorf("握手开始后不能修改传输参数")
+	}
+	local := *params
+	c.localParams = &local
+	c.recvWindow = flowcontrol.NewReceiveWindow(local.InitialMaxData)
+	return nil
+}
+
+// StartHandshake 以指定角色开始TLS握手。本端传输参数中的连接ID由连接自动填写：
+// 服务端填写客户端首个Initial包的目标连接ID和Retry包的源连接ID，客户端不能发送这些参数。
+// 客户端的传输参数随ClientHello发送；服务端在收到并校验客户端的传输参数、完成兼容版本协商之后发送
+func (c *Connection) StartHandshake(perspective protocol.Perspective) error {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	if c.perspective != 0 {
+		return fmt.Errorf("握手已经开始")
+	}
+	if perspective != c.cryptoSetup.Perspective() {
+		return fmt.Errorf("连接的角色与加密设置的角色不一致")
+	}
+	params := c.localParams
+	params.InitialSourceConnectionID = c.srcConnID
+	if perspective == protocol.PerspectiveServer {
+		params.OriginalDestinationConnectionID = c.originalDestConnID
+		params.RetrySourceConnectionID = c.retrySrcConnID
+	} else {
+		params.OriginalDestinationConnectionID = nil
+		params.StatelessResetToken = nil
+		params.PreferredAddress = nil
+		params.RetrySourceConnectionID = nil
+	}
+	params.VersionInformation = c.LocalVersionInformation()
+	if err := params.Validate(perspective); err != nil {
+		return err
+	}
+	c.perspective = perspective
+
+	if perspective == protocol.PerspectiveClient {
+		if err := c.sendTransportParameters(); err != nil {
+			return err
+		}
+	} else {
+		// 服务端在恢复会话之后才发送传输参数，提前交给TLS握手判断能否接受0-RTT
+		current := *params
+		c.cryptoSetup.SetEarlyDataParameters(&current)
+	}
+	if err := c.cryptoSetup.StartHandshake(); err != nil {
+		return err
+	}
+	// 客户端尝试0-RTT时按票据记录的服务端传输参数限制0-RTT数据
+	c.earlyParams = c.cryptoSetup.RememberedTransportParameters()
+	return nil
+}
+
+// LocalTransportParameters 返回本端的传输参数
+func (c *Connection) LocalTransportParameters() *protocol.TransportParameters {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	params := *c.localParams
+	return &params
+}
+
+// PeerTransportParameters 返回对端的传输参数，尚未收到时返回nil
+func (c *Connection) PeerTransportParameters() *protocol.TransportParameters {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	if c.peerParams == nil {
+		return nil
+	}
+	params := *c.peerParams
+	return &params
+}
+
+// IdleTimeout 返回协商后的空闲超时：双方max_idle_timeout中较小的非零值，0表示不限制，见RFC 9000第10.1节
+func (c *Connection) IdleTimeout() time.Duration {
+	c.frameMux.Lock()
+	defer c.frameMux.Unlock()
+
+	timeout := c.localParams.MaxIdleTimeout
+	if c.peerParams != nil {
+		if peer := c.peerParams.MaxIdleTimeout; peer > 0 && (timeout == 0 || peer < timeout) {
+			timeout = peer
+		}
+	}
+	return timeout
+}
+
+// sendTransportParameters 编码本端的传输参数并交给TLS握手发送，调用方需持有frameMux
+func (c *Connection) sendTransportParameters() error {
+	data, err := c.localParams.Append(nil, c.perspective)
+	if err != nil {
+		return err
+	}
+	return c.cryptoSetup.SetTransportParameters(data)
+}
+
+// handleTransportParameters 解析并校验TLS握手收到的对端传输参数，每个连接只处理一次。
+// 服务端据此完成兼容版本协商，然后发送自己的传输参数。调用方需持有frameMux
+func (c *Connection) handleTransportParameters() error {
+	if c.peerParams != nil {
+		return nil
+	}
+	data := c.cryptoSetup.PeerTransportParameters()
+	if data == nil {
+		return nil
+	}
+	params, err := protocol.ParseTransportParameters(data, c.perspective.Opposite())
+	if err != nil {
+		return err
+	}
+	if err := c.validatePeerConnIDs(params); err != nil {
+		return err
+	}
+
+	if c.perspective == protocol.PerspectiveServer {
+		if err := c.NegotiateVersion(params.VersionInformation); err != nil {
+			return err
+		}
+	} else {
+		if err := c.ValidateVersionInformation(params.VersionInformation); err != nil {
+			return err
+		}
+		// 接受0-RTT的服务端不能降低客户端发送0-RTT数据时使用的限制，见RFC 9000第7.4.1节
+		if c.earlyParams != nil && c.cryptoSetup.EarlyDataState() != crypto.EarlyDataRejected {
+			if err := params.ValidateZeroRTT(c.earlyParams); err != nil {
+				return err
+			}
+		}
+	}
+	c.peerParams = params
+	c.applyPeerFlowControlLimits()
+	// 对端的传输参数给出了允许本端打开的流数量
+	c.notifyStreams()
+	if size := int(params.MaxUDPPayloadSize); size < c.maxDatagramSize {
+		c.maxDatagramSize = size
+	}
+
+	if c.perspective == protocol.PerspectiveServer {
+		// 版本协商可能改变了连接使用的版本
+		c.localParams.VersionInformation = c.LocalVersionInformation()
+		return c.sendTransportParameters()
+	}
+	return nil
+}
+
+// validatePeerConnIDs 校验对端传输参数中的连接ID与数据包中实际使用的连接ID一致，
+// 防止攻击者篡改握手期间的连接ID，见RFC 9000第7.3节
+func (c *Connection) validatePeerConnIDs(params *protocol.TransportParameters) error {
+	if string(params.InitialSourceConnectionID) != string(c.destConnID) {
+		return protocol.NewTransportError(protocol.TransportParameterError,
+			"initial_source_connection_id与对端的源连接ID不一致")
+	}
+	if c.perspective == protocol.PerspectiveServer {
+		return nil
+	}
+	if string(params.OriginalDestinationConnectionID) != string(c.originalDestConnID) {
+		return protocol.NewTransportError(protocol.TransportParameterError,
+			"original_destination_connection_id与首个Initial包的目标连接ID不一致")
+	}
+	if c.retrySrcConnID == nil {
+		if params.RetrySourceConnectionID != nil {
+			return protocol.NewTransportError(protocol.TransportParameterError,
+				"未发生Retry时服务端不能发送retry_source_connection_id")
+		}
+	} else if string(params.RetrySourceConnectionID) != string(c.retrySrcConnID) {
+		return protocol.NewTransportError(protocol.TransportParameterError,
+			"retry_source_connection_id与Retry包的源连接ID不一致")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package connection
+
+import (
+	"LQUIC/internal/protocol"
+)
+
+// SetVersion 设置连接使用的QUIC版本，同时作为兼容版本协商的原始版本
+func (c *Connection) SetVersion(version uint32) {
+	c.versionMux.Lock()
+	c.version = version
+	c.originalVersion = version
+	c.versionMux.Unlock()
+	c.cryptoSetup.SetVersion(version)
+}
+
+// SetAvailableVersions 设置本端支持的版本，按优先级从高到低排列
+func (c *Connection) SetAvailableVersions(versions []uint32) {
+	c.versionMux.Lock()
+	defer c.versionMux.Unlock()
+	c.availableVersions = versions
+}
+
+// SetVersionNegotiated 客户端因版本协商包重新发起连接时调用，之后要求服务端的传输参数携带version_information
+func (c *Connection) SetVersionNegotiated() {
+	c.versionMux.Lock()
+	defer c.versionMux.Unlock()
+	c.versionNegotiated = true
+}
+
+// Version 返回连接当前使用的QUIC版本
+func (c *Connection) Version() uint32 {
+	c.versionMux.RLock()
+	defer c.versionMux.RUnlock()
+	return c.version
+}
+
+// OriginalVersion 返回客户端首个Initial包使用的版本
+func (c *Connection) OriginalVersion() uint32 {
+	c.versionMux.RLock()
+	defer c.versionMux.RUnlock()
+	return c.originalVersion
+}
+
+// LocalVersionInformation 返回本端需要在传输参数中发送的version_information
+func (c *Connection) LocalVersionInformation() *protocol.VersionInformation {
+	c.versionMux.RLock()
+	defer c.versionMux.RUnlock()
+	return &protocol.VersionInformation{
+		ChosenVersion:     c.version,
+		AvailableVersions: c.availableVersions,
+	}
+}
+
+// SwitchVersion 兼容版本协商选定新版本后切换连接使用的版本，
+// 之后发送的数据包和派生的Initial密钥都使用新版本
+func (c *Connection) SwitchVersion(version uint32) error {
+	c.versionMux.Lock()
+	if !protocol.IsCompatibleVersion(c.originalVersion, version) ||
+		!protocol.IsSupportedVersion(c.availableVersions, version) {
+		c.versionMux.Unlock()
+		return protocol.NewTransportError(protocol.VersionNegotiationError,
+			"无法从版本0x%x兼容切换到0x%x", c.originalVersion, version)
+	}
+	c.version = version
+	c.versionMux.Unlock()
+	c.cryptoSetup.SetVersion(version)
+	return nil
+}
+
+// NegotiateVersion 服务端根据客户端的version_information选择连接使用的版本
+func (c *Connection) NegotiateVersion(client *protocol.VersionInformation) error {
+	original := c.OriginalVersion()
+	if client != nil && client.ChosenVersion != original {
+		return protocol.NewTransportError(protocol.VersionNegotiationError,
+			"version_information中的版本0x%x与Initial包的版本0x%x不一致", client.ChosenVersion, original)
+	}
+	c.versionMux.RLock()
+	version := protocol.ChooseCompatibleVersion(c.availableVersions, original, client)
+	c.versionMux.RUnlock()
+	if version == c.Version() {
+		return nil
+	}
+	return c.SwitchVersion(version)
+}
+
+// ValidateVersionInformation 客户端校验服务端的version_information，见RFC 9368第4节：
+// 服务端选定的版本必须与实际使用的版本一致；因版本协商包重新发起的连接必须收到version_information，
+// 且按本端的优先级从服务端的Available Versions中选出的版本就是实际使用的版本，防止攻击者伪造版本协商包降级
+func (c *Connection) ValidateVersionInformation(server *protocol.VersionInformation) error {
+	c.versionMux.RLock()
+	defer c.versionMux.RUnlock()
+
+	if server == nil {
+		if c.versionNegotiated {
+			return protocol.NewTransportError(protocol.VersionNegotiationError, "版本协商之后服务端没有发送version_information")
+		}
+		return nil
+	}
+	if server.ChosenVersion != c.version {
+		return protocol.NewTransportError(protocol.VersionNegotiationError,
+			"服务端选定的版本0x%x与连接使用的版本0x%x不一致", server.ChosenVersion, c.version)
+	}
+	if c.versionNegotiated {
+		if version, ok := protocol.ChooseSupportedVersion(c.availableVersions, server.AvailableVersions); !ok || version != c.version {
+			return protocol.NewTransportError(protocol.VersionNegotiationError,
+				"按服务端支持的版本%x应选择0x%x，实际使用0x%x", server.AvailableVersions, version, c.version)
+		}
+	}
+	return nil
+}
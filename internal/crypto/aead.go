@@ -0,0 +1,162 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"LQUIC/internal/protocol"
+)
+
+var (
+	// ErrKeysNotYetAvailable 指定加密级别的密钥尚未安装
+	ErrKeysNotYetAvailable = errors.New("加密级别的密钥尚未安装")
+	// ErrKeysDiscarded 指定加密级别的密钥已经丢弃，该级别的数据包应直接丢弃
+	ErrKeysDiscarded = errors.New("加密级别的密钥已经丢弃")
+	// ErrDecryptionFailed 数据包解密或认证失败
+	ErrDecryptionFailed = errors.New("数据包解密失败")
+)
+
+// cipherSuite 描述TLS 1.3密码套件在QUIC包保护中使用的参数
+type cipherSuite struct {
+	ID     uint16
+	KeyLen int
+	// Hash HKDF使用的哈希函数
+	Hash func() hash.Hash
+	// ConfidentialityLimit 同一密钥最多加密的数据包数量，IntegrityLimit 连接中最多允许认证失败的数据包数量，
+	// 见RFC 9001第6.6节
+	ConfidentialityLimit uint64
+	IntegrityLimit       uint64
+	// newAEAD 使用包保护密钥创建AEAD
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// 包保护使用的IV长度，三种密码套件均为12字节
+const ivLen = 12
+
+// newAESGCM 创建AES-GCM
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cipherSuites QUIC支持的TLS 1.3密码套件，见RFC 9001第5.3节
+var cipherSuites = map[uint16]*cipherSuite{
+	tls.TLS_AES_128_GCM_SHA256: {
+		ID: tls.TLS_AES_128_GCM_SHA256, KeyLen: 16, Hash: sha256.New, newAEAD: newAESGCM,
+		ConfidentialityLimit: 1 << 23, IntegrityLimit: 1 << 52,
+	},
+	tls.TLS_AES_256_GCM_SHA384: {
+		ID: tls.TLS_AES_256_GCM_SHA384, KeyLen: 32, Hash: sha512.New384, newAEAD: newAESGCM,
+		ConfidentialityLimit: 1 << 23, IntegrityLimit: 1 << 52,
+	},
+	// ChaCha20-Poly1305的机密性上限超过了可能的包序号数量
+	tls.TLS_CHACHA20_POLY1305_SHA256: {
+		ID: tls.TLS_CHACHA20_POLY1305_SHA256, KeyLen: 32, Hash: sha256.New, newAEAD: chacha20poly1305.New,
+		ConfidentialityLimit: 1 << 62, IntegrityLimit: 1 << 36,
+	},
+}
+
+// getCipherSuite 返回密码套件参数
+func getCipherSuite(id uint16) (*cipherSuite, error) {
+	suite, ok := cipherSuites[id]
+	if !ok {
+		return nil, fmt.Errorf("不支持的密码套件: 0x%04x", id)
+	}
+	return suite, nil
+}
+
+// PacketAEAD 使用一组包保护密钥加解密数据包负载，见RFC 9001第5.3节
+type PacketAEAD struct {
+	aead  cipher.AEAD
+	iv    []byte
+	nonce []byte
+	// 使用该密钥加密的数据包和认证失败的数据包数量
+	sealed   uint64
+	failures uint64
+}
+
+// NewPacketAEAD 使用包保护密钥和IV创建PacketAEAD
+func NewPacketAEAD(suiteID uint16, key, iv []byte) (*PacketAEAD, error) {
+	suite, err := getCipherSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != suite.KeyLen || len(iv) != ivLen {
+		return nil, fmt.Errorf("包保护密钥长度错误: 密钥%d字节，IV%d字节", len(key), len(iv))
+	}
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建AEAD失败: %v", err)
+	}
+	return &PacketAEAD{
+		aead:  aead,
+		iv:    append([]byte{}, iv...),
+		nonce: make([]byte, ivLen),
+	}, nil
+}
+
+// newPacketAEADFromSecret 从流量密钥派生包保护密钥和IV
+func newPacketAEADFromSecret(suiteID uint16, secret []byte, version uint32) (*PacketAEAD, error) {
+	suite, err := getCipherSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	params := getVersionParams(version)
+	key := hkdfExpandLabel(suite.Hash, secret, params.keyLabel, nil, suite.KeyLen)
+	iv := hkdfExpandLabel(suite.Hash, secret, params.ivLabel, nil, ivLen)
+	return NewPacketAEAD(suiteID, key, iv)
+}
+
+// Overhead 返回加密后负载增加的长度
+func (a *PacketAEAD) Overhead() int {
+	return a.aead.Overhead()
+}
+
+// makeNonce 将包序号左侧补零后与IV异或得到随机数
+func (a *PacketAEAD) makeNonce(pn protocol.PacketNumber) []byte {
+	copy(a.nonce, a.iv)
+	var pnBytes [8]byte
+	binary.BigEndian.PutUint64(pnBytes[:], uint64(pn))
+	for i, b := range pnBytes {
+		a.nonce[ivLen-8+i] ^= b
+	}
+	return a.nonce
+}
+
+// PacketsSealed 返回使用该密钥加密的数据包数量
+func (a *PacketAEAD) PacketsSealed() uint64 {
+	return a.sealed
+}
+
+// DecryptionFailures 返回使用该密钥认证失败的数据包数量
+func (a *PacketAEAD) DecryptionFailures() uint64 {
+	return a.failures
+}
+
+// Seal 加密负载并追加到dst，ad为数据包头部
+func (a *PacketAEAD) Seal(dst, plaintext []byte, pn protocol.PacketNumber, ad []byte) []byte {
+	a.sealed++
+	return a.aead.Seal(dst, a.makeNonce(pn), plaintext, ad)
+}
+
+// Open 解密负载并追加到dst，ad为去除头部保护后的数据包头部
+func (a *PacketAEAD) Open(dst, ciphertext []byte, pn protocol.PacketNumber, ad []byte) ([]byte, error) {
+	plaintext, err := a.aead.Open(dst, a.makeNonce(pn), ciphertext, ad)
+	if err != nil {
+		a.failures++
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"errors"
+
+	"LQUIC/internal/protocol"
+)
+
+// AEADStats 一个加密级别的包保护统计，见RFC 9001第6.6节
+type AEADStats struct {
+	// CipherSuite 使用的密码套件，尚未安装密钥时为0
+	CipherSuite uint16
+	// PacketsSealed 该级别所有密钥加密的数据包总数
+	PacketsSealed uint64
+	// CurrentKeySealed 当前发送密钥加密的数据包数量，与机密性上限比较
+	CurrentKeySealed uint64
+	// DecryptionFailures 该级别认证失败的数据包总数
+	DecryptionFailures uint64
+	// ConfidentialityLimit 和IntegrityLimit 该级别生效的AEAD使用上限
+	ConfidentialityLimit uint64
+	IntegrityLimit       uint64
+}
+
+// SetAEADLimits 设置比密码套件默认值更严格的AEAD使用上限，为0时使用密码套件的默认值
+func (c *CryptoSetup) SetAEADLimits(confidentialityLimit, integrityLimit uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.confidentialityLimit = confidentialityLimit
+	c.integrityLimit = integrityLimit
+}
+
+// AEADStats 返回指定加密级别的包保护统计
+func (c *CryptoSetup) AEADStats(level CryptoLevel) AEADStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if int(level) >= numLevels {
+		return AEADStats{}
+	}
+	stats := AEADStats{
+		CipherSuite:        c.suites[level],
+		PacketsSealed:      c.packetsSealed[level],
+		DecryptionFailures: c.decryptionFailures[level],
+	}
+	if c.sealers[level] != nil {
+		stats.CurrentKeySealed = c.sealers[level].PacketsSealed()
+	}
+	stats.ConfidentialityLimit, stats.IntegrityLimit = c.aeadLimits(level)
+	return stats
+}
+
+// aeadLimits 返回指定加密级别生效的机密性和完整性上限，调用方需持有互斥锁
+func (c *CryptoSetup) aeadLimits(level CryptoLevel) (confidentiality, integrity uint64) {
+	suite, err := getCipherSuite(c.suites[level])
+	if err != nil {
+		return 0, 0
+	}
+	confidentiality, integrity = suite.ConfidentialityLimit, suite.IntegrityLimit
+	if c.confidentialityLimit > 0 && c.confidentialityLimit < confidentiality {
+		confidentiality = c.confidentialityLimit
+	}
+	if c.integrityLimit > 0 && c.integrityLimit < integrity {
+		integrity = c.integrityLimit
+	}
+	return confidentiality, integrity
+}
+
+// checkConfidentialityLimit 当前发送密钥加密的数据包达到机密性上限后不能继续使用，
+// 返回AEAD_LIMIT_REACHED。调用方需持有互斥锁
+func (c *CryptoSetup) checkConfidentialityLimit(level CryptoLevel) error {
+	limit, _ := c.aeadLimits(level)
+	if c.sealers[level].PacketsSealed() >= limit {
+		return protocol.NewTransportError(protocol.AEADLimitReached, "加密的数据包达到机密性上限%d", limit)
+	}
+	return nil
+}
+
+// onOpenFailed 记录认证失败的数据包。Initial密钥由公开信息派生，不计入完整性上限；
+// Handshake和1-RTT密钥认证失败的总数超过上限后返回AEAD_LIMIT_REACHED。调用方需持有互斥锁
+func (c *CryptoSetup) onOpenFailed(level CryptoLevel, err error) error {
+	if !errors.Is(err, ErrDecryptionFailed) {
+		return err
+	}
+	c.decryptionFailures[level]++
+	if level == LevelInitial {
+		return err
+	}
+	_, limit := c.aeadLimits(level)
+	if failures := c.decryptionFailures[LevelHandshake] + c.decryptionFailures[LevelOneRTT]; failures > limit {
+		return protocol.NewTransportError(protocol.AEADLimitReached, "认证失败的数据包超过完整性上限%d", limit)
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package crypto
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplayWindow 默认的0-RTT反重放时间窗口，客户端时间与服务器时间相差超过窗口的0-RTT尝试被拒绝
+	DefaultReplayWindow = 10 * time.Second
+	// DefaultStrikeRegisterEntries 重放记录默认最多保存的记录数量
+	DefaultStrikeRegisterEntries = 100000
+	// DefaultReplayFilterFalsePositiveRate 布隆过滤器默认的误判率，误判只会使0-RTT回退到1-RTT
+	DefaultReplayFilterFalsePositiveRate = 0.001
+)
+
+// AntiReplay 0-RTT反重放保护，见RFC 8446第8节。服务器上的所有连接共享同一个实例，
+// 重放到其他连接上的0-RTT数据同样能被发现；集群可以实现该接口接入共享的存储（例如Redis），
+// 在所有服务器实例之间检测重放
+type AntiReplay interface {
+	// Accept 记录一次0-RTT尝试，key由ReplayKey根据会话票据和ClientHello计算，
+	// clientTime为客户端发送ClientHello的时间。key在时间窗口内首次出现时返回true；
+	// 可能是重放、客户端时间超出窗口或无法判断时返回false，此时0-RTT被拒绝，连接回退到1-RTT
+	Accept(key []byte, clientTime time.Time) bool
+}
+
+// ReplayKey 计算0-RTT尝试的反重放键：SHA-256(len(ticket) | ticket | clientHello)。
+// 重放的ClientHello与原始的完全相同，同一张票据的正常连接使用不同的随机数，得到不同的键
+func ReplayKey(ticket, clientHello []byte) []byte {
+	h := sha256.New()
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(ticket)))
+	h.Write(length[:])
+	h.Write(ticket)
+	h.Write(clientHello)
+	return h.Sum(nil)
+}
+
+// strike 重放记录中的一条记录
+type strike struct {
+	key        [sha256.Size]byte
+	clientTime time.Time
+}
+
+// strikeHeap 按客户端时间排列的最小堆，堆顶是最旧的记录
+type strikeHeap []strike
+
+func (h strikeHeap) Len() int           { return len(h) }
+func (h strikeHeap) Less(i, j int) bool { return h[i].clientTime.Before(h[j].clientTime) }
+func (h strikeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *strikeHeap) Push(x any)        { *h = append(*h, x.(strike)) }
+func (h *strikeHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// StrikeRegister 精确记录时间窗口内所有0-RTT尝试的反重放保护。
+// 记录数量达到上限时淘汰最旧的记录，并把下限提高到该记录的客户端时间，
+// 不晚于下限的尝试无法判断是否重放，一律拒绝；创建时的下限为当前时间，
+// 因此进程重启后不会接受重启之前可能已经处理过的0-RTT尝试
+type StrikeRegister struct {
+	mutex      sync.Mutex
+	window     time.Duration
+	maxEntries int
+	// horizon 下限，客户端时间不晚于该时间的尝试被拒绝
+	horizon time.Time
+	strikes map[[sha256.Size]byte]time.Time
+	order   strikeHeap
+	// now 返回当前时间，测试中可以替换
+	now func() time.Time
+}
+
+// NewStrikeRegister 创建反重放记录，window为允许的客户端时钟偏差，为0时使用DefaultReplayWindow；
+// maxEntries为最多保存的记录数量，为0时使用DefaultStrikeRegisterEntries
+func NewStrikeRegister(window time.Duration, maxEntries int) *StrikeRegister {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultStrikeRegisterEntries
+	}
+	return &StrikeRegister{
+		window:     window,
+		maxEntries: maxEntries,
+		horizon:    time.Now(),
+		strikes:    make(map[[sha256.Size]byte]time.Time),
+		now:        time.Now,
+	}
+}
+
+// Accept 实现AntiReplay接口
+func (s *StrikeRegister) Accept(key []byte, clientTime time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if !withinWindow(now, clientTime, s.window) || !clientTime.After(s.horizon) {
+		return false
+	}
+	// 客户端时间早于窗口的记录不会再被查询，可以删除
+	for s.order.Len() > 0 && s.order[0].clientTime.Before(now.Add(-s.window)) {
+		delete(s.strikes, heap.Pop(&s.order).(strike).key)
+	}
+
+	k := sha256.Sum256(key)
+	if _, seen := s.strikes[k]; seen {
+		return false
+	}
+	for s.order.Len() >= s.maxEntries {
+		oldest := heap.Pop(&s.order).(strike)
+		delete(s.strikes, oldest.key)
+		if oldest.clientTime.After(s.horizon) {
+			s.horizon = oldest.clientTime
+		}
+	}
+	// 淘汰的记录可能与本次尝试相同，不晚于下限的尝试无法判断
+	if !clientTime.After(s.horizon) {
+		return false
+	}
+	s.strikes[k] = clientTime
+	heap.Push(&s.order, strike{key: k, clientTime: clientTime})
+	return true
+}
+
+// Len 返回保存的记录数量
+func (s *StrikeRegister) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.strikes)
+}
+
+// ReplayFilter 按时间分桶的布隆过滤器实现的反重放保护，内存占用固定，
+// 以少量误判（合法的0-RTT被拒绝并回退到1-RTT）换取不随连接数增长的内存。
+// 两个过滤器轮流使用，每个覆盖两倍时间窗口，保证记录至少保留到客户端时间超出窗口
+type ReplayFilter struct {
+	mutex  sync.Mutex
+	window time.Duration
+	// horizon 下限，含义同StrikeRegister
+	horizon time.Time
+	// bucket 当前过滤器对应的时间桶序号
+	bucket  int64
+	current *bloomFilter
+	// previous 上一个时间桶的过滤器
+	previous *bloomFilter
+	// now 返回当前时间，测试中可以替换
+	now func() time.Time
+}
+
+// NewReplayFilter 创建反重放过滤器，capacity为每个时间桶（两倍window）内预期的0-RTT尝试数量，
+// falsePositiveRate为期望的误判率，为0时使用DefaultReplayFilterFalsePositiveRate
+func NewReplayFilter(window time.Duration, capacity int, falsePositiveRate float64) *ReplayFilter {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if capacity <= 0 {
+		capacity = DefaultStrikeRegisterEntries
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = DefaultReplayFilterFalsePositiveRate
+	}
+	now := time.Now()
+	f := &ReplayFilter{
+		window:   window,
+		horizon:  now,
+		current:  newBloomFilter(capacity, falsePositiveRate),
+		previous: newBloomFilter(capacity, falsePositiveRate),
+		now:      time.Now,
+	}
+	f.bucket = f.bucketOf(now)
+	return f
+}
+
+// Accept 实现AntiReplay接口
+func (f *ReplayFilter) Accept(key []byte, clientTime time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+	if !withinWindow(now, clientTime, f.window) || !clientTime.After(f.horizon) {
+		return false
+	}
+	f.rotate(now)
+
+	h := sha256.Sum256(key)
+	if f.current.contains(h) || f.previous.contains(h) {
+		return false
+	}
+	f.current.add(h)
+	return true
+}
+
+// bucketOf 返回时间所在的时间桶序号
+func (f *ReplayFilter) bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(2*f.window)
+}
+
+// rotate 进入新的时间桶时轮换过滤器，调用方需持有互斥锁
+func (f *ReplayFilter) rotate(now time.Time) {
+	bucket := f.bucketOf(now)
+	switch {
+	case bucket == f.bucket:
+		return
+	case bucket == f.bucket+1:
+		f.previous, f.current = f.current, f.previous
+	default:
+		// 超过一个时间桶没有0-RTT尝试，两个过滤器中的记录都已经超出窗口
+		f.previous.reset()
+	}
+	f.current.reset()
+	f.bucket = bucket
+}
+
+// withinWindow 返回客户端时间与服务器时间的偏差是否在窗口内
+func withinWindow(now, clientTime time.Time, window time.Duration) bool {
+	return !clientTime.Before(now.Add(-window)) && !clientTime.After(now.Add(window))
+}
+
+// bloomFilter 使用双重哈希的布隆过滤器
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes int
+}
+
+// newBloomFilter 按容量n和误判率p计算位数m = -n·ln(p)/ln(2)²和哈希函数个数k = m/n·ln(2)
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, hashes: k}
+}
+
+// position 由哈希值的前两个64位整数h1、h2生成第i个位置h1 + i·h2
+func (b *bloomFilter) position(h [sha256.Size]byte, i int) uint64 {
+	h1 := binary.BigEndian.Uint64(h[0:8])
+	h2 := binary.BigEndian.Uint64(h[8:16]) | 1
+	return (h1 + uint64(i)*h2) % b.m
+}
+
+// add 将哈希值加入过滤器
+func (b *bloomFilter) add(h [sha256.Size]byte) {
+	for i := 0; i < b.hashes; i++ {
+		pos := b.position(h, i)
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// contains 返回哈希值是否可能在过滤器中
+func (b *bloomFilter) contains(h [sha256.Size]byte) bool {
+	for i := 0; i < b.hashes; i++ {
+		pos := b.position(h, i)
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reset 清空过滤器
+func (b *bloomFilter) reset() {
+	clear(b.bits)
+}
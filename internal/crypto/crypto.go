@@ -2,12 +2,12 @@
 package crypto
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"sync"
-	"time"
+
+	"LQUIC/internal/protocol"
 )
 
 // CryptoLevel 表示加密级别
@@ -20,6 +20,11 @@ const (
 	LevelHandshake
 	// LevelOneRTT 1-RTT加密级别
 	LevelOneRTT
+	// LevelZeroRTT 0-RTT加密级别，只保护客户端发送的0-RTT数据包，与1-RTT共享包序号空间
+	LevelZeroRTT
+
+	// numLevels 加密级别的数量
+	numLevels = int(LevelZeroRTT) + 1
 )
 
 // CryptoSetup 管理QUIC连接的加密状态
@@ -28,313 +33,414 @@ type CryptoSetup struct {
 
 	// TLS配置
 	tlsConfig *tls.Config
+	// TLS 1.3握手状态，StartHandshake之后非nil
+	tlsConn *tls.QUICConn
+	// 本端的角色，决定Initial密钥和TLS握手的方向
+	perspective protocol.Perspective
+	// 各加密级别待发送的握手数据
+	cryptoData [numLevels][]byte
+	// 本端编码后的传输参数，SetTransportParameters之后非nil
+	transportParams []byte
+	// TLS握手是否正在等待本端的传输参数
+	transportParamsRequired bool
+	// 对端的传输参数扩展
+	peerTransportParams []byte
+	// 当前使用的QUIC版本，决定初始盐值和HKDF标签
+	version uint32
+	// 派生Initial密钥使用的目标连接ID，SetInitialKeys之后非nil
+	initialConnID protocol.ConnectionID
+	// Initial读取密钥对应的版本，兼容版本协商期间可能与当前版本不同
+	initialReadVersion uint32
+	// 兼容版本协商中另一个版本的Initial读取密钥，该版本的数据包通过认证之后取代当前的读取密钥
+	nextInitial *initialOpener
 	// 当前加密级别
 	level CryptoLevel
+	// 各加密级别用于发送和接收的包保护密钥
+	sealers [numLevels]*PacketAEAD
+	openers [numLevels]*PacketAEAD
+	// 各加密级别用于发送和接收的头部保护密钥
+	headerSealers [numLevels]*HeaderProtector
+	headerOpeners [numLevels]*HeaderProtector
+	// 各加密级别的密钥是否已经丢弃，丢弃后不再安装，该级别的数据包直接丢弃
+	discarded [numLevels]bool
+	// Handshake级别的流量密钥，兼容版本协商切换版本后用于重新派生
+	handshakeReadSecret  []byte
+	handshakeWriteSecret []byte
+	// 1-RTT密钥更新状态
+	keyUpdate keyUpdateState
+	// 各加密级别使用的密码套件和包保护统计
+	suites             [numLevels]uint16
+	packetsSealed      [numLevels]uint64
+	decryptionFailures [numLevels]uint64
+	// 覆盖密码套件默认值的AEAD使用上限，0表示使用默认值
+	confidentialityLimit uint64
+	integrityLimit       uint64
 	// 是否完成握手
 	handshakeComplete bool
-	// 握手数据
-	handshakeData []byte
-	// 会话票据
-	sessionTicket []byte
-	// 0-RTT密钥
-	zeroRTTKey []byte
-	// 0-RTT反重放保护
-	zeroRTTReplayWindow map[string]int64
-	// 0-RTT reject标志
-	zeroRTTRejected bool
-	// 0-RTT回退数据
-	zeroRTTFallbackData []byte
+	// 握手是否已经确认：服务端在握手完成时确认，客户端在收到HANDSHAKE_DONE帧时确认
+	handshakeConfirmed bool
+	// 服务端在Initial级别收到的第一条握手消息，即ClientHello，用于密钥日志和0-RTT的反重放保护；
+	// 消息完整后不再追加，对端发送的CRYPTO数据不会一直累积
+	clientHello []byte
+	// 0-RTT反重放保护，为nil时服务端不接受0-RTT
+	antiReplay AntiReplay
+	// 服务端TLS配置的随机数源，签发票据时提供预先选定的ticket_age_add
+	ticketAgeAdd *ticketAgeAddRand
+	// 是否允许0-RTT：客户端恢复会话时发送0-RTT数据，服务端接受0-RTT数据并签发允许0-RTT的票据
+	earlyDataEnabled bool
+	// 0-RTT的状态
+	earlyData EarlyDataState
+	// earlyDataParams 服务端当前的传输参数，恢复会话时不能降低票据记录的限制才接受0-RTT
+	earlyDataParams *protocol.TransportParameters
+	// rememberedParams 客户端从票据中取出的服务端传输参数，0-RTT数据不能超出其中的限制
+	rememberedParams *protocol.TransportParameters
+	// 以NSS密钥日志格式输出流量密钥的目标，为nil时不输出
+	keyLogWriter io.Writer
+	// ClientHello中的client_random，密钥日志以此标识连接
+	clientRandom []byte
 }
 
-// NewCryptoSetup 创建新的加密设置
-func NewCryptoSetup(tlsConfig *tls.Config) *CryptoSetup {
+// NewCryptoSetup 创建新的加密设置，perspective指定本端是客户端还是服务端，
+// 决定Initial密钥的读写方向和TLS握手的角色
+func NewCryptoSetup(tlsConfig *tls.Config, perspective protocol.Perspective) *CryptoSetup {
 	return &CryptoSetup{
-		tlsConfig:           tlsConfig,
-		level:               LevelInitial,
-		zeroRTTReplayWindow: make(map[string]int64),
+		tlsConfig:   tlsConfig,
+		perspective: perspective,
+		version:     protocol.Version1,
+		level:       LevelInitial,
+		keyUpdate:   newKeyUpdateState(),
 	}
 }
 
-// HandleCryptoFrame 处理加密帧
-func (c *CryptoSetup) HandleCryptoFrame(data []byte, level CryptoLevel) error {
+// SetVersion 设置QUIC版本，兼容版本协商切换版本后需要重新设置。
+// 已经安装的Initial发送密钥和Handshake密钥使用新版本的盐值和标签重新派生，Initial读取密钥在收到新版本的数据包后切换：
+// 服务端在收到客户端的传输参数时才能选定版本，此时TLS已经给出了Handshake级别的流量密钥
+func (c *CryptoSetup) SetVersion(version uint32) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if level < c.level {
-		return fmt.Errorf("收到过期的加密级别数据")
+	c.version = version
+	if c.initialConnID != nil && !c.discarded[LevelInitial] {
+		// Initial密钥固定使用AES-128-GCM，派生不会失败。发送密钥立即改用新版本；对端在收到新版本的
+		// 数据包之前仍以原来的版本发送Initial包，保留原来的读取密钥，新版本的数据包通过认证后
+		// 由CommitInitialVersion切换，见RFC 9368第2.3节
+		_, writeSecret := c.initialSecrets(version)
+		_ = c.installWriteKeys(LevelInitial, initialSuiteID, writeSecret)
+		_ = c.prepareInitialVersion(version)
+	}
+	// 密码套件在安装时已经校验过，重新派生不会失败
+	suiteID := c.suites[LevelHandshake]
+	if c.handshakeReadSecret != nil {
+		_ = c.installReadKeys(LevelHandshake, suiteID, c.handshakeReadSecret)
 	}
+	if c.handshakeWriteSecret != nil {
+		_ = c.installWriteKeys(LevelHandshake, suiteID, c.handshakeWriteSecret)
+	}
+}
 
-	// 处理握手数据
-	c.handshakeData = append(c.handshakeData, data...)
-	return nil
+// Version 返回当前使用的QUIC版本
+func (c *CryptoSetup) Version() uint32 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.version
 }
 
-// SetHandshakeComplete 设置握手完成状态
-func (c *CryptoSetup) SetHandshakeComplete() {
+// InstallKeys 从读写两个方向的流量密钥派生并安装指定加密级别的包保护密钥
+func (c *CryptoSetup) InstallKeys(level CryptoLevel, suiteID uint16, readSecret, writeSecret []byte) error {
+	if int(level) >= numLevels {
+		return fmt.Errorf("无效的加密级别: %d", level)
+	}
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.handshakeComplete = true
-	c.level = LevelOneRTT
+	if err := c.installReadKeys(level, suiteID, readSecret); err != nil {
+		return err
+	}
+	return c.installWriteKeys(level, suiteID, writeSecret)
 }
 
-// HandshakeComplete 检查握手是否完成
-func (c *CryptoSetup) HandshakeComplete() bool {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// installReadKeys 从对端的流量密钥派生并安装用于接收的密钥，调用方需持有互斥锁
+func (c *CryptoSetup) installReadKeys(level CryptoLevel, suiteID uint16, secret []byte) error {
+	if c.discarded[level] {
+		return ErrKeysDiscarded
+	}
+	opener, err := newPacketAEADFromSecret(suiteID, secret, c.version)
+	if err != nil {
+		return err
+	}
+	headerOpener, err := newHeaderProtectorFromSecret(suiteID, secret, c.version)
+	if err != nil {
+		return err
+	}
+	switch level {
+	case LevelHandshake:
+		c.handshakeReadSecret = append([]byte{}, secret...)
+	case LevelOneRTT:
+		if err := c.setOneRTTReadSecret(suiteID, secret); err != nil {
+			return err
+		}
+	}
+	c.suites[level] = suiteID
+	c.openers[level] = opener
+	c.headerOpeners[level] = headerOpener
+	return nil
+}
 
-	return c.handshakeComplete
+// installWriteKeys 从本端的流量密钥派生并安装用于发送的密钥，调用方需持有互斥锁
+func (c *CryptoSetup) installWriteKeys(level CryptoLevel, suiteID uint16, secret []byte) error {
+	if c.discarded[level] {
+		return ErrKeysDiscarded
+	}
+	sealer, err := newPacketAEADFromSecret(suiteID, secret, c.version)
+	if err != nil {
+		return err
+	}
+	headerSealer, err := newHeaderProtectorFromSecret(suiteID, secret, c.version)
+	if err != nil {
+		return err
+	}
+	switch level {
+	case LevelHandshake:
+		c.handshakeWriteSecret = append([]byte{}, secret...)
+	case LevelOneRTT:
+		c.setOneRTTWriteSecret(suiteID, secret)
+	}
+	c.suites[level] = suiteID
+	c.sealers[level] = sealer
+	c.headerSealers[level] = headerSealer
+	return nil
 }
 
-// GetCurrentLevel 获取当前加密级别
-func (c *CryptoSetup) GetCurrentLevel() CryptoLevel {
+// HasKeys 检查指定加密级别是否已经安装了任一方向的包保护密钥。
+// 安装密钥之后该级别的数据包不再以明文收发，缺少某个方向的密钥时收发失败
+func (c *CryptoSetup) HasKeys(level CryptoLevel) bool {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
-	return c.level
+	return int(level) < numLevels && (c.sealers[level] != nil || c.openers[level] != nil)
 }
 
-// GetCryptoData 获取指定加密级别的加密数据
-func (c *CryptoSetup) GetCryptoData(level CryptoLevel) []byte {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-
-	// 检查TLS配置是否有效
-	if c.tlsConfig == nil {
-		return nil
+// DiscardKeys 丢弃指定加密级别两个方向的密钥，见RFC 9001第4.9节：客户端发送第一个Handshake包、
+// 服务端第一次成功处理Handshake包后丢弃Initial密钥，握手确认后丢弃Handshake密钥。
+// 丢弃之后该级别的密钥不再安装，收发数据包返回ErrKeysDiscarded。1-RTT密钥不能丢弃
+func (c *CryptoSetup) DiscardKeys(level CryptoLevel) {
+	if int(level) >= numLevels || level == LevelOneRTT {
+		return
 	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// 根据加密级别生成相应的握手数据
+	c.discarded[level] = true
+	c.sealers[level] = nil
+	c.openers[level] = nil
+	c.headerSealers[level] = nil
+	c.headerOpeners[level] = nil
 	switch level {
 	case LevelInitial:
-		// 使用TLS 1.3的初始密钥
-		return c.generateInitialSecrets()
+		c.initialConnID = nil
+		c.nextInitial = nil
 	case LevelHandshake:
-		// 使用TLS 1.3的握手密钥
-		return c.generateHandshakeSecrets()
-	case LevelOneRTT:
-		// 使用TLS 1.3的应用数据密钥
-		return c.generateApplicationSecrets()
-	default:
-		return nil
+		c.handshakeReadSecret = nil
+		c.handshakeWriteSecret = nil
 	}
 }
 
-// UpdateSessionTicket 更新会话票据
-func (c *CryptoSetup) UpdateSessionTicket(ticket []byte) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// KeysDiscarded 检查指定加密级别的密钥是否已经丢弃
+func (c *CryptoSetup) KeysDiscarded(level CryptoLevel) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	if !c.handshakeComplete {
-		return fmt.Errorf("握手未完成，无法更新会话票据")
-	}
+	return int(level) < numLevels && c.discarded[level]
+}
 
-	c.sessionTicket = ticket
-	return nil
+// Overhead 返回指定加密级别加密后负载增加的长度，未安装密钥时为0
+func (c *CryptoSetup) Overhead(level CryptoLevel) int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if int(level) >= numLevels || c.sealers[level] == nil {
+		return 0
+	}
+	return c.sealers[level].Overhead()
 }
 
-// CompleteOneRTT 完成1-RTT握手
-func (c *CryptoSetup) CompleteOneRTT() ([]byte, error) {
+// Seal 使用指定加密级别的密钥加密数据包负载，header作为附加数据。
+// 1-RTT包头的密钥阶段位需要与KeyPhase一致；当前密钥达到机密性上限时返回AEAD_LIMIT_REACHED
+func (c *CryptoSetup) Seal(level CryptoLevel, dst, payload []byte, pn protocol.PacketNumber, header []byte) ([]byte, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	// 验证TLS配置和握手状态
-	if c.tlsConfig == nil || c.tlsConfig.Rand == nil || !c.handshakeComplete {
-		return nil, fmt.Errorf("无效的TLS配置或握手未完成")
+	if err := c.checkKeys(level, c.sealers[:]); err != nil {
+		return nil, err
 	}
-
-	// 根据QUIC规范生成会话票据
-	ticket := make([]byte, 32)
-	if _, err := c.tlsConfig.Rand.Read(ticket); err != nil {
-		return nil, fmt.Errorf("生成会话票据失败: %v", err)
+	if err := c.checkConfidentialityLimit(level); err != nil {
+		return nil, err
 	}
-
-	// 使用握手数据和会话票据派生最终的会话密钥
-	info := append([]byte("tls13 resumption "), c.handshakeData...)
-	ticketKey := hkdfExtract(info, ticket)
-
-	// 保存会话票据
-	c.sessionTicket = ticket
-
-	return ticketKey, nil
+	if level == LevelOneRTT {
+		sealed, err := c.sealOneRTT(dst, payload, pn, header)
+		if err != nil {
+			return nil, err
+		}
+		c.packetsSealed[level]++
+		return sealed, nil
+	}
+	c.packetsSealed[level]++
+	return c.sealers[level].Seal(dst, payload, pn, header), nil
 }
 
-// TryZeroRTT 尝试0-RTT连接
-func (c *CryptoSetup) TryZeroRTT(ticketID []byte) (bool, []byte) {
+// Open 使用指定加密级别的密钥解密并认证数据包负载。
+// 1-RTT数据包根据去除头部保护后的密钥阶段位选择密钥；认证失败的数据包超过完整性上限时返回AEAD_LIMIT_REACHED
+func (c *CryptoSetup) Open(level CryptoLevel, dst, payload []byte, pn protocol.PacketNumber, header []byte) ([]byte, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	// 验证会话票据和握手数据
-	if len(ticketID) == 0 || c.handshakeData == nil {
-		return false, nil
+	if err := c.checkKeys(level, c.openers[:]); err != nil {
+		return nil, err
 	}
-
-	// 检查是否已被拒绝
-	if c.zeroRTTRejected {
-		return false, nil
+	var plaintext []byte
+	var err error
+	if level == LevelOneRTT {
+		plaintext, err = c.openOneRTT(dst, payload, pn, header)
+	} else {
+		plaintext, err = c.openers[level].Open(dst, payload, pn, header)
 	}
-
-	// 反重放保护：检查时间戳和计数器
-	ticketKey := string(ticketID)
-	timestamp := time.Now().Unix()
-	if lastUsed, exists := c.zeroRTTReplayWindow[ticketKey]; exists {
-		// 检查时间窗口（10秒内的重放）
-		if timestamp-lastUsed < 10 {
-			return false, nil
-		}
+	if err != nil {
+		return nil, c.onOpenFailed(level, err)
 	}
+	return plaintext, nil
+}
 
-	// 更新重放窗口
-	c.zeroRTTReplayWindow[ticketKey] = timestamp
-
-	// 根据QUIC规范生成0-RTT密钥
-	info := append([]byte("tls13 0-rtt "), c.handshakeData...)
-	zeroRTTKey := hkdfExtract(info, ticketID)
-
-	// 验证密钥有效性
-	if len(zeroRTTKey) == 0 {
-		return false, nil
+// checkKeys 检查指定加密级别的包保护密钥可用，keys为sealers或openers。调用方需持有互斥锁
+func (c *CryptoSetup) checkKeys(level CryptoLevel, keys []*PacketAEAD) error {
+	if int(level) >= numLevels {
+		return ErrKeysNotYetAvailable
+	}
+	if c.discarded[level] {
+		return ErrKeysDiscarded
 	}
+	if keys[level] == nil {
+		return ErrKeysNotYetAvailable
+	}
+	return nil
+}
 
-	// 保存0-RTT密钥和回退数据
-	c.zeroRTTKey = zeroRTTKey
-	c.zeroRTTFallbackData = c.handshakeData
+// EncryptHeader 使用指定加密级别的头部保护密钥掩盖首字节和包序号
+func (c *CryptoSetup) EncryptHeader(level CryptoLevel, sample []byte, firstByte *byte, pnBytes []byte) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	return true, zeroRTTKey
+	if int(level) < numLevels && c.discarded[level] {
+		return ErrKeysDiscarded
+	}
+	if int(level) >= numLevels || c.headerSealers[level] == nil {
+		return ErrKeysNotYetAvailable
+	}
+	return c.headerSealers[level].EncryptHeader(sample, firstByte, pnBytes)
 }
 
-// SetZeroRTTKey 设置0-RTT密钥
-func (c *CryptoSetup) SetZeroRTTKey(key []byte) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// DecryptHeader 使用指定加密级别的头部保护密钥去除首字节和包序号的掩码
+func (c *CryptoSetup) DecryptHeader(level CryptoLevel, sample []byte, firstByte *byte, pnBytes []byte) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	// 验证密钥的有效性
-	if key == nil {
-		return fmt.Errorf("无效的0-RTT密钥")
+	if int(level) < numLevels && c.discarded[level] {
+		return ErrKeysDiscarded
 	}
-
-	// 存储0-RTT密钥
-	c.zeroRTTKey = key
-	return nil
+	if int(level) >= numLevels || c.headerOpeners[level] == nil {
+		return ErrKeysNotYetAvailable
+	}
+	return c.headerOpeners[level].DecryptHeader(sample, firstByte, pnBytes)
 }
 
-// generateInitialSecrets 生成初始密钥
-func (c *CryptoSetup) generateInitialSecrets() []byte {
-	// 使用QUIC版本1的标准初始盐值
-	initialSalt := []byte{0x38, 0x76, 0x2C, 0xF7, 0xF5, 0x59, 0x34, 0xB3, 0x4D, 0x17, 0x2A, 0x14, 0x48, 0x9B, 0x7C, 0xD1, 0xF4, 0x3E, 0x5A, 0x8B}
+// HandleCryptoFrame 处理按序重组后的CRYPTO数据，交给TLS握手处理。
+// 握手产生的待发送数据通过GetCryptoData获取，未启动握手时只记录数据
+func (c *CryptoSetup) HandleCryptoFrame(data []byte, level CryptoLevel) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	if c.tlsConfig == nil {
+	// 对端可能重传已经离开的加密级别的CRYPTO数据，直接丢弃，见RFC 9000第7.5节
+	if level < c.level {
 		return nil
 	}
 
-	// 使用8字节长度的连接ID，符合QUIC规范
-	connID := make([]byte, 8)
-	if _, err := c.tlsConfig.Rand.Read(connID); err != nil {
+	if level == LevelInitial && c.perspective == protocol.PerspectiveServer {
+		c.recordClientHello(data)
+	}
+	if c.tlsConn == nil {
 		return nil
 	}
-
-	// 使用HKDF-Extract生成初始密钥
-	initialSecret := hkdfExtract(initialSalt, connID)
-	return initialSecret
+	if level == LevelInitial {
+		c.recordClientRandom(c.clientHello)
+	}
+	if err := c.tlsConn.HandleData(levelToTLS(level), data); err != nil {
+		return tlsError(err)
+	}
+	return c.processEvents()
 }
 
-// generateHandshakeSecrets 生成握手密钥
-func (c *CryptoSetup) generateHandshakeSecrets() []byte {
-	if c.tlsConfig == nil || c.handshakeData == nil {
-		return nil
+// recordClientHello 记录服务端在Initial级别收到的数据，直到得到完整的第一条握手消息。调用方需持有互斥锁
+func (c *CryptoSetup) recordClientHello(data []byte) {
+	if n, ok := handshakeMessageLen(c.clientHello); ok && len(c.clientHello) >= n {
+		return
+	}
+	c.clientHello = append(c.clientHello, data...)
+	if n, ok := handshakeMessageLen(c.clientHello); ok && len(c.clientHello) > n {
+		c.clientHello = c.clientHello[:n]
 	}
+}
 
-	// 验证握手数据长度
-	if len(c.handshakeData) < 64 {
-		return nil
+// handshakeMessageLen 根据TLS握手消息的头部（类型1字节、长度3字节）返回整条消息的长度，头部不完整时返回false
+func handshakeMessageLen(b []byte) (int, bool) {
+	if len(b) < 4 {
+		return 0, false
 	}
+	return 4 + (int(b[1])<<16 | int(b[2])<<8 | int(b[3])), true
+}
 
-	// 按照TLS 1.3标准提取密钥材料
-	clientRandom := c.handshakeData[:32]
-	serverRandom := c.handshakeData[32:64]
-	keyMaterial := append(clientRandom, serverRandom...)
+// SetHandshakeComplete 设置握手完成状态，客户端收到HANDSHAKE_DONE帧后握手得到确认
+func (c *CryptoSetup) SetHandshakeComplete() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// 使用TLS 1.3的密钥派生函数生成握手密钥
-	handshakeContext := sha256.Sum256(keyMaterial)
-	handshakeSecret := hkdfExtract(handshakeContext[:], []byte("tls13 hs"))
+	c.handshakeComplete = true
+	c.handshakeConfirmed = true
+	c.level = LevelOneRTT
+}
 
-	// 派生客户端握手流量密钥
-	clientLabel := []byte("tls13 quic client hs")
-	clientHandshakeSecret := hkdfExtract(handshakeSecret, clientLabel)
-	clientTrafficSecret := hkdfExtract(clientHandshakeSecret, []byte("key"))
+// HandshakeComplete 检查握手是否完成
+func (c *CryptoSetup) HandshakeComplete() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	// 派生服务端握手流量密钥
-	serverLabel := []byte("tls13 quic server hs")
-	serverHandshakeSecret := hkdfExtract(handshakeSecret, serverLabel)
-	serverTrafficSecret := hkdfExtract(serverHandshakeSecret, []byte("key"))
+	return c.handshakeComplete
+}
 
-	// 根据当前角色返回相应的密钥
-	if c.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
-		return serverTrafficSecret // 作为服务端
-	}
-	return clientTrafficSecret // 作为客户端
+// GetCurrentLevel 获取当前加密级别
+func (c *CryptoSetup) GetCurrentLevel() CryptoLevel {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.level
 }
 
-// generateApplicationSecrets 生成应用数据密钥
-func (c *CryptoSetup) generateApplicationSecrets() []byte {
-	if !c.handshakeComplete || c.handshakeData == nil {
-		return nil
-	}
+// GetCryptoData 取出TLS握手产生的指定加密级别待发送的数据，没有数据时返回nil
+func (c *CryptoSetup) GetCryptoData(level CryptoLevel) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// 验证握手数据长度
-	if len(c.handshakeData) < 96 {
+	if int(level) >= numLevels {
 		return nil
 	}
-
-	// 从握手数据中提取TLS主密钥
-	handshakeTrafficSecret := c.handshakeData[:32]
-
-	// 使用HKDF-Expand-Label派生应用数据密钥
-	appSecret := hkdfExpandLabel(handshakeTrafficSecret, []byte("tls13 quic app"), nil, 32)
-
-	// 派生QUIC应用数据流量密钥
-	trafficSecret := hkdfExpandLabel(appSecret, []byte("quic traffic"), nil, 32)
-	return trafficSecret
+	data := c.cryptoData[level]
+	c.cryptoData[level] = nil
+	return data
 }
 
-// hkdfExpandLabel 实现HKDF-Expand-Label函数
-func hkdfExpandLabel(secret, label []byte, context []byte, length uint16) []byte {
-	// 构造HKDF标签
-	var hkdfLabel []byte
-	// 添加长度（2字节）
-	hkdfLabel = append(hkdfLabel, byte(length>>8), byte(length))
-	// 添加标签长度（1字节）
-	hkdfLabel = append(hkdfLabel, byte(len(label)))
-	// 添加标签
-	hkdfLabel = append(hkdfLabel, label...)
-	// 添加上下文长度（1字节）
-	hkdfLabel = append(hkdfLabel, byte(len(context)))
-	// 添加上下文（如果有）
-	if context != nil {
-		hkdfLabel = append(hkdfLabel, context...)
-	}
-
-	// 使用HMAC-SHA256作为哈希函数
-	h := hmac.New(sha256.New, secret)
-
-	// 输出密钥材料
-	output := make([]byte, 0, length)
-	counter := byte(1)
-	for len(output) < int(length) {
-		h.Reset()
-		h.Write([]byte{counter})
-		h.Write(hkdfLabel)
-		output = append(output, h.Sum(nil)...)
-		counter++
-	}
-
-	return output[:length]
-}
+// SetAntiReplay 设置0-RTT反重放保护，服务器的所有连接应使用同一个实例
+func (c *CryptoSetup) SetAntiReplay(antiReplay AntiReplay) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-// hkdfExtract 实现HKDF-Extract函数
-func hkdfExtract(salt, ikm []byte) []byte {
-	// 使用crypto/tls包中的标准HKDF-Extract实现
-	h := hmac.New(sha256.New, salt)
-	h.Write(ikm)
-	return h.Sum(nil)
+	c.antiReplay = antiReplay
 }
@@ -2,9 +2,29 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"LQUIC/internal/protocol"
 )
 
 func TestNewCryptoSetup(t *testing.T) {
@@ -12,7 +32,7 @@ func TestNewCryptoSetup(t *testing.T) {
 	tlsConfig := &tls.Config{}
 
 	// 创建CryptoSetup实例
-	cs := NewCryptoSetup(tlsConfig)
+	cs := NewCryptoSetup(tlsConfig, protocol.PerspectiveClient)
 
 	// 验证初始状态
 	if cs.tlsConfig != tlsConfig {
@@ -24,54 +44,55 @@ func TestNewCryptoSetup(t *testing.T) {
 	if cs.handshakeComplete {
 		t.Error("初始握手状态应为false")
 	}
-	if len(cs.handshakeData) != 0 {
+	if len(cs.clientHello) != 0 {
 		t.Error("初始握手数据应为空")
 	}
-	if len(cs.sessionTicket) != 0 {
-		t.Error("初始会话票据应为空")
-	}
-	if len(cs.zeroRTTKey) != 0 {
-		t.Error("初始0-RTT密钥应为空")
-	}
 }
 
 func TestHandleCryptoFrame(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+	cs := NewCryptoSetup(nil, protocol.PerspectiveServer)
 
-	// 测试处理Initial级别数据
-	data := []byte("test data")
-	err := cs.HandleCryptoFrame(data, LevelInitial)
-	if err != nil {
+	// 服务端记录Initial级别的第一条握手消息，消息可能分多次到达
+	hello := []byte{1, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	if err := cs.HandleCryptoFrame(hello[:3], LevelInitial); err != nil {
 		t.Errorf("处理Initial级别数据失败: %v", err)
 	}
+	if err := cs.HandleCryptoFrame(hello[3:], LevelInitial); err != nil {
+		t.Errorf("处理Initial级别数据失败: %v", err)
+	}
+	if !bytes.Equal(cs.clientHello, hello) {
+		t.Errorf("ClientHello保存错误，期望%v，实际%v", hello, cs.clientHello)
+	}
 
-	// 验证数据是否正确保存
-	if !bytes.Equal(cs.handshakeData, data) {
-		t.Errorf("握手数据保存错误，期望%v，实际%v", data, cs.handshakeData)
+	// 消息完整之后的数据和其他加密级别的数据不再累积
+	if err := cs.HandleCryptoFrame([]byte("additional data"), LevelInitial); err != nil {
+		t.Errorf("处理Initial级别数据失败: %v", err)
+	}
+	if err := cs.HandleCryptoFrame([]byte("handshake data"), LevelHandshake); err != nil {
+		t.Errorf("处理Handshake级别数据失败: %v", err)
+	}
+	if !bytes.Equal(cs.clientHello, hello) {
+		t.Errorf("ClientHello之后的数据不应被记录，实际%v", cs.clientHello)
 	}
 
-	// 测试处理过期的加密级别
+	// 重传的过期加密级别数据直接丢弃，不作为错误
 	cs.level = LevelHandshake
-	err = cs.HandleCryptoFrame(data, LevelInitial)
-	if err == nil {
-		t.Error("处理过期加密级别应该返回错误")
+	if err := cs.HandleCryptoFrame([]byte("retransmitted"), LevelInitial); err != nil {
+		t.Errorf("过期加密级别的数据应被丢弃，实际返回错误: %v", err)
 	}
 
-	// 测试追加数据
-	newData := []byte("additional data")
-	err = cs.HandleCryptoFrame(newData, LevelHandshake)
-	if err != nil {
-		t.Errorf("追加握手数据失败: %v", err)
+	// 客户端不记录对端的握手数据
+	client := NewCryptoSetup(nil, protocol.PerspectiveClient)
+	if err := client.HandleCryptoFrame(hello, LevelInitial); err != nil {
+		t.Errorf("处理Initial级别数据失败: %v", err)
 	}
-
-	expectedData := append(data, newData...)
-	if !bytes.Equal(cs.handshakeData, expectedData) {
-		t.Errorf("握手数据追加错误，期望%v，实际%v", expectedData, cs.handshakeData)
+	if len(client.clientHello) != 0 {
+		t.Errorf("客户端不应记录握手数据，实际%v", client.clientHello)
 	}
 }
 
 func TestSetHandshakeComplete(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+	cs := NewCryptoSetup(nil, protocol.PerspectiveClient)
 
 	// 设置握手完成
 	cs.SetHandshakeComplete()
@@ -86,7 +107,7 @@ func TestSetHandshakeComplete(t *testing.T) {
 }
 
 func TestHandshakeComplete(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+	cs := NewCryptoSetup(nil, protocol.PerspectiveClient)
 
 	// 初始状态应为未完成
 	if cs.HandshakeComplete() {
@@ -103,7 +124,7 @@ func TestHandshakeComplete(t *testing.T) {
 }
 
 func TestGetCurrentLevel(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+	cs := NewCryptoSetup(nil, protocol.PerspectiveClient)
 
 	// 验证初始级别
 	if cs.GetCurrentLevel() != LevelInitial {
@@ -118,167 +139,1825 @@ func TestGetCurrentLevel(t *testing.T) {
 }
 
 func TestGetCryptoData(t *testing.T) {
-	// 创建带有TLS配置的CryptoSetup实例
-	tlsConfig := &tls.Config{
-		ClientSessionCache: tls.NewLRUClientSessionCache(10),
-		Rand:               rand.Reader,
+	clientConfig, _ := newTestTLSConfigs(t)
+
+	// 未配置TLS时无法开始握手
+	if err := NewCryptoSetup(nil, protocol.PerspectiveClient).StartHandshake(); err == nil {
+		t.Error("缺少TLS配置时应返回错误")
 	}
-	cs := NewCryptoSetup(tlsConfig)
 
-	// 测试无效的TLS配置
-	cs.tlsConfig = nil
+	cs := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
 	if data := cs.GetCryptoData(LevelInitial); data != nil {
-		t.Error("无效TLS配置应返回nil")
+		t.Error("握手开始前不应有待发送数据")
+	}
+	if err := cs.StartHandshake(); err != nil {
+		t.Fatalf("开始握手失败: %v", err)
+	}
+	// 尚未设置传输参数时握手暂停，设置后产生ClientHello
+	if !cs.TransportParametersRequired() || cs.GetCryptoData(LevelInitial) != nil {
+		t.Fatal("未设置传输参数时应等待传输参数")
+	}
+	if err := cs.SetTransportParameters([]byte{0x0f, 0x00}); err != nil {
+		t.Fatalf("设置传输参数失败: %v", err)
+	}
+	if cs.TransportParametersRequired() {
+		t.Error("设置传输参数后不应继续等待")
+	}
+	if err := cs.StartHandshake(); err == nil {
+		t.Error("重复开始握手应返回错误")
 	}
 
-	// 恢复TLS配置
-	cs.tlsConfig = tlsConfig
-
-	// 测试初始密钥生成
+	// 客户端开始握手后产生Initial级别的ClientHello
 	initialData := cs.GetCryptoData(LevelInitial)
-	if initialData == nil {
-		t.Error("初始密钥生成失败")
+	if len(initialData) == 0 || initialData[0] != 1 {
+		t.Fatalf("应产生ClientHello，实际%x", initialData)
+	}
+	if data := cs.GetCryptoData(LevelInitial); data != nil {
+		t.Error("待发送数据取出后应被清空")
 	}
-
-	// 测试握手密钥生成（数据不足）
 	if data := cs.GetCryptoData(LevelHandshake); data != nil {
-		t.Error("握手数据不足时应返回nil")
+		t.Error("Handshake级别不应有待发送数据")
 	}
 
-	// 设置足够的握手数据
-	cs.handshakeData = make([]byte, 64)
-	handshakeData := cs.GetCryptoData(LevelHandshake)
-	if handshakeData == nil {
-		t.Error("握手密钥生成失败")
+	// 测试无效的加密级别
+	if data := cs.GetCryptoData(CryptoLevel(99)); data != nil {
+		t.Error("无效加密级别应返回nil")
 	}
+}
 
-	// 测试应用数据密钥生成（握手未完成）
-	if data := cs.GetCryptoData(LevelOneRTT); data != nil {
-		t.Error("握手未完成时应返回nil")
+// newTestTLSConfigs 生成使用自签名证书的客户端和服务端TLS配置
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
 	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
 
-	// 完成握手并设置足够的数据
-	cs.handshakeData = make([]byte, 96)
-	cs.SetHandshakeComplete()
-	appData := cs.GetCryptoData(LevelOneRTT)
-	if appData == nil {
-		t.Error("应用数据密钥生成失败")
+		BasicConstraintsValid: true,
 	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("解析证书失败: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
 
-	// 测试无效的加密级别
-	if data := cs.GetCryptoData(CryptoLevel(99)); data != nil {
-		t.Error("无效加密级别应返回nil")
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: roots}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return clientConfig, serverConfig
+}
+
+// exchangeCryptoData 在两端之间传递握手数据，直到没有新的数据产生。
+// 握手等待传输参数时提供空的传输参数
+func exchangeCryptoData(client, server *CryptoSetup) error {
+	for progressed := true; progressed; {
+		progressed = false
+		for _, pair := range [][2]*CryptoSetup{{client, server}, {server, client}} {
+			if pair[0].TransportParametersRequired() {
+				if err := pair[0].SetTransportParameters([]byte{}); err != nil {
+					return err
+				}
+			}
+			for level := LevelInitial; level <= LevelOneRTT; level++ {
+				data := pair[0].GetCryptoData(level)
+				if len(data) == 0 {
+					continue
+				}
+				progressed = true
+				if err := pair[1].HandleCryptoFrame(data, level); err != nil {
+					return err
+				}
+			}
+		}
 	}
+	return nil
 }
 
-func TestUpdateSessionTicket(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+func TestTLSHandshake(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	if err := client.StartHandshake(); err != nil {
+		t.Fatalf("客户端开始握手失败: %v", err)
+	}
+	if err := server.StartHandshake(); err != nil {
+		t.Fatalf("服务端开始握手失败: %v", err)
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+
+	if !client.HandshakeComplete() || !server.HandshakeComplete() {
+		t.Fatal("双方都应完成握手")
+	}
+	if !client.IsClient() || server.IsClient() {
+		t.Error("握手角色错误")
+	}
+	for _, level := range []CryptoLevel{LevelHandshake, LevelOneRTT} {
+		if !client.HasKeys(level) || !server.HasKeys(level) {
+			t.Errorf("加密级别%d的密钥未安装", level)
+		}
+	}
+	if state := client.ConnectionState(); !state.HandshakeComplete || len(state.PeerCertificates) != 1 {
+		t.Error("客户端应验证服务端证书")
+	}
 
-	// 测试握手未完成时更新会话票据
-	ticket := []byte("test ticket")
-	err := cs.UpdateSessionTicket(ticket)
-	if err == nil {
-		t.Error("握手未完成时应返回错误")
+	// 握手得到的1-RTT密钥可以互相解密
+	header := []byte{0x40, 1, 2, 3, 4}
+	sealed, err := client.Seal(LevelOneRTT, nil, []byte("application data"), 0, header)
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
 	}
+	opened, err := server.Open(LevelOneRTT, nil, sealed, 0, header)
+	if err != nil || string(opened) != "application data" {
+		t.Fatalf("解密失败: %v", err)
+	}
+}
 
-	// 完成握手
-	cs.SetHandshakeComplete()
+func TestTransportParametersExchange(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	clientParams := []byte{0x0f, 0x01, 0xaa}
+	serverParams := []byte{0x0f, 0x01, 0xbb}
+	if err := client.SetTransportParameters(clientParams); err != nil {
+		t.Fatalf("设置客户端传输参数失败: %v", err)
+	}
+	if err := client.StartHandshake(); err != nil {
+		t.Fatalf("客户端开始握手失败: %v", err)
+	}
+	if err := server.StartHandshake(); err != nil {
+		t.Fatalf("服务端开始握手失败: %v", err)
+	}
 
-	// 测试更新会话票据
-	err = cs.UpdateSessionTicket(ticket)
+	// 服务端收到ClientHello后暂停，等待本端的传输参数
+	if err := server.HandleCryptoFrame(client.GetCryptoData(LevelInitial), LevelInitial); err != nil {
+		t.Fatalf("处理ClientHello失败: %v", err)
+	}
+	if !server.TransportParametersRequired() {
+		t.Fatal("服务端应等待传输参数")
+	}
+	if !bytes.Equal(server.PeerTransportParameters(), clientParams) {
+		t.Errorf("服务端收到的传输参数错误: %x", server.PeerTransportParameters())
+	}
+	if data := server.GetCryptoData(LevelHandshake); data != nil {
+		t.Error("设置传输参数之前不应发送EncryptedExtensions")
+	}
+	if err := server.SetTransportParameters(serverParams); err != nil {
+		t.Fatalf("设置服务端传输参数失败: %v", err)
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+	if !client.HandshakeComplete() || !server.HandshakeComplete() {
+		t.Fatal("双方都应完成握手")
+	}
+	if !bytes.Equal(client.PeerTransportParameters(), serverParams) {
+		t.Errorf("客户端收到的传输参数错误: %x", client.PeerTransportParameters())
+	}
+}
+
+func TestStatelessResetGenerator(t *testing.T) {
+	if _, err := NewStatelessResetGenerator(make([]byte, 16)); err == nil {
+		t.Error("密钥长度错误时应返回错误")
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	g1, err := NewStatelessResetGenerator(key)
 	if err != nil {
-		t.Errorf("更新会话票据失败: %v", err)
+		t.Fatalf("创建生成器失败: %v", err)
 	}
-	if !bytes.Equal(cs.sessionTicket, ticket) {
-		t.Errorf("会话票据设置错误，期望%v，实际%v", ticket, cs.sessionTicket)
+	g2, _ := NewStatelessResetGenerator(key)
+	random, _ := NewStatelessResetGenerator(nil)
+
+	connID := protocol.ConnectionID{1, 2, 3, 4}
+	// 相同密钥对同一连接ID生成相同的令牌，不同连接ID或密钥的令牌不同
+	if g1.Token(connID) != g2.Token(connID) {
+		t.Error("相同密钥应生成相同的令牌")
+	}
+	if g1.Token(connID) == g1.Token(protocol.ConnectionID{1, 2, 3, 5}) {
+		t.Error("不同连接ID的令牌应不同")
+	}
+	if g1.Token(connID) == random.Token(connID) {
+		t.Error("不同密钥的令牌应不同")
 	}
 }
 
-func TestCompleteOneRTT(t *testing.T) {
-	// 创建带有TLS配置的CryptoSetup实例
-	tlsConfig := &tls.Config{
-		ClientSessionCache: tls.NewLRUClientSessionCache(10),
-		Rand:               rand.Reader,
+func TestTLSHandshakeCertificateError(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	// 客户端不信任服务端的自签名证书
+	clientConfig.RootCAs = x509.NewCertPool()
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	if err := client.StartHandshake(); err != nil {
+		t.Fatalf("客户端开始握手失败: %v", err)
+	}
+	if err := server.StartHandshake(); err != nil {
+		t.Fatalf("服务端开始握手失败: %v", err)
 	}
-	cs := NewCryptoSetup(tlsConfig)
 
-	// 测试无效的TLS配置
-	cs.tlsConfig = nil
-	_, err := cs.CompleteOneRTT()
-	if err == nil {
-		t.Error("无效TLS配置应返回错误")
+	err := exchangeCryptoData(client, server)
+	var transportErr *protocol.TransportError
+	if !errors.As(err, &transportErr) || transportErr.Code < protocol.CryptoErrorBase {
+		t.Fatalf("证书验证失败应返回CRYPTO_ERROR，实际%v", err)
 	}
+	if client.HandshakeComplete() {
+		t.Error("证书验证失败时握手不应完成")
+	}
+}
 
-	// 恢复TLS配置
-	cs.tlsConfig = tlsConfig
+func TestSessionResumption(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	clientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	serverConfig.SetSessionTicketKeys([][32]byte{{1}})
 
-	// 设置握手数据并完成握手
-	cs.handshakeData = make([]byte, 96)
-	cs.SetHandshakeComplete()
+	handshake := func() (*CryptoSetup, *CryptoSetup) {
+		t.Helper()
+		client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+		server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+		if err := client.StartHandshake(); err != nil {
+			t.Fatalf("客户端开始握手失败: %v", err)
+		}
+		if err := server.StartHandshake(); err != nil {
+			t.Fatalf("服务端开始握手失败: %v", err)
+		}
+		if err := exchangeCryptoData(client, server); err != nil {
+			t.Fatalf("握手失败: %v", err)
+		}
+		return client, server
+	}
+
+	// 服务端在握手完成后通过crypto/tls签发会话票据，客户端保存到会话缓存
+	client, server := handshake()
+	if client.ConnectionState().DidResume || server.ConnectionState().DidResume {
+		t.Fatal("首次握手不应恢复会话")
+	}
+	if _, ok := clientConfig.ClientSessionCache.Get(clientConfig.ServerName); !ok {
+		t.Fatal("握手完成后客户端应保存会话票据")
+	}
+
+	// 使用保存的票据恢复会话，恢复的会话同样得到可以互相解密的1-RTT密钥
+	client, server = handshake()
+	if !client.ConnectionState().DidResume || !server.ConnectionState().DidResume {
+		t.Fatal("使用保存的票据应恢复会话")
+	}
+	header := []byte{0x40, 1, 2, 3, 4}
+	sealed, err := server.Seal(LevelOneRTT, nil, []byte("resumed"), 0, header)
+	if err != nil {
+		t.Fatalf("加密失败: %v", err)
+	}
+	if opened, err := client.Open(LevelOneRTT, nil, sealed, 0, header); err != nil || string(opened) != "resumed" {
+		t.Fatalf("解密失败: %v", err)
+	}
+}
+
+func TestStrikeRegister(t *testing.T) {
+	now := time.Now().Add(time.Minute)
+	sr := NewStrikeRegister(10*time.Second, 3)
+	sr.now = func() time.Time { return now }
+
+	if !sr.Accept([]byte("a"), now) {
+		t.Fatal("首次出现的尝试应被接受")
+	}
+	if sr.Accept([]byte("a"), now.Add(time.Second)) {
+		t.Error("重放应被拒绝")
+	}
+	// 客户端时钟偏差超出窗口
+	if sr.Accept([]byte("b"), now.Add(-11*time.Second)) || sr.Accept([]byte("b"), now.Add(11*time.Second)) {
+		t.Error("客户端时间超出窗口的尝试应被拒绝")
+	}
+	// 早于创建时间的尝试可能在重启之前处理过
+	if sr.Accept([]byte("c"), time.Now().Add(-time.Second)) {
+		t.Error("早于下限的尝试应被拒绝")
+	}
+
+	// 达到上限时淘汰最旧的记录并提高下限
+	sr.Accept([]byte("b"), now.Add(-5*time.Second))
+	sr.Accept([]byte("c"), now.Add(-3*time.Second))
+	if !sr.Accept([]byte("d"), now.Add(-time.Second)) || sr.Len() != 3 {
+		t.Fatalf("达到上限时应淘汰旧记录，记录数量%d", sr.Len())
+	}
+	if sr.Accept([]byte("b"), now.Add(-5*time.Second)) {
+		t.Error("被淘汰的记录重放时应因早于下限被拒绝")
+	}
+
+	// 时间窗口过去后记录被清理
+	now = now.Add(time.Minute)
+	if !sr.Accept([]byte("e"), now) || sr.Len() != 1 {
+		t.Errorf("超出窗口的记录应被清理，记录数量%d", sr.Len())
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	now := time.Now().Add(time.Minute)
+	rf := NewReplayFilter(10*time.Second, 1000, 0)
+	rf.now = func() time.Time { return now }
+
+	if !rf.Accept([]byte("a"), now) {
+		t.Fatal("首次出现的尝试应被接受")
+	}
+	if rf.Accept([]byte("a"), now) {
+		t.Error("重放应被拒绝")
+	}
+	if rf.Accept([]byte("b"), now.Add(-11*time.Second)) {
+		t.Error("客户端时间超出窗口的尝试应被拒绝")
+	}
+
+	// 记录跨越时间桶轮换保留到客户端时间超出窗口
+	sent := now
+	for i := 1; i <= 10; i++ {
+		now = sent.Add(time.Duration(i) * time.Second)
+		if rf.Accept([]byte("a"), sent) {
+			t.Fatalf("%d秒后重放应被拒绝", i)
+		}
+	}
+
+	// 误判率接近配置值
+	accepted := 0
+	for i := 0; i < 1000; i++ {
+		if rf.Accept([]byte(fmt.Sprintf("key-%d", i)), now) {
+			accepted++
+		}
+	}
+	if accepted < 990 {
+		t.Errorf("误判过多，1000次新的尝试只接受了%d次", accepted)
+	}
+}
+
+func TestVersionParams(t *testing.T) {
+	cs := NewCryptoSetup(nil, protocol.PerspectiveClient)
+	if cs.Version() != protocol.Version1 {
+		t.Errorf("默认版本错误，实际0x%x", cs.Version())
+	}
+
+	v1 := getVersionParams(protocol.Version1)
+	v2 := getVersionParams(protocol.Version2)
+	if bytes.Equal(v1.initialSalt, v2.initialSalt) || bytes.Equal(v1.retryKey, v2.retryKey) {
+		t.Error("版本1和版本2应使用不同的初始盐值和Retry密钥")
+	}
+	if v2.keyLabel != "quicv2 key" || v2.ivLabel != "quicv2 iv" || v2.hpLabel != "quicv2 hp" || v2.kuLabel != "quicv2 ku" {
+		t.Error("版本2的HKDF标签错误")
+	}
+	if v1.keyLabel != "quic key" || v1.kuLabel != "quic ku" {
+		t.Error("版本1的HKDF标签错误")
+	}
+
+	cs.SetVersion(protocol.Version2)
+	if cs.Version() != protocol.Version2 {
+		t.Error("设置版本失败")
+	}
+}
+
+func TestRetryToken(t *testing.T) {
+	g, err := NewTokenGenerator(nil)
+	if err != nil {
+		t.Fatalf("创建令牌生成器失败: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4433}
+	origDestConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	retrySrcConnID := protocol.ConnectionID{9, 10, 11, 12}
+
+	token, err := g.NewRetryToken(addr, origDestConnID, retrySrcConnID)
+	if err != nil {
+		t.Fatalf("生成令牌失败: %v", err)
+	}
+	decoded, err := g.DecodeToken(token, addr)
+	if err != nil {
+		t.Fatalf("解密令牌失败: %v", err)
+	}
+	if !decoded.IsRetryToken || !bytes.Equal(decoded.OriginalDestConnID, origDestConnID) || !bytes.Equal(decoded.RetrySrcConnID, retrySrcConnID) {
+		t.Errorf("令牌内容错误: %+v", decoded)
+	}
+
+	// 令牌绑定客户端地址
+	other := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 4433}
+	if _, err := g.DecodeToken(token, other); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("其他地址使用令牌应该失败，实际%v", err)
+	}
+
+	// 篡改或其他密钥生成的令牌无法解密
+	token[len(token)-1] ^= 1
+	if _, err := g.DecodeToken(token, addr); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("篡改的令牌应该失败，实际%v", err)
+	}
+	other2, _ := NewTokenGenerator(nil)
+	token2, _ := other2.NewRetryToken(addr, origDestConnID, retrySrcConnID)
+	if _, err := g.DecodeToken(token2, addr); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("其他密钥生成的令牌应该失败，实际%v", err)
+	}
+
+	if _, err := NewTokenGenerator(make([]byte, 16)); err == nil {
+		t.Error("密钥长度错误时应该返回错误")
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("无效的十六进制字符串: %v", err)
+	}
+	return b
+}
+
+func TestPacketAEAD(t *testing.T) {
+	tests := []struct {
+		name       string
+		suite      uint16
+		key        string
+		iv         string
+		pn         protocol.PacketNumber
+		header     string
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			// RFC 9001附录A.3，服务端Initial包
+			name:       "AES-128-GCM",
+			suite:      tls.TLS_AES_128_GCM_SHA256,
+			key:        "cf3a5331653c364c88f0f379b6067e37",
+			iv:         "0ac1493ca1905853b0bba03e",
+			pn:         1,
+			header:     "c1000000010008f067a5502a4262b50040750001",
+			plaintext:  "02000000000600405a020000560303eefce7f7b37ba1d1632e96677825ddf73988cfc79825df566dc5430b9a045a1200130100002e00330024001d00209d3c940d89690b84d08a60993c144eca684d1081287c834d5311bcf32bb9da1a002b00020304",
+			ciphertext: "5a482cd0991cd25b0aac406a5816b6394100f37a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3bded74b562bfb19fb84022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc42158407dd074ee",
+		},
+		{
+			// RFC 9001附录A.5，ChaCha20-Poly1305短包头数据包
+			name:       "ChaCha20-Poly1305",
+			suite:      tls.TLS_CHACHA20_POLY1305_SHA256,
+			key:        "c6d98ff3441c3fe1b2182094f69caa2ed4b716b65488960a7a984979fb23e1c8",
+			iv:         "e0459b3474bdd0e44a41c144",
+			pn:         654360564,
+			header:     "4200bff4",
+			plaintext:  "01",
+			ciphertext: "655e5cd55c41f69080575d7999c25a5bfb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewPacketAEAD(tt.suite, mustDecodeHex(t, tt.key), mustDecodeHex(t, tt.iv))
+			if err != nil {
+				t.Fatalf("创建PacketAEAD失败: %v", err)
+			}
+			header := mustDecodeHex(t, tt.header)
+			ciphertext := a.Seal(nil, mustDecodeHex(t, tt.plaintext), tt.pn, header)
+			if !bytes.Equal(ciphertext, mustDecodeHex(t, tt.ciphertext)) {
+				t.Fatalf("密文错误: %x", ciphertext)
+			}
+			plaintext, err := a.Open(nil, ciphertext, tt.pn, header)
+			if err != nil || !bytes.Equal(plaintext, mustDecodeHex(t, tt.plaintext)) {
+				t.Fatalf("解密失败: %v", err)
+			}
+
+			// 包序号或头部不同时认证失败
+			if _, err := a.Open(nil, ciphertext, tt.pn+1, header); !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("包序号错误时应该解密失败，实际%v", err)
+			}
+			header[0] ^= 1
+			if _, err := a.Open(nil, ciphertext, tt.pn, header); !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("头部被篡改时应该解密失败，实际%v", err)
+			}
+		})
+	}
+
+	if _, err := NewPacketAEAD(tls.TLS_AES_256_GCM_SHA384, make([]byte, 16), make([]byte, 12)); err == nil {
+		t.Error("密钥长度与密码套件不符时应该返回错误")
+	}
+	if _, err := NewPacketAEAD(0x13ff, make([]byte, 16), make([]byte, 12)); err == nil {
+		t.Error("不支持的密码套件应该返回错误")
+	}
+}
+
+func TestInstallKeys(t *testing.T) {
+	clientSecret := bytes.Repeat([]byte{1}, 32)
+	serverSecret := bytes.Repeat([]byte{2}, 32)
+	header := []byte{0x40, 0x01}
+	payload := []byte("handshake data")
+
+	for _, suite := range []uint16{tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384, tls.TLS_CHACHA20_POLY1305_SHA256} {
+		client := NewCryptoSetup(nil, protocol.PerspectiveClient)
+		server := NewCryptoSetup(nil, protocol.PerspectiveServer)
+		if client.HasKeys(LevelHandshake) || client.Overhead(LevelHandshake) != 0 {
+			t.Fatal("未安装密钥时不应有包保护密钥")
+		}
+		if _, err := client.Seal(LevelHandshake, nil, payload, 1, header); !errors.Is(err, ErrKeysNotYetAvailable) {
+			t.Fatalf("未安装密钥时应该返回ErrKeysNotYetAvailable，实际%v", err)
+		}
+
+		if err := client.InstallKeys(LevelHandshake, suite, serverSecret, clientSecret); err != nil {
+			t.Fatalf("安装客户端密钥失败: %v", err)
+		}
+		if err := server.InstallKeys(LevelHandshake, suite, clientSecret, serverSecret); err != nil {
+			t.Fatalf("安装服务端密钥失败: %v", err)
+		}
+		if client.Overhead(LevelHandshake) != 16 {
+			t.Errorf("认证标签长度错误: %d", client.Overhead(LevelHandshake))
+		}
+
+		sealed, err := client.Seal(LevelHandshake, nil, payload, 1, header)
+		if err != nil {
+			t.Fatalf("加密失败: %v", err)
+		}
+		opened, err := server.Open(LevelHandshake, nil, sealed, 1, header)
+		if err != nil || !bytes.Equal(opened, payload) {
+			t.Fatalf("0x%04x: 解密失败: %v", suite, err)
+		}
+		// 同一端的读写密钥不同
+		if _, err := client.Open(LevelHandshake, nil, sealed, 1, header); err == nil {
+			t.Error("读写方向应使用不同的密钥")
+		}
+	}
+}
+
+func TestHeaderProtector(t *testing.T) {
+	// RFC 9001附录A中的头部保护示例
+	tests := []struct {
+		name      string
+		suite     uint16
+		hpKey     string
+		sample    string
+		firstByte byte
+		pn        string
+		protected string // 保护后的首字节和包序号
+	}{
+		{
+			name:      "客户端Initial包",
+			suite:     tls.TLS_AES_128_GCM_SHA256,
+			hpKey:     "9f50449e04a0e810283a1e9933adedd2",
+			sample:    "d1b1c98dd7689fb8ec11d242b123dc9b",
+			firstByte: 0xc3,
+			pn:        "00000002",
+			protected: "c07b9aec34",
+		},
+		{
+			name:      "服务端Initial包",
+			suite:     tls.TLS_AES_128_GCM_SHA256,
+			hpKey:     "c206b8d9b9f0f37644430b490eeaa314",
+			sample:    "2cd0991cd25b0aac406a5816b6394100",
+			firstByte: 0xc1,
+			pn:        "0001",
+			protected: "cfc0d9",
+		},
+		{
+			name:      "ChaCha20短包头",
+			suite:     tls.TLS_CHACHA20_POLY1305_SHA256,
+			hpKey:     "25a282b9e82f06f21f488917a4fc8f1b73573685608597d0efcb076b0ab7a7a4",
+			sample:    "5e5cd55c41f69080575d7999c25a5bfb",
+			firstByte: 0x42,
+			pn:        "00bff4",
+			protected: "4cfe4189",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hp, err := NewHeaderProtector(tt.suite, mustDecodeHex(t, tt.hpKey))
+			if err != nil {
+				t.Fatalf("创建头部保护失败: %v", err)
+			}
+			sample := mustDecodeHex(t, tt.sample)
+			firstByte, pn := tt.firstByte, mustDecodeHex(t, tt.pn)
+			if err := hp.EncryptHeader(sample, &firstByte, pn); err != nil {
+				t.Fatalf("添加头部保护失败: %v", err)
+			}
+			if got := hex.EncodeToString(append([]byte{firstByte}, pn...)); got != tt.protected {
+				t.Fatalf("保护后的头部错误: %s", got)
+			}
+
+			// 接收方传入包序号偏移处的4个字节，只有实际的包序号被还原
+			pnBytes := append(pn, 0xaa, 0xbb, 0xcc, 0xdd)[:4]
+			if err := hp.DecryptHeader(sample, &firstByte, pnBytes); err != nil {
+				t.Fatalf("去除头部保护失败: %v", err)
+			}
+			want := append(mustDecodeHex(t, tt.pn), 0xaa, 0xbb, 0xcc, 0xdd)[:4]
+			if firstByte != tt.firstByte || !bytes.Equal(pnBytes, want) {
+				t.Errorf("去除保护后的头部错误: %x %x", firstByte, pnBytes)
+			}
+		})
+	}
+
+	if _, err := NewHeaderProtector(tls.TLS_AES_128_GCM_SHA256, make([]byte, 32)); err == nil {
+		t.Error("密钥长度错误时应该返回错误")
+	}
+	hp, _ := NewHeaderProtector(tls.TLS_AES_128_GCM_SHA256, make([]byte, 16))
+	var firstByte byte = 0x40
+	if err := hp.EncryptHeader(make([]byte, 8), &firstByte, make([]byte, 4)); err == nil {
+		t.Error("采样长度错误时应该返回错误")
+	}
+}
+
+func TestInitialSecrets(t *testing.T) {
+	// RFC 9001附录A.1和RFC 9369附录A.1中的Initial密钥
+	destConnID := protocol.ConnectionID(mustDecodeHex(t, "8394c8f03e515708"))
+	type keys struct {
+		secret, key, iv, hp string
+	}
+	tests := []struct {
+		name           string
+		version        uint32
+		client, server keys
+	}{
+		{
+			name:    "版本1",
+			version: protocol.Version1,
+			client: keys{
+				secret: "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+				key:    "1f369613dd76d5467730efcbe3b1a22d",
+				iv:     "fa044b2f42a3fd3b46fb255c",
+				hp:     "9f50449e04a0e810283a1e9933adedd2",
+			},
+			server: keys{
+				secret: "3c199828fd139efd216c155ad844cc81fb82fa8d7446fa7d78be803acdda951b",
+				key:    "cf3a5331653c364c88f0f379b6067e37",
+				iv:     "0ac1493ca1905853b0bba03e",
+				hp:     "c206b8d9b9f0f37644430b490eeaa314",
+			},
+		},
+		{
+			name:    "版本2",
+			version: protocol.Version2,
+			client: keys{
+				secret: "14ec9d6eb9fd7af83bf5a668bc17a7e283766aade7ecd0891f70f9ff7f4bf47b",
+				key:    "8b1a0bc121284290a29e0971b5cd045d",
+				iv:     "91f73e2351d8fa91660e909f",
+				hp:     "45b95e15235d6f45a6b19cbcb0294ba9",
+			},
+			server: keys{
+				secret: "0263db1782731bf4588e7e4d93b7463907cb8cd8200b5da55a8bd488eafc37c1",
+				key:    "82db637861d55e1d011f19ea71d5d2a7",
+				iv:     "dd13c276499c0249d3310652",
+				hp:     "edf6d05c83121201b436e16877593c3a",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSecret, serverSecret := initialSecrets(tt.version, destConnID)
+			params := getVersionParams(tt.version)
+			for _, side := range []struct {
+				name   string
+				secret []byte
+				want   keys
+			}{
+				{"客户端", clientSecret, tt.client},
+				{"服务端", serverSecret, tt.server},
+			} {
+				got := keys{
+					secret: hex.EncodeToString(side.secret),
+					key:    hex.EncodeToString(hkdfExpandLabel(sha256.New, side.secret, params.keyLabel, nil, 16)),
+					iv:     hex.EncodeToString(hkdfExpandLabel(sha256.New, side.secret, params.ivLabel, nil, 12)),
+					hp:     hex.EncodeToString(hkdfExpandLabel(sha256.New, side.secret, params.hpLabel, nil, 16)),
+				}
+				if got != side.want {
+					t.Errorf("%s的Initial密钥错误: %+v", side.name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSetInitialKeys(t *testing.T) {
+	destConnID := protocol.ConnectionID{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+	if err := NewCryptoSetup(&tls.Config{}, 0).SetInitialKeys(destConnID); err == nil {
+		t.Error("角色无效时设置Initial密钥应该返回错误")
+	}
+
+	// 密钥的方向由创建时指定的角色决定，不需要等待握手开始
+	client := NewCryptoSetup(&tls.Config{ServerName: "localhost"}, protocol.PerspectiveClient)
+	server := NewCryptoSetup(&tls.Config{}, protocol.PerspectiveServer)
+	if err := client.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装客户端Initial密钥失败: %v", err)
+	}
+	if err := server.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装服务端Initial密钥失败: %v", err)
+	}
+
+	header := []byte{0xc3, 0x00, 0x00, 0x00, 0x01}
+	roundTrip := func(sender, receiver *CryptoSetup) error {
+		sealed, err := sender.Seal(LevelInitial, nil, []byte("hello"), 2, header)
+		if err != nil {
+			return err
+		}
+		_, err = receiver.Open(LevelInitial, nil, sealed, 2, header)
+		return err
+	}
+	if err := roundTrip(client, server); err != nil {
+		t.Errorf("服务端无法解密客户端的Initial包: %v", err)
+	}
+	if err := roundTrip(server, client); err != nil {
+		t.Errorf("客户端无法解密服务端的Initial包: %v", err)
+	}
+
+	// 切换版本后使用版本2的盐值重新派生，两端版本不一致时无法解密
+	client.SetVersion(protocol.Version2)
+	if err := roundTrip(client, server); err == nil {
+		t.Error("两端版本不一致时不应解密成功")
+	}
+
+	// 服务端切换版本后立即以新版本发送，收到新版本的数据包之前仍保留原来版本的读取密钥
+	v1Client := NewCryptoSetup(&tls.Config{ServerName: "localhost"}, protocol.PerspectiveClient)
+	if err := v1Client.SetInitialKeys(destConnID); err != nil {
+		t.Fatalf("安装客户端Initial密钥失败: %v", err)
+	}
+	server.SetVersion(protocol.Version2)
+	if err := roundTrip(v1Client, server); err != nil {
+		t.Errorf("切换版本后服务端应继续接受原来版本的Initial包: %v", err)
+	}
+	sealed, err := server.Seal(LevelInitial, nil, []byte("hello"), 3, header)
+	if err != nil {
+		t.Fatalf("加密Initial包失败: %v", err)
+	}
+	if _, err := client.OpenInitial(protocol.Version2, nil, sealed, 3, header); err != nil {
+		t.Errorf("切换版本后服务端应以版本2发送: %v", err)
+	}
+	if sealed, err = client.Seal(LevelInitial, nil, []byte("hello"), 3, header); err != nil {
+		t.Fatalf("加密Initial包失败: %v", err)
+	}
+	if _, err := server.OpenInitial(protocol.Version2, nil, sealed, 3, header); err != nil {
+		t.Fatalf("服务端无法解密版本2的Initial包: %v", err)
+	}
+	server.CommitInitialVersion(protocol.Version2)
+	if err := roundTrip(client, server); err != nil {
+		t.Errorf("收到版本2的数据包后服务端无法解密: %v", err)
+	}
+	if err := roundTrip(v1Client, server); err == nil {
+		t.Error("收到版本2的数据包后不再接受原来版本的Initial包")
+	}
+
+	// 使用不同的目标连接ID派生的密钥无法解密
+	if err := server.SetInitialKeys(protocol.ConnectionID{1, 2, 3, 4}); err != nil {
+		t.Fatalf("安装服务端Initial密钥失败: %v", err)
+	}
+	if err := roundTrip(client, server); err == nil {
+		t.Error("目标连接ID不一致时不应解密成功")
+	}
+}
+
+func TestInitialVersionKeys(t *testing.T) {
+	destConnID := protocol.ConnectionID{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	client := NewCryptoSetup(&tls.Config{ServerName: "localhost"}, protocol.PerspectiveClient)
+	server := NewCryptoSetup(&tls.Config{}, protocol.PerspectiveServer)
+	server.SetVersion(protocol.Version2)
+	for _, c := range []*CryptoSetup{client, server} {
+		if err := c.SetInitialKeys(destConnID); err != nil {
+			t.Fatalf("安装Initial密钥失败: %v", err)
+		}
+	}
+
+	header := []byte{0xc3, 0x00, 0x00, 0x00, 0x01}
+	sealed, err := server.Seal(LevelInitial, nil, []byte("hello"), 0, header)
+	if err != nil {
+		t.Fatalf("加密Initial包失败: %v", err)
+	}
+	if _, err := client.OpenInitial(protocol.Version2, nil, sealed, 0, header); err == nil {
+		t.Fatal("没有版本2的Initial密钥时不应解密成功")
+	}
+
+	// 派生版本2的读取密钥用于尝试解密，当前版本和发送密钥不变
+	if err := client.PrepareInitialVersion(protocol.Version2); err != nil {
+		t.Fatalf("派生版本2的Initial密钥失败: %v", err)
+	}
+	if _, err := client.OpenInitial(protocol.Version2, nil, []byte("forged payload with tag"), 0, header); err == nil {
+		t.Error("伪造的数据包不应通过认证")
+	}
+	if plaintext, err := client.OpenInitial(protocol.Version2, nil, sealed, 0, header); err != nil || string(plaintext) != "hello" {
+		t.Fatalf("以版本2的密钥解密失败: %q, %v", plaintext, err)
+	}
+	if client.Version() != protocol.Version1 {
+		t.Error("尝试解密不应切换版本")
+	}
+	if _, err := client.Open(LevelInitial, nil, sealed, 0, header); err == nil {
+		t.Error("确认之前当前的读取密钥仍为版本1")
+	}
+
+	// 通过认证后版本2的读取密钥取代当前的读取密钥
+	client.CommitInitialVersion(protocol.Version2)
+	if _, err := client.Open(LevelInitial, nil, sealed, 0, header); err != nil {
+		t.Errorf("确认后应使用版本2的读取密钥: %v", err)
+	}
+	if _, err := client.OpenInitial(protocol.Version1, nil, sealed, 0, header); err == nil {
+		t.Error("确认后不再保留版本1的读取密钥")
+	}
+}
+
+func TestDiscardKeys(t *testing.T) {
+	if err := NewCryptoSetup(&tls.Config{}, 0).StartHandshake(); err == nil {
+		t.Error("角色无效时开始握手应该返回错误")
+	}
+
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	if client.Perspective() != protocol.PerspectiveClient || server.Perspective() != protocol.PerspectiveServer {
+		t.Fatal("角色应与创建时指定的一致")
+	}
+	destConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, cs := range []*CryptoSetup{client, server} {
+		if err := cs.SetInitialKeys(destConnID); err != nil {
+			t.Fatalf("安装Initial密钥失败: %v", err)
+		}
+		if err := cs.StartHandshake(); err != nil {
+			t.Fatalf("开始握手失败: %v", err)
+		}
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+
+	header := []byte{0xc3, 0x00, 0x00, 0x00, 0x01}
+	sealed, err := client.Seal(LevelHandshake, nil, []byte("hello"), 1, header)
+	if err != nil {
+		t.Fatalf("加密Handshake包失败: %v", err)
+	}
+
+	for _, level := range []CryptoLevel{LevelInitial, LevelHandshake} {
+		client.DiscardKeys(level)
+		server.DiscardKeys(level)
+		if !client.KeysDiscarded(level) || !server.KeysDiscarded(level) {
+			t.Fatalf("加密级别%d的密钥应已丢弃", level)
+		}
+		if client.HasKeys(level) {
+			t.Errorf("加密级别%d丢弃后不应有密钥", level)
+		}
+		if _, err := client.Seal(level, nil, []byte("hello"), 2, header); !errors.Is(err, ErrKeysDiscarded) {
+			t.Errorf("加密级别%d丢弃后加密应返回ErrKeysDiscarded，实际%v", level, err)
+		}
+	}
+	if _, err := server.Open(LevelHandshake, nil, sealed, 1, header); !errors.Is(err, ErrKeysDiscarded) {
+		t.Errorf("丢弃后解密应返回ErrKeysDiscarded，实际%v", err)
+	}
+	firstByte := header[0]
+	if err := server.DecryptHeader(LevelHandshake, make([]byte, 16), &firstByte, header[1:]); !errors.Is(err, ErrKeysDiscarded) {
+		t.Errorf("丢弃后去除头部保护应返回ErrKeysDiscarded，实际%v", err)
+	}
+	if err := client.SetInitialKeys(destConnID); !errors.Is(err, ErrKeysDiscarded) {
+		t.Errorf("丢弃后不能重新安装Initial密钥，实际%v", err)
+	}
+	// 切换版本不会重新派生已经丢弃的密钥
+	client.SetVersion(protocol.Version2)
+	if client.HasKeys(LevelInitial) || client.HasKeys(LevelHandshake) {
+		t.Error("切换版本后不应重新安装已丢弃的密钥")
+	}
+
+	// 1-RTT密钥不能丢弃
+	client.DiscardKeys(LevelOneRTT)
+	if client.KeysDiscarded(LevelOneRTT) || !client.HasKeys(LevelOneRTT) {
+		t.Error("1-RTT密钥不应被丢弃")
+	}
+}
+
+func TestHKDFExpandLabel(t *testing.T) {
+	// 输出长度超过一个哈希块时需要串联T(i-1)
+	secret := mustDecodeHex(t, "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea")
+	long := hkdfExpandLabel(sha256.New, secret, "quic key", nil, 80)
+	if len(long) != 80 {
+		t.Fatalf("输出长度错误: %d", len(long))
+	}
+	short := hkdfExpandLabel(sha256.New, secret, "quic key", nil, 16)
+	if hex.EncodeToString(short) != "1f369613dd76d5467730efcbe3b1a22d" {
+		t.Errorf("派生的密钥错误: %x", short)
+	}
+	// 长度是HkdfLabel的一部分，不同长度的输出前缀不同
+	if bytes.Equal(long[:16], short) {
+		t.Error("不同长度的输出不应共享前缀")
+	}
+	if bytes.Equal(long[32:64], long[:32]) {
+		t.Error("各输出块不应相同")
+	}
+	if got := hkdfExpandLabel(sha512.New384, secret, "quic key", nil, 32); bytes.Equal(got, hkdfExpandLabel(sha256.New, secret, "quic key", nil, 32)) {
+		t.Error("不同哈希函数的输出不应相同")
+	}
+}
 
-	// 测试完成1-RTT握手
-	ticket, err := cs.CompleteOneRTT()
+func TestNextTrafficSecret(t *testing.T) {
+	// RFC 9001附录A.5中的密钥更新示例
+	secret := mustDecodeHex(t, "9ac312a7f877468ebe69422748ad00a15443f18203a07d6060f688f30f21632b")
+	next, err := nextTrafficSecret(tls.TLS_CHACHA20_POLY1305_SHA256, secret, protocol.Version1)
 	if err != nil {
-		t.Errorf("完成1-RTT握手失败: %v", err)
+		t.Fatalf("派生下一代密钥失败: %v", err)
 	}
-	if len(ticket) == 0 {
-		t.Error("生成的会话票据不应为空")
+	if got := hex.EncodeToString(next); got != "1223504755036d556342ee9361d253421a826c9ecdf3c7148684b36b714881f9" {
+		t.Errorf("下一代密钥错误: %s", got)
 	}
+}
 
-	// 验证会话票据的有效性
-	if len(ticket) != 32 {
-		t.Errorf("会话票据长度错误，期望32字节，实际%d字节", len(ticket))
+// newOneRTTPair 创建已经安装1-RTT密钥并确认握手的一对CryptoSetup
+func newOneRTTPair(t *testing.T) (*CryptoSetup, *CryptoSetup) {
+	t.Helper()
+
+	clientSecret := bytes.Repeat([]byte{1}, 32)
+	serverSecret := bytes.Repeat([]byte{2}, 32)
+	client := NewCryptoSetup(nil, protocol.PerspectiveClient)
+	server := NewCryptoSetup(nil, protocol.PerspectiveServer)
+	if err := client.InstallKeys(LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, serverSecret, clientSecret); err != nil {
+		t.Fatalf("安装客户端密钥失败: %v", err)
+	}
+	if err := server.InstallKeys(LevelOneRTT, tls.TLS_AES_128_GCM_SHA256, clientSecret, serverSecret); err != nil {
+		t.Fatalf("安装服务端密钥失败: %v", err)
 	}
+	client.SetHandshakeComplete()
+	server.SetHandshakeComplete()
+	return client, server
+}
+
+// sealOneRTTPacket 按发送方当前的密钥阶段构造并加密短包头数据包，返回包头和密文
+func sealOneRTTPacket(t *testing.T, sender *CryptoSetup, pn protocol.PacketNumber) ([]byte, []byte) {
+	t.Helper()
 
-	// 验证可以使用生成的会话票据进行0-RTT
-	success, key := cs.TryZeroRTT(ticket)
-	if !success {
-		t.Error("使用有效会话票据应返回true")
+	header := []byte{0x40, byte(pn)}
+	if sender.KeyPhase() {
+		header[0] |= keyPhaseBit
 	}
-	if key == nil {
-		t.Error("使用有效会话票据应返回非nil密钥")
+	sealed, err := sender.Seal(LevelOneRTT, nil, []byte("payload"), pn, header)
+	if err != nil {
+		t.Fatalf("加密包序号为%d的数据包失败: %v", pn, err)
 	}
+	return header, sealed
 }
 
-func TestTryZeroRTT(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+func TestKeyUpdate(t *testing.T) {
+	client, server := newOneRTTPair(t)
+	open := func(receiver *CryptoSetup, pn protocol.PacketNumber, header, sealed []byte) error {
+		_, err := receiver.Open(LevelOneRTT, nil, sealed, pn, header)
+		return err
+	}
 
-	// 测试无效的票据ID
-	success, key := cs.TryZeroRTT(nil)
-	if success {
-		t.Error("无效票据ID应返回false")
+	if err := client.InitiateKeyUpdate(); !errors.Is(err, ErrKeyUpdateNotAllowed) {
+		t.Fatalf("尚未发送数据包时不应允许密钥更新，实际%v", err)
+	}
+	h0, c0 := sealOneRTTPacket(t, client, 0)
+	if err := open(server, 0, h0, c0); err != nil {
+		t.Fatalf("解密客户端数据包失败: %v", err)
+	}
+	if err := client.InitiateKeyUpdate(); !errors.Is(err, ErrKeyUpdateNotAllowed) {
+		t.Fatalf("数据包被确认之前不应允许密钥更新，实际%v", err)
 	}
-	if key != nil {
-		t.Error("无效票据ID应返回nil密钥")
+	sh0, sc0 := sealOneRTTPacket(t, server, 0)
+	if err := open(client, 0, sh0, sc0); err != nil {
+		t.Fatalf("解密服务端数据包失败: %v", err)
 	}
 
-	// 设置握手数据
-	cs.handshakeData = []byte("test handshake data")
+	// 密钥阶段位与当前密钥不一致时拒绝加密
+	if _, err := client.Seal(LevelOneRTT, nil, nil, 1, []byte{0x40 | keyPhaseBit, 1}); err == nil {
+		t.Error("密钥阶段不一致时应该返回错误")
+	}
 
-	// 测试有效的票据ID
-	success, key = cs.TryZeroRTT([]byte("test id"))
-	if !success {
-		t.Error("有效票据ID应返回true")
+	// 客户端发起更新，更新之前加密的数据包乱序到达
+	h1, c1 := sealOneRTTPacket(t, client, 1)
+	client.SetLargestAcked(0)
+	if err := client.InitiateKeyUpdate(); err != nil {
+		t.Fatalf("发起密钥更新失败: %v", err)
+	}
+	if !client.KeyPhase() || client.KeyGeneration() != 1 {
+		t.Fatalf("密钥更新后阶段%v，代数%d", client.KeyPhase(), client.KeyGeneration())
+	}
+	h2, c2 := sealOneRTTPacket(t, client, 2)
+	if h2[0]&keyPhaseBit == 0 {
+		t.Fatal("更新后的数据包应设置密钥阶段位")
 	}
-	if key == nil {
-		t.Error("有效票据ID应返回非nil密钥")
+	if err := open(server, 2, h2, c2); err != nil {
+		t.Fatalf("服务端无法解密新密钥加密的数据包: %v", err)
+	}
+	if !server.KeyPhase() || server.KeyGeneration() != 1 {
+		t.Fatal("服务端应随对端更新密钥")
+	}
+	if err := open(server, 1, h1, c1); err != nil {
+		t.Errorf("乱序到达的旧阶段数据包应使用上一代密钥解密: %v", err)
+	}
+	sh1, sc1 := sealOneRTTPacket(t, server, 1)
+	if err := open(client, 1, sh1, sc1); err != nil {
+		t.Fatalf("客户端无法解密服务端更新后的数据包: %v", err)
+	}
+
+	// 伪造的下一阶段数据包不会触发更新
+	forged := append([]byte{}, c2...)
+	forged[0] ^= 1
+	if err := open(server, 3, []byte{0x40, 3}, forged); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("期望解密失败，实际%v", err)
+	}
+	if server.KeyGeneration() != 1 {
+		t.Error("解密失败的数据包不应触发密钥更新")
+	}
+
+	// 对端在本端用新密钥发送数据包之前再次更新密钥
+	client.SetLargestAcked(2)
+	if err := client.InitiateKeyUpdate(); err != nil {
+		t.Fatalf("发起第二次密钥更新失败: %v", err)
+	}
+	h3, c3 := sealOneRTTPacket(t, client, 3)
+	if err := open(server, 3, h3, c3); err != nil {
+		t.Fatalf("服务端无法解密第二次更新后的数据包: %v", err)
+	}
+	client.SetLargestAcked(3)
+	if err := client.InitiateKeyUpdate(); err != nil {
+		t.Fatalf("发起第三次密钥更新失败: %v", err)
+	}
+	h4, c4 := sealOneRTTPacket(t, client, 4)
+	var transportErr *protocol.TransportError
+	if err := open(server, 4, h4, c4); !errors.As(err, &transportErr) || transportErr.Code != protocol.KeyUpdateError {
+		t.Errorf("连续的密钥更新应返回KEY_UPDATE_ERROR，实际%v", err)
 	}
 }
 
-func TestSetZeroRTTKey(t *testing.T) {
-	cs := NewCryptoSetup(nil)
+func TestAutomaticKeyUpdate(t *testing.T) {
+	client, server := newOneRTTPair(t)
+	client.SetKeyUpdateConfig(KeyUpdateConfig{Interval: 2})
+	server.SetKeyUpdateConfig(KeyUpdateConfig{OldKeyTimeout: time.Nanosecond})
 
-	// 测试设置无效的密钥
-	if err := cs.SetZeroRTTKey(nil); err == nil {
-		t.Error("设置无效密钥应返回错误")
+	// 未被确认时即使达到间隔也不更新
+	h0, c0 := sealOneRTTPacket(t, client, 0)
+	h1, c1 := sealOneRTTPacket(t, client, 1)
+	if client.KeyGeneration() != 0 {
+		t.Fatal("数据包被确认之前不应自动更新密钥")
+	}
+	client.SetLargestAcked(0)
+	h2, c2 := sealOneRTTPacket(t, client, 2)
+	if !client.KeyPhase() || client.KeyGeneration() != 1 {
+		t.Fatal("达到更新间隔后应自动发起密钥更新")
+	}
+	if h2[0]&keyPhaseBit != 0 {
+		t.Fatal("触发更新的数据包仍使用旧密钥")
+	}
+
+	for pn, p := range [][2][]byte{{h0, c0}, {h1, c1}, {h2, c2}} {
+		if _, err := server.Open(LevelOneRTT, nil, p[1], protocol.PacketNumber(pn), p[0]); err != nil {
+			t.Fatalf("解密包序号为%d的数据包失败: %v", pn, err)
+		}
+	}
+	sealOneRTTPacket(t, server, 0)
+	h3, c3 := sealOneRTTPacket(t, client, 3)
+	if _, err := server.Open(LevelOneRTT, nil, c3, 3, h3); err != nil {
+		t.Fatalf("解密新密钥加密的数据包失败: %v", err)
+	}
+
+	// 超过保留时间后丢弃上一代接收密钥
+	time.Sleep(time.Millisecond)
+	if _, err := server.Open(LevelOneRTT, nil, c1, 1, h1); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("上一代密钥过期后应无法解密，实际%v", err)
+	}
+}
+
+func TestAEADLimits(t *testing.T) {
+	var transportErr *protocol.TransportError
+	isLimitReached := func(err error) bool {
+		return errors.As(err, &transportErr) && transportErr.Code == protocol.AEADLimitReached
+	}
+
+	client, server := newOneRTTPair(t)
+	if stats := NewCryptoSetup(nil, protocol.PerspectiveClient).AEADStats(LevelOneRTT); stats != (AEADStats{}) {
+		t.Errorf("未安装密钥时统计应为空: %+v", stats)
+	}
+	stats := client.AEADStats(LevelOneRTT)
+	if stats.CipherSuite != tls.TLS_AES_128_GCM_SHA256 || stats.ConfidentialityLimit != 1<<23 || stats.IntegrityLimit != 1<<52 {
+		t.Errorf("AES-128-GCM的上限错误: %+v", stats)
+	}
+	// 只能设置比密码套件默认值更严格的上限
+	client.SetAEADLimits(1<<60, 0)
+	if stats := client.AEADStats(LevelOneRTT); stats.ConfidentialityLimit != 1<<23 {
+		t.Errorf("不应放宽机密性上限: %d", stats.ConfidentialityLimit)
+	}
+
+	// 无法更新密钥时，达到机密性上限后拒绝继续加密
+	client.SetAEADLimits(4, 0)
+	for pn := protocol.PacketNumber(0); pn < 4; pn++ {
+		sealOneRTTPacket(t, client, pn)
+	}
+	if _, err := client.Seal(LevelOneRTT, nil, nil, 4, []byte{0x40, 4}); !isLimitReached(err) {
+		t.Errorf("达到机密性上限后应返回AEAD_LIMIT_REACHED，实际%v", err)
+	}
+	if stats := client.AEADStats(LevelOneRTT); stats.PacketsSealed != 4 || stats.CurrentKeySealed != 4 {
+		t.Errorf("加密的数据包数量错误: %+v", stats)
+	}
+
+	// 能够更新密钥时，在达到机密性上限之前强制更新
+	client, server = newOneRTTPair(t)
+	client.SetAEADLimits(8, 0)
+	sealOneRTTPacket(t, client, 0)
+	client.SetLargestAcked(0)
+	for pn := protocol.PacketNumber(1); pn < 4; pn++ {
+		sealOneRTTPacket(t, client, pn)
+	}
+	if client.KeyGeneration() != 1 {
+		t.Fatal("达到机密性上限的一半时应强制更新密钥")
+	}
+	if stats := client.AEADStats(LevelOneRTT); stats.PacketsSealed != 4 || stats.CurrentKeySealed != 0 {
+		t.Errorf("更新后的统计错误: %+v", stats)
+	}
+
+	// 认证失败的数据包超过完整性上限后返回AEAD_LIMIT_REACHED
+	server.SetAEADLimits(0, 2)
+	forged := make([]byte, 32)
+	for i := 0; i < 2; i++ {
+		if _, err := server.Open(LevelOneRTT, nil, forged, protocol.PacketNumber(i), []byte{0x40, byte(i)}); !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("期望解密失败，实际%v", err)
+		}
+	}
+	if _, err := server.Open(LevelOneRTT, nil, forged, 2, []byte{0x40, 2}); !isLimitReached(err) {
+		t.Errorf("超过完整性上限后应返回AEAD_LIMIT_REACHED，实际%v", err)
+	}
+	if stats := server.AEADStats(LevelOneRTT); stats.DecryptionFailures != 3 {
+		t.Errorf("认证失败的数据包数量错误: %d", stats.DecryptionFailures)
+	}
+
+	// Initial密钥认证失败不计入完整性上限
+	if err := server.InstallKeys(LevelInitial, tls.TLS_AES_128_GCM_SHA256, make([]byte, 32), make([]byte, 32)); err != nil {
+		t.Fatalf("安装Initial密钥失败: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := server.Open(LevelInitial, nil, forged, protocol.PacketNumber(i), []byte{0xc0}); !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("Initial包认证失败不应触发AEAD上限，实际%v", err)
+		}
+	}
+	if stats := server.AEADStats(LevelInitial); stats.DecryptionFailures != 3 {
+		t.Errorf("Initial级别认证失败的数据包数量错误: %d", stats.DecryptionFailures)
+	}
+}
+
+// newTestSessionState 完成一次握手，返回服务端签发会话票据时的TLS会话状态
+func newTestSessionState(t *testing.T) *tls.SessionState {
+	t.Helper()
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	var state *tls.SessionState
+	serverConfig.WrapSession = func(_ tls.ConnectionState, s *tls.SessionState) ([]byte, error) {
+		state = s
+		return s.Bytes()
+	}
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	if err := client.StartHandshake(); err != nil {
+		t.Fatalf("客户端开始握手失败: %v", err)
+	}
+	if err := server.StartHandshake(); err != nil {
+		t.Fatalf("服务端开始握手失败: %v", err)
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+	if state == nil {
+		t.Fatal("服务端没有签发会话票据")
+	}
+	return state
+}
+
+// unwrapTicket 使用配置的票据密钥解密票据，无法解密时返回nil
+func unwrapTicket(t *testing.T, config *tls.Config, raw []byte) *tls.SessionState {
+	t.Helper()
+	state, err := config.UnwrapSession(raw, tls.ConnectionState{})
+	if err != nil {
+		t.Fatalf("解密票据返回错误: %v", err)
+	}
+	return state
+}
+
+func TestSessionTicketEncryption(t *testing.T) {
+	state := newTestSessionState(t)
+	plaintext, err := state.Bytes()
+	if err != nil {
+		t.Fatalf("编码会话状态失败: %v", err)
+	}
+
+	secret := bytes.Repeat([]byte{7}, 32)
+	schedule, err := NewTicketKeySchedule(secret, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("创建票据密钥失败: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	schedule.now = func() time.Time { return now }
+
+	issuer := &tls.Config{}
+	SetSessionTicketKeySource(issuer, schedule)
+	raw, err := issuer.WrapSession(tls.ConnectionState{}, state)
+	if err != nil {
+		t.Fatalf("加密票据失败: %v", err)
+	}
+	if len(raw) == 0 || bytes.Contains(raw, plaintext) {
+		t.Fatal("票据应加密后发送")
+	}
+
+	// 共享主密钥的另一台服务器无需保存票据即可解密
+	otherSchedule, _ := NewTicketKeySchedule(secret, time.Hour, 1)
+	otherSchedule.now = schedule.now
+	other := &tls.Config{}
+	SetSessionTicketKeySource(other, otherSchedule)
+	opened := unwrapTicket(t, other, raw)
+	if opened == nil {
+		t.Fatal("共享主密钥的服务器应能解密票据")
+	}
+	if data, err := opened.Bytes(); err != nil || !bytes.Equal(data, plaintext) {
+		t.Errorf("解密的会话状态不一致: %v", err)
+	}
+
+	// 篡改的票据和不同主密钥签发的票据无法解密，握手回退到完整握手
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-1] ^= 1
+	if unwrapTicket(t, other, tampered) != nil {
+		t.Error("篡改的票据不应被解密")
+	}
+	randomSchedule, _ := NewTicketKeySchedule(nil, time.Hour, 1)
+	stranger := &tls.Config{}
+	SetSessionTicketKeySource(stranger, randomSchedule)
+	if unwrapTicket(t, stranger, raw) != nil {
+		t.Error("其他主密钥签发的票据不应被解密")
+	}
+
+	// 轮换后旧密钥仍可解密，超过保留数量后被淘汰
+	now = now.Add(time.Hour)
+	if unwrapTicket(t, other, raw) == nil {
+		t.Error("轮换一次后应能用旧密钥解密")
+	}
+	fresh, err := other.WrapSession(tls.ConnectionState{}, state)
+	if err != nil {
+		t.Fatalf("加密票据失败: %v", err)
+	}
+	if binary.BigEndian.Uint64(fresh) == binary.BigEndian.Uint64(raw) {
+		t.Error("轮换后应使用新密钥加密")
+	}
+	now = now.Add(time.Hour)
+	if unwrapTicket(t, other, raw) != nil {
+		t.Error("旧密钥淘汰后不应再解密票据")
+	}
+}
+
+func TestStaticTicketKeys(t *testing.T) {
+	state := newTestSessionState(t)
+	config := &tls.Config{}
+	SetSessionTicketKeySource(config, StaticTicketKeys{})
+	if _, err := config.WrapSession(tls.ConnectionState{}, state); !errors.Is(err, ErrNoTicketKey) {
+		t.Errorf("没有密钥时应返回ErrNoTicketKey，实际%v", err)
+	}
+
+	oldKey := TicketKey{ID: 1, Key: bytes.Repeat([]byte{1}, 32)}
+	newKey := TicketKey{ID: 2, Key: bytes.Repeat([]byte{2}, 32)}
+	SetSessionTicketKeySource(config, StaticTicketKeys{oldKey})
+	raw, err := config.WrapSession(tls.ConnectionState{}, state)
+	if err != nil {
+		t.Fatalf("加密票据失败: %v", err)
+	}
+	// 外部轮换：新密钥在前，旧密钥保留用于解密
+	SetSessionTicketKeySource(config, StaticTicketKeys{newKey, oldKey})
+	if unwrapTicket(t, config, raw) == nil {
+		t.Error("应能用旧密钥解密")
+	}
+
+	if _, err := NewTicketKeySchedule(make([]byte, 16), time.Hour, 1); err == nil {
+		t.Error("主密钥过短时应返回错误")
+	}
+}
+
+func TestLRUSessionStore(t *testing.T) {
+	newTicket := func(size int, validity time.Duration) *SessionTicket {
+		return &SessionTicket{Raw: make([]byte, size), ExpiresAt: time.Now().Add(validity)}
+	}
+
+	// 按数量淘汰最久未使用的票据
+	store := NewLRUSessionStore(2, 1<<20, -1)
+	defer store.Close()
+	store.Put("a", newTicket(10, time.Hour))
+	store.Put("b", newTicket(10, time.Hour))
+	if store.Get("a") == nil {
+		t.Fatal("应能取出票据a")
+	}
+	store.Put("c", newTicket(10, time.Hour))
+	if store.Get("b") != nil || store.Get("a") == nil || store.Get("c") == nil {
+		t.Error("应淘汰最久未使用的票据b")
+	}
+
+	// 按字节数淘汰
+	store = NewLRUSessionStore(100, 100, -1)
+	defer store.Close()
+	store.Put("a", newTicket(40, time.Hour))
+	store.Put("b", newTicket(40, time.Hour))
+	store.Put("c", newTicket(40, time.Hour))
+	if store.Len() != 2 || store.Get("a") != nil {
+		t.Errorf("超过字节上限时应淘汰最旧的票据，剩余%d个", store.Len())
+	}
+	if err := store.Put("big", newTicket(200, time.Hour)); err == nil {
+		t.Error("超过字节上限的票据应返回错误")
+	}
+	store.Delete("b")
+	if store.Get("b") != nil {
+		t.Error("删除后不应取出票据")
+	}
+
+	// 后台清理过期票据
+	store = NewLRUSessionStore(0, 0, 10*time.Millisecond)
+	defer store.Close()
+	store.Put("expiring", newTicket(1, 20*time.Millisecond))
+	store.Put("valid", newTicket(1, time.Hour))
+	deadline := time.Now().Add(time.Second)
+	for store.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if store.Len() != 1 || store.Get("valid") == nil {
+		t.Errorf("过期票据应在后台被清理，剩余%d个", store.Len())
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.json")
+	store, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("打开票据文件失败: %v", err)
+	}
+	ticket := &SessionTicket{Raw: []byte("ticket"), State: []byte("state"), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.Put("example.com", ticket); err != nil {
+		t.Fatalf("保存票据失败: %v", err)
+	}
+	store.Put("expired.com", &SessionTicket{Raw: []byte("old"), ExpiresAt: time.Now().Add(-time.Second)})
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("票据文件应只允许所有者读写: %v", err)
+	}
+
+	// 重新打开后票据仍然存在，过期票据被丢弃
+	reopened, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("重新打开票据文件失败: %v", err)
+	}
+	got := reopened.Get("example.com")
+	if got == nil || string(got.Raw) != "ticket" || string(got.State) != "state" {
+		t.Fatalf("重启后应能取出票据: %+v", got)
+	}
+	if reopened.Get("expired.com") != nil {
+		t.Error("过期的票据不应被取出")
+	}
+	reopened.Delete("example.com")
+	if again, _ := OpenFileSessionStore(path); again.Get("example.com") != nil {
+		t.Error("删除应写回文件")
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileSessionStore(path); err == nil {
+		t.Error("损坏的票据文件应返回错误")
+	}
+}
+
+func TestClientSessionCache(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	// 每个连接克隆服务端配置，需要固定的票据密钥才能恢复其他连接签发的会话
+	serverConfig.SetSessionTicketKeys([][32]byte{{1}})
+	path := filepath.Join(t.TempDir(), "tickets.json")
+
+	handshake := func() *CryptoSetup {
+		t.Helper()
+		store, err := OpenFileSessionStore(path)
+		if err != nil {
+			t.Fatalf("打开票据文件失败: %v", err)
+		}
+		config := clientConfig.Clone()
+		config.ClientSessionCache = NewClientSessionCache(store)
+		client := NewCryptoSetup(config, protocol.PerspectiveClient)
+		server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+		if err := client.StartHandshake(); err != nil {
+			t.Fatalf("客户端开始握手失败: %v", err)
+		}
+		if err := server.StartHandshake(); err != nil {
+			t.Fatalf("服务端开始握手失败: %v", err)
+		}
+		// 服务端在握手完成后自动签发会话票据
+		if err := exchangeCryptoData(client, server); err != nil {
+			t.Fatalf("握手失败: %v", err)
+		}
+		return client
+	}
+
+	if handshake().ConnectionState().DidResume {
+		t.Fatal("首次握手不应恢复会话")
+	}
+	// 票据保存在文件中，新的客户端（模拟进程重启）可以恢复会话
+	if !handshake().ConnectionState().DidResume {
+		t.Error("使用保存的票据应恢复会话")
+	}
+}
+
+// newEarlyDataParams 创建服务端的传输参数，maxData为连接的流量控制限制
+func newEarlyDataParams(maxData protocol.ByteCount) *protocol.TransportParameters {
+	return &protocol.TransportParameters{
+		OriginalDestinationConnectionID: protocol.ConnectionID{1, 2, 3, 4},
+		InitialSourceConnectionID:       protocol.ConnectionID{5, 6, 7, 8},
+		MaxUDPPayloadSize:               protocol.DefaultMaxUDPPayloadSize,
+		AckDelayExponent:                protocol.DefaultAckDelayExponent,
+		MaxAckDelay:                     protocol.DefaultMaxAckDelay,
+		InitialMaxData:                  maxData,
+		InitialMaxStreamDataBidiRemote:  1 << 16,
+		InitialMaxStreamDataUni:         1 << 16,
+		InitialMaxStreamsBidi:           10,
+		InitialMaxStreamsUni:            10,
+		ActiveConnectionIDLimit:         4,
+	}
+}
+
+// denyAntiReplay 拒绝所有0-RTT尝试的反重放保护
+type denyAntiReplay struct{}
+
+func (denyAntiReplay) Accept([]byte, time.Time) bool { return false }
+
+func TestEarlyData(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	// 客户端只有在ALPN与会话一致时才发送0-RTT数据
+	clientConfig.NextProtos = []string{"test"}
+	serverConfig.NextProtos = []string{"test"}
+	clientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	SetSessionTicketKeySource(serverConfig, StaticTicketKeys{{ID: 1, Key: make([]byte, TicketKeyLen)}})
+	register := NewStrikeRegister(0, 0)
+	params := newEarlyDataParams(1 << 20)
+	encode := func(p *protocol.TransportParameters) []byte {
+		t.Helper()
+		b, err := p.Append(nil, protocol.PerspectiveServer)
+		if err != nil {
+			t.Fatalf("编码传输参数失败: %v", err)
+		}
+		return b
+	}
+	encoded := encode(params)
+
+	start := func(clientEarly, serverEarly bool, antiReplay AntiReplay, serverParams *protocol.TransportParameters) (*CryptoSetup, *CryptoSetup) {
+		t.Helper()
+		client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+		server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+		if clientEarly {
+			client.EnableEarlyData()
+		}
+		if serverEarly {
+			server.EnableEarlyData()
+		}
+		server.SetAntiReplay(antiReplay)
+		// 服务端的传输参数记录在票据中，恢复会话时与当前的传输参数比较
+		server.SetEarlyDataParameters(serverParams)
+		if err := server.SetTransportParameters(encode(serverParams)); err != nil {
+			t.Fatalf("设置传输参数失败: %v", err)
+		}
+		// 客户端提前设置传输参数，ClientHello和0-RTT密钥在StartHandshake时产生
+		if err := client.SetTransportParameters([]byte{}); err != nil {
+			t.Fatalf("设置传输参数失败: %v", err)
+		}
+		if err := client.StartHandshake(); err != nil {
+			t.Fatalf("客户端开始握手失败: %v", err)
+		}
+		if err := server.StartHandshake(); err != nil {
+			t.Fatalf("服务端开始握手失败: %v", err)
+		}
+		return client, server
+	}
+
+	// 首次握手没有可以恢复的会话，服务端签发允许0-RTT的票据
+	client, server := start(true, true, register, params)
+	if client.HasKeys(LevelZeroRTT) || client.EarlyDataState() != EarlyDataNone {
+		t.Fatal("没有会话时不应使用0-RTT")
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+
+	// 恢复会话时客户端立即安装0-RTT密钥，服务端接受0-RTT数据
+	client, server = start(true, true, register, params)
+	if !client.HasKeys(LevelZeroRTT) || client.EarlyDataState() != EarlyDataPending {
+		t.Fatalf("恢复会话时应安装0-RTT密钥，状态: %v", client.EarlyDataState())
+	}
+	// 客户端按票据记录的服务端传输参数限制0-RTT数据
+	if remembered := client.RememberedTransportParameters(); remembered == nil || remembered.InitialMaxData != params.InitialMaxData {
+		t.Fatalf("客户端应取出票据记录的传输参数: %+v", remembered)
+	}
+	header := []byte{0xd0, 1, 2, 3}
+	sealed, err := client.Seal(LevelZeroRTT, nil, []byte("early"), 0, header)
+	if err != nil {
+		t.Fatalf("加密0-RTT数据失败: %v", err)
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+	if client.EarlyDataState() != EarlyDataAccepted || server.EarlyDataState() != EarlyDataAccepted {
+		t.Fatalf("0-RTT应被接受，客户端: %v，服务端: %v", client.EarlyDataState(), server.EarlyDataState())
+	}
+	opened, err := server.Open(LevelZeroRTT, nil, sealed, 0, header)
+	if err != nil || string(opened) != "early" {
+		t.Fatalf("服务端解密0-RTT数据失败: %q, %v", opened, err)
+	}
+	if client.HasKeys(LevelZeroRTT) {
+		t.Error("可以发送1-RTT包后客户端应丢弃0-RTT密钥")
+	}
+
+	// 服务端未允许0-RTT、反重放保护未通过、客户端时间超出窗口或降低了传输参数的限制时拒绝0-RTT，会话仍然恢复。
+	// 未允许0-RTT的服务端签发的票据不能用于0-RTT，放在最后
+	skewed := NewStrikeRegister(0, 0)
+	skewed.now = func() time.Time { return time.Now().Add(time.Minute) }
+	for _, tc := range []struct {
+		name         string
+		serverEarly  bool
+		antiReplay   AntiReplay
+		serverParams *protocol.TransportParameters
+	}{
+		{"反重放保护未通过", true, denyAntiReplay{}, params},
+		{"没有反重放保护", true, nil, params},
+		{"客户端时间超出反重放窗口", true, skewed, params},
+		{"降低了连接的流量控制限制", true, register, newEarlyDataParams(1 << 10)},
+		{"未允许0-RTT", false, register, params},
+	} {
+		name := tc.name
+		client, server := start(true, tc.serverEarly, tc.antiReplay, tc.serverParams)
+		if client.EarlyDataState() != EarlyDataPending {
+			t.Fatalf("%s: 客户端应尝试0-RTT", name)
+		}
+		if err := exchangeCryptoData(client, server); err != nil {
+			t.Fatalf("%s: 握手失败: %v", name, err)
+		}
+		if client.EarlyDataState() != EarlyDataRejected || server.EarlyDataState() != EarlyDataNone {
+			t.Errorf("%s: 0-RTT应被拒绝，客户端: %v，服务端: %v", name, client.EarlyDataState(), server.EarlyDataState())
+		}
+		if !client.ConnectionState().DidResume {
+			t.Errorf("%s: 拒绝0-RTT不影响会话恢复", name)
+		}
+		if client.HasKeys(LevelZeroRTT) || server.HasKeys(LevelZeroRTT) {
+			t.Errorf("%s: 0-RTT被拒绝后不应保留0-RTT密钥", name)
+		}
+	}
+
+	// 客户端未允许0-RTT时只恢复会话，服务端重新签发允许0-RTT的票据
+	client, server = start(false, true, register, params)
+	if client.HasKeys(LevelZeroRTT) {
+		t.Error("客户端未允许0-RTT时不应安装0-RTT密钥")
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+	if client.EarlyDataState() != EarlyDataNone || server.EarlyDataState() != EarlyDataNone {
+		t.Error("客户端未允许0-RTT时不应使用0-RTT")
+	}
+
+	// 重放的ClientHello在其他连接上同样被拒绝
+	client, _ = start(true, true, register, params)
+	clientHello := client.GetCryptoData(LevelInitial)
+	for i, want := range []EarlyDataState{EarlyDataAccepted, EarlyDataNone} {
+		replica := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+		replica.EnableEarlyData()
+		replica.SetAntiReplay(register)
+		replica.SetEarlyDataParameters(params)
+		if err := replica.SetTransportParameters(encoded); err != nil {
+			t.Fatalf("设置传输参数失败: %v", err)
+		}
+		if err := replica.StartHandshake(); err != nil {
+			t.Fatalf("服务端开始握手失败: %v", err)
+		}
+		if err := replica.HandleCryptoFrame(clientHello, LevelInitial); err != nil {
+			t.Fatalf("处理ClientHello失败: %v", err)
+		}
+		if got := replica.EarlyDataState(); got != want {
+			t.Errorf("第%d次收到ClientHello: 0-RTT状态应为%v，实际%v", i+1, want, got)
+		}
+	}
+}
+
+func TestEarlyDataStateString(t *testing.T) {
+	for state, want := range map[EarlyDataState]string{
+		EarlyDataNone:     "未使用",
+		EarlyDataPending:  "等待确认",
+		EarlyDataAccepted: "已接受",
+		EarlyDataRejected: "已拒绝",
+	} {
+		if got := state.String(); got != want {
+			t.Errorf("状态%d的名称应为%q，实际%q", state, want, got)
+		}
+	}
+}
+
+func TestTicketBinding(t *testing.T) {
+	params, err := newEarlyDataParams(1<<20).Append(nil, protocol.PerspectiveServer)
+	if err != nil {
+		t.Fatalf("编码传输参数失败: %v", err)
+	}
+	binding := TicketBinding{ServerName: "example.com", ALPN: "h3", CipherSuite: tls.TLS_AES_128_GCM_SHA256, TransportParameters: params}
+
+	// TLS会话状态的附加数据中保存绑定的属性
+	extra := appendTicketBinding(appendTicketExtra(nil, ticketExtraIssued, []byte{1}), binding)
+	if got := ticketBindingFromExtra(extra); got.Matches(binding) != nil || !bytes.Equal(got.TransportParameters, params) {
+		t.Errorf("从附加数据读取的绑定属性不一致: %+v", got)
+	}
+	if _, ok := ticketExtra(extra, ticketExtraIssued); !ok {
+		t.Error("写入绑定属性不应覆盖其他附加数据")
+	}
+
+	for name, current := range map[string]TicketBinding{
+		"其他主机":   {ServerName: "other.com", ALPN: "h3", CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		"其他协议":   {ServerName: "example.com", ALPN: "h2", CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		"其他密码套件": {ServerName: "example.com", ALPN: "h3", CipherSuite: tls.TLS_AES_256_GCM_SHA384},
+	} {
+		if binding.Matches(current) == nil {
+			t.Errorf("%s: 属性不一致时应返回错误", name)
+		}
+	}
+	if remembered, err := binding.Parameters(); err != nil || remembered.InitialMaxData != 1<<20 {
+		t.Errorf("应能解析记录的传输参数: %+v, %v", remembered, err)
+	}
+	if _, err := (TicketBinding{}).Parameters(); err == nil {
+		t.Error("没有记录传输参数时应返回错误")
+	}
+}
+
+// newTestClientCertificate 创建签发客户端证书的CA和带有指定URI SAN的客户端证书
+func newTestClientCertificate(t *testing.T, uris ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("生成CA证书失败: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("解析CA证书失败: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("解析URI失败: %v", err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("生成客户端证书失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestPeerIdentity(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	cert, clientCAs := newTestClientCertificate(t, "spiffe://example.org/service/echo", "https://example.org/echo")
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	serverConfig.ClientCAs = clientCAs
+	clientConfig.Certificates = []tls.Certificate{cert}
+
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	if server.PeerIdentity() != nil {
+		t.Fatal("握手开始之前不应有对端身份")
+	}
+	if err := client.StartHandshake(); err != nil {
+		t.Fatalf("客户端开始握手失败: %v", err)
+	}
+	if err := server.StartHandshake(); err != nil {
+		t.Fatalf("服务端开始握手失败: %v", err)
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+
+	id := server.PeerIdentity()
+	if id == nil {
+		t.Fatal("服务端应取得客户端经过验证的身份")
+	}
+	if id.SPIFFEID == nil || id.SPIFFEID.String() != "spiffe://example.org/service/echo" || id.TrustDomain() != "example.org" {
+		t.Errorf("SPIFFE ID错误: %v", id.SPIFFEID)
+	}
+	if len(id.URIs) != 2 || len(id.VerifiedChains) != 1 || len(id.VerifiedChains[0]) != 2 {
+		t.Errorf("URI SAN或证书链错误: %v, %d", id.URIs, len(id.VerifiedChains))
+	}
+	if id.Certificate.Subject.CommonName != "test client" {
+		t.Errorf("对端证书错误: %v", id.Certificate.Subject)
+	}
+	if serverID := client.PeerIdentity(); serverID == nil || serverID.SPIFFEID != nil || serverID.TrustDomain() != "" {
+		t.Errorf("客户端应取得服务器的身份且没有SPIFFE ID: %+v", serverID)
+	}
+
+	// 没有出示证书的客户端握手失败
+	noCert := clientConfig.Clone()
+	noCert.Certificates = nil
+	client = NewCryptoSetup(noCert, protocol.PerspectiveClient)
+	server = NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	client.StartHandshake()
+	server.StartHandshake()
+	if err := exchangeCryptoData(client, server); err == nil {
+		t.Error("要求客户端证书时没有出示证书的握手应失败")
+	}
+
+	// 没有经过验证的证书不产生身份
+	serverConfig.ClientAuth = tls.RequestClientCert
+	client = NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server = NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	client.StartHandshake()
+	server.StartHandshake()
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+	if server.PeerIdentity() != nil {
+		t.Error("没有验证的客户端证书不应产生身份")
+	}
+}
+
+func TestValidateSPIFFEID(t *testing.T) {
+	for raw, valid := range map[string]bool{
+		"spiffe://example.org/service/echo": true,
+		"spiffe://example.org":              true,
+		"https://example.org/echo":          false,
+		"spiffe:///echo":                    false,
+		"spiffe://Example.org/echo":         false,
+		"spiffe://example.org:8443/echo":    false,
+		"spiffe://user@example.org/echo":    false,
+		"spiffe://example.org/echo?x=1":     false,
+		"spiffe://example.org/echo/":        false,
+		"spiffe://example.org/a/../b":       false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("解析URI失败: %v", err)
+		}
+		if err := ValidateSPIFFEID(u); (err == nil) != valid {
+			t.Errorf("%s: 期望合法=%v，实际错误%v", raw, valid, err)
+		}
+	}
+}
+
+// failingWriter 写入总是失败的Writer
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("磁盘已满") }
+
+func TestKeyLog(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	// 服务端使用crypto/tls自身的密钥日志作为对照
+	var clientLog, tlsLog, ignoredLog bytes.Buffer
+	serverConfig.KeyLogWriter = &tlsLog
+	clientConfig.KeyLogWriter = &ignoredLog
+	client := NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server := NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	client.SetKeyLogWriter(&clientLog)
+	for _, cs := range []*CryptoSetup{client, server} {
+		if err := cs.StartHandshake(); err != nil {
+			t.Fatalf("开始握手失败: %v", err)
+		}
+	}
+	if err := exchangeCryptoData(client, server); err != nil {
+		t.Fatalf("握手失败: %v", err)
+	}
+
+	// 设置了SetKeyLogWriter时不再使用TLSConfig.KeyLogWriter
+	if ignoredLog.Len() != 0 {
+		t.Errorf("不应重复输出到TLSConfig.KeyLogWriter: %q", ignoredLog.String())
+	}
+	lines := strings.Split(strings.TrimSpace(clientLog.String()), "\n")
+	want := strings.Split(strings.TrimSpace(tlsLog.String()), "\n")
+	slices.Sort(lines)
+	slices.Sort(want)
+	if !slices.Equal(lines, want) {
+		t.Fatalf("密钥日志与crypto/tls输出的不一致:\n%s\n%s", clientLog.String(), tlsLog.String())
+	}
+	for i, label := range []string{"CLIENT_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0", "SERVER_HANDSHAKE_TRAFFIC_SECRET", "SERVER_TRAFFIC_SECRET_0"} {
+		if fields := strings.Fields(lines[i]); len(fields) != 3 || fields[0] != label || len(fields[1]) != 64 {
+			t.Errorf("密钥日志行格式错误: %q", lines[i])
+		}
 	}
 
-	// 测试设置有效的密钥
-	key := []byte("test key")
-	if err := cs.SetZeroRTTKey(key); err != nil {
-		t.Errorf("设置有效密钥失败: %v", err)
+	// 写入密钥日志失败时握手失败
+	clientConfig, serverConfig = newTestTLSConfigs(t)
+	client = NewCryptoSetup(clientConfig, protocol.PerspectiveClient)
+	server = NewCryptoSetup(serverConfig, protocol.PerspectiveServer)
+	server.SetKeyLogWriter(failingWriter{})
+	for _, cs := range []*CryptoSetup{client, server} {
+		if err := cs.StartHandshake(); err != nil {
+			t.Fatalf("开始握手失败: %v", err)
+		}
 	}
-	if !bytes.Equal(cs.zeroRTTKey, key) {
-		t.Errorf("0-RTT密钥设置错误，期望%v，实际%v", key, cs.zeroRTTKey)
+	if err := exchangeCryptoData(client, server); err == nil || server.HandshakeComplete() {
+		t.Error("写入密钥日志失败时应返回错误")
 	}
 }
@@ -0,0 +1,296 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+
+	"LQUIC/internal/protocol"
+)
+
+// EarlyDataState 表示0-RTT数据的状态
+type EarlyDataState int
+
+const (
+	// EarlyDataNone 连接没有使用0-RTT
+	EarlyDataNone EarlyDataState = iota
+	// EarlyDataPending 客户端已经安装0-RTT密钥，尚未得知服务器是否接受0-RTT数据
+	EarlyDataPending
+	// EarlyDataAccepted 服务器接受了0-RTT数据
+	EarlyDataAccepted
+	// EarlyDataRejected 服务器拒绝了0-RTT数据，客户端需要在1-RTT包中重新发送
+	EarlyDataRejected
+)
+
+// String 返回0-RTT状态的名称
+func (s EarlyDataState) String() string {
+	switch s {
+	case EarlyDataPending:
+		return "等待确认"
+	case EarlyDataAccepted:
+		return "已接受"
+	case EarlyDataRejected:
+		return "已拒绝"
+	default:
+		return "未使用"
+	}
+}
+
+// 服务端在会话票据中记录的附加数据名称
+const (
+	// ticketExtraIssued 票据的签发时间
+	ticketExtraIssued = "lquic-issued"
+	// ticketExtraAgeAdd 随票据发送给客户端的ticket_age_add，见RFC 8446第4.6.1节
+	ticketExtraAgeAdd = "lquic-age-add"
+)
+
+// ClientHello中pre_shared_key扩展的类型，见RFC 8446第4.2.11节
+const extensionPreSharedKey = 41
+
+// ticketAgeAddRand 包装服务端TLS配置的随机数源。crypto/tls在发送NewSessionTicket时从随机数源读取
+// 4字节的ticket_age_add且不保存，服务端预先选定该值并记录在票据中，由随机数源在这次读取时返回，
+// 恢复会话时才能从obfuscated_ticket_age还原客户端的票据年龄
+type ticketAgeAddRand struct {
+	mutex sync.Mutex
+	rand  io.Reader
+	// pending 下一次读取4字节时返回的ticket_age_add，为nil时直接读取rand
+	pending []byte
+}
+
+// Read 实现io.Reader
+func (r *ticketAgeAddRand) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.pending != nil && len(p) == len(r.pending) {
+		n := copy(p, r.pending)
+		r.pending = nil
+		return n, nil
+	}
+	return r.rand.Read(p)
+}
+
+// expect 设置下一次读取4字节时返回的ticket_age_add
+func (r *ticketAgeAddRand) expect(ageAdd []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pending = ageAdd
+}
+
+// consumed 返回设置的ticket_age_add是否已经被读取，未被读取时清除
+func (r *ticketAgeAddRand) consumed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ok := r.pending == nil
+	r.pending = nil
+	return ok
+}
+
+// obfuscatedTicketAge 从ClientHello的pre_shared_key扩展中取出第一个票据的obfuscated_ticket_age，
+// crypto/tls只对第一个票据接受0-RTT
+func obfuscatedTicketAge(hello []byte) (uint32, bool) {
+	s := cryptobyte.String(hello)
+	var msgType uint8
+	var body, sessionID, suites, compression, extensions cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) ||
+		!body.Skip(2+clientRandomLen) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&suites) ||
+		!body.ReadUint8LengthPrefixed(&compression) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return 0, false
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return 0, false
+		}
+		if typ != extensionPreSharedKey {
+			continue
+		}
+		var identities, identity cryptobyte.String
+		var age uint32
+		if !data.ReadUint16LengthPrefixed(&identities) ||
+			!identities.ReadUint16LengthPrefixed(&identity) || !identities.ReadUint32(&age) {
+			return 0, false
+		}
+		return age, true
+	}
+	return 0, false
+}
+
+// appendTicketExtra 在TLS会话状态的附加数据中设置一项name=value，已有的同名项被替换
+func appendTicketExtra(extra [][]byte, name string, value []byte) [][]byte {
+	prefix := []byte(name + "=")
+	out := make([][]byte, 0, len(extra)+1)
+	for _, e := range extra {
+		if !bytes.HasPrefix(e, prefix) {
+			out = append(out, e)
+		}
+	}
+	return append(out, append(prefix, value...))
+}
+
+// ticketExtra 返回TLS会话状态附加数据中名为name的项
+func ticketExtra(extra [][]byte, name string) ([]byte, bool) {
+	prefix := []byte(name + "=")
+	for _, e := range extra {
+		if bytes.HasPrefix(e, prefix) {
+			return e[len(prefix):], true
+		}
+	}
+	return nil, false
+}
+
+// EnableEarlyData 允许0-RTT，需要在StartHandshake之前调用。
+// 客户端恢复允许0-RTT的会话时安装0-RTT密钥；服务端签发允许0-RTT的会话票据，
+// 并在反重放保护通过后接受客户端的0-RTT数据，没有通过SetAntiReplay设置反重放保护的服务端不接受0-RTT
+func (c *CryptoSetup) EnableEarlyData() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.earlyDataEnabled = true
+}
+
+// EarlyDataState 返回0-RTT的状态。服务端只报告是否接受了0-RTT数据
+func (c *CryptoSetup) EarlyDataState() EarlyDataState {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.earlyData
+}
+
+// SetEarlyDataParameters 设置服务端当前的传输参数，需要在StartHandshake之前调用。
+// 票据记录的限制高于当前传输参数时不接受0-RTT，见RFC 9000第7.4.1节；未设置时服务端不接受0-RTT
+func (c *CryptoSetup) SetEarlyDataParameters(params *protocol.TransportParameters) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.earlyDataParams = params
+}
+
+// RememberedTransportParameters 返回客户端恢复会话时从票据中取出的服务端传输参数，
+// 发送0-RTT数据时不能超出其中的流量控制限制。没有尝试0-RTT时返回nil
+func (c *CryptoSetup) RememberedTransportParameters() *protocol.TransportParameters {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.rememberedParams
+}
+
+// handleResumeSession 在恢复会话时决定是否使用0-RTT，未允许0-RTT、票据绑定的属性与当前连接不一致
+// 或服务端的反重放保护未通过时清除会话状态的EarlyData。调用方需持有互斥锁
+func (c *CryptoSetup) handleResumeSession(state *tls.SessionState) {
+	if !state.EarlyData {
+		return
+	}
+	if !c.earlyDataEnabled {
+		state.EarlyData = false
+		return
+	}
+	if c.perspective == protocol.PerspectiveClient {
+		c.resumeEarlyData(state)
+	} else if !c.acceptEarlyData(state) {
+		state.EarlyData = false
+	}
+}
+
+// resumeEarlyData 客户端检查票据是否签发给当前的服务器名称并取出记住的传输参数，
+// 应用层协议和密码套件由crypto/tls检查。调用方需持有互斥锁
+func (c *CryptoSetup) resumeEarlyData(state *tls.SessionState) {
+	binding := ticketBindingFromExtra(state.Extra)
+	params, err := binding.Parameters()
+	if err != nil || binding.ServerName != c.tlsConfig.ServerName {
+		state.EarlyData = false
+		return
+	}
+	c.rememberedParams = params
+}
+
+// acceptEarlyData 服务端检查票据绑定的属性和0-RTT尝试是否为重放：由ClientHello中的obfuscated_ticket_age
+// 和票据记录的ticket_age_add还原客户端的票据年龄，票据签发时间加上该年龄即客户端发送ClientHello的时间，
+// 见RFC 8446第8.3节；以会话状态和ClientHello计算反重放键，同一ClientHello只能使用一次。调用方需持有互斥锁
+func (c *CryptoSetup) acceptEarlyData(state *tls.SessionState) bool {
+	if c.antiReplay == nil || c.earlyDataParams == nil {
+		return false
+	}
+	binding := ticketBindingFromExtra(state.Extra)
+	if binding.Matches(c.currentBinding(nil)) != nil {
+		return false
+	}
+	remembered, err := binding.Parameters()
+	if err != nil || c.earlyDataParams.ValidateZeroRTT(remembered) != nil {
+		return false
+	}
+	issued, ok := ticketExtra(state.Extra, ticketExtraIssued)
+	if !ok || len(issued) != 8 {
+		return false
+	}
+	ageAdd, ok := ticketExtra(state.Extra, ticketExtraAgeAdd)
+	if !ok || len(ageAdd) != 4 {
+		return false
+	}
+	obfuscated, ok := obfuscatedTicketAge(c.clientHello)
+	if !ok {
+		return false
+	}
+	age := time.Duration(obfuscated-binary.LittleEndian.Uint32(ageAdd)) * time.Millisecond
+	clientTime := time.Unix(0, int64(binary.BigEndian.Uint64(issued))).Add(age)
+	ticket, err := state.Bytes()
+	if err != nil {
+		return false
+	}
+	return c.antiReplay.Accept(ReplayKey(ticket, c.clientHello), clientTime)
+}
+
+// sendSessionTicket 服务端在握手完成后签发会话票据，记录签发时间和ticket_age_add供0-RTT的反重放保护使用，
+// 并记录票据绑定的连接属性和本端的传输参数。调用方需持有互斥锁
+func (c *CryptoSetup) sendSessionTicket() error {
+	ageAdd := make([]byte, 4)
+	if _, err := rand.Read(ageAdd); err != nil {
+		return err
+	}
+	issued := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	extra := appendTicketExtra(nil, ticketExtraIssued, issued)
+	extra = appendTicketExtra(extra, ticketExtraAgeAdd, ageAdd)
+	extra = appendTicketBinding(extra, c.currentBinding(c.transportParams))
+	c.ticketAgeAdd.expect(ageAdd)
+	if err := c.tlsConn.SendSessionTicket(tls.QUICSessionTicketOptions{
+		EarlyData: c.earlyDataEnabled,
+		Extra:     extra,
+	}); err != nil {
+		c.ticketAgeAdd.consumed()
+		return err
+	}
+	if !c.ticketAgeAdd.consumed() {
+		return fmt.Errorf("crypto/tls未按预期读取ticket_age_add")
+	}
+	return nil
+}
+
+// storeSession 客户端在会话状态中记录票据绑定的连接属性和服务端的传输参数后保存会话，
+// 保存失败只影响之后的会话恢复。调用方需持有互斥锁
+func (c *CryptoSetup) storeSession(state *tls.SessionState) {
+	binding := c.currentBinding(c.peerTransportParams)
+	// 恢复会话时crypto/tls尚未确定实际发送的SNI，客户端以配置的服务器名称为准
+	binding.ServerName = c.tlsConfig.ServerName
+	state.Extra = appendTicketBinding(state.Extra, binding)
+	_ = c.tlsConn.StoreSession(state)
+}
+
+// dropZeroRTTSealer 丢弃客户端的0-RTT发送密钥：0-RTT被拒绝，或已经可以发送1-RTT包，见RFC 9001第4.9.3节。
+// 调用方需持有互斥锁
+func (c *CryptoSetup) dropZeroRTTSealer() {
+	c.sealers[LevelZeroRTT] = nil
+	c.headerSealers[LevelZeroRTT] = nil
+}
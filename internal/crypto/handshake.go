@@ -0,0 +1,252 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// StartHandshake 以创建时指定的角色启动TLS 1.3握手。
+// 已经通过SetTransportParameters设置传输参数的客户端启动后即可通过GetCryptoData取得Initial级别的ClientHello；
+// 尚未设置传输参数时握手暂停，直到调用SetTransportParameters
+func (c *CryptoSetup) StartHandshake() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.tlsConfig == nil {
+		return fmt.Errorf("缺少TLS配置")
+	}
+	if c.tlsConn != nil {
+		return fmt.Errorf("TLS握手已经开始")
+	}
+	if c.perspective != protocol.PerspectiveClient && c.perspective != protocol.PerspectiveServer {
+		return fmt.Errorf("无效的角色: %d", c.perspective)
+	}
+
+	// QUIC只能使用TLS 1.3，见RFC 9001第4.2节
+	config := c.tlsConfig.Clone()
+	config.MinVersion = tls.VersionTLS13
+	if c.keyLogWriter != nil {
+		// 密钥在安装时由logSecret输出，其中包括crypto/tls不输出的0-RTT密钥
+		config.KeyLogWriter = nil
+	}
+	if c.perspective == protocol.PerspectiveServer {
+		random := config.Rand
+		if random == nil {
+			random = rand.Reader
+		}
+		c.ticketAgeAdd = &ticketAgeAddRand{rand: random}
+		config.Rand = c.ticketAgeAdd
+	}
+	// 通过会话事件决定恢复会话时是否使用0-RTT，客户端需要自行保存收到的会话
+	quicConfig := &tls.QUICConfig{TLSConfig: config, EnableSessionEvents: true}
+	if c.perspective == protocol.PerspectiveClient {
+		c.tlsConn = tls.QUICClient(quicConfig)
+	} else {
+		c.tlsConn = tls.QUICServer(quicConfig)
+	}
+
+	// 传输参数扩展是QUIC握手的必需扩展，未提前设置时在TLS需要时通过QUICTransportParametersRequired事件请求
+	if c.transportParams != nil {
+		c.tlsConn.SetTransportParameters(c.transportParams)
+	}
+	if err := c.tlsConn.Start(context.Background()); err != nil {
+		return tlsError(err)
+	}
+	return c.processEvents()
+}
+
+// IsClient 返回本端是否为客户端
+func (c *CryptoSetup) IsClient() bool {
+	return c.perspective == protocol.PerspectiveClient
+}
+
+// Perspective 返回创建时指定的本端角色
+func (c *CryptoSetup) Perspective() protocol.Perspective {
+	return c.perspective
+}
+
+// ConnectionState 返回TLS连接的状态，包括协商的ALPN和对端证书
+func (c *CryptoSetup) ConnectionState() tls.ConnectionState {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.tlsConn == nil {
+		return tls.ConnectionState{}
+	}
+	return c.tlsConn.ConnectionState()
+}
+
+// SetTransportParameters 设置本端编码后的传输参数，在TLS的quic_transport_parameters扩展中发送。
+// 客户端需要在StartHandshake之前设置；服务端可以在收到客户端的传输参数之后再设置，
+// 握手在此之前暂停，设置后继续处理握手并产生待发送的数据
+func (c *CryptoSetup) SetTransportParameters(params []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.transportParams = append([]byte{}, params...)
+	if !c.transportParamsRequired {
+		return nil
+	}
+	c.transportParamsRequired = false
+	c.tlsConn.SetTransportParameters(c.transportParams)
+	return c.processEvents()
+}
+
+// TransportParametersRequired 返回TLS握手是否正在等待本端的传输参数
+func (c *CryptoSetup) TransportParametersRequired() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.transportParamsRequired
+}
+
+// PeerTransportParameters 返回对端编码后的传输参数，尚未收到时返回nil
+func (c *CryptoSetup) PeerTransportParameters() []byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.peerTransportParams == nil {
+		return nil
+	}
+	return append([]byte{}, c.peerTransportParams...)
+}
+
+// Close 关闭TLS连接，释放握手状态
+func (c *CryptoSetup) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.tlsConn == nil {
+		return nil
+	}
+	return c.tlsConn.Close()
+}
+
+// processEvents 处理TLS连接产生的事件：安装密钥、缓存待发送的握手数据、记录对端的传输参数和握手完成。
+// TLS请求本端的传输参数时停止处理，由SetTransportParameters继续。
+// 调用方需持有互斥锁
+func (c *CryptoSetup) processEvents() error {
+	for {
+		e := c.tlsConn.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret:
+			level, ok := levelFromTLS(e.Level)
+			if !ok {
+				continue
+			}
+			if err := c.installReadKeys(level, e.Suite, e.Data); err != nil {
+				return err
+			}
+			if err := c.logSecret(level, true, e.Data); err != nil {
+				return err
+			}
+			if level == LevelZeroRTT {
+				// 服务端安装0-RTT接收密钥即表示接受了0-RTT数据
+				c.earlyData = EarlyDataAccepted
+			} else if level > c.level {
+				c.level = level
+			}
+		case tls.QUICSetWriteSecret:
+			level, ok := levelFromTLS(e.Level)
+			if !ok {
+				continue
+			}
+			if err := c.installWriteKeys(level, e.Suite, e.Data); err != nil {
+				return err
+			}
+			if err := c.logSecret(level, false, e.Data); err != nil {
+				return err
+			}
+			switch level {
+			case LevelZeroRTT:
+				c.earlyData = EarlyDataPending
+			case LevelOneRTT:
+				c.dropZeroRTTSealer()
+			}
+		case tls.QUICWriteData:
+			level, ok := levelFromTLS(e.Level)
+			if !ok {
+				return fmt.Errorf("无效的握手数据加密级别: %v", e.Level)
+			}
+			if level == LevelInitial && c.perspective == protocol.PerspectiveClient {
+				c.recordClientRandom(e.Data)
+			}
+			c.cryptoData[level] = append(c.cryptoData[level], e.Data...)
+		case tls.QUICTransportParameters:
+			c.peerTransportParams = append([]byte{}, e.Data...)
+		case tls.QUICTransportParametersRequired:
+			// 握手暂停，等待SetTransportParameters提供本端的传输参数
+			c.transportParamsRequired = true
+			return nil
+		case tls.QUICRejectedEarlyData:
+			// 客户端发送的0-RTT数据全部丢失，需要在1-RTT包中重新发送
+			c.earlyData = EarlyDataRejected
+			c.dropZeroRTTSealer()
+		case tls.QUICResumeSession:
+			c.handleResumeSession(e.SessionState)
+		case tls.QUICStoreSession:
+			c.storeSession(e.SessionState)
+		case tls.QUICHandshakeDone:
+			c.handshakeComplete = true
+			c.level = LevelOneRTT
+			if c.earlyData == EarlyDataPending {
+				c.earlyData = EarlyDataAccepted
+			}
+			// 服务端完成握手即确认握手，见RFC 9001第4.1.2节
+			if c.perspective == protocol.PerspectiveServer {
+				c.handshakeConfirmed = true
+				// 票据签发失败只影响之后的会话恢复
+				_ = c.sendSessionTicket()
+			}
+		}
+	}
+}
+
+// levelFromTLS 将crypto/tls的加密级别转换为CryptoLevel
+func levelFromTLS(level tls.QUICEncryptionLevel) (CryptoLevel, bool) {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return LevelInitial, true
+	case tls.QUICEncryptionLevelEarly:
+		return LevelZeroRTT, true
+	case tls.QUICEncryptionLevelHandshake:
+		return LevelHandshake, true
+	case tls.QUICEncryptionLevelApplication:
+		return LevelOneRTT, true
+	default:
+		return 0, false
+	}
+}
+
+// levelToTLS 将CryptoLevel转换为crypto/tls的加密级别
+func levelToTLS(level CryptoLevel) tls.QUICEncryptionLevel {
+	switch level {
+	case LevelZeroRTT:
+		return tls.QUICEncryptionLevelEarly
+	case LevelHandshake:
+		return tls.QUICEncryptionLevelHandshake
+	case LevelOneRTT:
+		return tls.QUICEncryptionLevelApplication
+	default:
+		return tls.QUICEncryptionLevelInitial
+	}
+}
+
+// tlsError 将TLS错误转换为传输层错误，TLS告警映射为CRYPTO_ERROR，见RFC 9001第4.8节
+func tlsError(err error) error {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return &protocol.TransportError{
+			Code:   protocol.CryptoErrorBase + protocol.TransportErrorCode(alert),
+			Reason: err.Error(),
+		}
+	}
+	return protocol.NewTransportError(protocol.InternalError, "TLS握手失败: %v", err)
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// HeaderProtectionSampleLen 计算头部保护掩码时的密文采样长度
+const HeaderProtectionSampleLen = 16
+
+// 头部保护掩码作用于首字节的位，长包头保护低4位，短包头保护低5位
+const (
+	longHeaderProtectedBits  = 0x0f
+	shortHeaderProtectedBits = 0x1f
+)
+
+// HeaderProtector 实现RFC 9001第5.4节的头部保护，
+// 使用密文采样生成掩码，掩盖首字节中的标志位和包序号
+type HeaderProtector struct {
+	// block AES密码套件使用AES-ECB生成掩码
+	block cipher.Block
+	// chachaKey ChaCha20密码套件的头部保护密钥
+	chachaKey []byte
+}
+
+// NewHeaderProtector 使用头部保护密钥创建HeaderProtector
+func NewHeaderProtector(suiteID uint16, hpKey []byte) (*HeaderProtector, error) {
+	suite, err := getCipherSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	if len(hpKey) != suite.KeyLen {
+		return nil, fmt.Errorf("头部保护密钥长度错误: %d字节", len(hpKey))
+	}
+	if suiteID == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		return &HeaderProtector{chachaKey: append([]byte{}, hpKey...)}, nil
+	}
+	block, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, fmt.Errorf("创建头部保护密钥失败: %v", err)
+	}
+	return &HeaderProtector{block: block}, nil
+}
+
+// newHeaderProtectorFromSecret 从流量密钥派生头部保护密钥
+func newHeaderProtectorFromSecret(suiteID uint16, secret []byte, version uint32) (*HeaderProtector, error) {
+	suite, err := getCipherSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	hpKey := hkdfExpandLabel(suite.Hash, secret, getVersionParams(version).hpLabel, nil, suite.KeyLen)
+	return NewHeaderProtector(suiteID, hpKey)
+}
+
+// mask 根据密文采样生成5字节的掩码
+func (p *HeaderProtector) mask(sample []byte) ([5]byte, error) {
+	var mask [5]byte
+	if len(sample) != HeaderProtectionSampleLen {
+		return mask, fmt.Errorf("头部保护采样长度错误: %d字节", len(sample))
+	}
+	if p.block != nil {
+		var out [aes.BlockSize]byte
+		p.block.Encrypt(out[:], sample)
+		copy(mask[:], out[:])
+		return mask, nil
+	}
+
+	// ChaCha20：采样的前4字节为小端序的块计数器，其余12字节为随机数
+	c, err := chacha20.NewUnauthenticatedCipher(p.chachaKey, sample[4:])
+	if err != nil {
+		return mask, fmt.Errorf("创建ChaCha20失败: %v", err)
+	}
+	c.SetCounter(binary.LittleEndian.Uint32(sample[:4]))
+	c.XORKeyStream(mask[:], mask[:])
+	return mask, nil
+}
+
+// protectedBits 返回首字节中受头部保护的位
+func protectedBits(firstByte byte) byte {
+	if firstByte&0x80 != 0 {
+		return longHeaderProtectedBits
+	}
+	return shortHeaderProtectedBits
+}
+
+// EncryptHeader 添加头部保护。firstByte为未保护的首字节，
+// pnBytes至少包含首字节指示的包序号长度，二者均被原地修改
+func (p *HeaderProtector) EncryptHeader(sample []byte, firstByte *byte, pnBytes []byte) error {
+	mask, err := p.mask(sample)
+	if err != nil {
+		return err
+	}
+	// 包序号长度需要在掩盖首字节之前读取
+	pnLen := int(*firstByte&0x03) + 1
+	if len(pnBytes) < pnLen {
+		return fmt.Errorf("包序号字段长度不足: %d字节", len(pnBytes))
+	}
+	*firstByte ^= mask[0] & protectedBits(*firstByte)
+	for i := 0; i < pnLen; i++ {
+		pnBytes[i] ^= mask[i+1]
+	}
+	return nil
+}
+
+// DecryptHeader 去除头部保护。pnBytes传入包序号偏移处最多4字节，
+// 只有去除保护后首字节指示的包序号长度范围内的字节会被修改
+func (p *HeaderProtector) DecryptHeader(sample []byte, firstByte *byte, pnBytes []byte) error {
+	mask, err := p.mask(sample)
+	if err != nil {
+		return err
+	}
+	*firstByte ^= mask[0] & protectedBits(*firstByte)
+	pnLen := int(*firstByte&0x03) + 1
+	if len(pnBytes) < pnLen {
+		return fmt.Errorf("包序号字段长度不足: %d字节", len(pnBytes))
+	}
+	for i := 0; i < pnLen; i++ {
+		pnBytes[i] ^= mask[i+1]
+	}
+	return nil
+}
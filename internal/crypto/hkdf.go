@@ -0,0 +1,49 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"hash"
+)
+
+// hkdfExtract 实现RFC 5869第2.2节的HKDF-Extract：PRK = HMAC-Hash(salt, IKM)
+func hkdfExtract(newHash func() hash.Hash, salt, ikm []byte) []byte {
+	h := hmac.New(newHash, salt)
+	h.Write(ikm)
+	return h.Sum(nil)
+}
+
+// hkdfExpand 实现RFC 5869第2.3节的HKDF-Expand：
+// T(i) = HMAC-Hash(PRK, T(i-1) | info | i)，输出T(1) | T(2) | ...的前length字节
+func hkdfExpand(newHash func() hash.Hash, prk, info []byte, length int) []byte {
+	h := hmac.New(newHash, prk)
+	output := make([]byte, 0, length+h.Size())
+	var prev []byte
+	for counter := byte(1); len(output) < length; counter++ {
+		h.Reset()
+		h.Write(prev)
+		h.Write(info)
+		h.Write([]byte{counter})
+		prev = h.Sum(nil)
+		output = append(output, prev...)
+	}
+	return output[:length]
+}
+
+// hkdfExpandLabel 实现RFC 8446第7.1节的HKDF-Expand-Label，标签自动加上"tls13 "前缀：
+//
+//	struct {
+//	    uint16 length = Length;
+//	    opaque label<7..255> = "tls13 " + Label;
+//	    opaque context<0..255> = Context;
+//	} HkdfLabel;
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	const labelPrefix = "tls13 "
+	hkdfLabel := make([]byte, 0, 2+1+len(labelPrefix)+len(label)+1+len(context))
+	hkdfLabel = append(hkdfLabel, byte(length>>8), byte(length))
+	hkdfLabel = append(hkdfLabel, byte(len(labelPrefix)+len(label)))
+	hkdfLabel = append(hkdfLabel, labelPrefix...)
+	hkdfLabel = append(hkdfLabel, label...)
+	hkdfLabel = append(hkdfLabel, byte(len(context)))
+	hkdfLabel = append(hkdfLabel, context...)
+	return hkdfExpand(newHash, secret, hkdfLabel, length)
+}
@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// initialSuiteID Initial包固定使用的密码套件，见RFC 9001第5.2节
+const initialSuiteID = tls.TLS_AES_128_GCM_SHA256
+
+// initialSecrets 由客户端首个Initial包的目标连接ID派生Initial级别客户端和服务端的流量密钥，见RFC 9001第5.2节：
+//
+//	initial_secret = HKDF-Extract(initial_salt, client_dst_connection_id)
+//	client_initial_secret = HKDF-Expand-Label(initial_secret, "client in", "", 32)
+//	server_initial_secret = HKDF-Expand-Label(initial_secret, "server in", "", 32)
+func initialSecrets(version uint32, destConnID protocol.ConnectionID) (clientSecret, serverSecret []byte) {
+	initialSecret := hkdfExtract(sha256.New, getVersionParams(version).initialSalt, destConnID)
+	clientSecret = hkdfExpandLabel(sha256.New, initialSecret, "client in", nil, sha256.Size)
+	serverSecret = hkdfExpandLabel(sha256.New, initialSecret, "server in", nil, sha256.Size)
+	return clientSecret, serverSecret
+}
+
+// SetInitialKeys 以客户端首个Initial包的目标连接ID派生并安装Initial级别的密钥，
+// 收到Retry包后需要以新的目标连接ID重新设置。读写方向由创建时指定的角色决定，与连接ID无关；
+// 之后通过SetVersion切换版本时会使用新版本的盐值重新派生
+func (c *CryptoSetup) SetInitialKeys(destConnID protocol.ConnectionID) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.perspective != protocol.PerspectiveClient && c.perspective != protocol.PerspectiveServer {
+		return fmt.Errorf("无效的角色，无法确定Initial密钥的方向: %d", c.perspective)
+	}
+	if c.discarded[LevelInitial] {
+		return ErrKeysDiscarded
+	}
+	c.initialConnID = append(protocol.ConnectionID{}, destConnID...)
+	return c.installInitialKeys()
+}
+
+// installInitialKeys 按当前版本和initialConnID安装Initial级别的密钥，调用方需持有互斥锁
+func (c *CryptoSetup) installInitialKeys() error {
+	readSecret, writeSecret := c.initialSecrets(c.version)
+	if err := c.installReadKeys(LevelInitial, initialSuiteID, readSecret); err != nil {
+		return err
+	}
+	c.initialReadVersion = c.version
+	c.nextInitial = nil
+	return c.installWriteKeys(LevelInitial, initialSuiteID, writeSecret)
+}
+
+// initialSecrets 按本端的角色返回指定版本Initial级别读写方向的流量密钥，调用方需持有互斥锁
+func (c *CryptoSetup) initialSecrets(version uint32) (readSecret, writeSecret []byte) {
+	clientSecret, serverSecret := initialSecrets(version, c.initialConnID)
+	if c.perspective == protocol.PerspectiveServer {
+		return clientSecret, serverSecret
+	}
+	return serverSecret, clientSecret
+}
+
+// initialOpener 某个版本的Initial读取密钥
+type initialOpener struct {
+	version      uint32
+	opener       *PacketAEAD
+	headerOpener *HeaderProtector
+}
+
+// PrepareInitialVersion 派生另一个版本的Initial读取密钥，用于尝试解密对端以兼容版本协商选定的版本发送的
+// Initial包，当前版本和其他密钥不变。该版本的数据包通过认证后由CommitInitialVersion取代当前的读取密钥
+func (c *CryptoSetup) PrepareInitialVersion(version uint32) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.prepareInitialVersion(version)
+}
+
+// prepareInitialVersion 实现PrepareInitialVersion，调用方需持有互斥锁
+func (c *CryptoSetup) prepareInitialVersion(version uint32) error {
+	if c.discarded[LevelInitial] {
+		return ErrKeysDiscarded
+	}
+	if c.initialConnID == nil {
+		return ErrKeysNotYetAvailable
+	}
+	if version == c.initialReadVersion {
+		c.nextInitial = nil
+		return nil
+	}
+	readSecret, _ := c.initialSecrets(version)
+	opener, err := newPacketAEADFromSecret(initialSuiteID, readSecret, version)
+	if err != nil {
+		return err
+	}
+	headerOpener, err := newHeaderProtectorFromSecret(initialSuiteID, readSecret, version)
+	if err != nil {
+		return err
+	}
+	c.nextInitial = &initialOpener{version: version, opener: opener, headerOpener: headerOpener}
+	return nil
+}
+
+// CommitInitialVersion 指定版本的Initial包通过认证后调用：该版本的读取密钥取代当前的读取密钥
+func (c *CryptoSetup) CommitInitialVersion(version uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.nextInitial == nil || c.nextInitial.version != version || c.discarded[LevelInitial] {
+		return
+	}
+	c.openers[LevelInitial] = c.nextInitial.opener
+	c.headerOpeners[LevelInitial] = c.nextInitial.headerOpener
+	c.initialReadVersion = version
+	c.nextInitial = nil
+}
+
+// initialReadKeys 返回指定版本的Initial读取密钥，调用方需持有互斥锁
+func (c *CryptoSetup) initialReadKeys(version uint32) (*PacketAEAD, *HeaderProtector, error) {
+	if c.discarded[LevelInitial] {
+		return nil, nil, ErrKeysDiscarded
+	}
+	switch {
+	case c.openers[LevelInitial] == nil:
+		return nil, nil, ErrKeysNotYetAvailable
+	case version == c.initialReadVersion:
+		return c.openers[LevelInitial], c.headerOpeners[LevelInitial], nil
+	case c.nextInitial != nil && version == c.nextInitial.version:
+		return c.nextInitial.opener, c.nextInitial.headerOpener, nil
+	}
+	return nil, nil, fmt.Errorf("没有版本0x%x的Initial密钥", version)
+}
+
+// DecryptInitialHeader 使用数据包版本对应的Initial头部保护密钥去除首字节和包序号的掩码
+func (c *CryptoSetup) DecryptInitialHeader(version uint32, sample []byte, firstByte *byte, pnBytes []byte) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	_, headerOpener, err := c.initialReadKeys(version)
+	if err != nil {
+		return err
+	}
+	return headerOpener.DecryptHeader(sample, firstByte, pnBytes)
+}
+
+// OpenInitial 使用数据包版本对应的Initial密钥解密并认证数据包负载
+func (c *CryptoSetup) OpenInitial(version uint32, dst, payload []byte, pn protocol.PacketNumber, header []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	opener, _, err := c.initialReadKeys(version)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := opener.Open(dst, payload, pn, header)
+	if err != nil {
+		return nil, c.onOpenFailed(LevelInitial, err)
+	}
+	return plaintext, nil
+}
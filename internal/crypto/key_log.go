@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"LQUIC/internal/protocol"
+)
+
+// NSS密钥日志格式（SSLKEYLOGFILE）中TLS 1.3流量密钥的标签
+const (
+	keyLogLabelClientEarly     = "CLIENT_EARLY_TRAFFIC_SECRET"
+	keyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogLabelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// ClientHello中client_random的位置：消息类型(1) + 长度(3) + legacy_version(2)之后的32字节
+const (
+	clientRandomOffset = 6
+	clientRandomLen    = 32
+)
+
+// keyLogMutex 保护所有连接共享的密钥日志输出，保证每一行完整写入
+var keyLogMutex sync.Mutex
+
+// SetKeyLogWriter 设置以NSS密钥日志格式输出TLS流量密钥的目标，需要在StartHandshake之前调用。
+// 0-RTT、Handshake和1-RTT级别的密钥在安装时各输出一行，Wireshark等工具据此解密抓包；
+// Initial密钥可以由目标连接ID派生，不需要输出。设置后不再使用TLSConfig.KeyLogWriter，避免重复输出。
+// 密钥日志会泄露连接的全部流量，只能用于调试
+func (c *CryptoSetup) SetKeyLogWriter(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.keyLogWriter = w
+}
+
+// recordClientRandom 从ClientHello中取出client_random，作为密钥日志中标识连接的字段。
+// 客户端在TLS产生ClientHello时调用，服务端在收到ClientHello时调用。调用方需持有互斥锁
+func (c *CryptoSetup) recordClientRandom(hello []byte) {
+	if c.keyLogWriter == nil || c.clientRandom != nil {
+		return
+	}
+	if len(hello) < clientRandomOffset+clientRandomLen || hello[0] != 1 {
+		return
+	}
+	c.clientRandom = append([]byte{}, hello[clientRandomOffset:clientRandomOffset+clientRandomLen]...)
+}
+
+// logSecret 以NSS密钥日志格式输出安装的流量密钥，read表示该密钥用于接收。调用方需持有互斥锁
+func (c *CryptoSetup) logSecret(level CryptoLevel, read bool, secret []byte) error {
+	if c.keyLogWriter == nil {
+		return nil
+	}
+	if c.clientRandom == nil {
+		return fmt.Errorf("尚未收到ClientHello，无法输出密钥日志")
+	}
+	// 客户端发送和服务端接收的是客户端的流量密钥
+	fromClient := read == (c.perspective == protocol.PerspectiveServer)
+	var label string
+	switch {
+	case level == LevelZeroRTT:
+		label = keyLogLabelClientEarly
+	case level == LevelHandshake && fromClient:
+		label = keyLogLabelClientHandshake
+	case level == LevelHandshake:
+		label = keyLogLabelServerHandshake
+	case level == LevelOneRTT && fromClient:
+		label = keyLogLabelClientTraffic
+	case level == LevelOneRTT:
+		label = keyLogLabelServerTraffic
+	default:
+		return nil
+	}
+
+	line := fmt.Appendf(nil, "%s %x %x\n", label, c.clientRandom, secret)
+	keyLogMutex.Lock()
+	defer keyLogMutex.Unlock()
+	if _, err := c.keyLogWriter.Write(line); err != nil {
+		return fmt.Errorf("写入密钥日志失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"LQUIC/internal/protocol"
+)
+
+const (
+	// DefaultKeyUpdateInterval 默认使用同一代1-RTT密钥发送多少个数据包后自动发起密钥更新，
+	// 远低于AES-GCM 2^23个数据包的机密性上限，见RFC 9001第6.6节
+	DefaultKeyUpdateInterval = 1 << 20
+	// DefaultOldKeyTimeout 密钥更新后默认保留上一代接收密钥的时长
+	DefaultOldKeyTimeout = 3 * time.Second
+
+	// keyPhaseBit 短包头首字节中的密钥阶段位
+	keyPhaseBit = 0x04
+)
+
+// ErrKeyUpdateNotAllowed 握手尚未确认，或对端尚未确认当前密钥阶段发送的数据包，不能发起密钥更新
+var ErrKeyUpdateNotAllowed = errors.New("当前不能发起密钥更新")
+
+// KeyUpdateConfig 1-RTT密钥更新策略
+type KeyUpdateConfig struct {
+	// Interval 使用同一代密钥发送多少个数据包后自动发起更新，为0时使用DefaultKeyUpdateInterval
+	Interval uint64
+	// OldKeyTimeout 密钥更新后保留上一代接收密钥的时长，用于解密乱序到达的数据包，为0时使用DefaultOldKeyTimeout
+	OldKeyTimeout time.Duration
+}
+
+// keyUpdateState 1-RTT密钥更新状态，见RFC 9001第6节。头部保护密钥不随密钥更新改变
+type keyUpdateState struct {
+	config KeyUpdateConfig
+	// 当前一代的流量密钥和密码套件
+	suiteID     uint16
+	readSecret  []byte
+	writeSecret []byte
+	// 当前密钥阶段，以及已经完成的密钥更新次数
+	keyPhase   bool
+	generation uint64
+	// nextOpener 预先派生的下一代接收密钥，用于识别对端发起的更新
+	nextOpener *PacketAEAD
+	// prevOpener 上一代接收密钥，超过prevExpiry后丢弃
+	prevOpener *PacketAEAD
+	prevExpiry time.Time
+	// firstSentPN 当前阶段发送的第一个数据包，被对端确认后才能再次发起更新
+	firstSentPN protocol.PacketNumber
+	// firstRecvPN 当前阶段收到的第一个数据包，阶段不同且包序号更小的数据包属于上一阶段
+	firstRecvPN protocol.PacketNumber
+	// largestAcked 对端确认的最大1-RTT包序号
+	largestAcked protocol.PacketNumber
+}
+
+// newKeyUpdateState 创建尚未安装1-RTT密钥的密钥更新状态
+func newKeyUpdateState() keyUpdateState {
+	return keyUpdateState{
+		config:       KeyUpdateConfig{Interval: DefaultKeyUpdateInterval, OldKeyTimeout: DefaultOldKeyTimeout},
+		firstSentPN:  protocol.InvalidPacketNumber,
+		firstRecvPN:  protocol.InvalidPacketNumber,
+		largestAcked: protocol.InvalidPacketNumber,
+	}
+}
+
+// nextTrafficSecret 派生下一代流量密钥：secret_<n+1> = HKDF-Expand-Label(secret_<n>, "quic ku", "", Hash.length)
+func nextTrafficSecret(suiteID uint16, secret []byte, version uint32) ([]byte, error) {
+	suite, err := getCipherSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	return hkdfExpandLabel(suite.Hash, secret, getVersionParams(version).kuLabel, nil, len(secret)), nil
+}
+
+// SetKeyUpdateConfig 设置1-RTT密钥更新策略
+func (c *CryptoSetup) SetKeyUpdateConfig(config KeyUpdateConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if config.Interval == 0 {
+		config.Interval = DefaultKeyUpdateInterval
+	}
+	if config.OldKeyTimeout == 0 {
+		config.OldKeyTimeout = DefaultOldKeyTimeout
+	}
+	c.keyUpdate.config = config
+}
+
+// KeyPhase 返回当前1-RTT密钥阶段，发送的短包头需要设置对应的密钥阶段位
+func (c *CryptoSetup) KeyPhase() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.keyUpdate.keyPhase
+}
+
+// KeyGeneration 返回已经完成的1-RTT密钥更新次数，包括对端发起的更新
+func (c *CryptoSetup) KeyGeneration() uint64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.keyUpdate.generation
+}
+
+// InitiateKeyUpdate 发起1-RTT密钥更新，之后发送的数据包使用新的密钥和密钥阶段。
+// 握手确认之前，或对端尚未确认当前阶段发送的数据包时返回ErrKeyUpdateNotAllowed
+func (c *CryptoSetup) InitiateKeyUpdate() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.canUpdateKeys() {
+		return ErrKeyUpdateNotAllowed
+	}
+	return c.rotateKeys()
+}
+
+// SetLargestAcked 记录对端确认的最大1-RTT包序号，当前阶段的数据包被确认后才能再次发起密钥更新
+func (c *CryptoSetup) SetLargestAcked(pn protocol.PacketNumber) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	k := &c.keyUpdate
+	if k.largestAcked == protocol.InvalidPacketNumber || pn > k.largestAcked {
+		k.largestAcked = pn
+	}
+}
+
+// setOneRTTReadSecret 记录1-RTT接收方向的流量密钥，并预先派生下一代接收密钥。调用方需持有互斥锁
+func (c *CryptoSetup) setOneRTTReadSecret(suiteID uint16, secret []byte) error {
+	next, err := nextTrafficSecret(suiteID, secret, c.version)
+	if err != nil {
+		return err
+	}
+	nextOpener, err := newPacketAEADFromSecret(suiteID, next, c.version)
+	if err != nil {
+		return err
+	}
+	c.keyUpdate.suiteID = suiteID
+	c.keyUpdate.readSecret = append([]byte{}, secret...)
+	c.keyUpdate.nextOpener = nextOpener
+	return nil
+}
+
+// setOneRTTWriteSecret 记录1-RTT发送方向的流量密钥。调用方需持有互斥锁
+func (c *CryptoSetup) setOneRTTWriteSecret(suiteID uint16, secret []byte) {
+	c.keyUpdate.suiteID = suiteID
+	c.keyUpdate.writeSecret = append([]byte{}, secret...)
+}
+
+// canUpdateKeys 检查能否发起密钥更新：握手已经确认，且当前阶段发送的数据包已被对端确认，
+// 见RFC 9001第6.1节。调用方需持有互斥锁
+func (c *CryptoSetup) canUpdateKeys() bool {
+	k := &c.keyUpdate
+	return c.handshakeConfirmed &&
+		c.sealers[LevelOneRTT] != nil && k.nextOpener != nil &&
+		k.firstSentPN != protocol.InvalidPacketNumber &&
+		k.largestAcked != protocol.InvalidPacketNumber && k.largestAcked >= k.firstSentPN
+}
+
+// rotateKeys 切换到下一代1-RTT密钥并翻转密钥阶段，保留上一代接收密钥用于解密乱序的数据包。
+// 调用方需持有互斥锁
+func (c *CryptoSetup) rotateKeys() error {
+	k := &c.keyUpdate
+	nextWrite, err := nextTrafficSecret(k.suiteID, k.writeSecret, c.version)
+	if err != nil {
+		return err
+	}
+	sealer, err := newPacketAEADFromSecret(k.suiteID, nextWrite, c.version)
+	if err != nil {
+		return err
+	}
+	nextRead, err := nextTrafficSecret(k.suiteID, k.readSecret, c.version)
+	if err != nil {
+		return err
+	}
+	opener := k.nextOpener
+	if err := c.setOneRTTReadSecret(k.suiteID, nextRead); err != nil {
+		return err
+	}
+
+	k.prevOpener = c.openers[LevelOneRTT]
+	k.prevExpiry = time.Now().Add(k.config.OldKeyTimeout)
+	c.openers[LevelOneRTT] = opener
+	c.sealers[LevelOneRTT] = sealer
+	k.writeSecret = nextWrite
+	k.keyPhase = !k.keyPhase
+	k.generation++
+	k.firstSentPN = protocol.InvalidPacketNumber
+	k.firstRecvPN = protocol.InvalidPacketNumber
+	return nil
+}
+
+// sealOneRTT 使用当前一代密钥加密1-RTT数据包，包头的密钥阶段位必须与当前阶段一致。
+// 当前密钥加密的数据包达到更新间隔或机密性上限的一半后自动发起密钥更新，
+// 为对端确认留出余量，避免达到上限。调用方需持有互斥锁
+func (c *CryptoSetup) sealOneRTT(dst, payload []byte, pn protocol.PacketNumber, header []byte) ([]byte, error) {
+	k := &c.keyUpdate
+	if len(header) == 0 || (header[0]&keyPhaseBit != 0) != k.keyPhase {
+		return nil, fmt.Errorf("包头的密钥阶段与当前密钥不一致")
+	}
+	sealer := c.sealers[LevelOneRTT]
+	sealed := sealer.Seal(dst, payload, pn, header)
+
+	if k.firstSentPN == protocol.InvalidPacketNumber {
+		k.firstSentPN = pn
+	}
+	limit, _ := c.aeadLimits(LevelOneRTT)
+	if n := sealer.PacketsSealed(); (n >= k.config.Interval || n >= limit/2) && c.canUpdateKeys() {
+		if err := c.rotateKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// openOneRTT 根据包头的密钥阶段位选择当前、上一代或下一代密钥解密1-RTT数据包，见RFC 9001第6.3节。
+// 使用下一代密钥解密成功表示对端发起了密钥更新，本端随之更新；
+// 对端在本端用新密钥发送数据包之前连续更新时返回KEY_UPDATE_ERROR。调用方需持有互斥锁
+func (c *CryptoSetup) openOneRTT(dst, payload []byte, pn protocol.PacketNumber, header []byte) ([]byte, error) {
+	k := &c.keyUpdate
+	if len(header) == 0 {
+		return nil, ErrDecryptionFailed
+	}
+	if k.prevOpener != nil && time.Now().After(k.prevExpiry) {
+		k.prevOpener = nil
+	}
+
+	if (header[0]&keyPhaseBit != 0) == k.keyPhase {
+		plaintext, err := c.openers[LevelOneRTT].Open(dst, payload, pn, header)
+		if err != nil {
+			return nil, err
+		}
+		if k.firstRecvPN == protocol.InvalidPacketNumber || pn < k.firstRecvPN {
+			k.firstRecvPN = pn
+		}
+		return plaintext, nil
+	}
+
+	// 密钥阶段不同：包序号早于当前阶段的数据包属于上一阶段
+	if k.prevOpener != nil && (k.firstRecvPN == protocol.InvalidPacketNumber || pn < k.firstRecvPN) {
+		return k.prevOpener.Open(dst, payload, pn, header)
+	}
+	if k.nextOpener == nil {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := k.nextOpener.Open(dst, payload, pn, header)
+	if err != nil {
+		return nil, err
+	}
+	if k.firstSentPN == protocol.InvalidPacketNumber {
+		return nil, protocol.NewTransportError(protocol.KeyUpdateError, "对端在确认上一次密钥更新之前再次更新密钥")
+	}
+	if err := c.rotateKeys(); err != nil {
+		return nil, err
+	}
+	k.firstRecvPN = pn
+	return plaintext, nil
+}
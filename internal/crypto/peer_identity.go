@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// PeerIdentity 对端证书经过验证的身份，服务端据此对客户端做服务间授权
+type PeerIdentity struct {
+	// Certificate 对端的叶子证书
+	Certificate *x509.Certificate
+	// VerifiedChains 验证通过的证书链，每条链以对端的叶子证书开头、以信任的根证书结尾
+	VerifiedChains [][]*x509.Certificate
+	// URIs 叶子证书中的URI SAN
+	URIs []*url.URL
+	// SPIFFEID 叶子证书中的SPIFFE ID，没有或不止一个spiffe URI SAN时为nil
+	SPIFFEID *url.URL
+}
+
+// NewPeerIdentity 从TLS连接状态中取出对端经过验证的身份，
+// 对端没有出示证书或证书没有经过验证（例如InsecureSkipVerify、RequestClientCert）时返回nil
+func NewPeerIdentity(state tls.ConnectionState) *PeerIdentity {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	id := &PeerIdentity{
+		Certificate:    leaf,
+		VerifiedChains: state.VerifiedChains,
+		URIs:           leaf.URIs,
+	}
+	// X.509 SVID只能包含一个SPIFFE ID
+	for _, u := range leaf.URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		if id.SPIFFEID != nil || ValidateSPIFFEID(u) != nil {
+			id.SPIFFEID = nil
+			break
+		}
+		id.SPIFFEID = u
+	}
+	return id
+}
+
+// TrustDomain 返回SPIFFE ID的信任域，没有SPIFFE ID时返回空字符串
+func (id *PeerIdentity) TrustDomain() string {
+	if id == nil || id.SPIFFEID == nil {
+		return ""
+	}
+	return id.SPIFFEID.Host
+}
+
+// ValidateSPIFFEID 检查URI是否为合法的SPIFFE ID：spiffe://信任域/路径，
+// 信任域只能包含小写字母、数字、'.'、'-'和'_'，路径不能包含空段或相对段，不能带端口、用户信息、查询或片段
+func ValidateSPIFFEID(u *url.URL) error {
+	if u.Scheme != "spiffe" {
+		return fmt.Errorf("SPIFFE ID的scheme必须为spiffe: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("SPIFFE ID缺少信任域")
+	}
+	if strings.Trim(u.Host, "abcdefghijklmnopqrstuvwxyz0123456789.-_") != "" {
+		return fmt.Errorf("SPIFFE ID的信任域包含非法字符: %q", u.Host)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return fmt.Errorf("SPIFFE ID不能包含用户信息、查询或片段")
+	}
+	if u.Path == "" {
+		return nil
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(u.Path, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("SPIFFE ID的路径包含空段或相对段: %q", u.Path)
+		}
+	}
+	return nil
+}
+
+// PeerIdentity 返回对端经过验证的身份，握手尚未验证对端证书时返回nil
+func (c *CryptoSetup) PeerIdentity() *PeerIdentity {
+	return NewPeerIdentity(c.ConnectionState())
+}
@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+)
+
+// RetryIntegrityTagLen Retry完整性标签的长度
+const RetryIntegrityTagLen = 16
+
+// retryAEAD 使用版本固定的密钥创建计算Retry完整性标签的AEAD
+func retryAEAD(version uint32) (cipher.AEAD, []byte, error) {
+	params := getVersionParams(version)
+	block, err := aes.NewCipher(params.retryKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建Retry密钥失败: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建Retry AEAD失败: %v", err)
+	}
+	return aead, params.retryNonce, nil
+}
+
+// retryPseudoPacket 构造Retry伪数据包：原始目标连接ID长度 + 原始目标连接ID + 不含标签的Retry包
+func retryPseudoPacket(origDestConnID, retry []byte) []byte {
+	pseudo := make([]byte, 0, 1+len(origDestConnID)+len(retry))
+	pseudo = append(pseudo, byte(len(origDestConnID)))
+	pseudo = append(pseudo, origDestConnID...)
+	return append(pseudo, retry...)
+}
+
+// ComputeRetryIntegrityTag 计算Retry包的完整性标签，retry为不含标签的Retry包，
+// 见RFC 9001第5.8节
+func ComputeRetryIntegrityTag(version uint32, origDestConnID, retry []byte) ([RetryIntegrityTagLen]byte, error) {
+	var tag [RetryIntegrityTagLen]byte
+	aead, nonce, err := retryAEAD(version)
+	if err != nil {
+		return tag, err
+	}
+	copy(tag[:], aead.Seal(nil, nonce, nil, retryPseudoPacket(origDestConnID, retry)))
+	return tag, nil
+}
+
+// VerifyRetryIntegrityTag 校验完整Retry包末尾的完整性标签
+func VerifyRetryIntegrityTag(version uint32, origDestConnID, retry []byte) bool {
+	if len(retry) < RetryIntegrityTagLen {
+		return false
+	}
+	body := retry[:len(retry)-RetryIntegrityTagLen]
+	tag, err := ComputeRetryIntegrityTag(version, origDestConnID, body)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(tag[:], retry[len(body):]) == 1
+}
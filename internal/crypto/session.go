@@ -2,91 +2,24 @@
 package crypto
 
 import (
-	"crypto/rand"
-	"sync"
+	"errors"
 	"time"
 )
 
-// SessionTicket 表示会话票据
+// ErrInvalidTicket 会话票据无法解密或格式错误
+var ErrInvalidTicket = errors.New("无效的会话票据")
+
+// SessionTicket 表示客户端保存的会话票据，会话状态由crypto/tls维护，
+// 服务端签发的票据经过TicketKeySource中的密钥加密，不含任何明文的会话密钥
 type SessionTicket struct {
-	// 票据ID
-	ID []byte
-	// 会话密钥
-	SessionKey []byte
 	// 创建时间
 	CreatedAt time.Time
 	// 过期时间
 	ExpiresAt time.Time
-}
-
-// SessionManager 管理会话票据和恢复
-type SessionManager struct {
-	mutex sync.RWMutex
-	// 存储会话票据，key为票据ID
-	tickets map[string]*SessionTicket
-	// 会话票据有效期
-	ticketValidity time.Duration
-}
-
-// NewSessionManager 创建新的会话管理器
-func NewSessionManager() *SessionManager {
-	return &SessionManager{
-		tickets:        make(map[string]*SessionTicket),
-		ticketValidity: 24 * time.Hour, // 默认票据有效期为24小时
-	}
-}
-
-// CreateTicket 创建新的会话票据
-func (sm *SessionManager) CreateTicket() (*SessionTicket, error) {
-	// 生成随机票据ID
-	id := make([]byte, 16)
-	if _, err := rand.Read(id); err != nil {
-		return nil, err
-	}
-
-	// 生成会话密钥
-	key := make([]byte, 32)
-	if _, err := rand.Read(key); err != nil {
-		return nil, err
-	}
-
-	now := time.Now()
-	ticket := &SessionTicket{
-		ID:         id,
-		SessionKey: key,
-		CreatedAt:  now,
-		ExpiresAt:  now.Add(sm.ticketValidity),
-	}
-
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-	sm.tickets[string(id)] = ticket
-
-	return ticket, nil
-}
-
-// GetTicket 获取会话票据
-func (sm *SessionManager) GetTicket(id []byte) *SessionTicket {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
-
-	ticket, exists := sm.tickets[string(id)]
-	if !exists || time.Now().After(ticket.ExpiresAt) {
-		return nil
-	}
-
-	return ticket
-}
-
-// RemoveExpiredTickets 清理过期的会话票据
-func (sm *SessionManager) RemoveExpiredTickets() {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
-	now := time.Now()
-	for id, ticket := range sm.tickets {
-		if now.After(ticket.ExpiresAt) {
-			delete(sm.tickets, id)
-		}
-	}
+	// Raw 加密后的票据，发送给客户端，服务端只需票据加密密钥即可还原票据内容
+	Raw []byte
+	// State 客户端保存的TLS会话恢复状态，与Raw一起用于恢复会话
+	State []byte
+	// 签发票据时连接的属性，与当前连接不一致时票据不能用于0-RTT
+	TicketBinding
 }
@@ -0,0 +1,285 @@
+package crypto
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionStoreEntries 内存票据存储默认最多保存的票据数量
+	DefaultSessionStoreEntries = 10000
+	// DefaultSessionStoreBytes 内存票据存储默认最多占用的字节数
+	DefaultSessionStoreBytes = 16 << 20
+	// DefaultSessionExpiryInterval 默认清理过期票据的间隔
+	DefaultSessionExpiryInterval = time.Minute
+)
+
+// SessionStore 保存客户端的会话票据，以服务器名称为键
+type SessionStore interface {
+	// Get 返回键对应的票据，不存在或已过期时返回nil
+	Get(key string) *SessionTicket
+	// Put 保存票据，覆盖键原有的票据
+	Put(key string, ticket *SessionTicket) error
+	// Delete 删除键对应的票据
+	Delete(key string)
+}
+
+// ticketSize 估算票据占用的字节数
+func ticketSize(key string, t *SessionTicket) int {
+	return len(key) + len(t.Raw) + len(t.State) +
+		len(t.ServerName) + len(t.ALPN) + len(t.TransportParameters)
+}
+
+// lruEntry LRU链表中的一项
+type lruEntry struct {
+	key    string
+	ticket *SessionTicket
+	size   int
+}
+
+// LRUSessionStore 内存中的票据存储，按数量和字节数限制容量，超出时淘汰最久未使用的票据，
+// 并在后台定期清理过期票据
+type LRUSessionStore struct {
+	mutex      sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	// entries中的元素按最近使用顺序排列，队首最新
+	entries *list.List
+	index   map[string]*list.Element
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLRUSessionStore 创建内存票据存储，maxEntries和maxBytes为0时使用默认值；
+// expiryInterval为后台清理过期票据的间隔，为0时使用DefaultSessionExpiryInterval，为负数时不在后台清理
+func NewLRUSessionStore(maxEntries, maxBytes int, expiryInterval time.Duration) *LRUSessionStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultSessionStoreEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultSessionStoreBytes
+	}
+	if expiryInterval == 0 {
+		expiryInterval = DefaultSessionExpiryInterval
+	}
+	s := &LRUSessionStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    list.New(),
+		index:      make(map[string]*list.Element),
+		closeChan:  make(chan struct{}),
+	}
+	if expiryInterval > 0 {
+		go s.expiryLoop(expiryInterval)
+	}
+	return s
+}
+
+// Get 实现SessionStore接口，命中的票据成为最近使用的票据
+func (s *LRUSessionStore) Get(key string) *SessionTicket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.ticket.ExpiresAt) {
+		s.remove(elem)
+		return nil
+	}
+	s.entries.MoveToFront(elem)
+	return entry.ticket
+}
+
+// Put 实现SessionStore接口，超出容量时淘汰最久未使用的票据
+func (s *LRUSessionStore) Put(key string, ticket *SessionTicket) error {
+	size := ticketSize(key, ticket)
+	if size > s.maxBytes {
+		return fmt.Errorf("票据过大: %d字节，上限%d字节", size, s.maxBytes)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, ok := s.index[key]; ok {
+		s.remove(elem)
+	}
+	s.index[key] = s.entries.PushFront(&lruEntry{key: key, ticket: ticket, size: size})
+	s.bytes += size
+	for s.entries.Len() > s.maxEntries || s.bytes > s.maxBytes {
+		s.remove(s.entries.Back())
+	}
+	return nil
+}
+
+// Delete 实现SessionStore接口
+func (s *LRUSessionStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, ok := s.index[key]; ok {
+		s.remove(elem)
+	}
+}
+
+// Len 返回保存的票据数量
+func (s *LRUSessionStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.entries.Len()
+}
+
+// RemoveExpired 删除所有过期的票据
+func (s *LRUSessionStore) RemoveExpired() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for elem := s.entries.Front(); elem != nil; {
+		next := elem.Next()
+		if now.After(elem.Value.(*lruEntry).ticket.ExpiresAt) {
+			s.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Close 停止后台清理
+func (s *LRUSessionStore) Close() error {
+	s.closeOnce.Do(func() { close(s.closeChan) })
+	return nil
+}
+
+// expiryLoop 定期清理过期票据，直到Close
+func (s *LRUSessionStore) expiryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeChan:
+			return
+		case <-ticker.C:
+			s.RemoveExpired()
+		}
+	}
+}
+
+// remove 删除链表中的一项，调用方需持有互斥锁
+func (s *LRUSessionStore) remove(elem *list.Element) {
+	entry := s.entries.Remove(elem).(*lruEntry)
+	delete(s.index, entry.key)
+	s.bytes -= entry.size
+}
+
+// FileSessionStore 保存在文件中的票据存储，用于在进程重启后保留客户端的恢复票据。
+// 每次修改后以临时文件加重命名的方式整体写回，适合客户端保存的少量票据
+type FileSessionStore struct {
+	mutex   sync.Mutex
+	path    string
+	tickets map[string]*SessionTicket
+}
+
+// OpenFileSessionStore 打开票据文件，文件不存在时创建空的存储，已过期的票据在加载时丢弃
+func OpenFileSessionStore(path string) (*FileSessionStore, error) {
+	s := &FileSessionStore{path: path, tickets: make(map[string]*SessionTicket)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取票据文件失败: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.tickets); err != nil {
+		return nil, fmt.Errorf("解析票据文件失败: %v", err)
+	}
+	s.removeExpired(time.Now())
+	return s, nil
+}
+
+// Get 实现SessionStore接口
+func (s *FileSessionStore) Get(key string) *SessionTicket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ticket, ok := s.tickets[key]
+	if !ok || time.Now().After(ticket.ExpiresAt) {
+		return nil
+	}
+	return ticket
+}
+
+// Put 实现SessionStore接口，写入文件失败时返回错误，内存中的票据仍然更新
+func (s *FileSessionStore) Put(key string, ticket *SessionTicket) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tickets[key] = ticket
+	s.removeExpired(time.Now())
+	return s.save()
+}
+
+// Delete 实现SessionStore接口
+func (s *FileSessionStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.tickets[key]; ok {
+		delete(s.tickets, key)
+		_ = s.save()
+	}
+}
+
+// RemoveExpired 删除所有过期的票据并写回文件
+func (s *FileSessionStore) RemoveExpired() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.removeExpired(time.Now()) {
+		_ = s.save()
+	}
+}
+
+// removeExpired 删除过期的票据，返回是否有票据被删除。调用方需持有互斥锁
+func (s *FileSessionStore) removeExpired(now time.Time) bool {
+	removed := false
+	for key, ticket := range s.tickets {
+		if now.After(ticket.ExpiresAt) {
+			delete(s.tickets, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// save 将票据写回文件，票据包含会话密钥，文件只允许所有者读写。调用方需持有互斥锁
+func (s *FileSessionStore) save() error {
+	data, err := json.Marshal(s.tickets)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("写入票据文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入票据文件失败: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("写入票据文件失败: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("写入票据文件失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// StatelessResetGenerator 从静态密钥和连接ID派生无状态重置令牌，见RFC 9000第10.3.2节。
+// 令牌只依赖连接ID，服务器在丢失连接状态后仍能为收到的数据包生成相同的令牌
+type StatelessResetGenerator struct {
+	key []byte
+}
+
+// NewStatelessResetGenerator 创建无状态重置令牌生成器，key为32字节的密钥，为空时随机生成；
+// 多台服务器共享时需配置相同的密钥
+func NewStatelessResetGenerator(key []byte) (*StatelessResetGenerator, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("生成无状态重置密钥失败: %v", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("无状态重置密钥长度错误，期望32字节，实际%d字节", len(key))
+	}
+	return &StatelessResetGenerator{key: append([]byte{}, key...)}, nil
+}
+
+// Token 返回连接ID对应的无状态重置令牌：HMAC-SHA256(key, connID)的前16字节
+func (g *StatelessResetGenerator) Token(connID protocol.ConnectionID) protocol.StatelessResetToken {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(connID)
+	var token protocol.StatelessResetToken
+	copy(token[:], mac.Sum(nil))
+	return token
+}
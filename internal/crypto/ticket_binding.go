@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// 在TLS会话状态的附加数据中记录票据绑定属性的名称
+const (
+	ticketExtraServerName  = "lquic-sni"
+	ticketExtraALPN        = "lquic-alpn"
+	ticketExtraCipherSuite = "lquic-suite"
+	ticketExtraParams      = "lquic-params"
+)
+
+// TicketBinding 签发会话票据时连接的属性。属性与当前连接不一致的票据仍可以恢复会话，但不能用于0-RTT，
+// 防止票据被用于向其他主机或其他应用层协议发送0-RTT数据
+type TicketBinding struct {
+	// ServerName 客户端在SNI中提供的服务器名称
+	ServerName string
+	// ALPN 协商的应用层协议
+	ALPN string
+	// CipherSuite 协商的TLS密码套件
+	CipherSuite uint16
+	// TransportParameters 服务端编码后的传输参数，客户端据此限制0-RTT数据，见RFC 9000第7.4.1节
+	TransportParameters []byte
+}
+
+// Matches 检查票据记录的SNI、ALPN和密码套件与当前连接是否相同
+func (b TicketBinding) Matches(current TicketBinding) error {
+	if b.ServerName != current.ServerName {
+		return fmt.Errorf("票据签发给服务器%q，当前连接为%q", b.ServerName, current.ServerName)
+	}
+	if b.ALPN != current.ALPN {
+		return fmt.Errorf("票据签发时的应用层协议为%q，当前连接为%q", b.ALPN, current.ALPN)
+	}
+	if b.CipherSuite != current.CipherSuite {
+		return fmt.Errorf("票据签发时的密码套件为0x%04x，当前连接为0x%04x", b.CipherSuite, current.CipherSuite)
+	}
+	return nil
+}
+
+// Parameters 解析票据记录的服务端传输参数
+func (b TicketBinding) Parameters() (*protocol.TransportParameters, error) {
+	if b.TransportParameters == nil {
+		return nil, fmt.Errorf("票据没有记录服务端的传输参数")
+	}
+	return protocol.ParseTransportParameters(b.TransportParameters, protocol.PerspectiveServer)
+}
+
+// currentBinding 返回当前连接的票据绑定属性，params为服务端编码后的传输参数。调用方需持有互斥锁
+func (c *CryptoSetup) currentBinding(params []byte) TicketBinding {
+	state := c.tlsConn.ConnectionState()
+	return TicketBinding{
+		ServerName:          state.ServerName,
+		ALPN:                state.NegotiatedProtocol,
+		CipherSuite:         state.CipherSuite,
+		TransportParameters: params,
+	}
+}
+
+// appendTicketBinding 将票据绑定的属性写入TLS会话状态的附加数据
+func appendTicketBinding(extra [][]byte, b TicketBinding) [][]byte {
+	extra = appendTicketExtra(extra, ticketExtraServerName, []byte(b.ServerName))
+	extra = appendTicketExtra(extra, ticketExtraALPN, []byte(b.ALPN))
+	extra = appendTicketExtra(extra, ticketExtraCipherSuite, binary.BigEndian.AppendUint16(nil, b.CipherSuite))
+	if b.TransportParameters != nil {
+		extra = appendTicketExtra(extra, ticketExtraParams, b.TransportParameters)
+	}
+	return extra
+}
+
+// ticketBindingFromExtra 从TLS会话状态的附加数据中读取票据绑定的属性，缺少的属性保持零值
+func ticketBindingFromExtra(extra [][]byte) TicketBinding {
+	var b TicketBinding
+	if v, ok := ticketExtra(extra, ticketExtraServerName); ok {
+		b.ServerName = string(v)
+	}
+	if v, ok := ticketExtra(extra, ticketExtraALPN); ok {
+		b.ALPN = string(v)
+	}
+	if v, ok := ticketExtra(extra, ticketExtraCipherSuite); ok && len(v) == 2 {
+		b.CipherSuite = binary.BigEndian.Uint16(v)
+	}
+	if v, ok := ticketExtra(extra, ticketExtraParams); ok {
+		b.TransportParameters = append([]byte{}, v...)
+	}
+	return b
+}
@@ -0,0 +1,212 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// TicketKeyLen 会话票据加密密钥的长度，票据使用AES-256-GCM加密
+	TicketKeyLen = 32
+	// DefaultTicketKeyRotation 默认的票据加密密钥轮换间隔
+	DefaultTicketKeyRotation = 24 * time.Hour
+	// DefaultPreviousTicketKeys 默认保留的旧密钥数量，旧密钥只用于解密轮换之前签发的票据
+	DefaultPreviousTicketKeys = 2
+)
+
+// ErrNoTicketKey 密钥源没有提供可用的票据加密密钥
+var ErrNoTicketKey = errors.New("没有可用的会话票据加密密钥")
+
+// TicketKey 会话票据加密密钥
+type TicketKey struct {
+	// ID 密钥标识，写在票据开头，用于选择解密密钥
+	ID uint64
+	// Key 32字节的AES-256-GCM密钥
+	Key []byte
+}
+
+// TicketKeySource 提供会话票据加密密钥。第一个密钥是当前密钥，用于加密新票据；
+// 其余是轮换之前的旧密钥，只用于解密。多台服务器使用相同的密钥源时，任意一台都能解密其他服务器签发的票据
+type TicketKeySource interface {
+	TicketKeys() ([]TicketKey, error)
+}
+
+// StaticTicketKeys 固定的票据加密密钥，由外部（例如配置管理系统）负责轮换
+type StaticTicketKeys []TicketKey
+
+// TicketKeys 实现TicketKeySource接口
+func (s StaticTicketKeys) TicketKeys() ([]TicketKey, error) {
+	if len(s) == 0 {
+		return nil, ErrNoTicketKey
+	}
+	return s, nil
+}
+
+// TicketKeySchedule 按固定间隔轮换的票据加密密钥。每个轮换周期的密钥由共享的主密钥和周期序号派生：
+// key_n = HKDF-Expand-Label(secret, "lquic ticket", n, 32)，
+// 共享主密钥的服务器无需协调即可同步轮换
+type TicketKeySchedule struct {
+	mutex    sync.Mutex
+	secret   []byte
+	interval time.Duration
+	previous int
+	// now 返回当前时间，测试中可以替换
+	now func() time.Time
+	// 按周期序号缓存派生的密钥
+	cache map[uint64][]byte
+}
+
+// NewTicketKeySchedule 创建按interval轮换的票据密钥，保留previous个旧密钥。
+// secret为空时随机生成，此时签发的票据只有本进程能够解密
+func NewTicketKeySchedule(secret []byte, interval time.Duration, previous int) (*TicketKeySchedule, error) {
+	if secret == nil {
+		secret = make([]byte, TicketKeyLen)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("生成票据主密钥失败: %v", err)
+		}
+	}
+	if len(secret) < TicketKeyLen {
+		return nil, fmt.Errorf("票据主密钥至少需要%d字节，实际%d字节", TicketKeyLen, len(secret))
+	}
+	if interval <= 0 {
+		interval = DefaultTicketKeyRotation
+	}
+	if previous < 0 {
+		previous = 0
+	}
+	return &TicketKeySchedule{
+		secret:   append([]byte{}, secret...),
+		interval: interval,
+		previous: previous,
+		now:      time.Now,
+		cache:    make(map[uint64][]byte),
+	}, nil
+}
+
+// TicketKeys 返回当前周期的密钥和之前previous个周期的密钥
+func (s *TicketKeySchedule) TicketKeys() ([]TicketKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current := uint64(s.now().UnixNano() / int64(s.interval))
+	keys := make([]TicketKey, 0, s.previous+1)
+	for i := 0; i <= s.previous && uint64(i) <= current; i++ {
+		epoch := current - uint64(i)
+		keys = append(keys, TicketKey{ID: epoch, Key: s.keyFor(epoch)})
+	}
+	// 清理已经不再使用的密钥
+	for epoch := range s.cache {
+		if epoch+uint64(s.previous) < current {
+			delete(s.cache, epoch)
+		}
+	}
+	return keys, nil
+}
+
+// keyFor 派生指定周期的密钥，调用方需持有互斥锁
+func (s *TicketKeySchedule) keyFor(epoch uint64) []byte {
+	if key, ok := s.cache[epoch]; ok {
+		return key
+	}
+	context := binary.BigEndian.AppendUint64(nil, epoch)
+	key := hkdfExpandLabel(sha256.New, s.secret, "lquic ticket", context, TicketKeyLen)
+	s.cache[epoch] = key
+	return key
+}
+
+// sealWithTicketKeys 使用密钥源的当前密钥加密：密钥标识(8) + 随机数(12) + 密文，密钥标识作为附加数据
+func sealWithTicketKeys(source TicketKeySource, plaintext []byte) ([]byte, error) {
+	keys, err := source.TicketKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoTicketKey
+	}
+	aead, err := newTicketAEAD(keys[0].Key)
+	if err != nil {
+		return nil, err
+	}
+	raw := binary.BigEndian.AppendUint64(nil, keys[0].ID)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成票据随机数失败: %v", err)
+	}
+	raw = append(raw, nonce...)
+	return aead.Seal(raw, nonce, plaintext, raw[:8]), nil
+}
+
+// openWithTicketKeys 按密钥标识选择密钥源中的密钥解密sealWithTicketKeys的结果，
+// 签发票据的密钥已经被淘汰或票据由其他密钥源签发时返回ErrInvalidTicket
+func openWithTicketKeys(source TicketKeySource, raw []byte) ([]byte, error) {
+	// 密钥标识(8) + 随机数(12)
+	if len(raw) < 8+12 {
+		return nil, ErrInvalidTicket
+	}
+	keys, err := source.TicketKeys()
+	if err != nil {
+		return nil, err
+	}
+	keyID := binary.BigEndian.Uint64(raw)
+	for _, key := range keys {
+		if key.ID != keyID {
+			continue
+		}
+		aead, err := newTicketAEAD(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := raw[8 : 8+aead.NonceSize()]
+		plaintext, err := aead.Open(nil, nonce, raw[8+aead.NonceSize():], raw[:8])
+		if err != nil {
+			return nil, ErrInvalidTicket
+		}
+		return plaintext, nil
+	}
+	return nil, ErrInvalidTicket
+}
+
+// newTicketAEAD 使用票据加密密钥创建AES-256-GCM
+func newTicketAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != TicketKeyLen {
+		return nil, fmt.Errorf("票据加密密钥长度错误，期望%d字节，实际%d字节", TicketKeyLen, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetSessionTicketKeySource 让服务端的TLS会话票据使用TicketKeySource中的密钥加密。
+// 每个连接的握手使用克隆的tls.Config，自动生成的票据密钥在连接之间不共享，
+// 需要通过密钥源使所有连接（以及共享密钥源的其他服务器）都能解密彼此签发的票据
+func SetSessionTicketKeySource(config *tls.Config, source TicketKeySource) {
+	config.WrapSession = func(_ tls.ConnectionState, state *tls.SessionState) ([]byte, error) {
+		data, err := state.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return sealWithTicketKeys(source, data)
+	}
+	config.UnwrapSession = func(identity []byte, _ tls.ConnectionState) (*tls.SessionState, error) {
+		data, err := openWithTicketKeys(source, identity)
+		if err != nil {
+			// 无法解密的票据被忽略，握手回退到完整握手
+			return nil, nil
+		}
+		state, err := tls.ParseSessionState(data)
+		if err != nil {
+			return nil, nil
+		}
+		return state, nil
+	}
+}
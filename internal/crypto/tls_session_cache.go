@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// maxTLSTicketLifetime TLS 1.3会话票据的最长有效期，见RFC 8446第4.6.1节
+const maxTLSTicketLifetime = 7 * 24 * time.Hour
+
+// clientSessionCache 以SessionStore保存客户端TLS会话恢复状态的tls.ClientSessionCache
+type clientSessionCache struct {
+	store SessionStore
+}
+
+// NewClientSessionCache 将SessionStore适配为tls.ClientSessionCache，键为TLS使用的服务器名称。
+// 使用FileSessionStore时，客户端在进程重启后仍能恢复会话
+func NewClientSessionCache(store SessionStore) tls.ClientSessionCache {
+	return &clientSessionCache{store: store}
+}
+
+// Get 实现tls.ClientSessionCache接口，无法解析的状态被删除
+func (c *clientSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	ticket := c.store.Get(key)
+	if ticket == nil {
+		return nil, false
+	}
+	state, err := tls.ParseSessionState(ticket.State)
+	if err != nil {
+		c.store.Delete(key)
+		return nil, false
+	}
+	session, err := tls.NewResumptionState(ticket.Raw, state)
+	if err != nil {
+		c.store.Delete(key)
+		return nil, false
+	}
+	return session, true
+}
+
+// Put 实现tls.ClientSessionCache接口，session为nil时删除键对应的状态
+func (c *clientSessionCache) Put(key string, session *tls.ClientSessionState) {
+	if session == nil {
+		c.store.Delete(key)
+		return
+	}
+	raw, state, err := session.ResumptionState()
+	if err != nil || state == nil {
+		return
+	}
+	data, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	_ = c.store.Put(key, &SessionTicket{
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(maxTLSTicketLifetime),
+		Raw:           raw,
+		State:         data,
+		TicketBinding: ticketBindingFromExtra(state.Extra),
+	})
+}
@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"LQUIC/internal/protocol"
+)
+
+// RetryTokenValidity Retry令牌的有效期，客户端收到Retry后会立即重发Initial包
+const RetryTokenValidity = 10 * time.Second
+
+// 令牌类型，写在明文的第一个字节
+const (
+	tokenTypeRetry byte = iota
+)
+
+var (
+	// ErrInvalidToken 令牌无法解密或格式错误
+	ErrInvalidToken = errors.New("无效的地址验证令牌")
+	// ErrTokenExpired 令牌已过期
+	ErrTokenExpired = errors.New("地址验证令牌已过期")
+)
+
+// AddressToken 解密后的地址验证令牌
+type AddressToken struct {
+	// IsRetryToken 是否为Retry包下发的令牌
+	IsRetryToken bool
+	// OriginalDestConnID 客户端首个Initial包的目标连接ID
+	OriginalDestConnID protocol.ConnectionID
+	// RetrySrcConnID 服务端在Retry包中使用的源连接ID
+	RetrySrcConnID protocol.ConnectionID
+	// IssuedAt 令牌的签发时间
+	IssuedAt time.Time
+}
+
+// TokenGenerator 生成和校验服务端的地址验证令牌。令牌使用AES-256-GCM加密，
+// 并以客户端地址作为附加数据，只有同一地址的客户端才能使用
+type TokenGenerator struct {
+	aead cipher.AEAD
+}
+
+// NewTokenGenerator 创建令牌生成器，key为32字节的密钥，为空时随机生成
+func NewTokenGenerator(key []byte) (*TokenGenerator, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("生成令牌密钥失败: %v", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("令牌密钥长度错误，期望32字节，实际%d字节", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建令牌密钥失败: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("创建令牌AEAD失败: %v", err)
+	}
+	return &TokenGenerator{aead: aead}, nil
+}
+
+// NewRetryToken 生成Retry包携带的令牌，绑定客户端地址和原始目标连接ID
+func (g *TokenGenerator) NewRetryToken(addr net.Addr, origDestConnID, retrySrcConnID protocol.ConnectionID) ([]byte, error) {
+	plaintext := []byte{tokenTypeRetry}
+	plaintext = binary.BigEndian.AppendUint64(plaintext, uint64(time.Now().UnixNano()))
+	plaintext = append(plaintext, byte(len(origDestConnID)))
+	plaintext = append(plaintext, origDestConnID...)
+	plaintext = append(plaintext, byte(len(retrySrcConnID)))
+	plaintext = append(plaintext, retrySrcConnID...)
+
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("生成令牌随机数失败: %v", err)
+	}
+	return g.aead.Seal(nonce, nonce, plaintext, encodeAddr(addr)), nil
+}
+
+// DecodeToken 解密令牌并校验客户端地址和有效期
+func (g *TokenGenerator) DecodeToken(token []byte, addr net.Addr) (*AddressToken, error) {
+	nonceSize := g.aead.NonceSize()
+	if len(token) < nonceSize {
+		return nil, ErrInvalidToken
+	}
+	plaintext, err := g.aead.Open(nil, token[:nonceSize], token[nonceSize:], encodeAddr(addr))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// 类型(1) + 签发时间(8) + 连接ID长度(1)
+	if len(plaintext) < 10 || plaintext[0] != tokenTypeRetry {
+		return nil, ErrInvalidToken
+	}
+	t := &AddressToken{
+		IsRetryToken: true,
+		IssuedAt:     time.Unix(0, int64(binary.BigEndian.Uint64(plaintext[1:9]))),
+	}
+	rest := plaintext[9:]
+	if t.OriginalDestConnID, rest, err = readConnID(rest); err != nil {
+		return nil, err
+	}
+	if t.RetrySrcConnID, rest, err = readConnID(rest); err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrInvalidToken
+	}
+	if time.Since(t.IssuedAt) > RetryTokenValidity {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// readConnID 读取带一字节长度前缀的连接ID
+func readConnID(b []byte) (protocol.ConnectionID, []byte, error) {
+	if len(b) < 1 || int(b[0]) > protocol.MaxConnectionIDLen || len(b) < 1+int(b[0]) {
+		return nil, nil, ErrInvalidToken
+	}
+	n := int(b[0])
+	return protocol.ConnectionID(b[1 : 1+n]), b[1+n:], nil
+}
+
+// encodeAddr 将客户端地址编码为令牌的附加数据
+func encodeAddr(addr net.Addr) []byte {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		b := append([]byte{}, udpAddr.IP.To16()...)
+		return binary.BigEndian.AppendUint16(b, uint16(udpAddr.Port))
+	}
+	return []byte(addr.String())
+}
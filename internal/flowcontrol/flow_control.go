@@ -45,6 +45,17 @@ func (f *FlowController) UpdateWindow(bytes protocol.ByteCount) {
 	f.lastWindowUpdate = time.Now()
 }
 
+// UpdateSendWindow 根据对端通告的MAX_DATA扩大发送窗口，窗口只增不减
+func (f *FlowController) UpdateSendWindow(size WindowSize) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if size > f.windowSize {
+		f.windowSize = size
+		f.lastWindowUpdate = time.Now()
+	}
+}
+
 // UpdateRecvWindow 更新接收窗口
 func (f *FlowController) UpdateRecvWindow(bytes protocol.ByteCount) {
 	f.mutex.Lock()
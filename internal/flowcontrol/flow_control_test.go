@@ -115,3 +115,73 @@ func TestGetWindowSize(t *testing.T) {
 		t.Errorf("更新窗口后大小错误，期望1024，实际%d", fc.GetWindowSize())
 	}
 }
+
+func TestUpdateSendWindow(t *testing.T) {
+	fc := NewFlowController(1024, 4096)
+
+	// 对端通告更大的窗口
+	fc.UpdateSendWindow(2048)
+	if fc.GetWindowSize() != 2048 {
+		t.Errorf("窗口大小错误，期望2048，实际%d", fc.GetWindowSize())
+	}
+	if !fc.CanSend(2000) {
+		t.Error("扩大窗口后应该可以发送2000字节")
+	}
+
+	// 较小的MAX_DATA不会缩小窗口
+	fc.UpdateSendWindow(512)
+	if fc.GetWindowSize() != 2048 {
+		t.Errorf("窗口不应缩小，期望2048，实际%d", fc.GetWindowSize())
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	w := NewSendWindow(100)
+	w.AddBytesSent(60)
+	if w.Available() != 40 {
+		t.Errorf("可发送的数据量错误，期望40，实际%d", w.Available())
+	}
+
+	// 对端的上限只增不减
+	if w.UpdateLimit(80) || w.Limit() != 100 {
+		t.Error("较小的上限不应缩小发送窗口")
+	}
+	if !w.UpdateLimit(200) || w.Available() != 140 {
+		t.Errorf("扩大上限后可发送的数据量错误，实际%d", w.Available())
+	}
+	w.AddBytesSent(140)
+	if w.Available() != 0 {
+		t.Errorf("发送窗口用完后可发送的数据量应为0，实际%d", w.Available())
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	w := NewReceiveWindow(100)
+
+	// 最大偏移量只记录增量，不能超出通告的上限
+	if n, ok := w.UpdateHighest(40); !ok || n != 40 {
+		t.Errorf("最大偏移量的增量错误: %d, %v", n, ok)
+	}
+	if n, ok := w.UpdateHighest(30); !ok || n != 0 {
+		t.Errorf("重复的数据不应增加最大偏移量: %d, %v", n, ok)
+	}
+	if !w.AddBytesReceived(60) {
+		t.Fatal("上限之内的数据应被接受")
+	}
+	if w.AddBytesReceived(1) {
+		t.Error("超出通告上限的数据应被拒绝")
+	}
+
+	// 读取不足一半窗口时不通告新的上限
+	w.AddBytesRead(40)
+	if _, ok := w.WindowUpdate(); ok {
+		t.Error("剩余窗口超过一半时不应通告新的上限")
+	}
+	w.AddBytesRead(20)
+	if limit, ok := w.WindowUpdate(); !ok || limit != 160 || w.Limit() != 160 {
+		t.Errorf("新的上限错误，期望160，实际%d", limit)
+	}
+	if _, ok := w.UpdateHighest(160); !ok {
+		t.Error("通告新的上限后应接受更多的数据")
+	}
+}
@@ -0,0 +1,140 @@
+package flowcontrol
+
+import (
+	"sync"
+
+	"LQUIC/internal/protocol"
+)
+
+// SendWindow 发送方向的流量控制，见RFC 9000第4.1节：对端通过传输参数和MAX_DATA、MAX_STREAM_DATA帧
+// 给出允许本端发送的最大偏移量，已发送的数据不能超过该上限
+type SendWindow struct {
+	mutex sync.Mutex
+
+	// 对端允许发送的最大偏移量
+	limit protocol.ByteCount
+	// 已经发送的数据量
+	sent protocol.ByteCount
+}
+
+// NewSendWindow 创建发送窗口，limit为对端初始允许发送的数据量
+func NewSendWindow(limit protocol.ByteCount) *SendWindow {
+	return &SendWindow{limit: limit}
+}
+
+// UpdateLimit 根据对端通告的上限扩大发送窗口，上限只增不减，扩大时返回true
+func (w *SendWindow) UpdateLimit(limit protocol.ByteCount) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if limit <= w.limit {
+		return false
+	}
+	w.limit = limit
+	return true
+}
+
+// AddBytesSent 记录已发送的数据
+func (w *SendWindow) AddBytesSent(n protocol.ByteCount) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.sent += n
+}
+
+// Available 返回还可以发送的数据量
+func (w *SendWindow) Available() protocol.ByteCount {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.sent >= w.limit {
+		return 0
+	}
+	return w.limit - w.sent
+}
+
+// Limit 返回对端允许发送的最大偏移量
+func (w *SendWindow) Limit() protocol.ByteCount {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.limit
+}
+
+// ReceiveWindow 接收方向的流量控制：本端向对端通告允许接收的最大偏移量，收到超出上限的数据时对端违反了流量控制。
+// 应用读取数据后窗口向前滑动，已读取的数据超过窗口的一半时通过MAX_DATA或MAX_STREAM_DATA帧通告新的上限
+type ReceiveWindow struct {
+	mutex sync.Mutex
+
+	// 窗口大小，即通告的上限与已读取数据量之差
+	window protocol.ByteCount
+	// 已经通告给对端的最大偏移量
+	limit protocol.ByteCount
+	// 收到的数据的最大偏移量
+	highest protocol.ByteCount
+	// 应用已经读取的数据量
+	read protocol.ByteCount
+}
+
+// NewReceiveWindow 创建接收窗口，window为通过传输参数通告的初始上限
+func NewReceiveWindow(window protocol.ByteCount) *ReceiveWindow {
+	return &ReceiveWindow{window: window, limit: window}
+}
+
+// UpdateHighest 记录收到的数据的最大偏移量，返回最大偏移量增加的数据量；超出通告的上限时返回false
+func (w *ReceiveWindow) UpdateHighest(offset protocol.ByteCount) (protocol.ByteCount, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.updateHighest(offset)
+}
+
+// AddBytesReceived 记录新收到的数据量，连接级别的窗口以各个流新增的数据量累计；超出通告的上限时返回false
+func (w *ReceiveWindow) AddBytesReceived(n protocol.ByteCount) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, ok := w.updateHighest(w.highest + n)
+	return ok
+}
+
+// updateHighest 实现UpdateHighest，调用方需持有互斥锁
+func (w *ReceiveWindow) updateHighest(offset protocol.ByteCount) (protocol.ByteCount, bool) {
+	if offset <= w.highest {
+		return 0, true
+	}
+	if offset > w.limit {
+		return 0, false
+	}
+	increment := offset - w.highest
+	w.highest = offset
+	return increment, true
+}
+
+// AddBytesRead 记录应用已经读取的数据量
+func (w *ReceiveWindow) AddBytesRead(n protocol.ByteCount) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.read += n
+}
+
+// WindowUpdate 已读取的数据使剩余窗口不足一半时滑动窗口，返回需要通告给对端的新上限
+func (w *ReceiveWindow) WindowUpdate() (protocol.ByteCount, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.limit-w.read > w.window/2 {
+		return 0, false
+	}
+	w.limit = w.read + w.window
+	return w.limit, true
+}
+
+// Limit 返回已经通告给对端的最大偏移量
+func (w *ReceiveWindow) Limit() protocol.ByteCount {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.limit
+}
@@ -0,0 +1,141 @@
+package frame
+
+import (
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// AckRange 表示一段连续被确认的包序号区间（闭区间）
+type AckRange struct {
+	Smallest protocol.PacketNumber
+	Largest  protocol.PacketNumber
+}
+
+// ECNCounts ACK帧中携带的ECN计数
+type ECNCounts struct {
+	ECT0  uint64
+	ECT1  uint64
+	ECNCE uint64
+}
+
+// AckFrame ACK帧
+type AckFrame struct {
+	// Ranges 按包序号从大到小排列且互不重叠的确认区间
+	Ranges []AckRange
+	// AckDelay 编码后的ACK延迟，需要按ack_delay_exponent换算
+	AckDelay uint64
+	// ECN 非nil时编码为ACK_ECN帧
+	ECN *ECNCounts
+}
+
+// LargestAcked 返回被确认的最大包序号
+func (f *AckFrame) LargestAcked() protocol.PacketNumber {
+	if len(f.Ranges) == 0 {
+		return 0
+	}
+	return f.Ranges[0].Largest
+}
+
+// LowestAcked 返回被确认的最小包序号
+func (f *AckFrame) LowestAcked() protocol.PacketNumber {
+	if len(f.Ranges) == 0 {
+		return 0
+	}
+	return f.Ranges[len(f.Ranges)-1].Smallest
+}
+
+// AcksPacket 判断指定包序号是否被确认
+func (f *AckFrame) AcksPacket(pn protocol.PacketNumber) bool {
+	for _, r := range f.Ranges {
+		if pn >= r.Smallest && pn <= r.Largest {
+			return true
+		}
+	}
+	return false
+}
+
+// Append 实现Frame接口
+func (f *AckFrame) Append(b []byte) ([]byte, error) {
+	if len(f.Ranges) == 0 {
+		return nil, fmt.Errorf("ACK帧至少需要一个确认区间")
+	}
+	typ := TypeAck
+	if f.ECN != nil {
+		typ = TypeAckECN
+	}
+	first := f.Ranges[0]
+	if first.Smallest > first.Largest {
+		return nil, fmt.Errorf("无效的确认区间: %d-%d", first.Smallest, first.Largest)
+	}
+	b, err := appendVarInts(b, typ, uint64(first.Largest), f.AckDelay,
+		uint64(len(f.Ranges)-1), uint64(first.Largest-first.Smallest))
+	if err != nil {
+		return nil, err
+	}
+
+	prevSmallest := first.Smallest
+	for _, r := range f.Ranges[1:] {
+		// 相邻区间之间至少间隔一个未确认的包序号
+		if r.Smallest > r.Largest || r.Largest+2 > prevSmallest {
+			return nil, fmt.Errorf("确认区间未按降序排列或存在重叠")
+		}
+		gap := uint64(prevSmallest - r.Largest - 2)
+		if b, err = appendVarInts(b, gap, uint64(r.Largest-r.Smallest)); err != nil {
+			return nil, err
+		}
+		prevSmallest = r.Smallest
+	}
+
+	if f.ECN != nil {
+		return appendVarInts(b, f.ECN.ECT0, f.ECN.ECT1, f.ECN.ECNCE)
+	}
+	return b, nil
+}
+
+// parseAck 解析ACK帧
+func (r *reader) parseAck(withECN bool) Frame {
+	largest := r.varint()
+	f := &AckFrame{AckDelay: r.varint()}
+	rangeCount := r.varint()
+	firstRange := r.varint()
+	if r.err != nil {
+		return nil
+	}
+	if firstRange > largest {
+		r.fail(protocol.FrameEncodingError, "第一个确认区间超出最大确认包序号")
+		return nil
+	}
+	smallest := largest - firstRange
+	f.Ranges = append(f.Ranges, AckRange{
+		Smallest: protocol.PacketNumber(smallest),
+		Largest:  protocol.PacketNumber(largest),
+	})
+
+	for i := uint64(0); i < rangeCount; i++ {
+		gap := r.varint()
+		length := r.varint()
+		if r.err != nil {
+			return nil
+		}
+		if gap+2 > smallest {
+			r.fail(protocol.FrameEncodingError, "确认区间间隔超出范围")
+			return nil
+		}
+		largest = smallest - gap - 2
+		if length > largest {
+			r.fail(protocol.FrameEncodingError, "确认区间长度超出范围")
+			return nil
+		}
+		smallest = largest - length
+		f.Ranges = append(f.Ranges, AckRange{
+			Smallest: protocol.PacketNumber(smallest),
+			Largest:  protocol.PacketNumber(largest),
+		})
+	}
+
+	if withECN {
+		f.ECN = &ECNCounts{ECT0: r.varint(), ECT1: r.varint(), ECNCE: r.varint()}
+	}
+	return f
+}
@@ -0,0 +1,228 @@
+package frame
+
+import (
+	"LQUIC/internal/protocol"
+)
+
+// PaddingFrame 连续的PADDING帧，解析时合并为一个
+type PaddingFrame struct {
+	// Length 填充的字节数，至少为1
+	Length int
+}
+
+// Append 实现Frame接口
+func (f *PaddingFrame) Append(b []byte) ([]byte, error) {
+	n := f.Length
+	if n < 1 {
+		n = 1
+	}
+	return append(b, make([]byte, n)...), nil
+}
+
+// parsePadding 合并连续的PADDING字节
+func (r *reader) parsePadding() Frame {
+	f := &PaddingFrame{Length: 1}
+	for r.off < len(r.data) && r.data[r.off] == 0 {
+		r.off++
+		f.Length++
+	}
+	return f
+}
+
+// PingFrame PING帧
+type PingFrame struct{}
+
+// Append 实现Frame接口
+func (f *PingFrame) Append(b []byte) ([]byte, error) {
+	return append(b, byte(TypePing)), nil
+}
+
+// CryptoFrame CRYPTO帧
+type CryptoFrame struct {
+	Offset protocol.ByteCount
+	Data   []byte
+}
+
+// Append 实现Frame接口
+func (f *CryptoFrame) Append(b []byte) ([]byte, error) {
+	b, err := appendVarInts(b, TypeCrypto, uint64(f.Offset), uint64(len(f.Data)))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, f.Data...), nil
+}
+
+// parseCrypto 解析CRYPTO帧
+func (r *reader) parseCrypto() Frame {
+	f := &CryptoFrame{Offset: protocol.ByteCount(r.varint())}
+	f.Data = r.bytes(r.varint())
+	if r.err == nil && uint64(f.Offset)+uint64(len(f.Data)) > protocol.MaxVarInt {
+		r.fail(protocol.FrameEncodingError, "CRYPTO帧偏移量超出上限")
+	}
+	return f
+}
+
+// NewTokenFrame NEW_TOKEN帧
+type NewTokenFrame struct {
+	Token []byte
+}
+
+// Append 实现Frame接口
+func (f *NewTokenFrame) Append(b []byte) ([]byte, error) {
+	b, err := appendVarInts(b, TypeNewToken, uint64(len(f.Token)))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, f.Token...), nil
+}
+
+// parseNewToken 解析NEW_TOKEN帧
+func (r *reader) parseNewToken() Frame {
+	f := &NewTokenFrame{Token: r.bytes(r.varint())}
+	if r.err == nil && len(f.Token) == 0 {
+		r.fail(protocol.FrameEncodingError, "NEW_TOKEN帧的令牌为空")
+	}
+	return f
+}
+
+// MaxDataFrame MAX_DATA帧
+type MaxDataFrame struct {
+	MaximumData protocol.ByteCount
+}
+
+// Append 实现Frame接口
+func (f *MaxDataFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeMaxData, uint64(f.MaximumData))
+}
+
+// DataBlockedFrame DATA_BLOCKED帧
+type DataBlockedFrame struct {
+	MaximumData protocol.ByteCount
+}
+
+// Append 实现Frame接口
+func (f *DataBlockedFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeDataBlocked, uint64(f.MaximumData))
+}
+
+// NewConnectionIDFrame NEW_CONNECTION_ID帧
+type NewConnectionIDFrame struct {
+	SequenceNumber      uint64
+	RetirePriorTo       uint64
+	ConnectionID        protocol.ConnectionID
+	StatelessResetToken [16]byte
+}
+
+// Append 实现Frame接口
+func (f *NewConnectionIDFrame) Append(b []byte) ([]byte, error) {
+	if len(f.ConnectionID) < 1 || len(f.ConnectionID) > protocol.MaxConnectionIDLen {
+		return nil, &protocol.TransportError{Code: protocol.FrameEncodingError, FrameType: TypeNewConnectionID, Reason: "无效的连接ID长度"}
+	}
+	b, err := appendVarInts(b, TypeNewConnectionID, f.SequenceNumber, f.RetirePriorTo)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, byte(len(f.ConnectionID)))
+	b = append(b, f.ConnectionID...)
+	return append(b, f.StatelessResetToken[:]...), nil
+}
+
+// parseNewConnectionID 解析NEW_CONNECTION_ID帧
+func (r *reader) parseNewConnectionID() Frame {
+	f := &NewConnectionIDFrame{
+		SequenceNumber: r.varint(),
+		RetirePriorTo:  r.varint(),
+	}
+	connIDLen := r.bytes(1)
+	if r.err != nil {
+		return nil
+	}
+	if connIDLen[0] < 1 || connIDLen[0] > protocol.MaxConnectionIDLen {
+		r.fail(protocol.FrameEncodingError, "无效的连接ID长度")
+		return nil
+	}
+	f.ConnectionID = protocol.ConnectionID(r.bytes(uint64(connIDLen[0])))
+	copy(f.StatelessResetToken[:], r.bytes(16))
+	if r.err == nil && f.RetirePriorTo > f.SequenceNumber {
+		r.fail(protocol.FrameEncodingError, "Retire Prior To大于序列号")
+	}
+	return f
+}
+
+// RetireConnectionIDFrame RETIRE_CONNECTION_ID帧
+type RetireConnectionIDFrame struct {
+	SequenceNumber uint64
+}
+
+// Append 实现Frame接口
+func (f *RetireConnectionIDFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeRetireConnectionID, f.SequenceNumber)
+}
+
+// PathChallengeFrame PATH_CHALLENGE帧
+type PathChallengeFrame struct {
+	Data [8]byte
+}
+
+// Append 实现Frame接口
+func (f *PathChallengeFrame) Append(b []byte) ([]byte, error) {
+	return append(append(b, byte(TypePathChallenge)), f.Data[:]...), nil
+}
+
+// PathResponseFrame PATH_RESPONSE帧
+type PathResponseFrame struct {
+	Data [8]byte
+}
+
+// Append 实现Frame接口
+func (f *PathResponseFrame) Append(b []byte) ([]byte, error) {
+	return append(append(b, byte(TypePathResponse)), f.Data[:]...), nil
+}
+
+// ConnectionCloseFrame CONNECTION_CLOSE帧
+type ConnectionCloseFrame struct {
+	// IsApplicationError 为true时编码为应用层关闭帧（0x1d）
+	IsApplicationError bool
+	ErrorCode          uint64
+	// FrameType 触发错误的帧类型，仅传输层关闭帧携带
+	FrameType    uint64
+	ReasonPhrase string
+}
+
+// Append 实现Frame接口
+func (f *ConnectionCloseFrame) Append(b []byte) ([]byte, error) {
+	var err error
+	if f.IsApplicationError {
+		b, err = appendVarInts(b, TypeConnectionCloseApp, f.ErrorCode)
+	} else {
+		b, err = appendVarInts(b, TypeConnectionClose, f.ErrorCode, f.FrameType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendVarInts(b, uint64(len(f.ReasonPhrase))); err != nil {
+		return nil, err
+	}
+	return append(b, f.ReasonPhrase...), nil
+}
+
+// parseConnectionClose 解析CONNECTION_CLOSE帧
+func (r *reader) parseConnectionClose(isApplicationError bool) Frame {
+	f := &ConnectionCloseFrame{
+		IsApplicationError: isApplicationError,
+		ErrorCode:          r.varint(),
+	}
+	if !isApplicationError {
+		f.FrameType = r.varint()
+	}
+	f.ReasonPhrase = string(r.bytes(r.varint()))
+	return f
+}
+
+// HandshakeDoneFrame HANDSHAKE_DONE帧
+type HandshakeDoneFrame struct{}
+
+// Append 实现Frame接口
+func (f *HandshakeDoneFrame) Append(b []byte) ([]byte, error) {
+	return append(b, byte(TypeHandshakeDone)), nil
+}
@@ -0,0 +1,234 @@
+// Package frame 实现QUIC帧的序列化和解析
+package frame
+
+import (
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+// 帧类型，见RFC 9000第19节
+const (
+	TypePadding            uint64 = 0x00
+	TypePing               uint64 = 0x01
+	TypeAck                uint64 = 0x02
+	TypeAckECN             uint64 = 0x03
+	TypeResetStream        uint64 = 0x04
+	TypeStopSending        uint64 = 0x05
+	TypeCrypto             uint64 = 0x06
+	TypeNewToken           uint64 = 0x07
+	TypeStream             uint64 = 0x08 // 0x08-0x0f，低三位为OFF/LEN/FIN标志
+	TypeMaxData            uint64 = 0x10
+	TypeMaxStreamData      uint64 = 0x11
+	TypeMaxStreamsBidi     uint64 = 0x12
+	TypeMaxStreamsUni      uint64 = 0x13
+	TypeDataBlocked        uint64 = 0x14
+	TypeStreamDataBlocked  uint64 = 0x15
+	TypeStreamsBlockedBidi uint64 = 0x16
+	TypeStreamsBlockedUni  uint64 = 0x17
+	TypeNewConnectionID    uint64 = 0x18
+	TypeRetireConnectionID uint64 = 0x19
+	TypePathChallenge      uint64 = 0x1a
+	TypePathResponse       uint64 = 0x1b
+	TypeConnectionClose    uint64 = 0x1c
+	TypeConnectionCloseApp uint64 = 0x1d
+	TypeHandshakeDone      uint64 = 0x1e
+)
+
+// Frame 表示一个QUIC帧
+type Frame interface {
+	// Append 将帧序列化后追加到b
+	Append(b []byte) ([]byte, error)
+}
+
+// Parse 从data开头解析一个帧，返回帧和占用的字节数
+func Parse(data []byte) (Frame, int, error) {
+	typ, n, err := protocol.ReadVarInt(data)
+	if err != nil {
+		return nil, 0, &protocol.TransportError{Code: protocol.FrameEncodingError, Reason: "帧类型截断"}
+	}
+	// 帧类型必须使用最短编码
+	if n != protocol.VarIntLen(typ) {
+		return nil, 0, &protocol.TransportError{
+			Code:      protocol.ProtocolViolation,
+			FrameType: typ,
+			Reason:    "帧类型未使用最短编码",
+		}
+	}
+
+	r := &reader{data: data, off: n, frameType: typ}
+	var f Frame
+	switch {
+	case typ == TypePadding:
+		f = r.parsePadding()
+	case typ == TypePing:
+		f = &PingFrame{}
+	case typ == TypeAck || typ == TypeAckECN:
+		f = r.parseAck(typ == TypeAckECN)
+	case typ == TypeResetStream:
+		f = r.parseResetStream()
+	case typ == TypeStopSending:
+		f = r.parseStopSending()
+	case typ == TypeCrypto:
+		f = r.parseCrypto()
+	case typ == TypeNewToken:
+		f = r.parseNewToken()
+	case typ >= TypeStream && typ <= TypeStream|0x07:
+		f = r.parseStream(typ)
+	case typ == TypeMaxData:
+		f = &MaxDataFrame{MaximumData: protocol.ByteCount(r.varint())}
+	case typ == TypeMaxStreamData:
+		f = &MaxStreamDataFrame{StreamID: protocol.StreamID(r.varint()), MaximumStreamData: protocol.ByteCount(r.varint())}
+	case typ == TypeMaxStreamsBidi || typ == TypeMaxStreamsUni:
+		f = r.parseMaxStreams(typ == TypeMaxStreamsBidi)
+	case typ == TypeDataBlocked:
+		f = &DataBlockedFrame{MaximumData: protocol.ByteCount(r.varint())}
+	case typ == TypeStreamDataBlocked:
+		f = &StreamDataBlockedFrame{StreamID: protocol.StreamID(r.varint()), MaximumStreamData: protocol.ByteCount(r.varint())}
+	case typ == TypeStreamsBlockedBidi || typ == TypeStreamsBlockedUni:
+		f = r.parseStreamsBlocked(typ == TypeStreamsBlockedBidi)
+	case typ == TypeNewConnectionID:
+		f = r.parseNewConnectionID()
+	case typ == TypeRetireConnectionID:
+		f = &RetireConnectionIDFrame{SequenceNumber: r.varint()}
+	case typ == TypePathChallenge:
+		pc := &PathChallengeFrame{}
+		copy(pc.Data[:], r.bytes(8))
+		f = pc
+	case typ == TypePathResponse:
+		pr := &PathResponseFrame{}
+		copy(pr.Data[:], r.bytes(8))
+		f = pr
+	case typ == TypeConnectionClose || typ == TypeConnectionCloseApp:
+		f = r.parseConnectionClose(typ == TypeConnectionCloseApp)
+	case typ == TypeHandshakeDone:
+		f = &HandshakeDoneFrame{}
+	default:
+		return nil, 0, &protocol.TransportError{
+			Code:      protocol.FrameEncodingError,
+			FrameType: typ,
+			Reason:    fmt.Sprintf("未知的帧类型: 0x%x", typ),
+		}
+	}
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return f, r.off, nil
+}
+
+// ParseAll 解析数据包负载中的全部帧
+func ParseAll(data []byte) ([]Frame, error) {
+	var frames []Frame
+	for len(data) > 0 {
+		f, n, err := Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, f)
+		data = data[n:]
+	}
+	return frames, nil
+}
+
+// AppendAll 依次序列化多个帧
+func AppendAll(b []byte, frames []Frame) ([]byte, error) {
+	var err error
+	for _, f := range frames {
+		if b, err = f.Append(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// IsAllowed 检查帧能否出现在指定类型的数据包中，见RFC 9000第12.4节表3
+func IsAllowed(f Frame, packetType protocol.PacketType) bool {
+	switch packetType {
+	case protocol.PacketTypeInitial, protocol.PacketTypeHandshake:
+		switch ff := f.(type) {
+		case *PaddingFrame, *PingFrame, *AckFrame, *CryptoFrame:
+			return true
+		case *ConnectionCloseFrame:
+			// 只允许传输层的CONNECTION_CLOSE
+			return !ff.IsApplicationError
+		default:
+			return false
+		}
+	case protocol.PacketTypeZeroRTT:
+		switch f.(type) {
+		case *AckFrame, *CryptoFrame, *HandshakeDoneFrame, *NewTokenFrame,
+			*PathResponseFrame, *RetireConnectionIDFrame:
+			return false
+		default:
+			return true
+		}
+	case protocol.PacketTypeOneRTT:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsAckEliciting 判断帧是否会触发对端发送ACK
+func IsAckEliciting(f Frame) bool {
+	switch f.(type) {
+	case *AckFrame, *PaddingFrame, *ConnectionCloseFrame:
+		return false
+	default:
+		return true
+	}
+}
+
+// reader 按顺序读取帧字段，遇到错误后后续读取均返回零值
+type reader struct {
+	data      []byte
+	off       int
+	frameType uint64
+	err       error
+}
+
+// fail 记录第一个解析错误
+func (r *reader) fail(code protocol.TransportErrorCode, reason string) {
+	if r.err == nil {
+		r.err = &protocol.TransportError{Code: code, FrameType: r.frameType, Reason: reason}
+	}
+}
+
+// varint 读取一个可变长度整数
+func (r *reader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n, err := protocol.ReadVarInt(r.data[r.off:])
+	if err != nil {
+		r.fail(protocol.FrameEncodingError, "帧字段截断")
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+// bytes 读取n字节
+func (r *reader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.off) {
+		r.fail(protocol.FrameEncodingError, "帧数据截断")
+		return nil
+	}
+	b := r.data[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b
+}
+
+// appendVarInts 依次写入多个可变长度整数
+func appendVarInts(b []byte, values ...uint64) ([]byte, error) {
+	var err error
+	for _, v := range values {
+		if b, err = protocol.AppendVarInt(b, v); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,167 @@
+package frame
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"LQUIC/internal/protocol"
+)
+
+func TestFrameAppendParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"PADDING", &PaddingFrame{Length: 5}},
+		{"PING", &PingFrame{}},
+		{"ACK", &AckFrame{
+			Ranges:   []AckRange{{Smallest: 90, Largest: 100}, {Smallest: 50, Largest: 80}, {Smallest: 1, Largest: 1}},
+			AckDelay: 42,
+		}},
+		{"ACK_ECN", &AckFrame{
+			Ranges: []AckRange{{Smallest: 7, Largest: 7}},
+			ECN:    &ECNCounts{ECT0: 1, ECT1: 2, ECNCE: 3},
+		}},
+		{"RESET_STREAM", &ResetStreamFrame{StreamID: 4, ErrorCode: 0x100, FinalSize: 1 << 20}},
+		{"STOP_SENDING", &StopSendingFrame{StreamID: 8, ErrorCode: 7}},
+		{"CRYPTO", &CryptoFrame{Offset: 1000, Data: []byte("client hello")}},
+		{"NEW_TOKEN", &NewTokenFrame{Token: []byte("token")}},
+		{"STREAM", &StreamFrame{StreamID: 3, Offset: 1234, Data: []byte("hello"), Fin: true, DataLenPresent: true}},
+		{"STREAM无偏移", &StreamFrame{StreamID: 0, Data: []byte("hello"), DataLenPresent: true}},
+		{"MAX_DATA", &MaxDataFrame{MaximumData: 1 << 30}},
+		{"MAX_STREAM_DATA", &MaxStreamDataFrame{StreamID: 5, MaximumStreamData: 65536}},
+		{"MAX_STREAMS", &MaxStreamsFrame{Bidirectional: true, MaximumStreams: 100}},
+		{"MAX_STREAMS单向", &MaxStreamsFrame{MaximumStreams: 3}},
+		{"DATA_BLOCKED", &DataBlockedFrame{MaximumData: 1 << 20}},
+		{"STREAM_DATA_BLOCKED", &StreamDataBlockedFrame{StreamID: 9, MaximumStreamData: 100}},
+		{"STREAMS_BLOCKED", &StreamsBlockedFrame{Bidirectional: false, MaximumStreams: 10}},
+		{"NEW_CONNECTION_ID", &NewConnectionIDFrame{
+			SequenceNumber:      2,
+			RetirePriorTo:       1,
+			ConnectionID:        protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+			StatelessResetToken: [16]byte{0xa, 0xb},
+		}},
+		{"RETIRE_CONNECTION_ID", &RetireConnectionIDFrame{SequenceNumber: 3}},
+		{"PATH_CHALLENGE", &PathChallengeFrame{Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"PATH_RESPONSE", &PathResponseFrame{Data: [8]byte{8, 7, 6, 5, 4, 3, 2, 1}}},
+		{"CONNECTION_CLOSE", &ConnectionCloseFrame{ErrorCode: 0xa, FrameType: TypeStream, ReasonPhrase: "bad stream"}},
+		{"CONNECTION_CLOSE应用层", &ConnectionCloseFrame{IsApplicationError: true, ErrorCode: 0x42, ReasonPhrase: "bye"}},
+		{"HANDSHAKE_DONE", &HandshakeDoneFrame{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.frame.Append(nil)
+			if err != nil {
+				t.Fatalf("序列化失败: %v", err)
+			}
+			parsed, n, err := Parse(data)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if n != len(data) {
+				t.Errorf("解析长度错误，期望%d，实际%d", len(data), n)
+			}
+			if !reflect.DeepEqual(parsed, tt.frame) {
+				t.Errorf("帧不匹配，期望%+v，实际%+v", tt.frame, parsed)
+			}
+		})
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	frames := []Frame{
+		&CryptoFrame{Data: []byte("hello")},
+		&PingFrame{},
+		// 不带长度的STREAM帧必须位于末尾
+		&StreamFrame{StreamID: 4, Data: []byte("tail")},
+	}
+	data, err := AppendAll(nil, frames)
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+	parsed, err := ParseAll(data)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, frames) {
+		t.Errorf("帧不匹配，期望%+v，实际%+v", frames, parsed)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		code protocol.TransportErrorCode
+	}{
+		{"未知帧类型", []byte{0x1f}, protocol.FrameEncodingError},
+		{"帧类型非最短编码", []byte{0x40, 0x01}, protocol.ProtocolViolation},
+		{"CRYPTO数据截断", []byte{0x06, 0x00, 0x05, 'a'}, protocol.FrameEncodingError},
+		{"ACK区间越界", []byte{0x02, 0x05, 0x00, 0x00, 0x06}, protocol.FrameEncodingError},
+		{"空NEW_TOKEN", []byte{0x07, 0x00}, protocol.FrameEncodingError},
+		{"连接ID长度为0", append([]byte{0x18, 0x01, 0x00, 0x00}, make([]byte, 16)...), protocol.FrameEncodingError},
+		{"MAX_STREAMS超限", []byte{0x12, 0xd0, 0, 0, 0, 0, 0, 0, 1}, protocol.FrameEncodingError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Parse(tt.data)
+			var terr *protocol.TransportError
+			if !errors.As(err, &terr) {
+				t.Fatalf("期望传输层错误，实际%v", err)
+			}
+			if terr.Code != tt.code {
+				t.Errorf("错误码不匹配，期望0x%x，实际0x%x", tt.code, terr.Code)
+			}
+		})
+	}
+}
+
+func TestAckFrameRanges(t *testing.T) {
+	f := &AckFrame{Ranges: []AckRange{{Smallest: 10, Largest: 12}, {Smallest: 3, Largest: 5}}}
+	if f.LargestAcked() != 12 || f.LowestAcked() != 3 {
+		t.Errorf("确认区间边界错误: %d-%d", f.LowestAcked(), f.LargestAcked())
+	}
+	for pn, acked := range map[protocol.PacketNumber]bool{3: true, 5: true, 6: false, 9: false, 11: true, 13: false} {
+		if f.AcksPacket(pn) != acked {
+			t.Errorf("AcksPacket(%d)错误，期望%v", pn, acked)
+		}
+	}
+
+	// 区间重叠时无法编码
+	overlap := &AckFrame{Ranges: []AckRange{{Smallest: 5, Largest: 8}, {Smallest: 3, Largest: 4}}}
+	if _, err := overlap.Append(nil); err == nil {
+		t.Error("重叠的确认区间应该返回错误")
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		frame      Frame
+		packetType protocol.PacketType
+		allowed    bool
+	}{
+		{"Initial中的CRYPTO", &CryptoFrame{}, protocol.PacketTypeInitial, true},
+		{"Initial中的STREAM", &StreamFrame{}, protocol.PacketTypeInitial, false},
+		{"Handshake中的传输层关闭", &ConnectionCloseFrame{}, protocol.PacketTypeHandshake, true},
+		{"Handshake中的应用层关闭", &ConnectionCloseFrame{IsApplicationError: true}, protocol.PacketTypeHandshake, false},
+		{"0-RTT中的STREAM", &StreamFrame{}, protocol.PacketTypeZeroRTT, true},
+		{"0-RTT中的ACK", &AckFrame{}, protocol.PacketTypeZeroRTT, false},
+		{"0-RTT中的HANDSHAKE_DONE", &HandshakeDoneFrame{}, protocol.PacketTypeZeroRTT, false},
+		{"1-RTT中的HANDSHAKE_DONE", &HandshakeDoneFrame{}, protocol.PacketTypeOneRTT, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if IsAllowed(tt.frame, tt.packetType) != tt.allowed {
+				t.Errorf("期望%v", tt.allowed)
+			}
+		})
+	}
+
+	if IsAckEliciting(&AckFrame{}) || IsAckEliciting(&PaddingFrame{}) || !IsAckEliciting(&PingFrame{}) {
+		t.Error("IsAckEliciting判断错误")
+	}
+}
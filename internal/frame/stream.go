@@ -0,0 +1,185 @@
+package frame
+
+import (
+	"LQUIC/internal/protocol"
+)
+
+// STREAM帧类型中的标志位
+const (
+	streamFinBit = 0x01
+	streamLenBit = 0x02
+	streamOffBit = 0x04
+)
+
+// StreamFrame STREAM帧
+type StreamFrame struct {
+	StreamID protocol.StreamID
+	Offset   protocol.ByteCount
+	Data     []byte
+	Fin      bool
+	// DataLenPresent 是否写入长度字段，不写时数据延伸到数据包末尾
+	DataLenPresent bool
+}
+
+// Append 实现Frame接口
+func (f *StreamFrame) Append(b []byte) ([]byte, error) {
+	typ := TypeStream
+	if f.Fin {
+		typ |= streamFinBit
+	}
+	if f.DataLenPresent {
+		typ |= streamLenBit
+	}
+	if f.Offset != 0 {
+		typ |= streamOffBit
+	}
+	b, err := appendVarInts(b, typ, uint64(f.StreamID))
+	if err != nil {
+		return nil, err
+	}
+	if f.Offset != 0 {
+		if b, err = appendVarInts(b, uint64(f.Offset)); err != nil {
+			return nil, err
+		}
+	}
+	if f.DataLenPresent {
+		if b, err = appendVarInts(b, uint64(len(f.Data))); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, f.Data...), nil
+}
+
+// parseStream 解析STREAM帧
+func (r *reader) parseStream(typ uint64) Frame {
+	f := &StreamFrame{
+		StreamID:       protocol.StreamID(r.varint()),
+		Fin:            typ&streamFinBit != 0,
+		DataLenPresent: typ&streamLenBit != 0,
+	}
+	if typ&streamOffBit != 0 {
+		f.Offset = protocol.ByteCount(r.varint())
+	}
+	if f.DataLenPresent {
+		f.Data = r.bytes(r.varint())
+	} else if r.err == nil {
+		f.Data = r.bytes(uint64(len(r.data) - r.off))
+	}
+	if r.err == nil && uint64(f.Offset)+uint64(len(f.Data)) > protocol.MaxVarInt {
+		r.fail(protocol.FrameEncodingError, "STREAM帧偏移量超出上限")
+	}
+	return f
+}
+
+// ResetStreamFrame RESET_STREAM帧
+type ResetStreamFrame struct {
+	StreamID  protocol.StreamID
+	ErrorCode uint64
+	FinalSize protocol.ByteCount
+}
+
+// Append 实现Frame接口
+func (f *ResetStreamFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeResetStream, uint64(f.StreamID), f.ErrorCode, uint64(f.FinalSize))
+}
+
+// parseResetStream 解析RESET_STREAM帧
+func (r *reader) parseResetStream() Frame {
+	return &ResetStreamFrame{
+		StreamID:  protocol.StreamID(r.varint()),
+		ErrorCode: r.varint(),
+		FinalSize: protocol.ByteCount(r.varint()),
+	}
+}
+
+// StopSendingFrame STOP_SENDING帧
+type StopSendingFrame struct {
+	StreamID  protocol.StreamID
+	ErrorCode uint64
+}
+
+// Append 实现Frame接口
+func (f *StopSendingFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeStopSending, uint64(f.StreamID), f.ErrorCode)
+}
+
+// parseStopSending 解析STOP_SENDING帧
+func (r *reader) parseStopSending() Frame {
+	return &StopSendingFrame{
+		StreamID:  protocol.StreamID(r.varint()),
+		ErrorCode: r.varint(),
+	}
+}
+
+// MaxStreamDataFrame MAX_STREAM_DATA帧
+type MaxStreamDataFrame struct {
+	StreamID          protocol.StreamID
+	MaximumStreamData protocol.ByteCount
+}
+
+// Append 实现Frame接口
+func (f *MaxStreamDataFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeMaxStreamData, uint64(f.StreamID), uint64(f.MaximumStreamData))
+}
+
+// StreamDataBlockedFrame STREAM_DATA_BLOCKED帧
+type StreamDataBlockedFrame struct {
+	StreamID          protocol.StreamID
+	MaximumStreamData protocol.ByteCount
+}
+
+// Append 实现Frame接口
+func (f *StreamDataBlockedFrame) Append(b []byte) ([]byte, error) {
+	return appendVarInts(b, TypeStreamDataBlocked, uint64(f.StreamID), uint64(f.MaximumStreamData))
+}
+
+// maxStreamCount 流数量上限，超出后流ID将无法用可变长度整数表示
+const maxStreamCount = 1 << 60
+
+// MaxStreamsFrame MAX_STREAMS帧
+type MaxStreamsFrame struct {
+	Bidirectional  bool
+	MaximumStreams uint64
+}
+
+// Append 实现Frame接口
+func (f *MaxStreamsFrame) Append(b []byte) ([]byte, error) {
+	typ := TypeMaxStreamsUni
+	if f.Bidirectional {
+		typ = TypeMaxStreamsBidi
+	}
+	return appendVarInts(b, typ, f.MaximumStreams)
+}
+
+// parseMaxStreams 解析MAX_STREAMS帧
+func (r *reader) parseMaxStreams(bidi bool) Frame {
+	f := &MaxStreamsFrame{Bidirectional: bidi, MaximumStreams: r.varint()}
+	if f.MaximumStreams > maxStreamCount {
+		r.fail(protocol.FrameEncodingError, "MAX_STREAMS超出上限")
+	}
+	return f
+}
+
+// StreamsBlockedFrame STREAMS_BLOCKED帧
+type StreamsBlockedFrame struct {
+	Bidirectional  bool
+	MaximumStreams uint64
+}
+
+// Append 实现Frame接口
+func (f *StreamsBlockedFrame) Append(b []byte) ([]byte, error) {
+	typ := TypeStreamsBlockedUni
+	if f.Bidirectional {
+		typ = TypeStreamsBlockedBidi
+	}
+	return appendVarInts(b, typ, f.MaximumStreams)
+}
+
+// parseStreamsBlocked 解析STREAMS_BLOCKED帧
+func (r *reader) parseStreamsBlocked(bidi bool) Frame {
+	f := &StreamsBlockedFrame{Bidirectional: bidi, MaximumStreams: r.varint()}
+	if f.MaximumStreams > maxStreamCount {
+		r.fail(protocol.FrameEncodingError, "STREAMS_BLOCKED超出上限")
+	}
+	return f
+}
@@ -0,0 +1,53 @@
+package packet
+
+import (
+	"bytes"
+)
+
+// ParseDatagram 解析一个UDP数据报中合并发送的全部数据包，见RFC 9000第12.2节。
+// 短包头数据包没有长度字段，因此只能位于数据报末尾。
+// 第一个数据包解析失败时返回错误；后续数据包解析失败或目标连接ID
+// 与第一个数据包不同时，忽略剩余部分并返回已解析的数据包
+func ParseDatagram(data []byte, shortConnIDLen int) ([]*Packet, error) {
+	var packets []*Packet
+	for len(data) > 0 {
+		hdr, hdrLen, packetLen, err := parseHeader(data, shortConnIDLen)
+		if err != nil {
+			if len(packets) == 0 {
+				return nil, err
+			}
+			break
+		}
+		if len(packets) > 0 && !bytes.Equal(hdr.DestConnID, packets[0].Header.DestConnID) {
+			break
+		}
+		packets = append(packets, &Packet{
+			Header:  *hdr,
+			Payload: data[hdrLen:packetLen],
+			Raw:     data[:packetLen],
+		})
+		// Retry包和短包头数据包占据数据报的剩余部分
+		data = data[packetLen:]
+	}
+	return packets, nil
+}
+
+// Coalesce 将多个已序列化的数据包合并为一个UDP数据报。
+// 短包头数据包必须位于最后，否则接收方无法确定其边界
+func Coalesce(packets ...[]byte) ([]byte, error) {
+	var size int
+	for i, p := range packets {
+		if len(p) == 0 {
+			return nil, ErrTooShort
+		}
+		if p[0]&headerFormBit == 0 && i != len(packets)-1 {
+			return nil, ErrShortHeaderNotLast
+		}
+		size += len(p)
+	}
+	datagram := make([]byte, 0, size)
+	for _, p := range packets {
+		datagram = append(datagram, p...)
+	}
+	return datagram, nil
+}
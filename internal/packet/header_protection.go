@@ -0,0 +1,72 @@
+package packet
+
+import (
+	"fmt"
+
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/protocol"
+)
+
+// HeaderUnmasker 去除头部保护的函数：根据密文采样原地还原首字节和包序号字段，
+// pnBytes为包序号偏移处的4个字节
+type HeaderUnmasker func(sample []byte, firstByte *byte, pnBytes []byte) error
+
+// Unprotect 去除数据包的头部保护，并重新解析首字节中的包序号长度、
+// 密钥阶段位以及包序号。unmask为nil时表示数据包未受保护。
+// Raw会被原地修改，Payload更新为包序号之后的负载
+func (p *Packet) Unprotect(unmask HeaderUnmasker) error {
+	h := &p.Header
+	// Retry包和版本协商包没有头部保护
+	if !h.hasPacketNumber() {
+		return nil
+	}
+	if len(p.Raw) == 0 {
+		// 本地构造的数据包没有线上字节，无需去除保护
+		if unmask == nil {
+			return nil
+		}
+		return fmt.Errorf("缺少数据包的原始字节: %w", ErrTooShort)
+	}
+
+	// 解析时按未去除保护的首字节读取了包序号，据此回推包序号的偏移
+	pnOffset := len(p.Raw) - len(p.Payload) - h.PacketNumberLen
+	if unmask != nil {
+		// 采样从包序号偏移之后4字节处开始，此时假定包序号长度为4，见RFC 9001第5.4.2节
+		sampleOffset := pnOffset + 4
+		if sampleOffset+crypto.HeaderProtectionSampleLen > len(p.Raw) {
+			return fmt.Errorf("数据包截断：头部保护采样: %w", ErrTooShort)
+		}
+		sample := p.Raw[sampleOffset : sampleOffset+crypto.HeaderProtectionSampleLen]
+		if err := unmask(sample, &p.Raw[0], p.Raw[pnOffset:sampleOffset]); err != nil {
+			return fmt.Errorf("去除头部保护失败: %w", err)
+		}
+	}
+
+	hdrLen, err := h.readProtectedFields(p.Raw, pnOffset)
+	if err != nil {
+		return err
+	}
+	p.Payload = p.Raw[hdrLen:]
+	return nil
+}
+
+// CheckReservedBits 校验去除头部保护后首字节中的保留位。
+// 为避免泄露头部保护密钥的信息，只能在负载认证通过后校验，见RFC 9001第5.4.1节
+func (p *Packet) CheckReservedBits() error {
+	if !p.Header.hasPacketNumber() || len(p.Raw) == 0 {
+		return nil
+	}
+	reservedBits := byte(shortHeaderReservedBits)
+	if p.Header.IsLongHeader() {
+		reservedBits = longHeaderReservedBits
+	}
+	if p.Raw[0]&reservedBits != 0 {
+		return ErrReservedBitsSet
+	}
+	return nil
+}
+
+// hasPacketNumber 判断该类型的数据包是否携带受头部保护的包序号
+func (h *Header) hasPacketNumber() bool {
+	return h.Type != protocol.PacketTypeRetry && h.Type != protocol.PacketTypeVersionNegotiation
+}
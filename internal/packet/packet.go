@@ -3,11 +3,43 @@ package packet
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
+	"LQUIC/internal/crypto"
 	"LQUIC/internal/protocol"
 )
 
+const (
+	// headerFormBit 长包头标志位
+	headerFormBit = 0x80
+	// fixedBit 固定位，QUIC v1中必须为1
+	fixedBit = 0x40
+	// longHeaderReservedBits 长包头中的保留位
+	longHeaderReservedBits = 0x0c
+	// shortHeaderReservedBits 短包头中的保留位
+	shortHeaderReservedBits = 0x18
+	// keyPhaseBit 短包头中的密钥阶段位
+	keyPhaseBit = 0x04
+	// packetNumberLenMask 包序号长度字段掩码
+	packetNumberLenMask = 0x03
+)
+
+var (
+	// ErrTooShort 数据包长度不足以容纳包头
+	ErrTooShort = errors.New("数据包太短")
+	// ErrFixedBitNotSet 固定位为0
+	ErrFixedBitNotSet = errors.New("包头固定位未设置")
+	// ErrReservedBitsSet 保留位非零
+	ErrReservedBitsSet = errors.New("包头保留位非零")
+	// ErrInvalidLength 长度字段与实际数据不符
+	ErrInvalidLength = errors.New("无效的长度字段")
+	// ErrInvalidConnIDLen 连接ID长度超过上限
+	ErrInvalidConnIDLen = errors.New("无效的连接ID长度")
+	// ErrShortHeaderNotLast 短包头数据包没有位于数据报末尾
+	ErrShortHeaderNotLast = errors.New("短包头数据包必须位于数据报末尾")
+)
+
 // Header 表示QUIC数据包头部
 type Header struct {
 	Type         protocol.PacketType
@@ -16,88 +48,95 @@ type Header struct {
 	SrcConnID    protocol.ConnectionID
 	PacketNumber protocol.PacketNumber
 	PayloadLen   protocol.ByteCount
+	// Token Initial包携带的令牌，Retry包携带的重试令牌
+	Token []byte
+	// PacketNumberLen 包序号编码长度（1-4字节），为0时按4字节编码
+	PacketNumberLen int
+	// KeyPhase 短包头中的密钥阶段位
+	KeyPhase bool
 }
 
-// Pack 将Header序列化为字节流
-func (h *Header) Pack() ([]byte, error) {
-	// 验证包类型
-	switch h.Type {
-	case protocol.PacketTypeInitial,
-		protocol.PacketTypeHandshake,
-		protocol.PacketTypeOneRTT,
-		protocol.PacketTypeRetry:
-		// 有效的包类型
-	default:
-		return nil, fmt.Errorf("无效的包类型: %d", h.Type)
-	}
+// IsLongHeader 判断该包头是否使用长包头格式
+func (h *Header) IsLongHeader() bool {
+	return h.Type != protocol.PacketTypeOneRTT
+}
 
-	// 预分配足够的空间
-	buf := make([]byte, 0, 1500) // 常见MTU大小
+// packetNumberLen 返回实际使用的包序号编码长度
+func (h *Header) packetNumberLen() int {
+	if h.PacketNumberLen < 1 || h.PacketNumberLen > 4 {
+		return 4
+	}
+	return h.PacketNumberLen
+}
 
-	// 写入包类型
-	buf = append(buf, byte(h.Type))
+// Pack 将Header序列化为字节流
+func (h *Header) Pack() ([]byte, error) {
+	return h.appendHeader(make([]byte, 0, 1500)) // 常见MTU大小
+}
 
-	// 写入版本号
-	versionBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(versionBuf, h.Version)
-	buf = append(buf, versionBuf...)
+// appendHeader 将包头追加写入buf
+func (h *Header) appendHeader(buf []byte) ([]byte, error) {
+	typeBits, err := longHeaderTypeBits(h.Version, h.Type)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.DestConnID) > protocol.MaxConnectionIDLen || len(h.SrcConnID) > protocol.MaxConnectionIDLen {
+		return nil, ErrInvalidConnIDLen
+	}
+	pnLen := h.packetNumberLen()
+
+	// 短包头：0|1|S|R|R|K|P|P + 目标连接ID + 包序号
+	if !h.IsLongHeader() {
+		firstByte := byte(fixedBit) | byte(pnLen-1)
+		if h.KeyPhase {
+			firstByte |= keyPhaseBit
+		}
+		buf = append(buf, firstByte)
+		buf = append(buf, h.DestConnID...)
+		return appendPacketNumber(buf, h.PacketNumber, pnLen), nil
+	}
 
-	// 写入目标连接ID
+	// 长包头：1|1|T|T|X|X|X|X + 版本号 + 连接ID
+	firstByte := byte(headerFormBit|fixedBit) | typeBits<<4
+	if h.Type != protocol.PacketTypeRetry {
+		firstByte |= byte(pnLen - 1)
+	}
+	buf = append(buf, firstByte)
+	buf = binary.BigEndian.AppendUint32(buf, h.Version)
 	buf = append(buf, byte(len(h.DestConnID)))
 	buf = append(buf, h.DestConnID...)
-
-	// 写入源连接ID
 	buf = append(buf, byte(len(h.SrcConnID)))
 	buf = append(buf, h.SrcConnID...)
 
-	// 写入包序号
-	pnBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(pnBuf, uint64(h.PacketNumber))
-	buf = append(buf, pnBuf...)
-
-	return buf, nil
-}
-
-// Unpack 从字节流解析Header
-func (h *Header) Unpack(data []byte) error {
-	if len(data) < 22 { // 最小包头长度
-		return fmt.Errorf("数据包太短")
+	// Retry包没有长度和包序号字段，令牌直接位于连接ID之后
+	if h.Type == protocol.PacketTypeRetry {
+		return append(buf, h.Token...), nil
 	}
 
-	var offset int
-
-	// 解析包类型
-	h.Type = protocol.PacketType(data[0])
-	offset++
-
-	// 解析版本号
-	h.Version = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
-
-	// 解析目标连接ID
-	destConnIDLen := int(data[offset])
-	offset++
-	if offset+destConnIDLen > len(data) {
-		return fmt.Errorf("数据包截断：目标连接ID")
+	// Initial包携带令牌
+	if h.Type == protocol.PacketTypeInitial {
+		buf, err = protocol.AppendVarInt(buf, uint64(len(h.Token)))
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, h.Token...)
 	}
-	h.DestConnID = protocol.ConnectionID(data[offset : offset+destConnIDLen])
-	offset += destConnIDLen
 
-	// 解析源连接ID
-	srcConnIDLen := int(data[offset])
-	offset++
-	if offset+srcConnIDLen > len(data) {
-		return fmt.Errorf("数据包截断：源连接ID")
+	// 长度字段覆盖包序号和负载
+	buf, err = protocol.AppendVarInt(buf, uint64(pnLen)+uint64(h.PayloadLen))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLength, err)
 	}
-	h.SrcConnID = protocol.ConnectionID(data[offset : offset+srcConnIDLen])
-	offset += srcConnIDLen
+	return appendPacketNumber(buf, h.PacketNumber, pnLen), nil
+}
 
-	// 解析包序号
-	if offset+8 > len(data) {
-		return fmt.Errorf("数据包截断：包序号")
+// Unpack 从字节流解析Header
+func (h *Header) Unpack(data []byte) error {
+	hdr, _, _, err := parseHeader(data, protocol.DefaultConnectionIDLen)
+	if err != nil {
+		return err
 	}
-	h.PacketNumber = protocol.PacketNumber(binary.BigEndian.Uint64(data[offset:]))
-
+	*h = *hdr
 	return nil
 }
 
@@ -105,110 +144,239 @@ func (h *Header) Unpack(data []byte) error {
 type Packet struct {
 	Header  Header
 	Payload []byte
+	// Raw 从数据报中解析出的该数据包的原始字节
+	Raw []byte
 }
 
 // Pack 将数据包序列化为字节流
 func (p *Packet) Pack() ([]byte, error) {
-	// 验证包类型
-	switch p.Header.Type {
-	case protocol.PacketTypeInitial,
-		protocol.PacketTypeHandshake,
-		protocol.PacketTypeOneRTT,
-		protocol.PacketTypeRetry:
-		// 有效的包类型
-	default:
-		return nil, fmt.Errorf("无效的包类型: %d", p.Header.Type)
+	p.Header.PayloadLen = protocol.ByteCount(len(p.Payload))
+	buf, err := p.Header.appendHeader(make([]byte, 0, 1500)) // 常见MTU大小
+	if err != nil {
+		return nil, err
 	}
-
-	// 预分配足够的空间
-	buf := make([]byte, 0, 1500) // 常见MTU大小
-
-	// 写入包类型
-	buf = append(buf, byte(p.Header.Type))
-
-	// 写入版本号
-	versionBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(versionBuf, p.Header.Version)
-	buf = append(buf, versionBuf...)
-
-	// 写入目标连接ID
-	buf = append(buf, byte(len(p.Header.DestConnID)))
-	buf = append(buf, p.Header.DestConnID...)
-
-	// 写入源连接ID
-	buf = append(buf, byte(len(p.Header.SrcConnID)))
-	buf = append(buf, p.Header.SrcConnID...)
-
-	// 写入包序号
-	pnBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(pnBuf, uint64(p.Header.PacketNumber))
-	buf = append(buf, pnBuf...)
-
-	// 写入负载长度
-	lenBuf := make([]byte, 8)
-	binary.BigEndian.PutUint64(lenBuf, uint64(len(p.Payload)))
-	buf = append(buf, lenBuf...)
-
-	// 写入负载
-	buf = append(buf, p.Payload...)
-
-	return buf, nil
+	return append(buf, p.Payload...), nil
 }
 
 // Unpack 从字节流解析数据包
 func Unpack(data []byte) (*Packet, error) {
-	if len(data) < 22 { // 最小包头长度
-		return nil, fmt.Errorf("数据包太短")
+	hdr, hdrLen, packetLen, err := parseHeader(data, protocol.DefaultConnectionIDLen)
+	if err != nil {
+		return nil, err
 	}
+	return &Packet{
+		Header:  *hdr,
+		Payload: data[hdrLen:packetLen],
+		Raw:     data[:packetLen],
+	}, nil
+}
 
-	var offset int
-	packet := &Packet{}
+// parseHeader 解析包头，返回包头长度（含包序号）以及整个数据包的长度
+func parseHeader(data []byte, shortConnIDLen int) (*Header, int, int, error) {
+	if len(data) < 1 {
+		return nil, 0, 0, ErrTooShort
+	}
+	firstByte := data[0]
+	// 版本协商包的固定位可以为0，需要在检查固定位之前识别
+	if firstByte&headerFormBit != 0 && len(data) >= 5 &&
+		binary.BigEndian.Uint32(data[1:5]) == protocol.VersionNegotiation {
+		return parseVersionNegotiationHeader(data)
+	}
+	if firstByte&fixedBit == 0 {
+		return nil, 0, 0, ErrFixedBitNotSet
+	}
+	if firstByte&headerFormBit == 0 {
+		return parseShortHeader(data, shortConnIDLen)
+	}
+	return parseLongHeader(data)
+}
 
-	// 解析包类型
-	packet.Header.Type = protocol.PacketType(data[0])
-	offset++
+// parseVersionNegotiationHeader 解析版本协商包的包头，负载为版本列表
+func parseVersionNegotiationHeader(data []byte) (*Header, int, int, error) {
+	h, _, err := ParseVersionNegotiation(data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	hdrLen := 7 + len(h.DestConnID) + len(h.SrcConnID)
+	h.PayloadLen = protocol.ByteCount(len(data) - hdrLen)
+	return h, hdrLen, len(data), nil
+}
 
-	// 解析版本号
-	packet.Header.Version = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
+// parseShortHeader 解析1-RTT短包头
+func parseShortHeader(data []byte, connIDLen int) (*Header, int, int, error) {
+	offset := 1
+	if offset+connIDLen > len(data) {
+		return nil, 0, 0, fmt.Errorf("数据包截断：短包头: %w", ErrTooShort)
+	}
+	h := &Header{
+		Type:       protocol.PacketTypeOneRTT,
+		DestConnID: protocol.ConnectionID(data[offset : offset+connIDLen]),
+	}
+	offset += connIDLen
+	hdrLen, err := h.readProtectedFields(data, offset)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return h, hdrLen, len(data), nil
+}
+
+// parseLongHeader 解析长包头
+func parseLongHeader(data []byte) (*Header, int, int, error) {
+	if len(data) < 7 { // 首字节 + 版本号 + 两个连接ID长度
+		return nil, 0, 0, ErrTooShort
+	}
+	firstByte := data[0]
+	h := &Header{Version: binary.BigEndian.Uint32(data[1:5])}
+	if !protocol.IsSupportedVersion(protocol.SupportedVersions, h.Version) {
+		return nil, 0, 0, ErrUnsupportedVersion
+	}
+	h.Type = longHeaderType(h.Version, firstByte)
+	offset := 5
 
 	// 解析目标连接ID
 	destConnIDLen := int(data[offset])
 	offset++
-	if offset+destConnIDLen > len(data) {
-		return nil, fmt.Errorf("数据包截断：目标连接ID")
+	if destConnIDLen > protocol.MaxConnectionIDLen {
+		return nil, 0, 0, ErrInvalidConnIDLen
 	}
-	packet.Header.DestConnID = protocol.ConnectionID(data[offset : offset+destConnIDLen])
+	if offset+destConnIDLen+1 > len(data) {
+		return nil, 0, 0, fmt.Errorf("数据包截断：目标连接ID: %w", ErrTooShort)
+	}
+	h.DestConnID = protocol.ConnectionID(data[offset : offset+destConnIDLen])
 	offset += destConnIDLen
 
 	// 解析源连接ID
 	srcConnIDLen := int(data[offset])
 	offset++
+	if srcConnIDLen > protocol.MaxConnectionIDLen {
+		return nil, 0, 0, ErrInvalidConnIDLen
+	}
 	if offset+srcConnIDLen > len(data) {
-		return nil, fmt.Errorf("数据包截断：源连接ID")
+		return nil, 0, 0, fmt.Errorf("数据包截断：源连接ID: %w", ErrTooShort)
 	}
-	packet.Header.SrcConnID = protocol.ConnectionID(data[offset : offset+srcConnIDLen])
+	h.SrcConnID = protocol.ConnectionID(data[offset : offset+srcConnIDLen])
 	offset += srcConnIDLen
 
+	// Retry包的剩余部分是令牌和16字节的完整性标签
+	if h.Type == protocol.PacketTypeRetry {
+		if len(data)-offset < crypto.RetryIntegrityTagLen {
+			return nil, 0, 0, fmt.Errorf("数据包截断：Retry完整性标签: %w", ErrTooShort)
+		}
+		h.Token = data[offset : len(data)-crypto.RetryIntegrityTagLen]
+		return h, len(data), len(data), nil
+	}
+
+	// 解析Initial包的令牌
+	if h.Type == protocol.PacketTypeInitial {
+		tokenLen, n, err := protocol.ReadVarInt(data[offset:])
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("数据包截断：令牌长度: %w", err)
+		}
+		offset += n
+		if tokenLen > uint64(len(data)-offset) {
+			return nil, 0, 0, fmt.Errorf("令牌长度超出数据包: %w", ErrInvalidLength)
+		}
+		h.Token = data[offset : offset+int(tokenLen)]
+		offset += int(tokenLen)
+	}
+
+	// 解析长度字段
+	length, n, err := protocol.ReadVarInt(data[offset:])
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("数据包截断：长度: %w", err)
+	}
+	offset += n
+	if length > uint64(len(data)-offset) {
+		return nil, 0, 0, ErrInvalidLength
+	}
+	packetLen := offset + int(length)
+
 	// 解析包序号
-	if offset+8 > len(data) {
-		return nil, fmt.Errorf("数据包截断：包序号")
+	hdrLen, err := h.readProtectedFields(data[:packetLen], offset)
+	if err != nil {
+		return nil, 0, 0, err
 	}
-	packet.Header.PacketNumber = protocol.PacketNumber(binary.BigEndian.Uint64(data[offset:]))
-	offset += 8
+	return h, hdrLen, packetLen, nil
+}
 
-	// 解析负载长度
-	if offset+8 > len(data) {
-		return nil, fmt.Errorf("数据包截断：负载长度")
+// readProtectedFields 解析受头部保护的字段：首字节中的密钥阶段位和包序号长度，
+// 以及包序号本身。data为单个数据包的字节，pnOffset为包序号的偏移，返回包头长度。
+// 头部保护去除之前这些字段的值不可信
+func (h *Header) readProtectedFields(data []byte, pnOffset int) (int, error) {
+	firstByte := data[0]
+	pnLen := int(firstByte&packetNumberLenMask) + 1
+	if pnOffset+pnLen > len(data) {
+		if h.IsLongHeader() {
+			return 0, ErrInvalidLength
+		}
+		return 0, fmt.Errorf("数据包截断：包序号: %w", ErrTooShort)
+	}
+	h.PacketNumberLen = pnLen
+	h.PacketNumber = readPacketNumber(data[pnOffset:], pnLen)
+	if !h.IsLongHeader() {
+		h.KeyPhase = firstByte&keyPhaseBit != 0
 	}
-	payloadLen := binary.BigEndian.Uint64(data[offset:])
-	offset += 8
+	hdrLen := pnOffset + pnLen
+	h.PayloadLen = protocol.ByteCount(len(data) - hdrLen)
+	return hdrLen, nil
+}
 
-	// 解析负载
-	if offset+int(payloadLen) > len(data) {
-		return nil, fmt.Errorf("数据包截断：负载")
+// 长包头类型位，按版本区分，见RFC 9000第17.2节和RFC 9369第3.2节
+var (
+	longHeaderTypesV1 = [4]protocol.PacketType{
+		protocol.PacketTypeInitial,
+		protocol.PacketTypeZeroRTT,
+		protocol.PacketTypeHandshake,
+		protocol.PacketTypeRetry,
+	}
+	longHeaderTypesV2 = [4]protocol.PacketType{
+		protocol.PacketTypeRetry,
+		protocol.PacketTypeInitial,
+		protocol.PacketTypeZeroRTT,
+		protocol.PacketTypeHandshake,
 	}
-	packet.Payload = data[offset : offset+int(payloadLen)]
+)
 
-	return packet, nil
+// longHeaderTypes 返回指定版本下类型位到包类型的映射
+func longHeaderTypes(version uint32) *[4]protocol.PacketType {
+	if version == protocol.Version2 {
+		return &longHeaderTypesV2
+	}
+	return &longHeaderTypesV1
+}
+
+// longHeaderTypeBits 将包类型映射为长包头中的类型位
+func longHeaderTypeBits(version uint32, t protocol.PacketType) (byte, error) {
+	if t == protocol.PacketTypeOneRTT {
+		// 短包头没有类型位
+		return 0, nil
+	}
+	for bits, typ := range longHeaderTypes(version) {
+		if typ == t {
+			return byte(bits), nil
+		}
+	}
+	return 0, fmt.Errorf("无效的包类型: %d", t)
+}
+
+// longHeaderType 从长包头首字节解析包类型
+func longHeaderType(version uint32, firstByte byte) protocol.PacketType {
+	return longHeaderTypes(version)[(firstByte>>4)&0x03]
+}
+
+// appendPacketNumber 写入包序号的低pnLen字节
+func appendPacketNumber(buf []byte, pn protocol.PacketNumber, pnLen int) []byte {
+	for i := pnLen - 1; i >= 0; i-- {
+		buf = append(buf, byte(pn>>(8*i)))
+	}
+	return buf
+}
+
+// readPacketNumber 读取pnLen字节的包序号
+func readPacketNumber(data []byte, pnLen int) protocol.PacketNumber {
+	var pn protocol.PacketNumber
+	for i := 0; i < pnLen; i++ {
+		pn = pn<<8 | protocol.PacketNumber(data[i])
+	}
+	return pn
 }
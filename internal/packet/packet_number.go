@@ -0,0 +1,51 @@
+package packet
+
+import (
+	"math/bits"
+
+	"LQUIC/internal/protocol"
+)
+
+// PacketNumberLen 根据对端已确认的最大包序号计算截断编码需要的字节数，
+// 见RFC 9000附录A.2。largestAcked为protocol.InvalidPacketNumber表示尚未有包被确认
+func PacketNumberLen(pn, largestAcked protocol.PacketNumber) int {
+	var numUnacked uint64
+	if largestAcked == protocol.InvalidPacketNumber {
+		numUnacked = uint64(pn) + 1
+	} else {
+		numUnacked = uint64(pn - largestAcked)
+	}
+
+	// 编码空间需要覆盖两倍以上的未确认范围
+	minBits := bits.Len64(numUnacked) + 1
+	pnLen := (minBits + 7) / 8
+	if pnLen > 4 {
+		pnLen = 4
+	}
+	return pnLen
+}
+
+// DecodePacketNumber 根据已接收的最大包序号还原被截断的包序号，
+// 见RFC 9000附录A.3。largestReceived为protocol.InvalidPacketNumber表示尚未收到数据包
+func DecodePacketNumber(largestReceived, truncated protocol.PacketNumber, pnLen int) protocol.PacketNumber {
+	if pnLen < 1 || pnLen > 4 {
+		pnLen = 4
+	}
+	expected := protocol.PacketNumber(0)
+	if largestReceived != protocol.InvalidPacketNumber {
+		expected = largestReceived + 1
+	}
+
+	win := protocol.PacketNumber(1) << (8 * pnLen)
+	hwin := win / 2
+	mask := win - 1
+	candidate := (expected &^ mask) | (truncated & mask)
+	switch {
+	case candidate+hwin <= expected && candidate < protocol.MaxPacketNumber+1-win:
+		return candidate + win
+	case candidate > expected+hwin && candidate >= win:
+		return candidate - win
+	default:
+		return candidate
+	}
+}
@@ -2,8 +2,12 @@ package packet
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"testing"
 
+	"LQUIC/internal/crypto"
 	"LQUIC/internal/protocol"
 )
 
@@ -114,3 +118,503 @@ func TestInvalidPacket(t *testing.T) {
 		t.Error("期望序列化无效包类型返回错误，但没有")
 	}
 }
+
+func TestLongHeaderWireFormat(t *testing.T) {
+	h := Header{
+		Type:            protocol.PacketTypeHandshake,
+		Version:         protocol.Version,
+		DestConnID:      protocol.ConnectionID{1, 2, 3, 4},
+		SrcConnID:       protocol.ConnectionID{5, 6},
+		PacketNumber:    0x1234,
+		PacketNumberLen: 2,
+		PayloadLen:      10,
+	}
+	data, err := h.Pack()
+	if err != nil {
+		t.Fatalf("序列化Header失败: %v", err)
+	}
+
+	expected := []byte{
+		0xe1,                   // 长包头 | 固定位 | Handshake | 包序号长度2
+		0x00, 0x00, 0x00, 0x01, // 版本号
+		0x04, 1, 2, 3, 4, // 目标连接ID
+		0x02, 5, 6, // 源连接ID
+		0x0c,       // 长度 = 包序号长度 + 负载长度
+		0x12, 0x34, // 包序号
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("长包头编码错误，期望%x，实际%x", expected, data)
+	}
+}
+
+func TestInitialPacketToken(t *testing.T) {
+	original := &Packet{
+		Header: Header{
+			Type:         protocol.PacketTypeInitial,
+			Version:      protocol.Version,
+			DestConnID:   protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+			SrcConnID:    protocol.ConnectionID{9, 10},
+			Token:        []byte("token"),
+			PacketNumber: 7,
+		},
+		Payload: bytes.Repeat([]byte{0xaa}, 100),
+	}
+	data, err := original.Pack()
+	if err != nil {
+		t.Fatalf("序列化Packet失败: %v", err)
+	}
+
+	// 附加的尾部数据不属于该数据包
+	unpacked, err := Unpack(append(data, 0xff, 0xff))
+	if err != nil {
+		t.Fatalf("反序列化Packet失败: %v", err)
+	}
+	if !bytes.Equal(unpacked.Header.Token, original.Header.Token) {
+		t.Errorf("Token不匹配，期望%v，实际%v", original.Header.Token, unpacked.Header.Token)
+	}
+	if !bytes.Equal(unpacked.Payload, original.Payload) {
+		t.Errorf("Payload不匹配，期望%v，实际%v", original.Payload, unpacked.Payload)
+	}
+}
+
+func TestShortHeaderPackUnpack(t *testing.T) {
+	original := &Packet{
+		Header: Header{
+			Type:            protocol.PacketTypeOneRTT,
+			DestConnID:      protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+			PacketNumber:    0x42,
+			PacketNumberLen: 1,
+			KeyPhase:        true,
+		},
+		Payload: []byte("short header payload"),
+	}
+	data, err := original.Pack()
+	if err != nil {
+		t.Fatalf("序列化Packet失败: %v", err)
+	}
+	if data[0] != 0x44 {
+		t.Errorf("短包头首字节错误，期望0x44，实际0x%x", data[0])
+	}
+
+	unpacked, err := Unpack(data)
+	if err != nil {
+		t.Fatalf("反序列化Packet失败: %v", err)
+	}
+	if unpacked.Header.Type != protocol.PacketTypeOneRTT {
+		t.Errorf("Type不匹配，期望%v，实际%v", protocol.PacketTypeOneRTT, unpacked.Header.Type)
+	}
+	if !bytes.Equal(unpacked.Header.DestConnID, original.Header.DestConnID) {
+		t.Errorf("DestConnID不匹配，期望%v，实际%v", original.Header.DestConnID, unpacked.Header.DestConnID)
+	}
+	if unpacked.Header.PacketNumber != original.Header.PacketNumber {
+		t.Errorf("PacketNumber不匹配，期望%v，实际%v", original.Header.PacketNumber, unpacked.Header.PacketNumber)
+	}
+	if !unpacked.Header.KeyPhase {
+		t.Error("KeyPhase应为true")
+	}
+	if !bytes.Equal(unpacked.Payload, original.Payload) {
+		t.Errorf("Payload不匹配，期望%v，实际%v", original.Payload, unpacked.Payload)
+	}
+}
+
+func TestHeaderParseErrors(t *testing.T) {
+	valid := &Packet{
+		Header: Header{
+			Type:       protocol.PacketTypeHandshake,
+			Version:    protocol.Version,
+			DestConnID: protocol.ConnectionID{1, 2, 3, 4},
+		},
+		Payload: []byte("payload"),
+	}
+	data, err := valid.Pack()
+	if err != nil {
+		t.Fatalf("序列化Packet失败: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+		err    error
+	}{
+		{"固定位为0", func(b []byte) []byte { b[0] &^= fixedBit; return b }, ErrFixedBitNotSet},
+		{"保留位非零", func(b []byte) []byte { b[0] |= 0x08; return b }, ErrReservedBitsSet},
+		{"长度超出数据", func(b []byte) []byte { return b[:len(b)-1] }, ErrInvalidLength},
+		{"连接ID过长", func(b []byte) []byte { b[5] = 21; return b }, ErrInvalidConnIDLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.modify(append([]byte(nil), data...))
+			// 保留位受头部保护，在去除保护并解密后才校验
+			p, err := Unpack(b)
+			if err == nil {
+				err = p.Unprotect(nil)
+			}
+			if err == nil {
+				err = p.CheckReservedBits()
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("期望错误%v，实际%v", tt.err, err)
+			}
+		})
+	}
+
+	// 短包头保留位非零
+	short := []byte{0x40 | 0x10, 1, 2, 3, 4, 5, 6, 7, 8, 0}
+	p, err := Unpack(short)
+	if err != nil {
+		t.Fatalf("解析短包头失败: %v", err)
+	}
+	if err := p.Unprotect(nil); err != nil {
+		t.Fatalf("去除头部保护失败: %v", err)
+	}
+	if err := p.CheckReservedBits(); !errors.Is(err, ErrReservedBitsSet) {
+		t.Errorf("期望错误%v，实际%v", ErrReservedBitsSet, err)
+	}
+}
+
+func TestPacketNumberLen(t *testing.T) {
+	tests := []struct {
+		name         string
+		pn           protocol.PacketNumber
+		largestAcked protocol.PacketNumber
+		expected     int
+	}{
+		// RFC 9000 附录A.2中的示例
+		{"RFC示例16位", 0xac5c02, 0xabe8b3, 2},
+		{"RFC示例18位", 0xace8fe, 0xabe8b3, 3},
+		{"尚未确认的首个包", 0, protocol.InvalidPacketNumber, 1},
+		{"紧随确认包", 101, 100, 1},
+		{"差距很大", 1 << 40, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if l := PacketNumberLen(tt.pn, tt.largestAcked); l != tt.expected {
+				t.Errorf("编码长度错误，期望%d，实际%d", tt.expected, l)
+			}
+		})
+	}
+}
+
+func TestDecodePacketNumber(t *testing.T) {
+	tests := []struct {
+		name            string
+		largestReceived protocol.PacketNumber
+		truncated       protocol.PacketNumber
+		pnLen           int
+		expected        protocol.PacketNumber
+	}{
+		// RFC 9000 附录A.3中的示例
+		{"RFC示例", 0xa82f30ea, 0x9b32, 2, 0xa82f9b32},
+		{"尚未收到数据包", protocol.InvalidPacketNumber, 0, 1, 0},
+		{"向上回绕", 0xff, 0x01, 1, 0x101},
+		{"向下回绕", 0x101, 0xff, 1, 0xff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pn := DecodePacketNumber(tt.largestReceived, tt.truncated, tt.pnLen); pn != tt.expected {
+				t.Errorf("解码错误，期望0x%x，实际0x%x", tt.expected, pn)
+			}
+		})
+	}
+}
+
+func TestTruncatedPacketNumberRoundTrip(t *testing.T) {
+	largestAcked := protocol.PacketNumber(0x12345600)
+	for _, pn := range []protocol.PacketNumber{0x12345601, 0x12345700, 0x12355600} {
+		original := &Packet{
+			Header: Header{
+				Type:            protocol.PacketTypeOneRTT,
+				DestConnID:      protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+				PacketNumber:    pn,
+				PacketNumberLen: PacketNumberLen(pn, largestAcked),
+			},
+			Payload: []byte{0x01},
+		}
+		data, err := original.Pack()
+		if err != nil {
+			t.Fatalf("序列化Packet失败: %v", err)
+		}
+		unpacked, err := Unpack(data)
+		if err != nil {
+			t.Fatalf("反序列化Packet失败: %v", err)
+		}
+		// 接收方已收到的最大包序号不小于发送方已确认的最大包序号
+		decoded := DecodePacketNumber(pn-1, unpacked.Header.PacketNumber, unpacked.Header.PacketNumberLen)
+		if decoded != pn {
+			t.Errorf("包序号还原错误，期望0x%x，实际0x%x", pn, decoded)
+		}
+	}
+}
+
+func TestParseCoalescedDatagram(t *testing.T) {
+	destConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	packets := []*Packet{
+		{Header: Header{Type: protocol.PacketTypeInitial, Version: protocol.Version, DestConnID: destConnID, PacketNumber: 1}, Payload: []byte("initial")},
+		{Header: Header{Type: protocol.PacketTypeHandshake, Version: protocol.Version, DestConnID: destConnID, PacketNumber: 2}, Payload: []byte("handshake")},
+		{Header: Header{Type: protocol.PacketTypeOneRTT, DestConnID: destConnID, PacketNumber: 3}, Payload: []byte("1-rtt")},
+	}
+	var raw [][]byte
+	for _, p := range packets {
+		data, err := p.Pack()
+		if err != nil {
+			t.Fatalf("序列化Packet失败: %v", err)
+		}
+		raw = append(raw, data)
+	}
+
+	// 短包头数据包不在末尾时无法合并
+	if _, err := Coalesce(raw[2], raw[0]); !errors.Is(err, ErrShortHeaderNotLast) {
+		t.Errorf("期望错误%v，实际%v", ErrShortHeaderNotLast, err)
+	}
+
+	datagram, err := Coalesce(raw...)
+	if err != nil {
+		t.Fatalf("合并数据包失败: %v", err)
+	}
+	parsed, err := ParseDatagram(datagram, len(destConnID))
+	if err != nil {
+		t.Fatalf("解析数据报失败: %v", err)
+	}
+	if len(parsed) != len(packets) {
+		t.Fatalf("数据包数量错误，期望%d，实际%d", len(packets), len(parsed))
+	}
+	for i, p := range parsed {
+		if p.Header.Type != packets[i].Header.Type {
+			t.Errorf("第%d个数据包类型错误，期望%v，实际%v", i, packets[i].Header.Type, p.Header.Type)
+		}
+		if !bytes.Equal(p.Payload, packets[i].Payload) {
+			t.Errorf("第%d个数据包负载错误，期望%q，实际%q", i, packets[i].Payload, p.Payload)
+		}
+		if !bytes.Equal(p.Raw, raw[i]) {
+			t.Errorf("第%d个数据包原始字节错误", i)
+		}
+	}
+
+	// 目标连接ID不同的后续数据包被忽略
+	other := &Packet{Header: Header{Type: protocol.PacketTypeHandshake, Version: protocol.Version, DestConnID: protocol.ConnectionID{9}}, Payload: []byte("x")}
+	otherData, _ := other.Pack()
+	parsed, err = ParseDatagram(append(append([]byte(nil), raw[0]...), otherData...), len(destConnID))
+	if err != nil || len(parsed) != 1 {
+		t.Errorf("期望只解析出1个数据包，实际%d个, %v", len(parsed), err)
+	}
+
+	// 数据报末尾的无效数据被忽略
+	parsed, err = ParseDatagram(append(append([]byte(nil), raw[0]...), 0, 0, 0), len(destConnID))
+	if err != nil || len(parsed) != 1 {
+		t.Errorf("期望只解析出1个数据包，实际%d个, %v", len(parsed), err)
+	}
+
+	// 第一个数据包无效时返回错误
+	if _, err := ParseDatagram([]byte{0, 0, 0}, len(destConnID)); err == nil {
+		t.Error("无效数据报应该返回错误")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	destConnID := protocol.ConnectionID{1, 2, 3, 4}
+	srcConnID := protocol.ConnectionID{5, 6, 7, 8, 9, 10, 11, 12}
+	data := ComposeVersionNegotiation(destConnID, srcConnID, []uint32{protocol.Version1, 0x1a2a3a4a})
+
+	hdr, versions, err := ParseVersionNegotiation(data)
+	if err != nil {
+		t.Fatalf("解析版本协商包失败: %v", err)
+	}
+	if hdr.Type != protocol.PacketTypeVersionNegotiation {
+		t.Errorf("包类型错误，期望%v，实际%v", protocol.PacketTypeVersionNegotiation, hdr.Type)
+	}
+	if !bytes.Equal(hdr.DestConnID, destConnID) || !bytes.Equal(hdr.SrcConnID, srcConnID) {
+		t.Error("版本协商包的连接ID不匹配")
+	}
+	if len(versions) != 2 || versions[0] != protocol.Version1 || versions[1] != 0x1a2a3a4a {
+		t.Errorf("版本列表错误: %x", versions)
+	}
+
+	// 数据报解析同样可以识别版本协商包，即使固定位为0
+	data[0] &^= fixedBit
+	packets, err := ParseDatagram(data, 8)
+	if err != nil || len(packets) != 1 || packets[0].Header.Type != protocol.PacketTypeVersionNegotiation {
+		t.Errorf("数据报中的版本协商包解析错误: %v", err)
+	}
+
+	// 版本列表长度不是4的倍数
+	if _, _, err := ParseVersionNegotiation(data[:len(data)-1]); !errors.Is(err, ErrInvalidVersionNegotiation) {
+		t.Errorf("期望错误%v，实际%v", ErrInvalidVersionNegotiation, err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	p := &Packet{
+		Header: Header{
+			Type:       protocol.PacketTypeInitial,
+			Version:    0x1a2a3a4a,
+			DestConnID: protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+			SrcConnID:  protocol.ConnectionID{9, 10},
+		},
+		Payload: []byte("payload"),
+	}
+	data, err := p.Pack()
+	if err != nil {
+		t.Fatalf("序列化Packet失败: %v", err)
+	}
+
+	if _, err := ParseDatagram(data, 8); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("期望错误%v，实际%v", ErrUnsupportedVersion, err)
+	}
+
+	// 与版本无关的字段仍然可以解析
+	hdr, err := ParseInvariantHeader(data)
+	if err != nil {
+		t.Fatalf("解析版本无关包头失败: %v", err)
+	}
+	if hdr.Version != 0x1a2a3a4a || !bytes.Equal(hdr.DestConnID, p.Header.DestConnID) || !bytes.Equal(hdr.SrcConnID, p.Header.SrcConnID) {
+		t.Errorf("版本无关包头解析错误: %+v", hdr)
+	}
+}
+
+func TestVersion2PacketTypes(t *testing.T) {
+	// RFC 9369第3.2节：版本2的长包头类型位
+	tests := []struct {
+		packetType protocol.PacketType
+		typeBits   byte
+	}{
+		{protocol.PacketTypeInitial, 0x1},
+		{protocol.PacketTypeZeroRTT, 0x2},
+		{protocol.PacketTypeHandshake, 0x3},
+		{protocol.PacketTypeRetry, 0x0},
+	}
+	for _, tt := range tests {
+		p := &Packet{
+			Header: Header{
+				Type:       tt.packetType,
+				Version:    protocol.Version2,
+				DestConnID: protocol.ConnectionID{1, 2, 3, 4},
+				SrcConnID:  protocol.ConnectionID{5, 6},
+				Token:      []byte("token"),
+			},
+			Payload: []byte("payload"),
+		}
+		data, err := p.Pack()
+		if tt.packetType == protocol.PacketTypeRetry {
+			data, err = ComposeRetry(protocol.Version2, p.Header.DestConnID, p.Header.SrcConnID, protocol.ConnectionID{9}, p.Header.Token)
+		}
+		if err != nil {
+			t.Fatalf("序列化失败: %v", err)
+		}
+		if bits := (data[0] >> 4) & 0x03; bits != tt.typeBits {
+			t.Errorf("包类型%v的类型位错误，期望%d，实际%d", tt.packetType, tt.typeBits, bits)
+		}
+		parsed, err := Unpack(data)
+		if err != nil {
+			t.Fatalf("解析失败: %v", err)
+		}
+		if parsed.Header.Type != tt.packetType || parsed.Header.Version != protocol.Version2 {
+			t.Errorf("解析结果错误: 类型%v，版本0x%x", parsed.Header.Type, parsed.Header.Version)
+		}
+	}
+
+	// 同样的首字节在版本1中表示不同的包类型
+	v1 := &Header{Type: protocol.PacketTypeInitial, Version: protocol.Version1, PayloadLen: 1}
+	data, err := v1.Pack()
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+	if bits := (data[0] >> 4) & 0x03; bits != 0x0 {
+		t.Errorf("版本1的Initial类型位错误，实际%d", bits)
+	}
+}
+
+func TestRetryIntegrityTag(t *testing.T) {
+	// RFC 9001附录A.4的Retry包
+	origDestConnID := protocol.ConnectionID{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+	expected := []byte{
+		0xff, 0x00, 0x00, 0x00, 0x01, 0x00, 0x08, 0xf0, 0x67, 0xa5, 0x50, 0x2a, 0x42, 0x62, 0xb5, 0x74,
+		0x6f, 0x6b, 0x65, 0x6e, 0x04, 0xa2, 0x65, 0xba, 0x2e, 0xff, 0x4d, 0x82, 0x90, 0x58, 0xfb, 0x3f,
+		0x0f, 0x24, 0x96, 0xba,
+	}
+	data, err := ComposeRetry(protocol.Version1, nil, protocol.ConnectionID{0xf0, 0x67, 0xa5, 0x50, 0x2a, 0x42, 0x62, 0xb5}, origDestConnID, []byte("token"))
+	if err != nil {
+		t.Fatalf("构造Retry包失败: %v", err)
+	}
+	// 示例中Retry包的未使用位为1，只比较完整性标签
+	if !bytes.Equal(data[1:len(data)-16], expected[1:len(expected)-16]) {
+		t.Fatalf("Retry包内容错误: %x", data)
+	}
+	p, err := Unpack(expected)
+	if err != nil {
+		t.Fatalf("解析Retry包失败: %v", err)
+	}
+	if p.Header.Type != protocol.PacketTypeRetry || string(p.Header.Token) != "token" {
+		t.Errorf("Retry包解析错误: 类型%v，令牌%q", p.Header.Type, p.Header.Token)
+	}
+	if !VerifyRetry(&p.Header, expected, origDestConnID) {
+		t.Error("RFC 9001附录A.4的完整性标签校验失败")
+	}
+	if !VerifyRetry(&p.Header, data, origDestConnID) {
+		t.Error("自行构造的Retry包校验结果错误")
+	}
+
+	// 原始目标连接ID不同或内容被篡改时校验失败
+	if VerifyRetry(&p.Header, expected, protocol.ConnectionID{1, 2, 3, 4}) {
+		t.Error("原始目标连接ID不同时应该校验失败")
+	}
+	tampered := append([]byte{}, expected...)
+	tampered[len(tampered)-20] ^= 1
+	if VerifyRetry(&p.Header, tampered, origDestConnID) {
+		t.Error("篡改后的Retry包应该校验失败")
+	}
+
+	// RFC 9369附录A.4的版本2 Retry包
+	v2 := []byte{
+		0xcf, 0x6b, 0x33, 0x43, 0xcf, 0x00, 0x08, 0xf0, 0x67, 0xa5, 0x50, 0x2a, 0x42, 0x62, 0xb5, 0x74,
+		0x6f, 0x6b, 0x65, 0x6e, 0xc8, 0x64, 0x6c, 0xe8, 0xbf, 0xe3, 0x39, 0x52, 0xd9, 0x55, 0x54, 0x36,
+		0x65, 0xdc, 0xc7, 0xb6,
+	}
+	p, err = Unpack(v2)
+	if err != nil {
+		t.Fatalf("解析版本2 Retry包失败: %v", err)
+	}
+	if p.Header.Type != protocol.PacketTypeRetry || !VerifyRetry(&p.Header, v2, origDestConnID) {
+		t.Error("RFC 9369附录A.4的完整性标签校验失败")
+	}
+}
+
+func TestUnprotect(t *testing.T) {
+	// RFC 9001附录A.3的服务端Initial包
+	data, _ := hex.DecodeString("cf000000010008f067a5502a4262b5004075c0d9" +
+		"5a482cd0991cd25b0aac406a5816b6394100f37a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3bded74b562bfb19fb84022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc42158407dd074ee")
+	hpKey, _ := hex.DecodeString("c206b8d9b9f0f37644430b490eeaa314")
+	hp, err := crypto.NewHeaderProtector(tls.TLS_AES_128_GCM_SHA256, hpKey)
+	if err != nil {
+		t.Fatalf("创建头部保护失败: %v", err)
+	}
+
+	p, err := Unpack(data)
+	if err != nil {
+		t.Fatalf("解析数据包失败: %v", err)
+	}
+	// 受保护的首字节指示4字节包序号
+	if p.Header.PacketNumberLen != 4 {
+		t.Fatalf("受保护的包序号长度应为4，实际%d", p.Header.PacketNumberLen)
+	}
+	if err := p.Unprotect(hp.DecryptHeader); err != nil {
+		t.Fatalf("去除头部保护失败: %v", err)
+	}
+	if p.Header.PacketNumber != 1 || p.Header.PacketNumberLen != 2 {
+		t.Errorf("包序号错误: %d，长度%d", p.Header.PacketNumber, p.Header.PacketNumberLen)
+	}
+	if got := hex.EncodeToString(p.Raw[:20]); got != "c1000000010008f067a5502a4262b50040750001" {
+		t.Errorf("去除保护后的包头错误: %s", got)
+	}
+	if len(p.Payload) != 115 || p.Payload[0] != 0x5a {
+		t.Errorf("负载范围错误，长度%d", len(p.Payload))
+	}
+	if err := p.CheckReservedBits(); err != nil {
+		t.Errorf("保留位校验失败: %v", err)
+	}
+
+	// 数据包过短，无法采样
+	short := &Packet{Header: Header{Type: protocol.PacketTypeOneRTT, PacketNumberLen: 1}, Raw: []byte{0x40, 1, 2}, Payload: []byte{2}}
+	if err := short.Unprotect(hp.DecryptHeader); !errors.Is(err, ErrTooShort) {
+		t.Errorf("期望错误%v，实际%v", ErrTooShort, err)
+	}
+}
@@ -0,0 +1,35 @@
+package packet
+
+import (
+	"LQUIC/internal/crypto"
+	"LQUIC/internal/protocol"
+)
+
+// ComposeRetry 构造带完整性标签的Retry包。destConnID和srcConnID分别为
+// 客户端的源连接ID和服务端新选择的连接ID，origDestConnID为客户端首个Initial包的目标连接ID
+func ComposeRetry(version uint32, destConnID, srcConnID, origDestConnID protocol.ConnectionID, token []byte) ([]byte, error) {
+	h := &Header{
+		Type:       protocol.PacketTypeRetry,
+		Version:    version,
+		DestConnID: destConnID,
+		SrcConnID:  srcConnID,
+		Token:      token,
+	}
+	data, err := h.Pack()
+	if err != nil {
+		return nil, err
+	}
+	tag, err := crypto.ComputeRetryIntegrityTag(version, origDestConnID, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, tag[:]...), nil
+}
+
+// VerifyRetry 使用原始目标连接ID校验Retry包的完整性标签，data为完整的Retry包
+func VerifyRetry(h *Header, data []byte, origDestConnID protocol.ConnectionID) bool {
+	if h.Type != protocol.PacketTypeRetry {
+		return false
+	}
+	return crypto.VerifyRetryIntegrityTag(h.Version, origDestConnID, data)
+}
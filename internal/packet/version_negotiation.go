@@ -0,0 +1,79 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"LQUIC/internal/protocol"
+)
+
+var (
+	// ErrUnsupportedVersion 长包头使用了本实现无法解析的版本
+	ErrUnsupportedVersion = errors.New("不支持的QUIC版本")
+	// ErrInvalidVersionNegotiation 版本协商包格式错误
+	ErrInvalidVersionNegotiation = errors.New("无效的版本协商包")
+)
+
+// ParseInvariantHeader 只解析与版本无关的包头字段（RFC 8999），
+// 用于处理无法识别版本的长包头，例如据此回复版本协商包
+func ParseInvariantHeader(data []byte) (*Header, error) {
+	if len(data) < 7 || data[0]&headerFormBit == 0 {
+		return nil, ErrTooShort
+	}
+	h := &Header{Version: binary.BigEndian.Uint32(data[1:5])}
+	offset := 5
+	destConnIDLen := int(data[offset])
+	offset++
+	if offset+destConnIDLen+1 > len(data) {
+		return nil, fmt.Errorf("数据包截断：目标连接ID: %w", ErrTooShort)
+	}
+	h.DestConnID = protocol.ConnectionID(data[offset : offset+destConnIDLen])
+	offset += destConnIDLen
+	srcConnIDLen := int(data[offset])
+	offset++
+	if offset+srcConnIDLen > len(data) {
+		return nil, fmt.Errorf("数据包截断：源连接ID: %w", ErrTooShort)
+	}
+	h.SrcConnID = protocol.ConnectionID(data[offset : offset+srcConnIDLen])
+	return h, nil
+}
+
+// ComposeVersionNegotiation 构造版本协商包。destConnID和srcConnID分别
+// 回显客户端数据包中的源连接ID和目标连接ID
+func ComposeVersionNegotiation(destConnID, srcConnID protocol.ConnectionID, versions []uint32) []byte {
+	buf := make([]byte, 0, 7+len(destConnID)+len(srcConnID)+4*len(versions))
+	// 首字节除包头形式位外的其余位可以任意取值
+	buf = append(buf, headerFormBit|fixedBit)
+	buf = binary.BigEndian.AppendUint32(buf, protocol.VersionNegotiation)
+	buf = append(buf, byte(len(destConnID)))
+	buf = append(buf, destConnID...)
+	buf = append(buf, byte(len(srcConnID)))
+	buf = append(buf, srcConnID...)
+	for _, v := range versions {
+		buf = binary.BigEndian.AppendUint32(buf, v)
+	}
+	return buf
+}
+
+// ParseVersionNegotiation 解析版本协商包，返回包头和服务端支持的版本列表
+func ParseVersionNegotiation(data []byte) (*Header, []uint32, error) {
+	h, err := ParseInvariantHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Version != protocol.VersionNegotiation {
+		return nil, nil, ErrInvalidVersionNegotiation
+	}
+	h.Type = protocol.PacketTypeVersionNegotiation
+
+	list := data[7+len(h.DestConnID)+len(h.SrcConnID):]
+	if len(list) == 0 || len(list)%4 != 0 {
+		return nil, nil, ErrInvalidVersionNegotiation
+	}
+	versions := make([]uint32, 0, len(list)/4)
+	for i := 0; i < len(list); i += 4 {
+		versions = append(versions, binary.BigEndian.Uint32(list[i:]))
+	}
+	return h, versions, nil
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// TransportErrorCode 表示RFC 9000第20.1节定义的传输层错误码
+type TransportErrorCode uint64
+
+const (
+	// NoError 无错误，用于正常关闭连接
+	NoError TransportErrorCode = 0x0
+	// InternalError 实现内部错误
+	InternalError TransportErrorCode = 0x1
+	// ConnectionRefused 服务端拒绝连接
+	ConnectionRefused TransportErrorCode = 0x2
+	// FlowControlError 对端超出流量控制限制
+	FlowControlError TransportErrorCode = 0x3
+	// StreamLimitError 对端超出流数量限制
+	StreamLimitError TransportErrorCode = 0x4
+	// StreamStateError 帧与流的状态不符
+	StreamStateError TransportErrorCode = 0x5
+	// FinalSizeError 流的最终大小不一致
+	FinalSizeError TransportErrorCode = 0x6
+	// FrameEncodingError 帧编码错误
+	FrameEncodingError TransportErrorCode = 0x7
+	// TransportParameterError 传输参数错误
+	TransportParameterError TransportErrorCode = 0x8
+	// ConnectionIDLimitError 对端提供的连接ID超出限制
+	ConnectionIDLimitError TransportErrorCode = 0x9
+	// ProtocolViolation 违反协议
+	ProtocolViolation TransportErrorCode = 0xa
+	// InvalidToken 无效的令牌
+	InvalidToken TransportErrorCode = 0xb
+	// ApplicationError 应用层错误
+	ApplicationError TransportErrorCode = 0xc
+	// CryptoBufferExceeded 加密数据缓冲区溢出
+	CryptoBufferExceeded TransportErrorCode = 0xd
+	// KeyUpdateError 密钥更新错误
+	KeyUpdateError TransportErrorCode = 0xe
+	// AEADLimitReached 达到AEAD使用上限
+	AEADLimitReached TransportErrorCode = 0xf
+	// NoViablePath 没有可用的网络路径
+	NoViablePath TransportErrorCode = 0x10
+	// VersionNegotiationError 版本协商信息不一致，见RFC 9368第10.2节
+	VersionNegotiationError TransportErrorCode = 0x11
+	// CryptoErrorBase TLS告警映射的错误码起始值（0x0100-0x01ff）
+	CryptoErrorBase TransportErrorCode = 0x100
+	// NoApplicationProtocol 双方没有共同支持的应用层协议，对应TLS的no_application_protocol告警，见RFC 9001第8.1节
+	NoApplicationProtocol = CryptoErrorBase + 120
+	// CertificateRequired 服务端要求客户端证书而客户端没有出示，对应TLS的certificate_required告警
+	CertificateRequired = CryptoErrorBase + 116
+)
+
+// TransportError 表示需要以CONNECTION_CLOSE帧通知对端的传输层错误
+type TransportError struct {
+	// Code 错误码
+	Code TransportErrorCode
+	// FrameType 触发错误的帧类型，未知时为0
+	FrameType uint64
+	// Reason 错误原因
+	Reason string
+}
+
+// NewTransportError 创建新的传输层错误
+func NewTransportError(code TransportErrorCode, format string, args ...interface{}) *TransportError {
+	return &TransportError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error 实现error接口
+func (e *TransportError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("传输层错误(0x%x)", uint64(e.Code))
+	}
+	return fmt.Sprintf("传输层错误(0x%x): %s", uint64(e.Code), e.Reason)
+}
+
+// ApplicationErrorCode 表示应用层协议定义的错误码，与传输层错误码属于不同的编码空间，见RFC 9000第20.2节
+type ApplicationErrorCode uint64
+
+// ApplicationCloseError 表示对端以应用层CONNECTION_CLOSE帧（0x1d）关闭连接的原因
+type ApplicationCloseError struct {
+	// Code 应用层错误码
+	Code ApplicationErrorCode
+	// Reason 错误原因
+	Reason string
+}
+
+// Error 实现error接口
+func (e *ApplicationCloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("应用层错误(0x%x)", uint64(e.Code))
+	}
+	return fmt.Sprintf("应用层错误(0x%x): %s", uint64(e.Code), e.Reason)
+}
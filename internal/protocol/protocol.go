@@ -1,12 +1,26 @@
 // Package protocol 定义QUIC协议的基本常量和类型
 package protocol
 
-// Version 定义QUIC版本号
-const Version = uint32(1)
+// Version 定义默认使用的QUIC版本号
+const Version = Version1
 
 // ConnectionID 表示QUIC连接ID
 type ConnectionID []byte
 
+const (
+	// MaxConnectionIDLen 是QUIC v1长包头中连接ID的最大长度
+	MaxConnectionIDLen = 20
+	// DefaultConnectionIDLen 是本实现生成的连接ID长度，短包头解析时依赖该长度
+	DefaultConnectionIDLen = 8
+)
+
+const (
+	// MinInitialDatagramSize 携带Initial包的UDP数据报的最小长度
+	MinInitialDatagramSize = 1200
+	// DefaultMaxDatagramSize 在获知路径MTU之前发送的UDP数据报的最大长度
+	DefaultMaxDatagramSize = 1252
+)
+
 // PacketType 定义QUIC数据包类型
 type PacketType uint8
 
@@ -19,13 +33,97 @@ const (
 	PacketTypeOneRTT
 	// PacketTypeRetry 重试数据包
 	PacketTypeRetry
+	// PacketTypeZeroRTT 0-RTT数据包
+	PacketTypeZeroRTT
+	// PacketTypeVersionNegotiation 版本协商数据包
+	PacketTypeVersionNegotiation
 )
 
-// StreamID 表示QUIC流ID
+// StreamID 表示QUIC流ID。最低位表示发起方（0为客户端，1为服务端），
+// 次低位表示类型（0为双向流，1为单向流），其余位为流的序号，见RFC 9000第2.1节
 type StreamID uint64
 
+// StreamType 表示流的类型
+type StreamType uint8
+
+const (
+	// StreamTypeBidi 双向流
+	StreamTypeBidi StreamType = iota
+	// StreamTypeUni 单向流，只有发起方可以发送数据
+	StreamTypeUni
+)
+
+// NewStreamID 返回由initiator发起的、指定类型的第num个流（从0开始）的ID
+func NewStreamID(num uint64, typ StreamType, initiator Perspective) StreamID {
+	id := StreamID(num << 2)
+	if initiator == PerspectiveServer {
+		id |= 0x1
+	}
+	if typ == StreamTypeUni {
+		id |= 0x2
+	}
+	return id
+}
+
+// InitiatedBy 返回发起该流的一方
+func (s StreamID) InitiatedBy() Perspective {
+	if s&0x1 == 0 {
+		return PerspectiveClient
+	}
+	return PerspectiveServer
+}
+
+// Type 返回流的类型
+func (s StreamID) Type() StreamType {
+	if s&0x2 == 0 {
+		return StreamTypeBidi
+	}
+	return StreamTypeUni
+}
+
+// Num 返回流在同一发起方、同一类型的流中的序号
+func (s StreamID) Num() uint64 {
+	return uint64(s >> 2)
+}
+
 // ByteCount 表示字节计数
 type ByteCount uint64
 
 // PacketNumber 表示数据包编号
 type PacketNumber uint64
+
+// InvalidPacketNumber 表示尚不存在的包序号，例如还没有任何数据包被确认
+const InvalidPacketNumber = ^PacketNumber(0)
+
+// MaxPacketNumber 包序号的最大取值（2^62-1）
+const MaxPacketNumber PacketNumber = 1<<62 - 1
+
+// Perspective 表示本端在连接中的角色
+type Perspective int
+
+const (
+	// PerspectiveServer 服务端
+	PerspectiveServer Perspective = 1
+	// PerspectiveClient 客户端
+	PerspectiveClient Perspective = 2
+)
+
+// Opposite 返回对端的角色
+func (p Perspective) Opposite() Perspective {
+	if p == PerspectiveServer {
+		return PerspectiveClient
+	}
+	return PerspectiveServer
+}
+
+// String 实现fmt.Stringer接口
+func (p Perspective) String() string {
+	switch p {
+	case PerspectiveServer:
+		return "服务端"
+	case PerspectiveClient:
+		return "客户端"
+	default:
+		return "未知角色"
+	}
+}
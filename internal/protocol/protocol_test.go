@@ -35,6 +35,7 @@ func TestPacketType(t *testing.T) {
 		{"Handshake包类型", PacketTypeHandshake, 2},
 		{"OneRTT包类型", PacketTypeOneRTT, 3},
 		{"Retry包类型", PacketTypeRetry, 4},
+		{"ZeroRTT包类型", PacketTypeZeroRTT, 5},
 	}
 
 	for _, tt := range tests {
@@ -59,6 +60,29 @@ func TestStreamID(t *testing.T) {
 	if sid != 1 {
 		t.Errorf("StreamID值错误，期望1，实际%d", sid)
 	}
+
+	// RFC 9000第2.1节：最低两位表示发起方和类型
+	tests := []struct {
+		id        StreamID
+		num       uint64
+		typ       StreamType
+		initiator Perspective
+	}{
+		{0, 0, StreamTypeBidi, PerspectiveClient},
+		{1, 0, StreamTypeBidi, PerspectiveServer},
+		{2, 0, StreamTypeUni, PerspectiveClient},
+		{3, 0, StreamTypeUni, PerspectiveServer},
+		{8, 2, StreamTypeBidi, PerspectiveClient},
+		{15, 3, StreamTypeUni, PerspectiveServer},
+	}
+	for _, tt := range tests {
+		if got := NewStreamID(tt.num, tt.typ, tt.initiator); got != tt.id {
+			t.Errorf("NewStreamID(%d, %d, %v)错误，期望%d，实际%d", tt.num, tt.typ, tt.initiator, tt.id, got)
+		}
+		if tt.id.Num() != tt.num || tt.id.Type() != tt.typ || tt.id.InitiatedBy() != tt.initiator {
+			t.Errorf("流%d的序号、类型或发起方错误", tt.id)
+		}
+	}
 }
 
 func TestByteCount(t *testing.T) {
@@ -76,3 +100,73 @@ func TestPacketNumber(t *testing.T) {
 		t.Errorf("PacketNumber值错误，期望100，实际%d", pn)
 	}
 }
+
+func TestChooseSupportedVersion(t *testing.T) {
+	if !IsSupportedVersion(SupportedVersions, Version1) {
+		t.Error("应支持QUIC版本1")
+	}
+	if IsSupportedVersion(SupportedVersions, VersionNegotiation) {
+		t.Error("版本协商的版本号不是有效的QUIC版本")
+	}
+
+	// 按本端优先级选择
+	v, ok := ChooseSupportedVersion([]uint32{3, 2, 1}, []uint32{1, 2})
+	if !ok || v != 2 {
+		t.Errorf("版本选择错误，期望2，实际%d", v)
+	}
+
+	// 没有共同支持的版本
+	if _, ok := ChooseSupportedVersion([]uint32{1}, []uint32{0x1a2a3a4a}); ok {
+		t.Error("没有共同版本时应返回false")
+	}
+}
+
+func TestVersionInformation(t *testing.T) {
+	info := &VersionInformation{ChosenVersion: Version1, AvailableVersions: []uint32{Version2, Version1}}
+	data := info.Append(nil)
+	if len(data) != 12 {
+		t.Fatalf("序列化长度错误，期望12，实际%d", len(data))
+	}
+	parsed, err := ParseVersionInformation(data)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if parsed.ChosenVersion != Version1 || len(parsed.AvailableVersions) != 2 || parsed.AvailableVersions[0] != Version2 {
+		t.Errorf("解析结果错误: %+v", parsed)
+	}
+
+	for _, data := range [][]byte{{}, {0, 0, 0}, {0, 0, 0, 0}, {0, 0, 0, 1, 0, 0, 0, 0}} {
+		if _, err := ParseVersionInformation(data); err == nil {
+			t.Errorf("无效的version_information应该返回错误: %x", data)
+		}
+	}
+}
+
+func TestChooseCompatibleVersion(t *testing.T) {
+	if !IsCompatibleVersion(Version1, Version2) || !IsCompatibleVersion(Version2, Version1) {
+		t.Error("版本1和版本2应该互相兼容")
+	}
+	if IsCompatibleVersion(Version1, 0x1a2a3a4a) {
+		t.Error("未知版本不应兼容")
+	}
+
+	client := &VersionInformation{ChosenVersion: Version1, AvailableVersions: []uint32{Version1, Version2}}
+	tests := []struct {
+		name   string
+		ours   []uint32
+		client *VersionInformation
+		want   uint32
+	}{
+		{"服务端优先版本2", []uint32{Version2, Version1}, client, Version2},
+		{"服务端优先版本1", []uint32{Version1, Version2}, client, Version1},
+		{"客户端不支持版本2", []uint32{Version2, Version1}, &VersionInformation{ChosenVersion: Version1, AvailableVersions: []uint32{Version1}}, Version1},
+		{"没有version_information", []uint32{Version2, Version1}, nil, Version1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v := ChooseCompatibleVersion(tt.ours, Version1, tt.client); v != tt.want {
+				t.Errorf("期望0x%x，实际0x%x", tt.want, v)
+			}
+		})
+	}
+}
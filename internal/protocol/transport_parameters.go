@@ -0,0 +1,446 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// transportParameterID 传输参数的标识，见RFC 9000第18.2节
+type transportParameterID uint64
+
+const (
+	paramOriginalDestinationConnectionID transportParameterID = 0x00
+	paramMaxIdleTimeout                  transportParameterID = 0x01
+	paramStatelessResetToken             transportParameterID = 0x02
+	paramMaxUDPPayloadSize               transportParameterID = 0x03
+	paramInitialMaxData                  transportParameterID = 0x04
+	paramInitialMaxStreamDataBidiLocal   transportParameterID = 0x05
+	paramInitialMaxStreamDataBidiRemote  transportParameterID = 0x06
+	paramInitialMaxStreamDataUni         transportParameterID = 0x07
+	paramInitialMaxStreamsBidi           transportParameterID = 0x08
+	paramInitialMaxStreamsUni            transportParameterID = 0x09
+	paramAckDelayExponent                transportParameterID = 0x0a
+	paramMaxAckDelay                     transportParameterID = 0x0b
+	paramDisableActiveMigration          transportParameterID = 0x0c
+	paramPreferredAddress                transportParameterID = 0x0d
+	paramActiveConnectionIDLimit         transportParameterID = 0x0e
+	paramInitialSourceConnectionID       transportParameterID = 0x0f
+	paramRetrySourceConnectionID         transportParameterID = 0x10
+	// paramVersionInformation 见RFC 9368第3节
+	paramVersionInformation transportParameterID = 0x11
+)
+
+const (
+	// DefaultMaxUDPPayloadSize max_udp_payload_size的默认值
+	DefaultMaxUDPPayloadSize = 65527
+	// DefaultAckDelayExponent ack_delay_exponent的默认值
+	DefaultAckDelayExponent = 3
+	// DefaultMaxAckDelay max_ack_delay的默认值
+	DefaultMaxAckDelay = 25 * time.Millisecond
+	// DefaultActiveConnectionIDLimit active_connection_id_limit的默认值
+	DefaultActiveConnectionIDLimit = 2
+
+	// MaxAckDelayExponent ack_delay_exponent的上限
+	MaxAckDelayExponent = 20
+	// MaxMaxAckDelay max_ack_delay必须小于2^14毫秒
+	MaxMaxAckDelay = (1<<14 - 1) * time.Millisecond
+	// MaxStreamCount initial_max_streams_bidi和initial_max_streams_uni的上限（2^60）
+	MaxStreamCount = 1 << 60
+	// StatelessResetTokenLen 无状态重置令牌的长度
+	StatelessResetTokenLen = 16
+)
+
+// StatelessResetToken 无状态重置令牌，见RFC 9000第10.3节
+type StatelessResetToken [StatelessResetTokenLen]byte
+
+// PreferredAddress preferred_address传输参数，服务端希望客户端在握手后迁移到的地址
+type PreferredAddress struct {
+	// IPv4和IPv6地址，未提供时为nil，端口为0
+	IPv4     net.IP
+	IPv4Port uint16
+	IPv6     net.IP
+	IPv6Port uint16
+	// ConnectionID 在新地址上使用的连接ID，不能为空
+	ConnectionID ConnectionID
+	// StatelessResetToken ConnectionID对应的无状态重置令牌
+	StatelessResetToken StatelessResetToken
+}
+
+// TransportParameters QUIC传输参数，在TLS的quic_transport_parameters扩展中交换，见RFC 9000第18节
+type TransportParameters struct {
+	// OriginalDestinationConnectionID 客户端首个Initial包的目标连接ID，只能由服务端发送
+	OriginalDestinationConnectionID ConnectionID
+	// MaxIdleTimeout 最大空闲超时，0表示不限制
+	MaxIdleTimeout time.Duration
+	// StatelessResetToken 服务端握手连接ID对应的无状态重置令牌，只能由服务端发送
+	StatelessResetToken *StatelessResetToken
+	// MaxUDPPayloadSize 本端愿意接收的最大UDP负载长度，不能小于1200
+	MaxUDPPayloadSize ByteCount
+	// InitialMaxData 连接级别的初始流量控制上限
+	InitialMaxData ByteCount
+	// 流级别的初始流量控制上限，分别对应本端发起的双向流、对端发起的双向流和单向流
+	InitialMaxStreamDataBidiLocal  ByteCount
+	InitialMaxStreamDataBidiRemote ByteCount
+	InitialMaxStreamDataUni        ByteCount
+	// 对端可以打开的双向流和单向流的初始数量
+	InitialMaxStreamsBidi uint64
+	InitialMaxStreamsUni  uint64
+	// AckDelayExponent ACK帧中ACK Delay字段的指数
+	AckDelayExponent uint8
+	// MaxAckDelay 本端延迟发送ACK的最长时间
+	MaxAckDelay time.Duration
+	// DisableActiveMigration 本端不支持主动连接迁移
+	DisableActiveMigration bool
+	// PreferredAddress 服务端的首选地址，只能由服务端发送
+	PreferredAddress *PreferredAddress
+	// ActiveConnectionIDLimit 本端愿意保存的对端连接ID数量，不能小于2
+	ActiveConnectionIDLimit uint64
+	// InitialSourceConnectionID 本端首个Initial包的源连接ID
+	InitialSourceConnectionID ConnectionID
+	// RetrySourceConnectionID Retry包的源连接ID，只能由服务端在发送Retry之后发送
+	RetrySourceConnectionID ConnectionID
+	// VersionInformation 兼容版本协商使用的version_information
+	VersionInformation *VersionInformation
+}
+
+// transportParameterError 创建TRANSPORT_PARAMETER_ERROR
+func transportParameterError(format string, args ...interface{}) *TransportError {
+	return NewTransportError(TransportParameterError, format, args...)
+}
+
+// Validate 检查传输参数的取值，sentBy为发送这些参数的一方
+func (p *TransportParameters) Validate(sentBy Perspective) error {
+	if p.MaxUDPPayloadSize < MinInitialDatagramSize {
+		return transportParameterError("max_udp_payload_size不能小于%d: %d", MinInitialDatagramSize, p.MaxUDPPayloadSize)
+	}
+	if p.AckDelayExponent > MaxAckDelayExponent {
+		return transportParameterError("ack_delay_exponent不能大于%d: %d", MaxAckDelayExponent, p.AckDelayExponent)
+	}
+	if p.MaxAckDelay > MaxMaxAckDelay {
+		return transportParameterError("max_ack_delay过大: %v", p.MaxAckDelay)
+	}
+	if p.ActiveConnectionIDLimit < DefaultActiveConnectionIDLimit {
+		return transportParameterError("active_connection_id_limit不能小于%d: %d", DefaultActiveConnectionIDLimit, p.ActiveConnectionIDLimit)
+	}
+	if p.InitialMaxStreamsBidi > MaxStreamCount || p.InitialMaxStreamsUni > MaxStreamCount {
+		return transportParameterError("初始流数量超过2^60")
+	}
+	for _, v := range []ByteCount{p.InitialMaxData, p.InitialMaxStreamDataBidiLocal, p.InitialMaxStreamDataBidiRemote, p.InitialMaxStreamDataUni} {
+		if v > MaxVarInt {
+			return transportParameterError("流量控制上限超出可变长度整数的范围: %d", v)
+		}
+	}
+	if p.MaxIdleTimeout < 0 || p.MaxIdleTimeout/time.Millisecond > MaxVarInt {
+		return transportParameterError("max_idle_timeout无效: %v", p.MaxIdleTimeout)
+	}
+	for _, id := range []ConnectionID{p.OriginalDestinationConnectionID, p.InitialSourceConnectionID, p.RetrySourceConnectionID} {
+		if len(id) > MaxConnectionIDLen {
+			return transportParameterError("连接ID过长: %d字节", len(id))
+		}
+	}
+	if p.InitialSourceConnectionID == nil {
+		return transportParameterError("缺少initial_source_connection_id")
+	}
+	if sentBy == PerspectiveClient {
+		if p.OriginalDestinationConnectionID != nil || p.StatelessResetToken != nil ||
+			p.PreferredAddress != nil || p.RetrySourceConnectionID != nil {
+			return transportParameterError("客户端不能发送仅限服务端的传输参数")
+		}
+		return nil
+	}
+	if p.OriginalDestinationConnectionID == nil {
+		return transportParameterError("缺少original_destination_connection_id")
+	}
+	if pa := p.PreferredAddress; pa != nil {
+		if len(pa.ConnectionID) == 0 || len(pa.ConnectionID) > MaxConnectionIDLen {
+			return transportParameterError("preferred_address的连接ID长度无效: %d", len(pa.ConnectionID))
+		}
+		if len(p.InitialSourceConnectionID) == 0 {
+			return transportParameterError("使用零长度连接ID的服务端不能提供preferred_address")
+		}
+		if (pa.IPv4 != nil && pa.IPv4.To4() == nil) || (pa.IPv6 != nil && pa.IPv6.To16() == nil) {
+			return transportParameterError("preferred_address的地址无效")
+		}
+	}
+	return nil
+}
+
+// ValidateZeroRTT 检查服务端的传输参数没有降低客户端为0-RTT记住的限制。
+// 服务端接受0-RTT时不能降低这些限制，客户端发现被降低时以PROTOCOL_VIOLATION关闭连接，见RFC 9000第7.4.1节
+func (p *TransportParameters) ValidateZeroRTT(remembered *TransportParameters) error {
+	limits := []struct {
+		name              string
+		current, previous uint64
+	}{
+		{"active_connection_id_limit", p.ActiveConnectionIDLimit, remembered.ActiveConnectionIDLimit},
+		{"initial_max_data", uint64(p.InitialMaxData), uint64(remembered.InitialMaxData)},
+		{"initial_max_stream_data_bidi_local", uint64(p.InitialMaxStreamDataBidiLocal), uint64(remembered.InitialMaxStreamDataBidiLocal)},
+		{"initial_max_stream_data_bidi_remote", uint64(p.InitialMaxStreamDataBidiRemote), uint64(remembered.InitialMaxStreamDataBidiRemote)},
+		{"initial_max_stream_data_uni", uint64(p.InitialMaxStreamDataUni), uint64(remembered.InitialMaxStreamDataUni)},
+		{"initial_max_streams_bidi", p.InitialMaxStreamsBidi, remembered.InitialMaxStreamsBidi},
+		{"initial_max_streams_uni", p.InitialMaxStreamsUni, remembered.InitialMaxStreamsUni},
+	}
+	for _, l := range limits {
+		if l.current < l.previous {
+			return NewTransportError(ProtocolViolation, "接受0-RTT时%s从%d降低到%d", l.name, l.previous, l.current)
+		}
+	}
+	return nil
+}
+
+// Append 校验传输参数后将其序列化并追加到b，sentBy为发送这些参数的一方。
+// 取默认值的参数不会被编码
+func (p *TransportParameters) Append(b []byte, sentBy Perspective) ([]byte, error) {
+	if err := p.Validate(sentBy); err != nil {
+		return b, err
+	}
+	w := &paramWriter{b: b}
+	if sentBy == PerspectiveServer {
+		w.bytes(paramOriginalDestinationConnectionID, p.OriginalDestinationConnectionID)
+	}
+	if p.MaxIdleTimeout > 0 {
+		w.varint(paramMaxIdleTimeout, uint64(p.MaxIdleTimeout/time.Millisecond))
+	}
+	if p.StatelessResetToken != nil {
+		w.bytes(paramStatelessResetToken, p.StatelessResetToken[:])
+	}
+	if p.MaxUDPPayloadSize != DefaultMaxUDPPayloadSize {
+		w.varint(paramMaxUDPPayloadSize, uint64(p.MaxUDPPayloadSize))
+	}
+	w.nonZero(paramInitialMaxData, uint64(p.InitialMaxData))
+	w.nonZero(paramInitialMaxStreamDataBidiLocal, uint64(p.InitialMaxStreamDataBidiLocal))
+	w.nonZero(paramInitialMaxStreamDataBidiRemote, uint64(p.InitialMaxStreamDataBidiRemote))
+	w.nonZero(paramInitialMaxStreamDataUni, uint64(p.InitialMaxStreamDataUni))
+	w.nonZero(paramInitialMaxStreamsBidi, p.InitialMaxStreamsBidi)
+	w.nonZero(paramInitialMaxStreamsUni, p.InitialMaxStreamsUni)
+	if p.AckDelayExponent != DefaultAckDelayExponent {
+		w.varint(paramAckDelayExponent, uint64(p.AckDelayExponent))
+	}
+	if p.MaxAckDelay != DefaultMaxAckDelay {
+		w.varint(paramMaxAckDelay, uint64(p.MaxAckDelay/time.Millisecond))
+	}
+	if p.DisableActiveMigration {
+		w.bytes(paramDisableActiveMigration, nil)
+	}
+	if p.PreferredAddress != nil {
+		w.bytes(paramPreferredAddress, p.PreferredAddress.append(nil))
+	}
+	if p.ActiveConnectionIDLimit != DefaultActiveConnectionIDLimit {
+		w.varint(paramActiveConnectionIDLimit, p.ActiveConnectionIDLimit)
+	}
+	w.bytes(paramInitialSourceConnectionID, p.InitialSourceConnectionID)
+	if p.RetrySourceConnectionID != nil {
+		w.bytes(paramRetrySourceConnectionID, p.RetrySourceConnectionID)
+	}
+	if p.VersionInformation != nil {
+		w.bytes(paramVersionInformation, p.VersionInformation.Append(nil))
+	}
+	return w.b, w.err
+}
+
+// ParseTransportParameters 解析并校验对端的传输参数，sentBy为发送这些参数的一方。
+// 未知的参数（包括保留的GREASE参数）被忽略，重复的参数视为错误
+func ParseTransportParameters(data []byte, sentBy Perspective) (*TransportParameters, error) {
+	p := &TransportParameters{
+		MaxUDPPayloadSize:       DefaultMaxUDPPayloadSize,
+		AckDelayExponent:        DefaultAckDelayExponent,
+		MaxAckDelay:             DefaultMaxAckDelay,
+		ActiveConnectionIDLimit: DefaultActiveConnectionIDLimit,
+	}
+	seen := make(map[transportParameterID]bool)
+	for len(data) > 0 {
+		id, n, err := ReadVarInt(data)
+		if err != nil {
+			return nil, transportParameterError("传输参数标识截断")
+		}
+		data = data[n:]
+		length, n, err := ReadVarInt(data)
+		if err != nil || uint64(len(data)-n) < length {
+			return nil, transportParameterError("传输参数0x%x长度无效", id)
+		}
+		value := data[n : n+int(length)]
+		data = data[n+int(length):]
+
+		paramID := transportParameterID(id)
+		if paramID > paramVersionInformation {
+			continue
+		}
+		if seen[paramID] {
+			return nil, transportParameterError("重复的传输参数0x%x", id)
+		}
+		seen[paramID] = true
+		if err := p.parseParameter(paramID, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Validate(sentBy); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseParameter 解析单个已知的传输参数
+func (p *TransportParameters) parseParameter(id transportParameterID, value []byte) error {
+	switch id {
+	case paramOriginalDestinationConnectionID:
+		p.OriginalDestinationConnectionID = append(ConnectionID{}, value...)
+	case paramInitialSourceConnectionID:
+		p.InitialSourceConnectionID = append(ConnectionID{}, value...)
+	case paramRetrySourceConnectionID:
+		p.RetrySourceConnectionID = append(ConnectionID{}, value...)
+	case paramStatelessResetToken:
+		if len(value) != StatelessResetTokenLen {
+			return transportParameterError("stateless_reset_token长度无效: %d", len(value))
+		}
+		var token StatelessResetToken
+		copy(token[:], value)
+		p.StatelessResetToken = &token
+	case paramDisableActiveMigration:
+		if len(value) != 0 {
+			return transportParameterError("disable_active_migration不能携带值")
+		}
+		p.DisableActiveMigration = true
+	case paramPreferredAddress:
+		pa, err := parsePreferredAddress(value)
+		if err != nil {
+			return err
+		}
+		p.PreferredAddress = pa
+	case paramVersionInformation:
+		v, err := ParseVersionInformation(value)
+		if err != nil {
+			return err
+		}
+		p.VersionInformation = v
+	default:
+		v, n, err := ReadVarInt(value)
+		if err != nil || n != len(value) {
+			return transportParameterError("传输参数0x%x的整数编码无效", uint64(id))
+		}
+		return p.setIntParameter(id, v)
+	}
+	return nil
+}
+
+// setIntParameter 设置整数类型的传输参数
+func (p *TransportParameters) setIntParameter(id transportParameterID, v uint64) error {
+	switch id {
+	case paramMaxIdleTimeout:
+		if v > uint64(time.Duration(1<<63-1)/time.Millisecond) {
+			return transportParameterError("max_idle_timeout过大: %d", v)
+		}
+		p.MaxIdleTimeout = time.Duration(v) * time.Millisecond
+	case paramMaxUDPPayloadSize:
+		p.MaxUDPPayloadSize = ByteCount(v)
+	case paramInitialMaxData:
+		p.InitialMaxData = ByteCount(v)
+	case paramInitialMaxStreamDataBidiLocal:
+		p.InitialMaxStreamDataBidiLocal = ByteCount(v)
+	case paramInitialMaxStreamDataBidiRemote:
+		p.InitialMaxStreamDataBidiRemote = ByteCount(v)
+	case paramInitialMaxStreamDataUni:
+		p.InitialMaxStreamDataUni = ByteCount(v)
+	case paramInitialMaxStreamsBidi:
+		p.InitialMaxStreamsBidi = v
+	case paramInitialMaxStreamsUni:
+		p.InitialMaxStreamsUni = v
+	case paramAckDelayExponent:
+		if v > MaxAckDelayExponent {
+			return transportParameterError("ack_delay_exponent不能大于%d: %d", MaxAckDelayExponent, v)
+		}
+		p.AckDelayExponent = uint8(v)
+	case paramMaxAckDelay:
+		if v > uint64(MaxMaxAckDelay/time.Millisecond) {
+			return transportParameterError("max_ack_delay过大: %d", v)
+		}
+		p.MaxAckDelay = time.Duration(v) * time.Millisecond
+	case paramActiveConnectionIDLimit:
+		p.ActiveConnectionIDLimit = v
+	}
+	return nil
+}
+
+// append 序列化preferred_address：IPv4地址和端口、IPv6地址和端口、连接ID及其无状态重置令牌
+func (pa *PreferredAddress) append(b []byte) []byte {
+	ipv4 := make([]byte, net.IPv4len)
+	if ip := pa.IPv4.To4(); ip != nil {
+		copy(ipv4, ip)
+	}
+	b = append(b, ipv4...)
+	b = binary.BigEndian.AppendUint16(b, pa.IPv4Port)
+	ipv6 := make([]byte, net.IPv6len)
+	if ip := pa.IPv6.To16(); ip != nil {
+		copy(ipv6, ip)
+	}
+	b = append(b, ipv6...)
+	b = binary.BigEndian.AppendUint16(b, pa.IPv6Port)
+	b = append(b, byte(len(pa.ConnectionID)))
+	b = append(b, pa.ConnectionID...)
+	return append(b, pa.StatelessResetToken[:]...)
+}
+
+// parsePreferredAddress 解析preferred_address，全零的地址和端口表示未提供该地址族
+func parsePreferredAddress(data []byte) (*PreferredAddress, error) {
+	const fixedLen = net.IPv4len + 2 + net.IPv6len + 2 + 1
+	if len(data) < fixedLen {
+		return nil, transportParameterError("preferred_address长度无效: %d", len(data))
+	}
+	pa := &PreferredAddress{}
+	if ip := net.IP(data[:net.IPv4len]); !ip.Equal(net.IPv4zero) {
+		pa.IPv4 = append(net.IP{}, ip...)
+	}
+	pa.IPv4Port = binary.BigEndian.Uint16(data[net.IPv4len:])
+	data = data[net.IPv4len+2:]
+	if ip := net.IP(data[:net.IPv6len]); !ip.Equal(net.IPv6zero) {
+		pa.IPv6 = append(net.IP{}, ip...)
+	}
+	pa.IPv6Port = binary.BigEndian.Uint16(data[net.IPv6len:])
+	data = data[net.IPv6len+2:]
+	connIDLen := int(data[0])
+	data = data[1:]
+	if len(data) != connIDLen+StatelessResetTokenLen {
+		return nil, transportParameterError("preferred_address长度无效")
+	}
+	pa.ConnectionID = append(ConnectionID{}, data[:connIDLen]...)
+	copy(pa.StatelessResetToken[:], data[connIDLen:])
+	return pa, nil
+}
+
+// paramWriter 依次写入传输参数，记录遇到的第一个错误
+type paramWriter struct {
+	b   []byte
+	err error
+}
+
+// bytes 写入标识、长度和值
+func (w *paramWriter) bytes(id transportParameterID, value []byte) {
+	if w.err != nil {
+		return
+	}
+	if w.b, w.err = AppendVarInt(w.b, uint64(id)); w.err != nil {
+		return
+	}
+	if w.b, w.err = AppendVarInt(w.b, uint64(len(value))); w.err != nil {
+		return
+	}
+	w.b = append(w.b, value...)
+}
+
+// varint 写入值为可变长度整数的参数
+func (w *paramWriter) varint(id transportParameterID, v uint64) {
+	value, err := AppendVarInt(nil, v)
+	if err != nil {
+		w.err = fmt.Errorf("传输参数0x%x: %w", uint64(id), err)
+		return
+	}
+	w.bytes(id, value)
+}
+
+// nonZero 只在值非零时写入整数参数，0是这些参数的默认值
+func (w *paramWriter) nonZero(id transportParameterID, v uint64) {
+	if v != 0 {
+		w.varint(id, v)
+	}
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newServerParams 返回一组取值都不是默认值的服务端传输参数
+func newServerParams() *TransportParameters {
+	return &TransportParameters{
+		OriginalDestinationConnectionID: ConnectionID{1, 2, 3, 4, 5, 6, 7, 8},
+		MaxIdleTimeout:                  30 * time.Second,
+		StatelessResetToken:             &StatelessResetToken{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		MaxUDPPayloadSize:               1500,
+		InitialMaxData:                  1 << 20,
+		InitialMaxStreamDataBidiLocal:   1 << 16,
+		InitialMaxStreamDataBidiRemote:  1 << 17,
+		InitialMaxStreamDataUni:         1 << 18,
+		InitialMaxStreamsBidi:           100,
+		InitialMaxStreamsUni:            3,
+		AckDelayExponent:                10,
+		MaxAckDelay:                     50 * time.Millisecond,
+		DisableActiveMigration:          true,
+		PreferredAddress: &PreferredAddress{
+			IPv4:                net.IPv4(127, 0, 0, 1).To4(),
+			IPv4Port:            4433,
+			IPv6:                net.ParseIP("::1"),
+			IPv6Port:            4434,
+			ConnectionID:        ConnectionID{9, 9, 9, 9},
+			StatelessResetToken: StatelessResetToken{0xff},
+		},
+		ActiveConnectionIDLimit:   4,
+		InitialSourceConnectionID: ConnectionID{0xaa, 0xbb},
+		RetrySourceConnectionID:   ConnectionID{0xcc},
+		VersionInformation:        &VersionInformation{ChosenVersion: Version1, AvailableVersions: []uint32{Version1, Version2}},
+	}
+}
+
+// appendParam 编码一个原始的传输参数
+func appendParam(b []byte, id uint64, value []byte) []byte {
+	b, _ = AppendVarInt(b, id)
+	b, _ = AppendVarInt(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func TestTransportParametersRoundTrip(t *testing.T) {
+	params := newServerParams()
+	data, err := params.Append(nil, PerspectiveServer)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	parsed, err := ParseTransportParameters(data, PerspectiveServer)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, params) {
+		t.Errorf("解析结果与原参数不一致\n期望%+v\n实际%+v", params, parsed)
+	}
+
+	// 零长度连接ID与缺省不同，需要保留
+	client := &TransportParameters{
+		MaxUDPPayloadSize:         DefaultMaxUDPPayloadSize,
+		AckDelayExponent:          DefaultAckDelayExponent,
+		MaxAckDelay:               DefaultMaxAckDelay,
+		ActiveConnectionIDLimit:   DefaultActiveConnectionIDLimit,
+		InitialSourceConnectionID: ConnectionID{},
+	}
+	data, err = client.Append(nil, PerspectiveClient)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	// 默认值不编码，只剩initial_source_connection_id
+	if len(data) != 2 {
+		t.Errorf("取默认值的参数不应编码，实际%x", data)
+	}
+	parsed, err = ParseTransportParameters(data, PerspectiveClient)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, client) {
+		t.Errorf("解析结果与原参数不一致\n期望%+v\n实际%+v", client, parsed)
+	}
+}
+
+func TestParseTransportParametersUnknown(t *testing.T) {
+	// 保留的GREASE参数（31*N+27）和其他未知参数被忽略
+	data := appendParam(nil, 31*5+27, []byte{1, 2, 3})
+	data = appendParam(data, 0x4000, nil)
+	data = appendParam(data, uint64(paramInitialSourceConnectionID), []byte{1})
+	params, err := ParseTransportParameters(data, PerspectiveClient)
+	if err != nil {
+		t.Fatalf("未知参数应被忽略: %v", err)
+	}
+	if string(params.InitialSourceConnectionID) != "\x01" || params.MaxUDPPayloadSize != DefaultMaxUDPPayloadSize {
+		t.Errorf("解析结果错误: %+v", params)
+	}
+}
+
+func TestParseTransportParametersErrors(t *testing.T) {
+	iscid := appendParam(nil, uint64(paramInitialSourceConnectionID), []byte{1})
+	odcid := appendParam(nil, uint64(paramOriginalDestinationConnectionID), []byte{2})
+	varint := func(id transportParameterID, v uint64) []byte {
+		value, _ := AppendVarInt(nil, v)
+		return appendParam(nil, uint64(id), value)
+	}
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		sentBy Perspective
+	}{
+		{"长度截断", append(append([]byte{}, iscid...), 0x01, 0x05, 0x00), PerspectiveClient},
+		{"重复的参数", join(iscid, varint(paramInitialMaxData, 1), varint(paramInitialMaxData, 2)), PerspectiveClient},
+		{"缺少initial_source_connection_id", varint(paramInitialMaxData, 1), PerspectiveClient},
+		{"服务端缺少original_destination_connection_id", iscid, PerspectiveServer},
+		{"客户端发送original_destination_connection_id", join(iscid, odcid), PerspectiveClient},
+		{"客户端发送stateless_reset_token", join(iscid, appendParam(nil, uint64(paramStatelessResetToken), make([]byte, 16))), PerspectiveClient},
+		{"stateless_reset_token长度错误", join(iscid, odcid, appendParam(nil, uint64(paramStatelessResetToken), make([]byte, 15))), PerspectiveServer},
+		{"max_udp_payload_size过小", join(iscid, varint(paramMaxUDPPayloadSize, 1199)), PerspectiveClient},
+		{"ack_delay_exponent过大", join(iscid, varint(paramAckDelayExponent, 21)), PerspectiveClient},
+		{"max_ack_delay过大", join(iscid, varint(paramMaxAckDelay, 1<<14)), PerspectiveClient},
+		{"active_connection_id_limit过小", join(iscid, varint(paramActiveConnectionIDLimit, 1)), PerspectiveClient},
+		{"initial_max_streams_bidi过大", join(iscid, varint(paramInitialMaxStreamsBidi, 1<<60+1)), PerspectiveClient},
+		{"整数参数包含多余字节", join(iscid, appendParam(nil, uint64(paramInitialMaxData), []byte{1, 2})), PerspectiveClient},
+		{"disable_active_migration携带值", join(iscid, appendParam(nil, uint64(paramDisableActiveMigration), []byte{1})), PerspectiveClient},
+		{"连接ID过长", appendParam(nil, uint64(paramInitialSourceConnectionID), make([]byte, 21)), PerspectiveClient},
+		{"preferred_address长度错误", join(iscid, odcid, appendParam(nil, uint64(paramPreferredAddress), make([]byte, 40))), PerspectiveServer},
+		{"preferred_address使用零长度连接ID", join(iscid, odcid, appendParam(nil, uint64(paramPreferredAddress), make([]byte, 41+16))), PerspectiveServer},
+		{"version_information长度错误", join(iscid, appendParam(nil, uint64(paramVersionInformation), []byte{0, 0, 0, 1, 0})), PerspectiveClient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTransportParameters(tt.data, tt.sentBy)
+			var transportErr *TransportError
+			if !errors.As(err, &transportErr) || transportErr.Code != TransportParameterError {
+				t.Errorf("应返回TRANSPORT_PARAMETER_ERROR，实际%v", err)
+			}
+		})
+	}
+}
+
+func TestTransportParametersAppendValidates(t *testing.T) {
+	// 客户端不能发送仅限服务端的参数
+	if _, err := newServerParams().Append(nil, PerspectiveClient); err == nil {
+		t.Error("客户端编码仅限服务端的参数时应返回错误")
+	}
+
+	params := newServerParams()
+	params.MaxUDPPayloadSize = 1000
+	if _, err := params.Append(nil, PerspectiveServer); err == nil {
+		t.Error("max_udp_payload_size小于1200时应返回错误")
+	}
+
+	// 使用零长度连接ID的服务端不能提供preferred_address
+	params = newServerParams()
+	params.InitialSourceConnectionID = ConnectionID{}
+	if _, err := params.Append(nil, PerspectiveServer); err == nil {
+		t.Error("零长度连接ID的服务端提供preferred_address时应返回错误")
+	}
+}
+
+func TestValidateZeroRTT(t *testing.T) {
+	remembered := newServerParams()
+	current := newServerParams()
+	if err := current.ValidateZeroRTT(remembered); err != nil {
+		t.Fatalf("相同的参数不应返回错误: %v", err)
+	}
+	// 提高限制或修改与0-RTT无关的参数是允许的
+	current.InitialMaxData *= 2
+	current.MaxIdleTimeout = time.Second
+	if err := current.ValidateZeroRTT(remembered); err != nil {
+		t.Errorf("提高限制不应返回错误: %v", err)
+	}
+
+	current = newServerParams()
+	current.InitialMaxStreamsUni = remembered.InitialMaxStreamsUni - 1
+	var terr *TransportError
+	if err := current.ValidateZeroRTT(remembered); !errors.As(err, &terr) || terr.Code != ProtocolViolation {
+		t.Errorf("降低限制应返回PROTOCOL_VIOLATION，实际%v", err)
+	}
+}
+
+func TestPerspective(t *testing.T) {
+	if PerspectiveClient.Opposite() != PerspectiveServer || PerspectiveServer.Opposite() != PerspectiveClient {
+		t.Error("对端角色错误")
+	}
+	if PerspectiveClient.String() != "客户端" || PerspectiveServer.String() != "服务端" {
+		t.Error("角色名称错误")
+	}
+}
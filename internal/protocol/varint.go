@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"errors"
+)
+
+// MaxVarInt 是可变长度整数能表示的最大值（2^62-1）
+const MaxVarInt = 1<<62 - 1
+
+var (
+	// ErrVarIntTooLarge 数值超出可变长度整数的表示范围
+	ErrVarIntTooLarge = errors.New("可变长度整数超出范围")
+	// ErrVarIntTruncated 数据不足以解析出完整的可变长度整数
+	ErrVarIntTruncated = errors.New("可变长度整数数据截断")
+	// ErrInvalidVarIntLen 指定的编码长度无效或不足以容纳数值
+	ErrInvalidVarIntLen = errors.New("无效的可变长度整数编码长度")
+)
+
+// VarIntLen 返回数值的最短编码长度，超出范围时返回0
+func VarIntLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	case v <= MaxVarInt:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// AppendVarInt 以最短编码将可变长度整数追加到b
+func AppendVarInt(b []byte, v uint64) ([]byte, error) {
+	length := VarIntLen(v)
+	if length == 0 {
+		return b, ErrVarIntTooLarge
+	}
+	return appendVarInt(b, v, length), nil
+}
+
+// AppendVarIntWithLen 以指定的编码长度（1、2、4或8字节）将可变长度整数追加到b，
+// 用于需要预留固定长度并在之后回填的字段
+func AppendVarIntWithLen(b []byte, v uint64, length int) ([]byte, error) {
+	if v > MaxVarInt {
+		return b, ErrVarIntTooLarge
+	}
+	switch length {
+	case 1, 2, 4, 8:
+	default:
+		return b, ErrInvalidVarIntLen
+	}
+	if VarIntLen(v) > length {
+		return b, ErrInvalidVarIntLen
+	}
+	return appendVarInt(b, v, length), nil
+}
+
+// ReadVarInt 从data开头读取可变长度整数，返回数值和占用的字节数
+func ReadVarInt(data []byte) (uint64, int, error) {
+	if len(data) < 1 {
+		return 0, 0, ErrVarIntTruncated
+	}
+	length := 1 << (data[0] >> 6)
+	if len(data) < length {
+		return 0, 0, ErrVarIntTruncated
+	}
+	v := uint64(data[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, length, nil
+}
+
+// appendVarInt 按给定长度写入数值，调用方保证长度足够
+func appendVarInt(b []byte, v uint64, length int) []byte {
+	switch length {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case 4:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b,
+			byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
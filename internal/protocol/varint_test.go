@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVarIntRFCExamples(t *testing.T) {
+	// RFC 9000 附录A.1中的示例
+	tests := []struct {
+		name     string
+		encoded  []byte
+		expected uint64
+	}{
+		{"8字节", []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, 151288809941952652},
+		{"4字节", []byte{0x9d, 0x7f, 0x3e, 0x7d}, 494878333},
+		{"2字节", []byte{0x7b, 0xbd}, 15293},
+		{"1字节", []byte{0x25}, 37},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, n, err := ReadVarInt(tt.encoded)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if v != tt.expected || n != len(tt.encoded) {
+				t.Errorf("解析错误，期望%d(%d字节)，实际%d(%d字节)", tt.expected, len(tt.encoded), v, n)
+			}
+
+			encoded, err := AppendVarInt(nil, tt.expected)
+			if err != nil {
+				t.Fatalf("编码失败: %v", err)
+			}
+			if !bytes.Equal(encoded, tt.encoded) {
+				t.Errorf("编码错误，期望%x，实际%x", tt.encoded, encoded)
+			}
+		})
+	}
+
+	// 非最短编码同样可以解析
+	v, n, err := ReadVarInt([]byte{0x40, 0x25})
+	if err != nil || v != 37 || n != 2 {
+		t.Errorf("解析非最短编码错误: %d, %d, %v", v, n, err)
+	}
+}
+
+func TestVarIntLen(t *testing.T) {
+	tests := []struct {
+		value    uint64
+		expected int
+	}{
+		{0, 1},
+		{63, 1},
+		{64, 2},
+		{16383, 2},
+		{16384, 4},
+		{1<<30 - 1, 4},
+		{1 << 30, 8},
+		{MaxVarInt, 8},
+		{MaxVarInt + 1, 0},
+	}
+	for _, tt := range tests {
+		if l := VarIntLen(tt.value); l != tt.expected {
+			t.Errorf("VarIntLen(%d)错误，期望%d，实际%d", tt.value, tt.expected, l)
+		}
+	}
+}
+
+func TestAppendVarIntWithLen(t *testing.T) {
+	b, err := AppendVarIntWithLen(nil, 37, 2)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	if !bytes.Equal(b, []byte{0x40, 0x25}) {
+		t.Errorf("编码错误，期望4025，实际%x", b)
+	}
+
+	b, err = AppendVarIntWithLen(nil, 37, 8)
+	if err != nil {
+		t.Fatalf("编码失败: %v", err)
+	}
+	if v, n, _ := ReadVarInt(b); v != 37 || n != 8 {
+		t.Errorf("强制8字节编码错误: %x", b)
+	}
+
+	// 长度不足以容纳数值
+	if _, err := AppendVarIntWithLen(nil, 16384, 2); !errors.Is(err, ErrInvalidVarIntLen) {
+		t.Errorf("期望错误%v，实际%v", ErrInvalidVarIntLen, err)
+	}
+	// 非法长度
+	if _, err := AppendVarIntWithLen(nil, 1, 3); !errors.Is(err, ErrInvalidVarIntLen) {
+		t.Errorf("期望错误%v，实际%v", ErrInvalidVarIntLen, err)
+	}
+}
+
+func TestVarIntErrors(t *testing.T) {
+	if _, err := AppendVarInt(nil, MaxVarInt+1); !errors.Is(err, ErrVarIntTooLarge) {
+		t.Errorf("期望错误%v，实际%v", ErrVarIntTooLarge, err)
+	}
+	if _, err := AppendVarIntWithLen(nil, MaxVarInt+1, 8); !errors.Is(err, ErrVarIntTooLarge) {
+		t.Errorf("期望错误%v，实际%v", ErrVarIntTooLarge, err)
+	}
+	if _, _, err := ReadVarInt(nil); !errors.Is(err, ErrVarIntTruncated) {
+		t.Errorf("期望错误%v，实际%v", ErrVarIntTruncated, err)
+	}
+	if _, _, err := ReadVarInt([]byte{0x9d, 0x7f}); !errors.Is(err, ErrVarIntTruncated) {
+		t.Errorf("期望错误%v，实际%v", ErrVarIntTruncated, err)
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import "encoding/binary"
+
+const (
+	// VersionNegotiation 版本协商包使用的版本号
+	VersionNegotiation = uint32(0)
+	// Version1 QUIC版本1（RFC 9000）
+	Version1 = uint32(0x00000001)
+	// Version2 QUIC版本2（RFC 9369）
+	Version2 = uint32(0x6b3343cf)
+)
+
+// SupportedVersions 本实现支持的QUIC版本，按优先级从高到低排列
+var SupportedVersions = []uint32{Version1, Version2}
+
+// IsSupportedVersion 检查版本号是否在给定的版本列表中
+func IsSupportedVersion(versions []uint32, v uint32) bool {
+	for _, version := range versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ChooseSupportedVersion 按本端的优先级选择双方都支持的版本
+func ChooseSupportedVersion(ours, theirs []uint32) (uint32, bool) {
+	for _, v := range ours {
+		if IsSupportedVersion(theirs, v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// IsCompatibleVersion 判断能否在握手过程中从from版本兼容地切换到to版本，
+// 版本1和版本2的首个ClientHello可以互相转换，见RFC 9369第4节
+func IsCompatibleVersion(from, to uint32) bool {
+	if from == to {
+		return true
+	}
+	return IsSupportedVersion([]uint32{Version1, Version2}, from) &&
+		IsSupportedVersion([]uint32{Version1, Version2}, to)
+}
+
+// VersionInformation version_information传输参数，见RFC 9368第3节
+type VersionInformation struct {
+	// ChosenVersion 发送方在当前连接中使用的版本
+	ChosenVersion uint32
+	// AvailableVersions 发送方支持的版本，按优先级从高到低排列
+	AvailableVersions []uint32
+}
+
+// Append 将version_information序列化后追加到b
+func (v *VersionInformation) Append(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, v.ChosenVersion)
+	for _, version := range v.AvailableVersions {
+		b = binary.BigEndian.AppendUint32(b, version)
+	}
+	return b
+}
+
+// ParseVersionInformation 解析version_information传输参数
+func ParseVersionInformation(data []byte) (*VersionInformation, error) {
+	if len(data) < 4 || len(data)%4 != 0 {
+		return nil, NewTransportError(TransportParameterError, "version_information长度无效: %d", len(data))
+	}
+	v := &VersionInformation{ChosenVersion: binary.BigEndian.Uint32(data)}
+	if v.ChosenVersion == VersionNegotiation {
+		return nil, NewTransportError(TransportParameterError, "version_information的Chosen Version不能为0")
+	}
+	for i := 4; i < len(data); i += 4 {
+		version := binary.BigEndian.Uint32(data[i:])
+		if version == VersionNegotiation {
+			return nil, NewTransportError(TransportParameterError, "version_information的Available Versions不能包含0")
+		}
+		v.AvailableVersions = append(v.AvailableVersions, version)
+	}
+	return v, nil
+}
+
+// ChooseCompatibleVersion 服务端根据客户端的version_information进行兼容版本协商：
+// 按本端优先级选择一个客户端支持且能从原始版本兼容切换的版本，见RFC 9368第2.3节
+func ChooseCompatibleVersion(ours []uint32, original uint32, client *VersionInformation) uint32 {
+	if client == nil {
+		return original
+	}
+	for _, v := range ours {
+		if v == original {
+			return original
+		}
+		if IsCompatibleVersion(original, v) && IsSupportedVersion(client.AvailableVersions, v) {
+			return v
+		}
+	}
+	return original
+}
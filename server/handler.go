@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"LQUIC/internal/connection"
+)
+
+// Handler 处理协商到某个应用层协议的连接
+type Handler interface {
+	// ServeConn 在连接完成握手后调用，每个连接调用一次，在独立的goroutine中执行
+	ServeConn(conn *connection.Connection)
+}
+
+// HandlerFunc 将普通函数适配为Handler
+type HandlerFunc func(conn *connection.Connection)
+
+// ServeConn 调用f(conn)
+func (f HandlerFunc) ServeConn(conn *connection.Connection) {
+	f(conn)
+}
+
+// ErrServerStarted 服务器启动后不能再注册处理器
+var ErrServerStarted = errors.New("服务器已经启动")
+
+// Handle 为ALPN协议标识（例如"h3"、"doq"）注册处理器，需要在Start之前调用。
+// 注册了处理器的服务器只接受这些协议，按注册顺序作为服务端的优先级参与TLS的ALPN协商；
+// 客户端提供的协议都不受支持时，握手以no_application_protocol错误关闭连接
+func (s *Server) Handle(alpn string, handler Handler) error {
+	if alpn == "" || len(alpn) > 255 {
+		return fmt.Errorf("无效的ALPN协议标识: %q", alpn)
+	}
+	if handler == nil {
+		return fmt.Errorf("协议%q的处理器为nil", alpn)
+	}
+
+	s.connectionsMux.Lock()
+	defer s.connectionsMux.Unlock()
+	if s.conn != nil {
+		return ErrServerStarted
+	}
+	if _, exists := s.handlers[alpn]; exists {
+		return fmt.Errorf("协议%q已经注册了处理器", alpn)
+	}
+	s.handlers[alpn] = handler
+	s.protocols = append(s.protocols, alpn)
+	return nil
+}
+
+// HandleFunc 为ALPN协议标识注册处理函数
+func (s *Server) HandleFunc(alpn string, handler func(conn *connection.Connection)) error {
+	if handler == nil {
+		return fmt.Errorf("协议%q的处理器为nil", alpn)
+	}
+	return s.Handle(alpn, HandlerFunc(handler))
+}
+
+// dispatch 将完成握手的连接交给协商到的应用层协议对应的处理器，每个连接只分发一次
+func (s *Server) dispatch(conn *connection.Connection) {
+	if conn.GetState() != connection.StateEstablished {
+		return
+	}
+	alpn := conn.ConnectionState().NegotiatedProtocol
+
+	s.connectionsMux.Lock()
+	// 已经从服务器移除的连接不再分发
+	if s.dispatched[conn] || s.connIDs[string(conn.GetSrcConnID())] != conn {
+		s.connectionsMux.Unlock()
+		return
+	}
+	s.dispatched[conn] = true
+	handler := s.handlers[alpn]
+	s.connectionsMux.Unlock()
+
+	if handler != nil {
+		go handler.ServeConn(conn)
+	}
+}
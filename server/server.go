@@ -3,9 +3,13 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"time"
 
 	"LQUIC/internal/connection"
 	"LQUIC/internal/crypto"
@@ -15,23 +19,65 @@ import (
 
 // Config 服务器配置
 type Config struct {
-	Addr      string
+	Addr string
+	// TLS配置，通过Handle注册了处理器时NextProtos由已注册的协议代替
 	TLSConfig *tls.Config
 	// 最大并发连接数
 	MaxConnections int
+	// 支持的QUIC版本，按优先级从高到低排列，为空时使用protocol.SupportedVersions
+	Versions []uint32
+	// 是否要求新连接先通过Retry完成地址验证，用于抵御伪造源地址的握手洪泛
+	RequireAddressValidation bool
+	// 加密地址验证令牌的32字节密钥，为空时随机生成；多台服务器共享时需配置相同的密钥
+	TokenKey []byte
+	// 使用同一代1-RTT密钥发送多少个数据包后自动发起密钥更新，为0时使用crypto.DefaultKeyUpdateInterval
+	KeyUpdateInterval uint64
+	// 向客户端通告的传输参数，为nil时使用connection.DefaultTransportParameters；
+	// 连接ID和无状态重置令牌由服务器为每个连接填写
+	TransportParameters *protocol.TransportParameters
+	// 派生无状态重置令牌的32字节密钥，为空时随机生成；多台服务器共享时需配置相同的密钥
+	StatelessResetKey []byte
+	// 所有连接共享的0-RTT反重放保护，为nil时使用crypto.NewStrikeRegister创建的进程内记录；
+	// 多台服务器需要接入共享的实现才能发现重放到其他实例上的0-RTT数据。
+	// 客户端时间由ClientHello中的票据年龄还原，与服务器时间相差超过时间窗口的0-RTT尝试被拒绝
+	AntiReplay crypto.AntiReplay
+	// 是否接受客户端的0-RTT数据，并签发允许0-RTT的会话票据
+	EnableEarlyData bool
+	// 加密会话票据的密钥，为nil时使用随机主密钥、按crypto.DefaultTicketKeyRotation轮换的密钥；
+	// 多台服务器共享相同的密钥源时，客户端可以在任意一台上恢复会话。
+	// TLSConfig设置了WrapSession或UnwrapSession时不使用
+	TicketKeys crypto.TicketKeySource
+	// 验证客户端证书的CA，不为nil时要求客户端出示由这些CA签发的证书（TLSConfig.ClientAuth为
+	// tls.VerifyClientCertIfGiven时客户端可以不出示证书），处理器通过Connection.PeerIdentity取得客户端身份
+	ClientCAs *x509.CertPool
+	// 以NSS密钥日志格式（SSLKEYLOGFILE）输出每个连接的流量密钥，供Wireshark等工具解密抓包，为nil时不输出。
+	// 设置后不再使用TLSConfig.KeyLogWriter；密钥日志会泄露全部流量，只能用于调试
+	KeyLogWriter io.Writer
 }
 
 // Server QUIC服务器
 type Server struct {
 	config Config
 	conn   *net.UDPConn
-	// 连接管理
+	// 连接管理，connections按客户端首个Initial包的目标连接ID索引，
+	// connIDs按服务器选择的连接ID索引，用于路由握手开始后的数据包
 	connections    map[string]*connection.Connection
+	connIDs        map[string]*connection.Connection
 	connectionsMux sync.RWMutex
 	// 连接ID生成器
 	idGenerator *connection.IDGenerator
-	// 关闭通道
+	// 地址验证令牌生成器
+	tokenGenerator *crypto.TokenGenerator
+	// 无状态重置令牌生成器
+	resetGenerator *crypto.StatelessResetGenerator
+	// 按ALPN协议标识注册的处理器，protocols按注册顺序记录服务端支持的协议；
+	// dispatched记录已经交给处理器的连接
+	handlers   map[string]Handler
+	protocols  []string
+	dispatched map[*connection.Connection]bool
+	// 关闭通道，closeOnce保证重复关闭时只关闭一次
 	closeChan chan struct{}
+	closeOnce sync.Once
 }
 
 // New 创建新的QUIC服务器
@@ -39,12 +85,67 @@ func New(config Config) (*Server, error) {
 	if config.MaxConnections <= 0 {
 		config.MaxConnections = 1000 // 默认最大连接数
 	}
+	if len(config.Versions) == 0 {
+		config.Versions = protocol.SupportedVersions
+	}
+	for _, v := range config.Versions {
+		if !protocol.IsSupportedVersion(protocol.SupportedVersions, v) {
+			return nil, fmt.Errorf("不支持的QUIC版本: 0x%x", v)
+		}
+	}
+
+	if config.AntiReplay == nil {
+		config.AntiReplay = crypto.NewStrikeRegister(crypto.DefaultReplayWindow, 0)
+	}
+	if config.TicketKeys == nil {
+		keys, err := crypto.NewTicketKeySchedule(nil, crypto.DefaultTicketKeyRotation, crypto.DefaultPreviousTicketKeys)
+		if err != nil {
+			return nil, err
+		}
+		config.TicketKeys = keys
+	}
+	if config.TLSConfig != nil && config.ClientCAs != nil {
+		config.TLSConfig = config.TLSConfig.Clone()
+		config.TLSConfig.ClientCAs = config.ClientCAs
+		if config.TLSConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+			config.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	// 每个连接的握手使用克隆的TLS配置，所有连接需要使用同一组票据密钥才能恢复彼此签发的会话
+	if config.TLSConfig != nil && config.TLSConfig.WrapSession == nil && config.TLSConfig.UnwrapSession == nil {
+		config.TLSConfig = config.TLSConfig.Clone()
+		crypto.SetSessionTicketKeySource(config.TLSConfig, config.TicketKeys)
+	}
+	if config.TransportParameters == nil {
+		config.TransportParameters = connection.DefaultTransportParameters()
+	}
+	// 提前校验传输参数，连接ID在每个连接开始握手时才能确定，这里以占位值代替
+	params := *config.TransportParameters
+	params.OriginalDestinationConnectionID = make(protocol.ConnectionID, connection.IDLength)
+	params.InitialSourceConnectionID = make(protocol.ConnectionID, connection.IDLength)
+	if err := params.Validate(protocol.PerspectiveServer); err != nil {
+		return nil, fmt.Errorf("无效的传输参数: %w", err)
+	}
+
+	tokenGenerator, err := crypto.NewTokenGenerator(config.TokenKey)
+	if err != nil {
+		return nil, err
+	}
+	resetGenerator, err := crypto.NewStatelessResetGenerator(config.StatelessResetKey)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Server{
-		config:      config,
-		connections: make(map[string]*connection.Connection),
-		idGenerator: connection.NewIDGenerator(connection.IDLength),
-		closeChan:   make(chan struct{}),
+		config:         config,
+		connections:    make(map[string]*connection.Connection),
+		connIDs:        make(map[string]*connection.Connection),
+		idGenerator:    connection.NewIDGenerator(connection.IDLength),
+		tokenGenerator: tokenGenerator,
+		resetGenerator: resetGenerator,
+		handlers:       make(map[string]Handler),
+		dispatched:     make(map[*connection.Connection]bool),
+		closeChan:      make(chan struct{}),
 	}, nil
 }
 
@@ -59,7 +160,14 @@ func (s *Server) Start() error {
 	if err != nil {
 		return fmt.Errorf("监听UDP失败: %v", err)
 	}
+	s.connectionsMux.Lock()
+	// 注册了处理器时只通过ALPN协商这些协议
+	if len(s.protocols) > 0 && s.config.TLSConfig != nil {
+		s.config.TLSConfig = s.config.TLSConfig.Clone()
+		s.config.TLSConfig.NextProtos = s.protocols
+	}
 	s.conn = conn
+	s.connectionsMux.Unlock()
 
 	go s.acceptLoop()
 	return nil
@@ -77,16 +185,30 @@ func (s *Server) acceptLoop() {
 			if err != nil {
 				continue
 			}
-			go s.handlePacket(buf[:n], remoteAddr)
+			// 读缓冲区会被下一次读取复用，需要复制；
+			// 握手数据依赖接收顺序，数据报按到达顺序依次处理
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			s.handlePacket(data, remoteAddr)
 		}
 	}
 }
 
-// handlePacket 处理接收到的数据包
+// handlePacket 处理接收到的UDP数据报，其中可能合并了多个数据包
 func (s *Server) handlePacket(data []byte, remoteAddr *net.UDPAddr) {
-	// 解析数据包
-	p, err := packet.Unpack(data)
+	// 解析数据报中的全部数据包，合并的数据包具有相同的目标连接ID
+	packets, err := packet.ParseDatagram(data, connection.IDLength)
 	if err != nil {
+		// 无法识别的版本，回复版本协商包
+		if errors.Is(err, packet.ErrUnsupportedVersion) {
+			s.sendVersionNegotiation(data, remoteAddr)
+		}
+		return
+	}
+	p := packets[0]
+
+	// 携带Initial包的数据报小于最小长度时直接丢弃，不创建连接状态也不回复，见RFC 9000第14.1节
+	if p.Header.Type == protocol.PacketTypeInitial && len(data) < protocol.MinInitialDatagramSize {
 		return
 	}
 
@@ -94,12 +216,44 @@ func (s *Server) handlePacket(data []byte, remoteAddr *net.UDPAddr) {
 	connKey := string(p.Header.DestConnID)
 	s.connectionsMux.RLock()
 	conn, exists := s.connections[connKey]
+	if !exists {
+		conn, exists = s.connIDs[connKey]
+	}
 	s.connectionsMux.RUnlock()
 
+	// 新连接使用了未启用的版本，回复版本协商包
+	if !exists && p.Header.IsLongHeader() && !protocol.IsSupportedVersion(s.config.Versions, p.Header.Version) {
+		s.sendVersionNegotiation(data, remoteAddr)
+		return
+	}
+
 	// 如果是新连接且是Initial包
 	if !exists && p.Header.Type == protocol.PacketTypeInitial {
-		// 创建新的加密设置
-		cryptoSetup := crypto.NewCryptoSetup(s.config.TLSConfig)
+		// 达到最大连接数时直接丢弃，不回复Retry包，也不创建任何连接状态
+		s.connectionsMux.RLock()
+		full := len(s.connections) >= s.config.MaxConnections
+		s.connectionsMux.RUnlock()
+		if full {
+			return
+		}
+
+		// 地址验证，未通过验证时同样不创建连接状态
+		origDestConnID, retrySrcConnID, ok := s.validateAddress(&p.Header, remoteAddr)
+		if !ok {
+			return
+		}
+
+		// 创建新的加密设置，Initial密钥由客户端选择的目标连接ID派生
+		cryptoSetup := crypto.NewCryptoSetup(s.config.TLSConfig, protocol.PerspectiveServer)
+		cryptoSetup.SetVersion(p.Header.Version)
+		cryptoSetup.SetKeyUpdateConfig(crypto.KeyUpdateConfig{Interval: s.config.KeyUpdateInterval})
+		cryptoSetup.SetAntiReplay(s.config.AntiReplay)
+		if s.config.KeyLogWriter != nil {
+			cryptoSetup.SetKeyLogWriter(s.config.KeyLogWriter)
+		}
+		if s.config.EnableEarlyData {
+			cryptoSetup.EnableEarlyData()
+		}
 
 		// 生成服务器连接ID
 		srcConnID, err := s.idGenerator.GenerateConnectionID()
@@ -107,23 +261,38 @@ func (s *Server) handlePacket(data []byte, remoteAddr *net.UDPAddr) {
 			return
 		}
 
-		// 创建新连接
+		// 创建新连接，服务器发送的数据包以客户端的源连接ID作为目标连接ID
 		conn = connection.NewConnection(
-			p.Header.DestConnID,
+			p.Header.SrcConnID,
 			srcConnID,
 			remoteAddr,
 			s.conn,
 			cryptoSetup,
 		)
+		conn.SetAvailableVersions(s.config.Versions)
+		conn.SetVersion(p.Header.Version)
+		conn.SetRetryConnIDs(origDestConnID, retrySrcConnID)
 
-		// 存储连接
-		s.connectionsMux.Lock()
-		if len(s.connections) >= s.config.MaxConnections {
-			s.connectionsMux.Unlock()
+		// 以服务端身份开始TLS握手，传输参数在收到客户端的传输参数后发送
+		params := *s.config.TransportParameters
+		token := s.resetGenerator.Token(srcConnID)
+		params.StatelessResetToken = &token
+		if err := conn.SetTransportParameters(&params); err != nil {
+			return
+		}
+		if err := conn.StartHandshake(protocol.PerspectiveServer); err != nil {
+			return
+		}
+		if err := cryptoSetup.SetInitialKeys(p.Header.DestConnID); err != nil {
 			return
 		}
+
+		// 存储连接，只有acceptLoop创建连接，检查之后连接数不会增加
+		s.connectionsMux.Lock()
 		s.connections[connKey] = conn
+		s.connIDs[string(srcConnID)] = conn
 		s.connectionsMux.Unlock()
+		go s.watchConnection(connKey, conn)
 	}
 
 	// 如果找不到连接
@@ -131,15 +300,111 @@ func (s *Server) handlePacket(data []byte, remoteAddr *net.UDPAddr) {
 		return
 	}
 
-	// 处理数据包
-	conn.HandlePacket(p)
+	// 处理数据包，完成握手的连接交给对应应用层协议的处理器
+	conn.HandleDatagram(packets)
+	s.dispatch(conn)
 }
 
-// Close 关闭服务器
-func (s *Server) Close() error {
-	close(s.closeChan)
-	if s.conn != nil {
-		return s.conn.Close()
+// watchConnection 等待连接关闭或空闲超时，之后将其从服务器移除。
+// 空闲超时的连接直接关闭，不发送CONNECTION_CLOSE帧，见RFC 9000第10.1节
+func (s *Server) watchConnection(connKey string, conn *connection.Connection) {
+	defer s.removeConnection(connKey, conn)
+	for {
+		var idle <-chan time.Time
+		if deadline, ok := conn.IdleDeadline(); ok {
+			idle = time.After(time.Until(deadline))
+		}
+		select {
+		case <-conn.Done():
+			return
+		case <-s.closeChan:
+			return
+		case <-idle:
+		}
+		// 等待期间收到了新的数据包时重新计算超时时刻
+		if deadline, ok := conn.IdleDeadline(); ok && time.Now().Before(deadline) {
+			continue
+		}
+		conn.Close()
+		return
 	}
-	return nil
+}
+
+// removeConnection 从服务器的全部连接索引和分发记录中移除连接
+func (s *Server) removeConnection(connKey string, conn *connection.Connection) {
+	s.connectionsMux.Lock()
+	defer s.connectionsMux.Unlock()
+	if s.connections[connKey] == conn {
+		delete(s.connections, connKey)
+	}
+	if key := string(conn.GetSrcConnID()); s.connIDs[key] == conn {
+		delete(s.connIDs, key)
+	}
+	delete(s.dispatched, conn)
+}
+
+// validateAddress 对新连接进行地址验证：携带有效Retry令牌的Initial包通过验证，
+// 要求地址验证时对没有令牌的Initial包回复Retry包。
+// 返回客户端首个Initial包的目标连接ID和Retry包的源连接ID
+func (s *Server) validateAddress(h *packet.Header, remoteAddr *net.UDPAddr) (protocol.ConnectionID, protocol.ConnectionID, bool) {
+	if len(h.Token) > 0 {
+		token, err := s.tokenGenerator.DecodeToken(h.Token, remoteAddr)
+		// 重发的Initial包必须以Retry包的源连接ID作为目标连接ID
+		if err == nil && token.IsRetryToken && string(token.RetrySrcConnID) == string(h.DestConnID) {
+			return token.OriginalDestConnID, token.RetrySrcConnID, true
+		}
+		// 客户端只处理一个Retry包，无效的Retry令牌无法通过再次Retry恢复，直接丢弃
+		if s.config.RequireAddressValidation {
+			return nil, nil, false
+		}
+	}
+	if !s.config.RequireAddressValidation {
+		return h.DestConnID, nil, true
+	}
+	s.sendRetry(h, remoteAddr)
+	return nil, nil, false
+}
+
+// sendRetry 回复携带地址验证令牌的Retry包
+func (s *Server) sendRetry(h *packet.Header, remoteAddr *net.UDPAddr) {
+	// 客户端重发Initial包时将使用新的连接ID
+	retrySrcConnID, err := s.idGenerator.GenerateConnectionID()
+	if err != nil {
+		return
+	}
+	token, err := s.tokenGenerator.NewRetryToken(remoteAddr, h.DestConnID, retrySrcConnID)
+	if err != nil {
+		return
+	}
+	retry, err := packet.ComposeRetry(h.Version, h.SrcConnID, retrySrcConnID, h.DestConnID, token)
+	if err != nil {
+		return
+	}
+	s.conn.WriteToUDP(retry, remoteAddr)
+}
+
+// sendVersionNegotiation 回复列出服务器所支持版本的版本协商包
+func (s *Server) sendVersionNegotiation(data []byte, remoteAddr *net.UDPAddr) {
+	// 过小的数据报不回复，避免被用于放大攻击
+	if len(data) < protocol.MinInitialDatagramSize {
+		return
+	}
+	hdr, err := packet.ParseInvariantHeader(data)
+	if err != nil || hdr.Version == protocol.VersionNegotiation {
+		return
+	}
+	vn := packet.ComposeVersionNegotiation(hdr.SrcConnID, hdr.DestConnID, s.config.Versions)
+	s.conn.WriteToUDP(vn, remoteAddr)
+}
+
+// Close 关闭服务器，可以重复调用
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+	})
+	return err
 }
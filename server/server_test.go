@@ -1,11 +1,30 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
 	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"LQUIC/client"
+	"LQUIC/internal/connection"
+	"LQUIC/internal/crypto"
 	"LQUIC/internal/packet"
 	"LQUIC/internal/protocol"
 )
@@ -63,6 +82,14 @@ func TestStartServer(t *testing.T) {
 	if server.conn == nil {
 		t.Error("UDP连接未建立")
 	}
+
+	// 重复关闭不应panic
+	if err := server.Close(); err != nil {
+		t.Errorf("关闭服务器失败: %v", err)
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("重复关闭服务器应返回nil，实际%v", err)
+	}
 }
 
 func TestHandlePacket(t *testing.T) {
@@ -97,7 +124,7 @@ func TestHandlePacket(t *testing.T) {
 			Version:    protocol.Version,
 			DestConnID: destConnID,
 		},
-		Payload: []byte("test payload"),
+		Payload: append([]byte("test payload"), make([]byte, protocol.MinInitialDatagramSize)...),
 	}
 
 	// 序列化并发送数据包
@@ -126,6 +153,57 @@ func TestHandlePacket(t *testing.T) {
 	}
 }
 
+func TestShortInitial(t *testing.T) {
+	server, err := New(Config{
+		Addr:      ":0",
+		TLSConfig: &tls.Config{},
+	})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	clientConn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("创建客户端连接失败: %v", err)
+	}
+	defer clientConn.Close()
+
+	// 小于1200字节的数据报中的Initial包被丢弃，不创建连接状态也不回复，见RFC 9000第14.1节
+	p := &packet.Packet{
+		Header: packet.Header{
+			Type:       protocol.PacketTypeInitial,
+			Version:    protocol.Version,
+			DestConnID: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			SrcConnID:  []byte{9, 10, 11, 12},
+		},
+		Payload: make([]byte, 100),
+	}
+	data, err := p.Pack()
+	if err != nil {
+		t.Fatalf("数据包序列化失败: %v", err)
+	}
+	if len(data) >= protocol.MinInitialDatagramSize {
+		t.Fatalf("测试数据报过长: %d字节", len(data))
+	}
+	if _, err := clientConn.Write(data); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := clientConn.Read(make([]byte, 2048)); err == nil {
+		t.Errorf("过小的Initial数据报不应得到回复，收到%d字节", n)
+	}
+
+	server.connectionsMux.RLock()
+	defer server.connectionsMux.RUnlock()
+	if len(server.connections) != 0 || len(server.connIDs) != 0 {
+		t.Error("过小的Initial数据报不应创建连接")
+	}
+}
+
 func TestMaxConnections(t *testing.T) {
 	// 创建服务器，设置最大连接数为1
 	server, err := New(Config{
@@ -165,7 +243,7 @@ func TestMaxConnections(t *testing.T) {
 			Version:    protocol.Version,
 			DestConnID: destConnID1,
 		},
-		Payload: []byte("test payload 1"),
+		Payload: append([]byte("test payload 1"), make([]byte, protocol.MinInitialDatagramSize)...),
 	}
 	data1, _ := p1.Pack()
 	_, err = clientConn1.Write(data1)
@@ -184,7 +262,7 @@ func TestMaxConnections(t *testing.T) {
 			Version:    protocol.Version,
 			DestConnID: destConnID2,
 		},
-		Payload: []byte("test payload 2"),
+		Payload: append([]byte("test payload 2"), make([]byte, protocol.MinInitialDatagramSize)...),
 	}
 	data2, _ := p2.Pack()
 	_, err = clientConn2.Write(data2)
@@ -203,4 +281,1012 @@ func TestMaxConnections(t *testing.T) {
 	if connCount > 1 {
 		t.Errorf("超出最大连接数限制，当前连接数: %d", connCount)
 	}
+
+	// 达到最大连接数时在地址验证之前丢弃新连接的Initial包，不回复Retry包
+	server.config.RequireAddressValidation = true
+	p3 := &packet.Packet{
+		Header: packet.Header{
+			Type:       protocol.PacketTypeInitial,
+			Version:    protocol.Version,
+			DestConnID: []byte{9, 10, 11, 12},
+			SrcConnID:  []byte{13, 14, 15, 16},
+		},
+		Payload: make([]byte, protocol.MinInitialDatagramSize),
+	}
+	data3, _ := p3.Pack()
+	server.handlePacket(data3, clientConn2.LocalAddr().(*net.UDPAddr))
+	clientConn2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := clientConn2.Read(make([]byte, 2048)); err == nil {
+		t.Errorf("达到最大连接数时不应回复数据包，收到%d字节", n)
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	server, err := New(Config{
+		Addr:      ":0",
+		TLSConfig: &tls.Config{},
+	})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	clientConn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("创建客户端连接失败: %v", err)
+	}
+	defer clientConn.Close()
+
+	// 构造使用未知版本的长包头
+	destConnID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	srcConnID := []byte{9, 10, 11, 12}
+	data := []byte{0xc0, 0x1a, 0x2a, 0x3a, 0x4a, byte(len(destConnID))}
+	data = append(data, destConnID...)
+	data = append(data, byte(len(srcConnID)))
+	data = append(data, srcConnID...)
+
+	// 过小的数据报不应得到回复
+	if _, err := clientConn.Write(data); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	buf := make([]byte, 2048)
+	clientConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := clientConn.Read(buf); err == nil {
+		t.Fatal("过小的数据报不应触发版本协商")
+	}
+
+	// 填充到最小Initial数据报大小后应收到版本协商包
+	padded := append(data, make([]byte, protocol.MinInitialDatagramSize-len(data))...)
+	if _, err := clientConn.Write(padded); err != nil {
+		t.Fatalf("发送数据包失败: %v", err)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := clientConn.Read(buf)
+	if err != nil {
+		t.Fatalf("未收到版本协商包: %v", err)
+	}
+	hdr, versions, err := packet.ParseVersionNegotiation(buf[:n])
+	if err != nil {
+		t.Fatalf("解析版本协商包失败: %v", err)
+	}
+	if string(hdr.DestConnID) != string(srcConnID) || string(hdr.SrcConnID) != string(destConnID) {
+		t.Error("版本协商包的连接ID未与客户端呼应")
+	}
+	if len(versions) != len(protocol.SupportedVersions) || versions[0] != protocol.SupportedVersions[0] {
+		t.Errorf("版本列表错误: %x", versions)
+	}
+
+	server.connectionsMux.RLock()
+	defer server.connectionsMux.RUnlock()
+	if len(server.connections) != 0 {
+		t.Error("不支持的版本不应创建连接")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server, err := New(Config{
+		Addr:                     ":0",
+		TLSConfig:                &tls.Config{},
+		RequireAddressValidation: true,
+	})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	clientConn, err := net.DialUDP("udp", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("创建客户端连接失败: %v", err)
+	}
+	defer clientConn.Close()
+
+	origDestConnID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+	srcConnID := protocol.ConnectionID{9, 10, 11, 12}
+	sendInitial := func(destConnID protocol.ConnectionID, token []byte) {
+		p := &packet.Packet{
+			Header: packet.Header{
+				Type:       protocol.PacketTypeInitial,
+				Version:    protocol.Version,
+				DestConnID: destConnID,
+				SrcConnID:  srcConnID,
+				Token:      token,
+			},
+			Payload: append([]byte{0x01}, make([]byte, protocol.MinInitialDatagramSize)...), // PING帧，之后以PADDING帧填充
+		}
+		data, err := p.Pack()
+		if err != nil {
+			t.Fatalf("数据包序列化失败: %v", err)
+		}
+		if _, err := clientConn.Write(data); err != nil {
+			t.Fatalf("发送数据包失败: %v", err)
+		}
+	}
+	connectionCount := func() int {
+		server.connectionsMux.RLock()
+		defer server.connectionsMux.RUnlock()
+		return len(server.connections)
+	}
+
+	// 没有令牌的Initial包得到Retry包
+	sendInitial(origDestConnID, nil)
+	buf := make([]byte, 2048)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := clientConn.Read(buf)
+	if err != nil {
+		t.Fatalf("未收到Retry包: %v", err)
+	}
+	retry, err := packet.Unpack(buf[:n])
+	if err != nil {
+		t.Fatalf("解析Retry包失败: %v", err)
+	}
+	if retry.Header.Type != protocol.PacketTypeRetry || string(retry.Header.DestConnID) != string(srcConnID) {
+		t.Fatalf("Retry包错误: 类型%v，目标连接ID%x", retry.Header.Type, retry.Header.DestConnID)
+	}
+	if !packet.VerifyRetry(&retry.Header, buf[:n], origDestConnID) {
+		t.Fatal("Retry完整性标签校验失败")
+	}
+	if connectionCount() != 0 {
+		t.Fatal("地址验证前不应创建连接")
+	}
+
+	// 令牌与目标连接ID不匹配时丢弃
+	sendInitial(origDestConnID, retry.Header.Token)
+	time.Sleep(50 * time.Millisecond)
+	if connectionCount() != 0 {
+		t.Fatal("目标连接ID与令牌不匹配时不应创建连接")
+	}
+
+	// 携带令牌重发Initial包后创建连接
+	retrySrcConnID := retry.Header.SrcConnID
+	sendInitial(retrySrcConnID, retry.Header.Token)
+	time.Sleep(100 * time.Millisecond)
+
+	server.connectionsMux.RLock()
+	conn, exists := server.connections[string(retrySrcConnID)]
+	server.connectionsMux.RUnlock()
+	if !exists {
+		t.Fatal("通过地址验证后服务器未创建连接")
+	}
+	if string(conn.OriginalDestConnID()) != string(origDestConnID) || string(conn.RetrySrcConnID()) != string(retrySrcConnID) {
+		t.Errorf("连接记录的连接ID错误: 原始%x，Retry%x", conn.OriginalDestConnID(), conn.RetrySrcConnID())
+	}
+}
+
+// newTestTLSConfigs 生成使用自签名证书的客户端和服务端TLS配置
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("解析证书失败: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: roots}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return clientConfig, serverConfig
+}
+
+// waitFor 轮询等待条件成立
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestTLSHandshake(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig, RequireAddressValidation: true})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	c, err := client.New(client.Config{RemoteAddr: server.conn.LocalAddr().String(), TLSConfig: clientConfig})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer c.Close()
+
+	// 经过Retry后完成握手，服务端在HANDSHAKE_DONE之前也已完成握手
+	if !waitFor(c.HandshakeComplete) {
+		t.Fatalf("客户端握手未完成: %v", c.Err())
+	}
+	state := c.ConnectionState()
+	if !state.HandshakeComplete || state.Version != tls.VersionTLS13 || len(state.PeerCertificates) == 0 {
+		t.Errorf("TLS连接状态错误: %+v", state)
+	}
+
+	// 客户端在发送Finished之前完成握手，服务端收到Finished后才完成握手
+	serverEstablished := func() bool {
+		server.connectionsMux.RLock()
+		defer server.connectionsMux.RUnlock()
+		for _, conn := range server.connections {
+			if conn.GetState() != connection.StateEstablished {
+				return false
+			}
+		}
+		return true
+	}
+	waitFor(serverEstablished)
+	server.connectionsMux.RLock()
+	defer server.connectionsMux.RUnlock()
+	if len(server.connections) != 1 {
+		t.Fatalf("服务器应有1个连接，实际%d个", len(server.connections))
+	}
+	for _, conn := range server.connections {
+		if conn.GetState() != connection.StateEstablished || !conn.ConnectionState().HandshakeComplete {
+			t.Error("服务端握手未完成")
+		}
+		// 握手中交换并校验了传输参数
+		peer := conn.PeerTransportParameters()
+		if peer == nil || string(peer.InitialSourceConnectionID) != string(conn.GetDestConnID()) {
+			t.Fatalf("服务端应收到客户端的传输参数: %+v", peer)
+		}
+		local := conn.LocalTransportParameters()
+		if string(local.RetrySourceConnectionID) != string(conn.RetrySrcConnID()) || local.StatelessResetToken == nil {
+			t.Errorf("服务端传输参数中的连接ID或无状态重置令牌错误: %+v", local)
+		}
+	}
+}
+
+func TestTLSHandshakeTransportParameters(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	serverParams := connection.DefaultTransportParameters()
+	serverParams.MaxIdleTimeout = 5 * time.Second
+	serverParams.MaxUDPPayloadSize = 1350
+	// 服务端优先使用QUIC v2，与使用v1发起连接的客户端完成兼容版本协商
+	server, err := New(Config{
+		Addr:                "127.0.0.1:0",
+		TLSConfig:           serverConfig,
+		Versions:            []uint32{protocol.Version2, protocol.Version1},
+		TransportParameters: serverParams,
+	})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	c, err := client.New(client.Config{RemoteAddr: server.conn.LocalAddr().String(), TLSConfig: clientConfig})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer c.Close()
+
+	if !waitFor(c.HandshakeComplete) {
+		t.Fatalf("客户端握手未完成: %v", c.Err())
+	}
+	if c.Version() != protocol.Version2 {
+		t.Errorf("应兼容切换到QUIC v2，实际0x%x", c.Version())
+	}
+
+	server.connectionsMux.RLock()
+	defer server.connectionsMux.RUnlock()
+	for _, conn := range server.connections {
+		if conn.IdleTimeout() != 5*time.Second {
+			t.Errorf("空闲超时应取双方的较小值，实际%v", conn.IdleTimeout())
+		}
+		peer := conn.PeerTransportParameters()
+		if peer == nil || peer.VersionInformation == nil || peer.VersionInformation.ChosenVersion != protocol.Version1 {
+			t.Fatalf("服务端应收到客户端的version_information: %+v", peer)
+		}
+	}
+
+	// 无效的传输参数在创建服务器时报告
+	invalid := connection.DefaultTransportParameters()
+	invalid.ActiveConnectionIDLimit = 1
+	if _, err := New(Config{Addr: "127.0.0.1:0", TransportParameters: invalid}); err == nil {
+		t.Error("active_connection_id_limit小于2时应返回错误")
+	}
+}
+
+func TestTLSHandshakeCertificateError(t *testing.T) {
+	_, serverConfig := newTestTLSConfigs(t)
+	server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	// 客户端不信任服务器的自签名证书
+	c, err := client.New(client.Config{
+		RemoteAddr: server.conn.LocalAddr().String(),
+		TLSConfig:  &tls.Config{ServerName: "localhost", RootCAs: x509.NewCertPool()},
+	})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer c.Close()
+
+	if !waitFor(func() bool { return c.Err() != nil }) {
+		t.Fatal("证书验证失败时客户端应返回错误")
+	}
+	if c.HandshakeComplete() {
+		t.Error("证书验证失败时握手不应完成")
+	}
+}
+
+func TestALPNDispatch(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	accepted := make(chan string, 2)
+	for _, alpn := range []string{"h3", "lquic-rpc"} {
+		alpn := alpn
+		err := server.HandleFunc(alpn, func(conn *connection.Connection) {
+			accepted <- alpn + "/" + conn.ConnectionState().NegotiatedProtocol
+		})
+		if err != nil {
+			t.Fatalf("注册处理器失败: %v", err)
+		}
+	}
+	if err := server.HandleFunc("h3", func(*connection.Connection) {}); err == nil {
+		t.Error("重复注册同一协议应返回错误")
+	}
+	if err := server.Handle("", HandlerFunc(func(*connection.Connection) {})); err == nil {
+		t.Error("空的协议标识应返回错误")
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+	if err := server.HandleFunc("doq", func(*connection.Connection) {}); !errors.Is(err, ErrServerStarted) {
+		t.Errorf("启动后注册处理器应返回ErrServerStarted，实际%v", err)
+	}
+
+	// 客户端按优先级提供协议，服务端选择双方都支持的协议并交给对应的处理器
+	rpcConfig := clientConfig.Clone()
+	rpcConfig.NextProtos = []string{"unknown", "lquic-rpc"}
+	c, err := client.New(client.Config{RemoteAddr: server.conn.LocalAddr().String(), TLSConfig: rpcConfig})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer c.Close()
+	if !waitFor(c.HandshakeComplete) {
+		t.Fatalf("客户端握手未完成: %v", c.Err())
+	}
+	if proto := c.ConnectionState().NegotiatedProtocol; proto != "lquic-rpc" {
+		t.Errorf("协商的协议错误: %q", proto)
+	}
+	select {
+	case got := <-accepted:
+		if got != "lquic-rpc/lquic-rpc" {
+			t.Errorf("连接交给了错误的处理器: %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("处理器没有收到连接")
+	}
+
+	// 没有共同支持的协议时以no_application_protocol关闭连接
+	otherConfig := clientConfig.Clone()
+	otherConfig.NextProtos = []string{"unknown"}
+	other, err := client.New(client.Config{RemoteAddr: server.conn.LocalAddr().String(), TLSConfig: otherConfig})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	if err := other.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+	defer other.Close()
+	if !waitFor(func() bool { return other.Err() != nil }) {
+		t.Fatal("没有共同支持的协议时客户端应返回错误")
+	}
+	var transportErr *protocol.TransportError
+	if err := other.Err(); !errors.As(err, &transportErr) || transportErr.Code != protocol.NoApplicationProtocol {
+		t.Errorf("期望no_application_protocol错误，实际%v", err)
+	}
+	if other.HandshakeComplete() {
+		t.Error("没有共同支持的协议时握手不应完成")
+	}
+	select {
+	case got := <-accepted:
+		t.Errorf("握手失败的连接不应交给处理器: %s", got)
+	default:
+	}
+}
+
+func TestConnectionCleanup(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	clientConfig.NextProtos = []string{"lquic-rpc"}
+
+	// tracked 返回服务器各个连接索引和分发记录中的连接数
+	tracked := func(s *Server) (int, int, int) {
+		s.connectionsMux.RLock()
+		defer s.connectionsMux.RUnlock()
+		return len(s.connections), len(s.connIDs), len(s.dispatched)
+	}
+	connect := func(s *Server) *client.Client {
+		c, err := client.New(client.Config{RemoteAddr: s.conn.LocalAddr().String(), TLSConfig: clientConfig})
+		if err != nil {
+			t.Fatalf("创建客户端失败: %v", err)
+		}
+		if err := c.Connect(); err != nil {
+			t.Fatalf("连接失败: %v", err)
+		}
+		if !waitFor(c.HandshakeComplete) {
+			t.Fatalf("客户端握手未完成: %v", c.Err())
+		}
+		return c
+	}
+
+	t.Run("关闭", func(t *testing.T) {
+		server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig})
+		if err != nil {
+			t.Fatalf("创建服务器失败: %v", err)
+		}
+		release := make(chan struct{})
+		err = server.HandleFunc("lquic-rpc", func(conn *connection.Connection) {
+			<-release
+			conn.Close()
+		})
+		if err != nil {
+			t.Fatalf("注册处理器失败: %v", err)
+		}
+		if err := server.Start(); err != nil {
+			t.Fatalf("启动服务器失败: %v", err)
+		}
+		defer server.Close()
+		c := connect(server)
+		defer c.Close()
+
+		if !waitFor(func() bool { _, _, d := tracked(server); return d == 1 }) {
+			t.Fatal("连接没有交给处理器")
+		}
+		if n, ids, d := tracked(server); n != 1 || ids != 1 || d != 1 {
+			t.Fatalf("关闭之前应记录连接: connections=%d connIDs=%d dispatched=%d", n, ids, d)
+		}
+		close(release)
+		if !waitFor(func() bool { n, ids, d := tracked(server); return n == 0 && ids == 0 && d == 0 }) {
+			n, ids, d := tracked(server)
+			t.Errorf("关闭的连接没有被移除: connections=%d connIDs=%d dispatched=%d", n, ids, d)
+		}
+	})
+
+	t.Run("空闲超时", func(t *testing.T) {
+		params := connection.DefaultTransportParameters()
+		params.MaxIdleTimeout = 300 * time.Millisecond
+		server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig, TransportParameters: params})
+		if err != nil {
+			t.Fatalf("创建服务器失败: %v", err)
+		}
+		accepted := make(chan *connection.Connection, 1)
+		err = server.HandleFunc("lquic-rpc", func(conn *connection.Connection) {
+			accepted <- conn
+		})
+		if err != nil {
+			t.Fatalf("注册处理器失败: %v", err)
+		}
+		if err := server.Start(); err != nil {
+			t.Fatalf("启动服务器失败: %v", err)
+		}
+		defer server.Close()
+		c := connect(server)
+		defer c.Close()
+
+		var conn *connection.Connection
+		select {
+		case conn = <-accepted:
+		case <-time.After(2 * time.Second):
+			t.Fatal("处理器没有收到连接")
+		}
+		// 客户端不再发送数据包，超过协商的空闲超时后服务器关闭并移除连接
+		if !waitFor(func() bool { n, ids, d := tracked(server); return n == 0 && ids == 0 && d == 0 }) {
+			n, ids, d := tracked(server)
+			t.Errorf("空闲超时的连接没有被移除: connections=%d connIDs=%d dispatched=%d", n, ids, d)
+		}
+		if conn.GetState() != connection.StateClosed {
+			t.Errorf("空闲超时的连接应已关闭，实际状态%v", conn.GetState())
+		}
+	})
+}
+
+func TestEarlyData(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	ticketKeys := crypto.StaticTicketKeys{{ID: 1, Key: make([]byte, crypto.TicketKeyLen)}}
+	// 收到的数据和此时的0-RTT状态
+	type request struct {
+		data  string
+		early crypto.EarlyDataState
+	}
+	requests := make(chan request, 1)
+
+	// 服务器回显流0上的数据；两台服务器共享票据密钥，客户端可以在任意一台上恢复会话
+	newServer := func(enableEarlyData bool, params *protocol.TransportParameters) *Server {
+		t.Helper()
+		server, err := New(Config{
+			Addr:                "127.0.0.1:0",
+			TLSConfig:           serverConfig,
+			EnableEarlyData:     enableEarlyData,
+			TicketKeys:          ticketKeys,
+			TransportParameters: params,
+		})
+		if err != nil {
+			t.Fatalf("创建服务器失败: %v", err)
+		}
+		err = server.HandleFunc("echo", func(conn *connection.Connection) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				t.Errorf("接受流失败: %v", err)
+				return
+			}
+			data, err := io.ReadAll(stream)
+			if err != nil {
+				t.Errorf("读取流数据失败: %v", err)
+				return
+			}
+			requests <- request{string(data), conn.EarlyDataState()}
+			stream.Write(data)
+			stream.Close()
+		})
+		if err != nil {
+			t.Fatalf("注册处理器失败: %v", err)
+		}
+		if err := server.Start(); err != nil {
+			t.Fatalf("启动服务器失败: %v", err)
+		}
+		return server
+	}
+	accepting := newServer(true, nil)
+	defer accepting.Close()
+	rejecting := newServer(false, nil)
+	defer rejecting.Close()
+	// 降低了流量控制限制的服务器不能接受按原来的限制发送的0-RTT数据
+	reduced := connection.DefaultTransportParameters()
+	reduced.InitialMaxData = 1 << 10
+	reducing := newServer(true, reduced)
+	defer reducing.Close()
+
+	store := crypto.NewLRUSessionStore(0, 0, -1)
+	echoConfig := clientConfig.Clone()
+	echoConfig.NextProtos = []string{"echo"}
+	// 连接后立即写入数据，握手完成后检查0-RTT的结果和回显的数据
+	exchange := func(server *Server, msg string, want crypto.EarlyDataState) {
+		t.Helper()
+		c, err := client.New(client.Config{
+			RemoteAddr:      server.conn.LocalAddr().String(),
+			TLSConfig:       echoConfig,
+			SessionStore:    store,
+			EnableEarlyData: true,
+		})
+		if err != nil {
+			t.Fatalf("创建客户端失败: %v", err)
+		}
+		defer c.Close()
+		if err := c.Connect(); err != nil {
+			t.Fatalf("连接失败: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		stream, err := c.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatalf("打开流失败: %v", err)
+		}
+		if _, err := stream.Write([]byte(msg)); err != nil {
+			t.Fatalf("写入流数据失败: %v", err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatalf("关闭流失败: %v", err)
+		}
+		if !waitFor(c.HandshakeComplete) {
+			t.Fatalf("客户端握手未完成: %v", c.Err())
+		}
+		if got := c.EarlyDataState(); got != want {
+			t.Errorf("%s: 客户端的0-RTT状态应为%v，实际%v", msg, want, got)
+		}
+
+		select {
+		case req := <-requests:
+			if req.data != msg {
+				t.Errorf("服务器收到的数据错误: %q", req.data)
+			}
+			// 服务端只报告是否接受了0-RTT数据
+			serverWant := crypto.EarlyDataNone
+			if want == crypto.EarlyDataAccepted {
+				serverWant = crypto.EarlyDataAccepted
+			}
+			if req.early != serverWant {
+				t.Errorf("%s: 服务端的0-RTT状态应为%v，实际%v", msg, serverWant, req.early)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: 服务器没有收到数据", msg)
+		}
+		if echo, err := io.ReadAll(stream); err != nil || string(echo) != msg {
+			t.Errorf("%s: 回显的数据错误: %q, %v", msg, echo, err)
+		}
+		// 等待服务器签发的会话票据
+		if !waitFor(func() bool { return store.Len() > 0 }) {
+			t.Fatal("客户端应保存会话票据")
+		}
+	}
+
+	// 首次连接没有可以恢复的会话，数据在握手完成后发送
+	exchange(accepting, "first", crypto.EarlyDataNone)
+	// 恢复会话时数据作为0-RTT数据发送并被接受
+	exchange(accepting, "early", crypto.EarlyDataAccepted)
+	// 票据记录的传输参数高于服务器当前的传输参数时拒绝0-RTT
+	exchange(reducing, "reduced", crypto.EarlyDataRejected)
+	// 服务器拒绝0-RTT时客户端在1-RTT包中重新发送数据
+	exchange(rejecting, "rejected", crypto.EarlyDataRejected)
+}
+
+func TestStreams(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	// 服务器回显客户端打开的每个双向流，并在单向流上报告回显的流数量
+	err = server.HandleFunc("echo", func(conn *connection.Connection) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		for range 2 {
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				t.Errorf("接受流失败: %v", err)
+				return
+			}
+			if _, err := io.Copy(stream, stream); err != nil {
+				t.Errorf("回显数据失败: %v", err)
+			}
+			stream.Close()
+		}
+		uni, err := conn.OpenUniStream()
+		if err != nil {
+			t.Errorf("打开单向流失败: %v", err)
+			return
+		}
+		uni.Write([]byte("2 streams"))
+		uni.Close()
+	})
+	if err != nil {
+		t.Fatalf("注册处理器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	echoConfig := clientConfig.Clone()
+	echoConfig.NextProtos = []string{"echo"}
+	c, err := client.New(client.Config{RemoteAddr: server.conn.LocalAddr().String(), TLSConfig: echoConfig})
+	if err != nil {
+		t.Fatalf("创建客户端失败: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.OpenStream(); err == nil {
+		t.Error("连接之前不能打开流")
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("连接失败: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	// 两个流的数据互不干扰
+	streams := make([]*connection.Stream, 2)
+	for i := range streams {
+		stream, err := c.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatalf("打开流失败: %v", err)
+		}
+		streams[i] = stream
+	}
+	if streams[0].StreamID() != 0 || streams[1].StreamID() != 4 {
+		t.Fatalf("客户端发起的双向流ID错误: %d, %d", streams[0].StreamID(), streams[1].StreamID())
+	}
+	for i, stream := range streams {
+		if _, err := fmt.Fprintf(stream, "message %d", i); err != nil {
+			t.Fatalf("写入流失败: %v", err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatalf("关闭流失败: %v", err)
+		}
+	}
+	for i, stream := range streams {
+		data, err := io.ReadAll(stream)
+		if err != nil || string(data) != fmt.Sprintf("message %d", i) {
+			t.Errorf("流%d回显的数据错误: %q, %v", stream.StreamID(), data, err)
+		}
+	}
+
+	uni, err := c.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatalf("接受单向流失败: %v", err)
+	}
+	if uni.StreamID() != 3 {
+		t.Errorf("服务器发起的单向流ID错误: %d", uni.StreamID())
+	}
+	if data, err := io.ReadAll(uni); err != nil || string(data) != "2 streams" {
+		t.Errorf("单向流的数据错误: %q, %v", data, err)
+	}
+}
+
+// syncBuffer 可以被多个连接并发写入的缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines 返回已经写入的各行，按字典序排列
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+	slices.Sort(lines)
+	return lines
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	var serverLog, clientLog syncBuffer
+	server, err := New(Config{
+		Addr:            "127.0.0.1:0",
+		TLSConfig:       serverConfig,
+		EnableEarlyData: true,
+		KeyLogWriter:    &serverLog,
+	})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	// 只有协商了应用层协议的会话才能使用0-RTT
+	if err := server.HandleFunc("echo", func(*connection.Connection) {}); err != nil {
+		t.Fatalf("注册处理器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	store := crypto.NewLRUSessionStore(0, 0, -1)
+	clientConfig.NextProtos = []string{"echo"}
+	connect := func() {
+		t.Helper()
+		c, err := client.New(client.Config{
+			RemoteAddr:      server.conn.LocalAddr().String(),
+			TLSConfig:       clientConfig,
+			SessionStore:    store,
+			EnableEarlyData: true,
+			KeyLogWriter:    &clientLog,
+		})
+		if err != nil {
+			t.Fatalf("创建客户端失败: %v", err)
+		}
+		defer c.Close()
+		if err := c.Connect(); err != nil {
+			t.Fatalf("连接失败: %v", err)
+		}
+		if !waitFor(c.HandshakeComplete) {
+			t.Fatalf("客户端握手未完成: %v", c.Err())
+		}
+		if !waitFor(func() bool { return store.Len() > 0 }) {
+			t.Fatal("客户端应保存会话票据")
+		}
+	}
+	// 第二次连接恢复会话并使用0-RTT
+	connect()
+	connect()
+
+	// 两端输出的密钥相同，每次连接四行，恢复会话的连接还有0-RTT密钥
+	if !waitFor(func() bool { return len(serverLog.lines()) == 9 }) {
+		t.Fatalf("服务端密钥日志的行数错误: %q", serverLog.lines())
+	}
+	lines := clientLog.lines()
+	if !slices.Equal(lines, serverLog.lines()) {
+		t.Fatalf("两端的密钥日志不一致:\n%q\n%q", lines, serverLog.lines())
+	}
+	labels := map[string]int{}
+	for _, line := range lines {
+		labels[strings.Fields(line)[0]]++
+	}
+	want := map[string]int{
+		"CLIENT_EARLY_TRAFFIC_SECRET":     1,
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET": 2,
+		"SERVER_HANDSHAKE_TRAFFIC_SECRET": 2,
+		"CLIENT_TRAFFIC_SECRET_0":         2,
+		"SERVER_TRAFFIC_SECRET_0":         2,
+	}
+	if !maps.Equal(labels, want) {
+		t.Errorf("密钥日志的标签错误: %v", labels)
+	}
+}
+
+// newTestClientCertificate 创建签发客户端证书的CA和带有指定URI SAN的客户端证书
+func newTestClientCertificate(t *testing.T, uris ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("生成CA证书失败: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("解析CA证书失败: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, raw := range uris {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("解析URI失败: %v", err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("生成客户端证书失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestClientCertificate(t *testing.T) {
+	clientConfig, serverConfig := newTestTLSConfigs(t)
+	cert, clientCAs := newTestClientCertificate(t, "spiffe://example.org/service/echo")
+	server, err := New(Config{Addr: "127.0.0.1:0", TLSConfig: serverConfig, ClientCAs: clientCAs})
+	if err != nil {
+		t.Fatalf("创建服务器失败: %v", err)
+	}
+	if serverConfig.ClientCAs != nil {
+		t.Error("不应修改调用方的TLS配置")
+	}
+	identities := make(chan *crypto.PeerIdentity, 1)
+	err = server.HandleFunc("rpc", func(conn *connection.Connection) {
+		identities <- conn.PeerIdentity()
+	})
+	if err != nil {
+		t.Fatalf("注册处理器失败: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("启动服务器失败: %v", err)
+	}
+	defer server.Close()
+
+	rpcConfig := clientConfig.Clone()
+	rpcConfig.NextProtos = []string{"rpc"}
+	connect := func(certs []tls.Certificate) *client.Client {
+		t.Helper()
+		c, err := client.New(client.Config{
+			RemoteAddr:   server.conn.LocalAddr().String(),
+			TLSConfig:    rpcConfig,
+			Certificates: certs,
+		})
+		if err != nil {
+			t.Fatalf("创建客户端失败: %v", err)
+		}
+		if err := c.Connect(); err != nil {
+			t.Fatalf("连接失败: %v", err)
+		}
+		return c
+	}
+
+	// 出示CA签发的证书的客户端完成握手，处理器取得客户端的SPIFFE ID
+	c := connect([]tls.Certificate{cert})
+	defer c.Close()
+	if !waitFor(c.HandshakeComplete) {
+		t.Fatalf("客户端握手未完成: %v", c.Err())
+	}
+	if id := c.PeerIdentity(); id == nil || id.Certificate.Subject.CommonName != "localhost" {
+		t.Errorf("客户端应取得服务器经过验证的身份: %+v", id)
+	}
+	select {
+	case id := <-identities:
+		if id == nil || id.SPIFFEID == nil || id.SPIFFEID.String() != "spiffe://example.org/service/echo" {
+			t.Fatalf("处理器应取得客户端的SPIFFE ID: %+v", id)
+		}
+		if len(id.VerifiedChains) != 1 {
+			t.Errorf("应有一条验证通过的证书链，实际%d条", len(id.VerifiedChains))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("处理器没有收到连接")
+	}
+
+	// 没有出示证书的客户端以certificate_required关闭连接
+	anonymous := connect(nil)
+	defer anonymous.Close()
+	if !waitFor(func() bool { return anonymous.Err() != nil }) {
+		t.Fatal("没有出示证书时客户端应返回错误")
+	}
+	var transportErr *protocol.TransportError
+	if err := anonymous.Err(); !errors.As(err, &transportErr) || transportErr.Code != protocol.CertificateRequired {
+		t.Errorf("期望certificate_required错误，实际%v", err)
+	}
+
+	// 其他CA签发的证书无法通过验证
+	untrusted, _ := newTestClientCertificate(t)
+	other := connect([]tls.Certificate{untrusted})
+	defer other.Close()
+	if !waitFor(func() bool { return other.Err() != nil }) {
+		t.Fatal("证书无法验证时客户端应返回错误")
+	}
+	select {
+	case id := <-identities:
+		t.Errorf("握手失败的连接不应交给处理器: %+v", id)
+	default:
+	}
 }